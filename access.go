@@ -0,0 +1,204 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Access levels of albums, see albumAccess
+const (
+	accessPublic  = "public"  // anyone may view the album
+	accessPIN     = "pin"     // viewers must enter the PIN of the album
+	accessPrivate = "private" // only the masters may view the album
+)
+
+const (
+	// albumKeyCookie holds the keys of the albums a viewer unlocked
+	albumKeyCookie = "albumkey"
+
+	// maxAlbumKeys limits the keys kept in the cookie
+	maxAlbumKeys = 20
+
+	// albumKeyTTL is how long the browser keeps the cookie
+	albumKeyTTL = 30 * 24 * time.Hour
+
+	// unlockAttempts limits the PINs a client may try per 10 minutes
+	unlockAttempts = 10
+)
+
+// accessRule restricts who may view an album
+type accessRule struct {
+	Level string // accessPublic, accessPIN or accessPrivate
+	PIN   string // for accessPIN
+}
+
+// unlockLimiter limits the PINs tried per IP address
+var unlockLimiter = rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// albumRule returns the access rule of the album, public by default
+func albumRule(album string) accessRule {
+	if rule, ok := albumAccess[album]; ok && rule.Level != "" {
+		return rule
+	}
+	return accessRule{Level: accessPublic}
+}
+
+// albumKey returns the key a viewer gets for the PIN of the album. It is no
+// longer valid once the PIN changes.
+func albumKey(album, pin string) string {
+	mac := hmac.New(sha256.New, photoTokenSecret())
+	mac.Write([]byte("album|" + album + "|" + pin))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// viewerAccess is what a client may view: everything as master, else the
+// public albums and those it unlocked
+type viewerAccess struct {
+	master bool
+	keys   []string
+}
+
+// accessKey is the context key of the viewerAccess of a request
+type accessKey struct{}
+
+// requestAccess returns the access of the request determined by albumGate
+func requestAccess(r *http.Request) viewerAccess {
+	a, _ := r.Context().Value(accessKey{}).(viewerAccess)
+	return a
+}
+
+// allowed reports whether the viewer may view the album
+func (a viewerAccess) allowed(album string) bool {
+	rule := albumRule(album)
+	switch {
+	case a.master || rule.Level == accessPublic:
+		return true
+	case rule.Level == accessPIN:
+		key := albumKey(album, rule.PIN)
+		for _, k := range a.keys {
+			if hmac.Equal([]byte(k), []byte(key)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filter drops the events of the current album if the viewer may not view it.
+// Only the resets, which make clients reload the show, e.g. when the album
+// changes, are kept.
+func (a viewerAccess) filter(events []historyEvent) []historyEvent {
+	if a.allowed(show.currentAlbum()) {
+		return events
+	}
+	kept := []historyEvent{}
+	for _, e := range events {
+		if e.Event == "reset" {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// albumContent reports whether the path serves content of the current album
+// or adds to it
+func albumContent(path string) bool {
+	switch path {
+	case "/photos.json", "/photos.zip", "/upload", "/reaction",
+		apiPrefix + "/show", apiPrefix + "/photos", apiPrefix + "/uploads", "/api/search", "/api/timeline":
+		return true
+	}
+	for _, prefix := range []string{"/photos/", "/thumbs/", "/slides/", "/narration/", "/download/", "/favorites/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// albumGate determines the access of each request to the albums, and rejects
+// requests for the content of the current album by viewers who may not view
+// it. The event stream, /events and /poll only drop the events, so that the
+// viewers notice when the album changes.
+func albumGate(accounts []masterAccount) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var a viewerAccess
+			_, a.master = masterCredentials(r, accounts)
+			if c, err := r.Cookie(albumKeyCookie); err == nil {
+				a.keys = strings.Split(c.Value, ".")
+			}
+			r = r.WithContext(context.WithValue(r.Context(), accessKey{}, a))
+
+			album := show.currentAlbum()
+			if isMaster(r.URL.Path) || !albumContent(r.URL.Path) || a.allowed(album) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			level := albumRule(album).Level
+			code := http.StatusForbidden
+			if level == accessPIN {
+				code = http.StatusUnauthorized
+			}
+			if r.URL.Path == "/photos.json" || strings.HasPrefix(r.URL.Path, "/api/") {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Cache-Control", "no-store")
+				w.WriteHeader(code)
+				json.NewEncoder(w).Encode(map[string]string{"access": level})
+				return
+			}
+			statusPage(w, r, code)
+		})
+	}
+}
+
+// Unlock checks the PIN in the pin parameter against that of the current
+// album. If it matches, the client gets the key of the album in a cookie.
+func Unlock(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if ok, wait := unlockLimiter.allow(clientIP(r), unlockAttempts, 10*time.Minute); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		statusPage(w, r, http.StatusTooManyRequests)
+		return
+	}
+
+	album := show.currentAlbum()
+	rule := albumRule(album)
+	if rule.Level != accessPIN {
+		statusPage(w, r, http.StatusBadRequest)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("pin")), []byte(rule.PIN)) != 1 {
+		statusPage(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	keys := []string{albumKey(album, rule.PIN)}
+	for _, k := range requestAccess(r).keys {
+		if k != keys[0] && len(keys) < maxAlbumKeys {
+			keys = append(keys, k)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     albumKeyCookie,
+		Value:    strings.Join(keys, "."),
+		Path:     "/",
+		MaxAge:   int(albumKeyTTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,130 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// altSuffix is appended to the file name of a photo to get the name of its
+// alt text sidecar file, e.g. IMG_0001.jpg.alt.txt
+const altSuffix = ".alt.txt"
+
+// altCache holds the alt texts read from sidecar files
+var altCache = struct {
+	sync.Mutex
+	entries map[string]altCacheEntry
+}{entries: make(map[string]altCacheEntry)}
+
+type altCacheEntry struct {
+	modTime time.Time
+	text    string
+}
+
+// sidecarAlt returns the alt text of the sidecar file of the photo, "" if it
+// has none. Only photos of the "dir" source have sidecar files.
+func sidecarAlt(album, name string) string {
+	d, ok := baseSource().(dirSource)
+	if !ok {
+		return ""
+	}
+	path, err := d.Path(context.Background(), album, name)
+	if err != nil {
+		return ""
+	}
+	path += altSuffix
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+
+	altCache.Lock()
+	e, ok := altCache.entries[path]
+	altCache.Unlock()
+	if ok && e.modTime.Equal(fi.ModTime()) {
+		return e.text
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	e = altCacheEntry{fi.ModTime(), cleanCaption(string(data))}
+	altCache.Lock()
+	altCache.entries[path] = e
+	altCache.Unlock()
+	return e.text
+}
+
+// photoAlt returns the alt text of the photo at position i of the show for
+// screen readers: the one set by the master, the one of its sidecar file, or
+// else its caption, which may be generated by the caption API. Title cards
+// are described by their text.
+func photoAlt(m photoMeta, album, name string, entries []playlistEntry, i int) string {
+	if m.Alt != "" {
+		return m.Alt
+	}
+	if i < len(entries) && entries[i].Card != nil {
+		return entries[i].Card.alt()
+	}
+	if alt := sidecarAlt(album, name); alt != "" {
+		return alt
+	}
+	return photoCaption(m, entries, i)
+}
+
+// altTexts returns the alt texts of the photos of the show
+func altTexts(album string, names []string, entries []playlistEntry) []string {
+	all := meta.album(album)
+	alts := make([]string, len(names))
+	for i, name := range names {
+		alts[i] = photoAlt(all[name], album, name, entries, i)
+	}
+	return alts
+}
+
+// slideEvent is sent as "set" event when the show advances
+type slideEvent struct {
+	ID          uint64           `json:"id"`
+	Alt         string           `json:"alt"`
+	Title       string           `json:"title,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Narration   string           `json:"narration,omitempty"` // URL of the audio clip to play
+	Layout      *slideLayout     `json:"layout,omitempty"`
+	Transition  *slideTransition `json:"transition,omitempty"`
+	Time        int64            `json:"time,omitempty"` // server time sent, in ms
+	At          int64            `json:"at,omitempty"`   // server time to show it, in ms
+}
+
+// newSlideEvent returns the event for the photo at position id
+func newSlideEvent(id uint64) slideEvent {
+	e := slideEvent{ID: id}
+	if snap := show.snapshot(); id < uint64(len(snap.photos)) {
+		name := snap.photos[id]
+		m := meta.get(snap.album, name)
+		e.Alt = photoAlt(m, snap.album, name, snap.entries, int(id))
+		e.Title, e.Description = m.Title, m.Description
+		e.Narration = narrationURL(snap.album, name)
+		e.Layout = layoutOf(snap.entries, int(id))
+	}
+	return e
+}
+
+// parseSlideEvent parses the data of a "set" event. Older recordings contain
+// only the position.
+func parseSlideEvent(data string) (slideEvent, error) {
+	var e slideEvent
+	if id, err := strconv.ParseUint(data, 10, 0); err == nil {
+		e.ID = id
+		return e, nil
+	}
+	err := json.Unmarshal([]byte(data), &e)
+	return e, err
+}
@@ -0,0 +1,208 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// slideStats are the engagement numbers of a single photo
+type slideStats struct {
+	Album      string         `json:"album"`
+	Photo      string         `json:"photo"`
+	Shown      int            `json:"shown"`     // how often the photo was displayed
+	Displayed  float64        `json:"displayed"` // total display time in seconds
+	MaxViewers int            `json:"maxViewers"`
+	Reactions  map[string]int `json:"reactions"`
+
+	order int // position of the first display
+}
+
+// analytics tracks per-slide engagement
+type analytics struct {
+	mu          sync.Mutex
+	slides      map[string]*slideStats
+	current     *slideStats
+	since       time.Time // display start of the current slide
+	viewers     int
+	peakViewers int
+}
+
+var stats = analytics{slides: make(map[string]*slideStats)}
+
+// currentPhoto returns the name of the currently displayed photo
+func currentPhoto() string {
+	return show.snapshot().photo()
+}
+
+// track accumulates the display time of the current slide until now.
+// It must be called with a.mu held.
+func (a *analytics) track(now time.Time) {
+	if a.current != nil {
+		a.current.Displayed += now.Sub(a.since).Seconds()
+	}
+	a.since = now
+}
+
+// show records that the given photo is now displayed
+func (a *analytics) show(album, photo string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.track(time.Now())
+	if photo == "" {
+		a.current = nil
+		return
+	}
+
+	key := album + "/" + photo
+	s, ok := a.slides[key]
+	if !ok {
+		s = &slideStats{
+			Album:     album,
+			Photo:     photo,
+			Reactions: make(map[string]int),
+			order:     len(a.slides),
+		}
+		a.slides[key] = s
+	}
+	s.Shown++
+	if a.viewers > s.MaxViewers {
+		s.MaxViewers = a.viewers
+	}
+	a.current = s
+}
+
+// connected updates the number of connected viewers by delta and returns the
+// new number
+func (a *analytics) connected(delta int) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.viewers += delta
+	if a.viewers > a.peakViewers {
+		a.peakViewers = a.viewers
+	}
+	if a.current != nil && a.viewers > a.current.MaxViewers {
+		a.current.MaxViewers = a.viewers
+	}
+	return a.viewers
+}
+
+// react counts a reaction to the current slide.
+// It returns false if no slide is displayed.
+func (a *analytics) react(reaction string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.current == nil {
+		return false
+	}
+	a.current.Reactions[reaction]++
+	return true
+}
+
+// analyticsSummary is the response of the analytics endpoint
+type analyticsSummary struct {
+	Viewers     int          `json:"viewers"`
+	PeakViewers int          `json:"peakViewers"`
+	Slides      []slideStats `json:"slides"`
+}
+
+// summary returns a snapshot of all stats, slides in order of first display
+func (a *analytics) summary() analyticsSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.track(time.Now())
+	sum := analyticsSummary{
+		Viewers:     a.viewers,
+		PeakViewers: a.peakViewers,
+		Slides:      make([]slideStats, 0, len(a.slides)),
+	}
+	for _, s := range a.slides {
+		c := *s
+		c.Reactions = make(map[string]int, len(s.Reactions))
+		for k, v := range s.Reactions {
+			c.Reactions[k] = v
+		}
+		sum.Slides = append(sum.Slides, c)
+	}
+	sort.Slice(sum.Slides, func(i, j int) bool {
+		return sum.Slides[i].order < sum.Slides[j].order
+	})
+	return sum
+}
+
+// validReaction reports whether the reaction is one of the configured ones
+func validReaction(reaction string) bool {
+	for _, r := range reactions {
+		if r == reaction {
+			return true
+		}
+	}
+	return false
+}
+
+// Reaction lets viewers react to the current slide.
+// The reaction is counted and broadcast to all clients.
+func Reaction(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	reaction := r.PostFormValue("reaction")
+	if !validReaction(reaction) {
+		errorPage(w, r, "Invalid reaction", http.StatusBadRequest)
+		return
+	}
+	if !stats.react(reaction) {
+		errorPage(w, r, "No photo shown", http.StatusConflict)
+		return
+	}
+	streamer.SendString("", "reaction", reaction)
+}
+
+// Analytics returns the engagement summary as JSON
+func Analytics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(stats.summary())
+}
+
+// AnalyticsCSV exports the per-slide engagement as CSV
+func AnalyticsCSV(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	sum := stats.summary()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="analytics.csv"`)
+
+	cw := csv.NewWriter(w)
+	header := []string{"album", "photo", "shown", "displayed_seconds", "max_viewers"}
+	for _, reaction := range reactions {
+		header = append(header, "reaction_"+strings.ToLower(reaction))
+	}
+	cw.Write(header)
+
+	for _, s := range sum.Slides {
+		row := []string{
+			s.Album,
+			s.Photo,
+			strconv.Itoa(s.Shown),
+			strconv.FormatFloat(s.Displayed, 'f', 1, 64),
+			strconv.Itoa(s.MaxViewers),
+		}
+		for _, reaction := range reactions {
+			row = append(row, strconv.Itoa(s.Reactions[reaction]))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+}
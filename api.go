@@ -0,0 +1,340 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiPrefix is the path of version 1 of the JSON API
+const apiPrefix = "/api/v1"
+
+// apiRoute is an endpoint of the API. The OpenAPI document is generated from
+// the routes, so the body types must match what the handler reads and writes.
+type apiRoute struct {
+	method  string
+	path    string // below apiPrefix
+	handle  httprouter.Handle
+	summary string
+	master  bool        // requires the credentials of the master
+	body    interface{} // type of the request body, nil if there is none
+	extra   bool        // the body may have further fields
+	form    []string    // fields of a multipart request body instead
+	reply   interface{} // type of the response body
+}
+
+var apiRoutes = []apiRoute{
+	{
+		method: "GET", path: "/show", handle: APIShow,
+		summary: "Current photo and state of the show",
+		reply:   apiShow{},
+	},
+	{
+		method: "GET", path: "/photos", handle: APIPhotos,
+		summary: "Photos of the show in their order",
+		reply:   apiPhotoList{},
+	},
+	{
+		method: "POST", path: "/commands", handle: APICommand,
+		summary: "Execute a command of the master page: set (id), next, prev, reset, reload, " +
+			"favorites (enabled), filter (tag), person (person), downloads (enabled), " +
+			"record (enabled), replay (name, speed), autoplay (enabled, interval), " +
+			"schedule (start, end), mode (mode) or album (id). With dryRun, the command " +
+			"is only checked and the reply tells what it would do. With stateVersion, it " +
+			"fails with 409 and the current state if the show changed since that version",
+		master: true,
+		body:   apiCommandBody{},
+		extra:  true,
+		reply:  apiShow{},
+	},
+	{
+		method: "POST", path: "/commands/batch", handle: APIBatch,
+		summary: "Execute a batch of commands in order, all or none of them. Only the commands " +
+			"which can be undone can be batched, the viewers get a single batch event. " +
+			"With stateVersion, the batch fails with 409 if the show changed since",
+		master: true,
+		body:   apiBatchBody{},
+		reply:  apiShow{},
+	},
+	{
+		method: "GET", path: "/remote", handle: APIRemote,
+		summary: "Current and next slide for a phone remote",
+		master:  true,
+		reply:   apiRemote{},
+	},
+	{
+		method: "POST", path: "/remote/next", handle: APIRemoteNext,
+		summary: "Advance the show, responding with 205 and no body if it wrapped around",
+		master:  true,
+		reply:   apiRemote{},
+	},
+	{
+		method: "POST", path: "/remote/prev", handle: APIRemotePrev,
+		summary: "Go back to the previous slide, responding with 205 and no body if it wrapped around",
+		master:  true,
+		reply:   apiRemote{},
+	},
+	{
+		method: "POST", path: "/remote/jump", handle: APIRemoteJump,
+		summary: "Show the slide at the position, responding with 404 if there is none",
+		master:  true,
+		body:    apiRemoteJump{},
+		reply:   apiRemote{},
+	},
+	{
+		method: "GET", path: "/remote/grid", handle: APIRemoteGrid,
+		summary: "Thumbnails of all slides to jump to",
+		master:  true,
+		reply:   apiRemoteGrid{},
+	},
+	{
+		method: "GET", path: "/staging", handle: APIStaging,
+		summary: "Imported and uploaded photos waiting to be published, the oldest first",
+		master:  true,
+		reply:   []*stagedPhoto{},
+	},
+	{
+		method: "POST", path: "/staging/publish", handle: APIPublishStaged,
+		summary: "Publish the staged photos with the ids into their albums, or all of the album, " +
+			"or all of them with an empty body",
+		master: true,
+		body:   apiPublishBody{},
+		reply:  apiPublished{},
+	},
+	{
+		method: "GET", path: "/invites", handle: APIInvites,
+		summary: "Invitations sent by email with their delivery state, the oldest first",
+		master:  true,
+		reply:   []invite{},
+	},
+	{
+		method: "POST", path: "/invites", handle: APISendInvites,
+		summary: "Invite the email addresses to the album, by default the current one, " +
+			"with the link to the show, its QR code and the PIN of the album. " +
+			"The invitations are sent in the background",
+		master: true,
+		body:   apiInviteBody{},
+		reply:  []invite{},
+	},
+	{
+		method: "POST", path: "/uploads", handle: APIUpload,
+		summary: "Upload photos as guest in the multipart fields photo, with the uploader in name",
+		form:    []string{"photo", "name"},
+		reply:   uploadResult{},
+	},
+}
+
+// isAPIMaster reports whether the path is an endpoint of the API for the
+// master
+func isAPIMaster(path string) bool {
+	for _, rt := range apiRoutes {
+		if rt.master && apiPrefix+rt.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// apiShow is the state of the show in the API
+type apiShow struct {
+	Album    string    `json:"album"`
+	ID       uint64    `json:"id"`
+	Count    int       `json:"count"`
+	Photo    string    `json:"photo"`
+	Version  uint64    `json:"version"`
+	Autoplay int64     `json:"autoplay"` // interval in seconds, 0 if paused
+	State    showState `json:"state"`
+	Mode     colorMode `json:"mode"`
+
+	StateVersion uint64 `json:"stateVersion"` // see stateVersion
+}
+
+// apiPhoto is a photo of the show in the API
+type apiPhoto struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Thumb   string `json:"thumb"`
+	Caption string `json:"caption"`
+	Alt     string `json:"alt"`
+
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// apiPhotoList is the response of APIPhotos
+type apiPhotoList struct {
+	Version uint64     `json:"version"`
+	Photos  []apiPhoto `json:"photos"`
+}
+
+// apiCommandBody is the request of APICommand. The parameters of the command
+// are further fields, strings, numbers or booleans.
+type apiCommandBody struct {
+	Cmd          string `json:"cmd"`
+	DryRun       bool   `json:"dryRun,omitempty"`       // only check it, see dryRun
+	StateVersion uint64 `json:"stateVersion,omitempty"` // expected version of the state
+}
+
+// apiError is the body of all error responses of the API
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiReply sends v as JSON with the status code
+func apiReply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiFail sends the error as JSON with the status code
+func apiFail(w http.ResponseWriter, code int, err error) {
+	apiReply(w, code, apiError{err.Error()})
+}
+
+// currentAPIShow returns the state of the show
+func currentAPIShow() apiShow {
+	snap := show.snapshot()
+	s := apiShow{
+		Album:    snap.album,
+		ID:       snap.pos,
+		Count:    len(snap.photos),
+		Version:  snap.version,
+		Autoplay: int64(player.playing().Seconds()),
+		State:    currentState(),
+		Mode:     currentMode(),
+
+		StateVersion: stateVersion.Load(),
+	}
+	if snap.pos < uint64(len(snap.photos)) {
+		s.Photo = snap.photos[snap.pos]
+	}
+	return s
+}
+
+// APIShow serves the state of the show
+func APIShow(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := show.loadErr(); err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiReply(w, http.StatusOK, currentAPIShow())
+}
+
+// APIPhotos serves the photos of the show in their order. The URLs contain
+// the token required by the hotlink protection.
+func APIPhotos(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	snap := show.snapshot()
+	if snap.err != nil {
+		apiFail(w, http.StatusInternalServerError, snap.err)
+		return
+	}
+
+	query := photoQuery(clientIP(r))
+	cdnURLs := cdnPhotoURLs(snap.album, snap.photos)
+	captions, _ := playlistInfo(snap.photos, snap.entries)
+	alts := altTexts(snap.album, snap.photos, snap.entries)
+	titles, descriptions := photoTitles(snap.photos)
+	photos := make([]apiPhoto, len(snap.photos))
+	for i, name := range snap.photos {
+		u, ok := cdnURLs[name]
+		if !ok {
+			u = "/photos/" + url.PathEscape(name) + query
+		}
+		photos[i] = apiPhoto{
+			Name:        name,
+			URL:         u,
+			Thumb:       "/thumbs/" + url.PathEscape(name) + query,
+			Caption:     captions[i],
+			Alt:         alts[i],
+			Title:       titles[i],
+			Description: descriptions[i],
+		}
+	}
+	apiReply(w, http.StatusOK, apiPhotoList{snap.version, photos})
+}
+
+// APICommand executes a command of the master given as JSON object, e.g.
+// {"cmd": "set", "id": 3}. The other fields are the parameters of the command,
+// see masterCommand. It responds with the new state of the show.
+func APICommand(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body map[string]interface{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	form, err := commandForm(body)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	auditCommand(r, form)
+	if isDryRun(form) {
+		plan, err := dryRun(r.Context(), form.Get("cmd"), form)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		apiReply(w, http.StatusOK, plan)
+		return
+	}
+	rec.command(form)
+	if err = masterCommand(form.Get("cmd"), form); err != nil {
+		code := http.StatusBadRequest
+		switch err {
+		case errUnknownCommand:
+			code = http.StatusNotFound
+		case errVersionConflict:
+			apiReply(w, http.StatusConflict, currentAPIShow())
+			return
+		}
+		apiFail(w, code, err)
+		return
+	}
+	apiReply(w, http.StatusOK, currentAPIShow())
+}
+
+// commandForm converts the fields of a JSON command to form values
+func commandForm(body map[string]interface{}) (url.Values, error) {
+	if _, ok := body["cmd"].(string); !ok {
+		return nil, errors.New("missing cmd")
+	}
+
+	form := make(url.Values, len(body))
+	for k, v := range body {
+		switch v := v.(type) {
+		case string:
+			form.Set(k, v)
+		case json.Number:
+			form.Set(k, v.String())
+		case bool:
+			form.Set(k, strconv.FormatBool(v))
+		case nil:
+		default:
+			return nil, errors.New("invalid value of " + k)
+		}
+	}
+	return form, nil
+}
+
+// APIUpload accepts photos uploaded by guests like GuestUpload
+func APIUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	res, code, err := receiveUploads(w, r)
+	if err != nil {
+		apiFail(w, code, errors.New(tr(requestLanguage(r), err.Error())))
+		return
+	}
+	apiReply(w, http.StatusOK, res)
+}
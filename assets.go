@@ -0,0 +1,53 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// assets are the default theme and the translations built into the binary,
+// so that it runs without any other files
+//
+//go:embed themes/default lang
+var assets embed.FS
+
+// overlayFS looks up files in each of the file systems in turn, the first one
+// having the file wins
+type overlayFS []fs.FS
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	for _, fsys := range o {
+		f, err := fsys.Open(name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// embedded returns the directory of the built-in assets
+func embedded(dir string) fs.FS {
+	sub, err := fs.Sub(assets, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// themeFS returns the files of the selected theme. Files on disk in themeDir
+// override the built-in ones, files missing in the theme are taken from the
+// default theme.
+func themeFS() fs.FS {
+	return overlayFS{
+		os.DirFS(filepath.Join(themeDir, theme)),
+		os.DirFS(filepath.Join(themeDir, defaultTheme)),
+		embedded("themes/" + defaultTheme),
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxAuditEntries limits the number of entries returned by AuditLog
+const maxAuditEntries = 1000
+
+// auditEntry is a single line of the audit log: a change requested by a
+// master and the state of the show before it
+type auditEntry struct {
+	Time    time.Time         `json:"time"`
+	Master  string            `json:"master"`
+	IP      string            `json:"ip"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Command map[string]string `json:"command,omitempty"`
+	Status  int               `json:"status"`
+	Before  apiShow           `json:"before"`
+}
+
+// audit appends the entries to the file at auditPath, which is never
+// rewritten
+var audit struct {
+	sync.Mutex
+	f *os.File
+}
+
+// auditKey is the context key of the audit entry of a request
+type auditKey struct{}
+
+// writeAudit appends the entry to the audit log
+func writeAudit(e *auditEntry) {
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.f == nil {
+		f, err := os.OpenFile(auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Println("audit:", err)
+			return
+		}
+		audit.f = f
+	}
+	if err := json.NewEncoder(audit.f).Encode(e); err != nil {
+		log.Println("audit:", err)
+	}
+}
+
+// audited serves the request of an authenticated master and records it in
+// the audit log, unless it only reads the state
+func audited(w http.ResponseWriter, r *http.Request, serve func(w http.ResponseWriter, r *http.Request)) {
+	if auditPath == "" || r.Method == "GET" || r.Method == "HEAD" {
+		serve(w, r)
+		return
+	}
+	m, _ := requestMaster(r)
+	e := &auditEntry{
+		Time:   time.Now(),
+		Master: m.Username,
+		IP:     clientIP(r),
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Before: currentAPIShow(),
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(r.Context(), auditKey{}, e))
+	serve(sw, r)
+
+	if e.Command == nil {
+		form := url.Values{}
+		for k, v := range r.URL.Query() {
+			form[k] = v
+		}
+		for k, v := range r.PostForm {
+			form[k] = v
+		}
+		if r.MultipartForm != nil {
+			for k, v := range r.MultipartForm.Value {
+				form[k] = v
+			}
+		}
+		if len(form) > 0 {
+			e.Command = commandMap(form)
+		}
+	}
+	e.Status = sw.code()
+	writeAudit(e)
+}
+
+// auditCommand records the command of a request whose form values are not
+// taken from the request body, like the JSON commands of the API
+func auditCommand(r *http.Request, form url.Values) {
+	if e, ok := r.Context().Value(auditKey{}).(*auditEntry); ok {
+		e.Command = commandMap(form)
+	}
+}
+
+// matches reports whether the entry matches the filters of AuditLog
+func (e *auditEntry) matches(q url.Values, since time.Time) bool {
+	is := func(key, v string) bool {
+		return q.Get(key) == "" || q.Get(key) == v
+	}
+	return is("master", e.Master) && is("ip", e.IP) && is("cmd", e.Command["cmd"]) &&
+		strings.HasPrefix(e.Path, q.Get("path")) && !e.Time.Before(since)
+}
+
+// AuditLog serves the entries of the audit log, the latest limit (default
+// 100) ones matching the parameters master, ip, cmd, path (a prefix) and
+// since (a time)
+func AuditLog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	limit := 100
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+		if limit > maxAuditEntries {
+			limit = maxAuditEntries
+		}
+	}
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = parseTime(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries := make([]auditEntry, 0)
+	f, err := os.Open(auditPath)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if f != nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			var e auditEntry
+			if json.Unmarshal(sc.Bytes(), &e) != nil {
+				continue
+			}
+			if !e.matches(q, since) {
+				continue
+			}
+			if entries = append(entries, e); len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+		if err = sc.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(entries)
+}
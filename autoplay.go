@@ -0,0 +1,131 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// autoplayer advances the photo show automatically
+type autoplayer struct {
+	mu       sync.Mutex
+	interval time.Duration // zero if paused
+	stop     chan struct{}
+	slide    chan struct{} // restarts the countdown after manual slide changes
+
+	kioskPos int // index of the current album in kioskPlaylist
+}
+
+var player = autoplayer{slide: make(chan struct{}, 1)}
+
+// start begins advancing the show every interval, unless a photo has its own
+// display duration
+func (p *autoplayer) start(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+
+	p.mu.Lock()
+	if p.stop != nil {
+		close(p.stop)
+	}
+	p.stop = make(chan struct{})
+	p.interval = interval
+	go p.run(p.stop, interval)
+	p.mu.Unlock()
+
+	p.changed()
+	return nil
+}
+
+// pause stops advancing the show
+func (p *autoplayer) pause() {
+	p.mu.Lock()
+	if p.stop == nil {
+		p.mu.Unlock()
+		return
+	}
+	close(p.stop)
+	p.stop = nil
+	p.interval = 0
+	p.mu.Unlock()
+
+	p.changed()
+}
+
+// playing returns the current interval, zero if paused
+func (p *autoplayer) playing() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.interval
+}
+
+// changed notifies all interested parties about the autoplay state
+func (p *autoplayer) changed() {
+	interval := p.playing()
+	streamer.SendInt("", "autoplay", int64(interval/time.Second))
+	mqttPublishAutoplay(interval > 0)
+}
+
+// slideChanged restarts the countdown, so that a photo chosen by the master
+// is shown for the full interval
+func (p *autoplayer) slideChanged() {
+	select {
+	case p.slide <- struct{}{}:
+	default:
+	}
+}
+
+func (p *autoplayer) run(stop chan struct{}, interval time.Duration) {
+	timer := time.NewTimer(displayDuration(interval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-p.slide:
+			timer.Reset(displayDuration(interval))
+		case <-timer.C:
+			if err := changeState(p.advance); err != nil {
+				log.Println("autoplay:", err)
+			}
+			timer.Reset(displayDuration(interval))
+		}
+	}
+}
+
+// advance shows the next photo. In kiosk mode the next album of the playlist
+// is started after the last photo, otherwise the show starts over.
+func (p *autoplayer) advance() error {
+	if snap := show.snapshot(); !kioskMode || len(kioskPlaylist) < 2 || snap.pos+1 < uint64(len(snap.photos)) {
+		return next()
+	}
+
+	p.mu.Lock()
+	p.kioskPos = (p.kioskPos + 1) % len(kioskPlaylist)
+	album := kioskPlaylist[p.kioskPos]
+	p.mu.Unlock()
+
+	return setAlbum(album)
+}
+
+// startKiosk starts the unattended show with the first album of the playlist
+func startKiosk() {
+	if !kioskMode {
+		return
+	}
+	if len(kioskPlaylist) > 0 {
+		if err := changeState(func() error { return setAlbum(kioskPlaylist[0]) }); err != nil {
+			log.Println("kiosk:", err)
+		}
+	}
+	if err := player.start(autoplayInterval); err != nil {
+		log.Println("kiosk:", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxBatch limits the number of commands in a batch
+const maxBatch = 50
+
+// apiBatchBody is the request of APIBatch
+type apiBatchBody struct {
+	Commands     []apiCommandBody `json:"commands"`
+	StateVersion uint64           `json:"stateVersion,omitempty"` // expected version of the state
+}
+
+// runBatch executes the commands in order, all or none of them: if one fails,
+// the show is restored to the state before the batch. Only the commands which
+// can be undone can be batched. The viewers get a single "batch" event with
+// the resulting state, undo restores the state before the whole batch.
+// It must be called with stateMu held.
+func runBatch(forms []url.Values) error {
+	if len(forms) == 0 || len(forms) > maxBatch {
+		return errors.New("batch of 1 to " + strconv.Itoa(maxBatch) + " commands expected")
+	}
+	for i, form := range forms {
+		if cmd := form.Get("cmd"); !undoable(cmd) {
+			return errors.New("command " + strconv.Itoa(i+1) + " can't be batched: " + cmd)
+		}
+	}
+
+	masterActed("batch")
+	before := currentUndoPoint()
+	streamer.hold()
+	for i, form := range forms {
+		if err := applyCommand(form.Get("cmd"), form); err != nil {
+			err = errors.New("command " + strconv.Itoa(i+1) + ": " + err.Error())
+			if rerr := restore(before); rerr != nil {
+				streamer.release(true) // show where the rollback ended
+				return errors.New(err.Error() + ", restoring the show failed: " + rerr.Error())
+			}
+			streamer.release(false)
+			return err
+		}
+	}
+	// recorded before the batch event, so that replays switch the album first
+	for _, form := range forms {
+		rec.command(form)
+	}
+	streamer.release(true)
+	pushUndo(before)
+	return nil
+}
+
+// APIBatch executes a batch of commands like APICommand, e.g.
+// {"commands": [{"cmd": "album", "id": "party"}, {"cmd": "set", "id": 0}]}.
+// It responds with the new state of the show.
+func APIBatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Commands     []map[string]interface{} `json:"commands"`
+		StateVersion json.Number              `json:"stateVersion"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	forms := make([]url.Values, len(body.Commands))
+	for i, c := range body.Commands {
+		form, err := commandForm(c)
+		if err == nil && isDryRun(form) {
+			err = errors.New("no dry run for batches")
+		}
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		forms[i] = form
+	}
+
+	commands, _ := json.Marshal(body.Commands)
+	auditCommand(r, url.Values{"cmd": {"batch"}, "commands": {string(commands)}})
+	err := expectVersion(body.StateVersion.String(), func() error {
+		return runBatch(forms)
+	})
+	if err == errVersionConflict {
+		apiReply(w, http.StatusConflict, currentAPIShow())
+		return
+	} else if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiReply(w, http.StatusOK, currentAPIShow())
+}
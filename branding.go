@@ -0,0 +1,64 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// brandingFile serves the image file, if it is configured and exists
+func brandingFile(w http.ResponseWriter, r *http.Request, file string) bool {
+	if file == "" {
+		return false
+	}
+	if fi, err := os.Stat(file); err != nil || fi.IsDir() {
+		return false
+	}
+	w.Header().Set("Cache-Control", "max-age=3600")
+	http.ServeFile(w, r, file)
+	return true
+}
+
+// Favicon serves faviconFile or else the favicon of the theme
+func Favicon(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !brandingFile(w, r, faviconFile) {
+		serveAsset(w, r, "favicon.ico")
+	}
+}
+
+// Logo serves logoFile
+func Logo(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !brandingFile(w, r, logoFile) {
+		http.NotFound(w, r)
+	}
+}
+
+// OGImage serves the preview image of links to the show, ogImageFile or else
+// the logo
+func OGImage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !brandingFile(w, r, ogImageFile) && !brandingFile(w, r, logoFile) {
+		http.NotFound(w, r)
+	}
+}
+
+// logoLink returns the URL of the logo or "" if there is none
+func logoLink() string {
+	if logoFile == "" {
+		return ""
+	}
+	return "/branding/logo"
+}
+
+// ogImageLink returns the absolute URL of the OpenGraph image or "" if there
+// is none, as link previews require absolute URLs
+func ogImageLink() string {
+	if ogImageFile == "" && logoFile == "" {
+		return ""
+	}
+	return publicURL + "/branding/og-image"
+}
@@ -0,0 +1,33 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import "sync/atomic"
+
+// browsing is set while the viewers may browse the photos on their own
+// devices. Browsing viewers leave the show until they return to it or the
+// master syncs everyone.
+var browsing atomic.Bool
+
+// browsingState is sent as "browsing" event when the master allows or stops
+// the browsing
+type browsingState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// setBrowsing allows or stops the browsing of the viewers. Stopping it brings
+// them back to the show.
+func setBrowsing(enabled bool) {
+	browsing.Store(enabled)
+	streamer.SendJSON("", "browsing", browsingState{enabled})
+}
+
+// syncViewers snaps all viewers back to the current slide, also those
+// browsing on their own. Unlike "set", the "sync" event is not ignored by
+// them. It returns how many viewers reported browsing.
+func syncViewers() int {
+	streamer.SendJSON("", "sync", timed(newSlideEvent(show.current())))
+	return syncFollowers()
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxCaptionLength limits the length of captions in bytes
+const maxCaptionLength = 500
+
+// captioner generates a description of a photo, used as its caption if it
+// has none
+type captioner interface {
+	// Caption describes the image file at the given path
+	Caption(ctx context.Context, path string) (string, error)
+}
+
+// captioning is the captioner selected in the config, nil if disabled
+var captioning captioner
+
+// newCaptioner returns the captioner selected in the config
+func newCaptioner() (captioner, error) {
+	switch captionType {
+	case "":
+		return nil, nil
+	case "command":
+		if captionCommand == "" {
+			return nil, errors.New("captionCommand not set")
+		}
+		return commandCaptioner(captionCommand), nil
+	case "api":
+		if captionURL == "" {
+			return nil, errors.New("captionURL not set")
+		}
+		return &apiCaptioner{url: captionURL, token: captionToken}, nil
+	default:
+		return nil, errors.New("unknown captioner: " + captionType)
+	}
+}
+
+// commandCaptioner runs a local program, e.g. an image captioning model, with
+// the path of the photo as last argument. It writes the caption to stdout.
+type commandCaptioner string
+
+func (c commandCaptioner) Caption(ctx context.Context, path string) (string, error) {
+	out, err := runCommand(ctx, string(c), path)
+	return string(out), err
+}
+
+// apiCaptioner posts the photo to an HTTP API, which responds with a JSON
+// object like {"caption": "A dog on a beach"}
+type apiCaptioner struct {
+	url   string
+	token string // sent as bearer token if set
+}
+
+func (c *apiCaptioner) Caption(ctx context.Context, path string) (string, error) {
+	var res struct {
+		Caption string `json:"caption"`
+	}
+	err := postImage(ctx, c.url, c.token, path, &res)
+	return res.Caption, err
+}
+
+// cleanCaption trims a caption to a single line of at most maxCaptionLength
+func cleanCaption(s string) string {
+	return truncateBytes(strings.Join(strings.Fields(s), " "), maxCaptionLength)
+}
+
+// truncateBytes shortens s to at most n bytes without cutting runes in half
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// autoCaption generates the caption of a photo without one. It reports
+// whether a caption was added.
+func autoCaption(ctx context.Context, album, name string) (bool, error) {
+	if captioning == nil || meta.get(album, name).Caption != "" {
+		return false, nil
+	}
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return false, err
+	}
+	caption, err := captioning.Caption(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	if caption = cleanCaption(caption); caption == "" {
+		return false, nil
+	}
+
+	err = meta.update(album, name, func(m *photoMeta) {
+		if m.Caption == "" { // not set by the master in the meantime
+			m.Caption = caption
+			m.AutoCaption = true
+		}
+	})
+	return err == nil, err
+}
+
+// photoCaption returns the caption of the photo at position i of the show:
+// the caption of the playlist entry if there is one, else the caption stored
+// in the catalog or, with placeCaptions, the place where it was taken
+func photoCaption(m photoMeta, entries []playlistEntry, i int) string {
+	if i < len(entries) && entries[i].Caption != "" {
+		return entries[i].Caption
+	}
+	if m.Caption == "" && placeCaptions {
+		return m.Place
+	}
+	return m.Caption
+}
@@ -0,0 +1,326 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Kinds of title cards
+const (
+	cardTitle        = "title"        // e.g. the title of the show
+	cardSection      = "section"      // divider, titled by its section by default
+	cardIntermission = "intermission" // e.g. "Back in 10 minutes"
+)
+
+// Size of the rendered title cards in pixels
+const (
+	cardWidth  = 1920
+	cardHeight = 1080
+)
+
+// cardPrefix starts the names of the title cards in the photo list
+const cardPrefix = "_card-"
+
+// titleCard is a slide which is not an image file but rendered by the server,
+// defined in the playlist or shown ad hoc by the master
+type titleCard struct {
+	Kind  string `json:"kind"`
+	Title string `json:"title,omitempty"`
+	Text  string `json:"text,omitempty"` // below the title, may have several lines
+
+	adHoc bool // not saved in the playlist
+}
+
+// newCard validates the card. A section card without title gets the one of
+// its section.
+func newCard(kind, title, text, section string) (*titleCard, error) {
+	switch kind {
+	case "", cardTitle:
+		kind = cardTitle
+	case cardSection:
+		if title == "" {
+			title = section
+		}
+	case cardIntermission:
+		if title == "" {
+			title = "Intermission"
+		}
+	default:
+		return nil, errors.New("unknown card kind: " + kind)
+	}
+	if title == "" && text == "" {
+		return nil, errors.New("card without title and text")
+	}
+	return &titleCard{Kind: kind, Title: title, Text: text}, nil
+}
+
+// name returns the name of the card in the photo list. It depends on the
+// look, so that changing it doesn't serve outdated renderings.
+func (c *titleCard) name() string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%q %q %q %s %s", c.Kind, c.Title, c.Text, backgroundColor, textColor)))
+	return cardPrefix + hex.EncodeToString(h[:6]) + ".png"
+}
+
+// alt returns the text of the card for screen readers
+func (c *titleCard) alt() string {
+	return strings.TrimSpace(c.Title + "\n" + c.Text)
+}
+
+// cards holds the title cards of the photo list by name and the ad hoc cards
+// of the master in the order they were shown
+var cards = struct {
+	sync.Mutex
+	byName map[string]*titleCard
+	adHoc  []adHocCard
+}{byName: make(map[string]*titleCard)}
+
+// adHocCard is a title card shown by the master after the photo named after
+type adHocCard struct {
+	after string
+	entry playlistEntry
+}
+
+// addCard registers the card and returns its playlist entry
+func addCard(c *titleCard, e playlistEntry) playlistEntry {
+	name := c.name()
+	cards.Lock()
+	cards.byName[name] = c
+	cards.Unlock()
+	e.Photo, e.Card = name, c
+	return e
+}
+
+// isCard reports whether the name of the photo list is a title card
+func isCard(name string) bool {
+	if !strings.HasPrefix(name, cardPrefix) {
+		return false
+	}
+	cards.Lock()
+	defer cards.Unlock()
+	return cards.byName[name] != nil
+}
+
+// withoutSlides returns the names which are photos of the album, not title
+// cards, text slides or images of web servers
+func withoutSlides(names []string) []string {
+	photos := make([]string, 0, len(names))
+	for _, name := range names {
+		if !isCard(name) && !isTextSlide(name) && !strings.HasPrefix(name, webPrefix) {
+			photos = append(photos, name)
+		}
+	}
+	return photos
+}
+
+// withAdHocCards inserts the ad hoc cards into the photo list after the photos
+// they were shown at, or at the end if these are gone
+func withAdHocCards(names []string, entries []playlistEntry) ([]string, []playlistEntry) {
+	cards.Lock()
+	adHoc := cards.adHoc
+	cards.Unlock()
+	if len(adHoc) == 0 {
+		return names, entries
+	}
+
+	if entries == nil {
+		entries = make([]playlistEntry, len(names))
+		for i, name := range names {
+			entries[i] = playlistEntry{Photo: name}
+		}
+	}
+	for _, c := range adHoc {
+		pos := len(names)
+		for i, name := range names {
+			if name == c.after {
+				pos = i + 1
+				break
+			}
+		}
+		names = append(names[:pos:pos], append([]string{c.entry.Photo}, names[pos:]...)...)
+		entries = append(entries[:pos:pos], append([]playlistEntry{c.entry}, entries[pos:]...)...)
+	}
+	return names, entries
+}
+
+// showCard inserts the card after the current photo and shows it
+func showCard(c *titleCard) error {
+	c.adHoc = true
+	e := addCard(c, playlistEntry{})
+	current := currentPhoto()
+
+	cards.Lock()
+	adHoc := make([]adHocCard, 0, len(cards.adHoc)+1)
+	for _, other := range cards.adHoc {
+		if other.entry.Photo != e.Photo { // the card moves if shown again
+			adHoc = append(adHoc, other)
+		}
+	}
+	cards.adHoc = append(adHoc, adHocCard{after: current, entry: e})
+	cards.Unlock()
+
+	if err := swapPhotos(current); err != nil {
+		return err
+	}
+	listChanged()
+	for i, name := range show.snapshot().photos {
+		if name == e.Photo {
+			return setID(uint64(i), nil)
+		}
+	}
+	return errors.New("card not in the photo list")
+}
+
+// clearCards removes the ad hoc cards. If one is displayed, the show
+// continues at the photo it was shown after.
+func clearCards() error {
+	current := currentPhoto()
+	cards.Lock()
+	for i := len(cards.adHoc) - 1; i >= 0; i-- { // cards may follow cards
+		if c := cards.adHoc[i]; c.entry.Photo == current {
+			current = c.after
+		}
+	}
+	cards.adHoc = nil
+	cards.Unlock()
+
+	if err := swapPhotos(current); err != nil {
+		return err
+	}
+	listChanged()
+	slideAdvanced(show.current(), nil)
+	return nil
+}
+
+// cardSource adds the title cards and the images of web servers of the
+// playlists to the photos of a source. Their paths are the renderings and the
+// downloaded copies in cacheDir.
+type cardSource struct {
+	photoSource
+}
+
+func (s cardSource) Path(ctx context.Context, album, name string) (string, error) {
+	cards.Lock()
+	c := cards.byName[name]
+	cards.Unlock()
+	if c == nil {
+		if u, ok := webImageURL(name); ok {
+			return webImagePath(ctx, name, u)
+		}
+		return s.photoSource.Path(ctx, album, name)
+	}
+
+	path := filepath.Join(cacheDir, "cards", name)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".card-")
+	if err != nil {
+		return "", err
+	}
+	err = png.Encode(tmp, c.render())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// baseSource returns the source of the photos without the title cards
+func baseSource() photoSource {
+	if s, ok := source.(cardSource); ok {
+		return s.photoSource
+	}
+	return source
+}
+
+// render draws the card in the colors of the pages with the pixel font of
+// the watermark
+func (c *titleCard) render() *image.RGBA {
+	bg, ok := parseColor(backgroundColor)
+	if !ok {
+		bg = color.RGBA{0, 0, 0, 255}
+	}
+	fg, ok := parseColor(textColor)
+	if !ok {
+		fg = color.RGBA{255, 255, 255, 255}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, cardWidth, cardHeight))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = bg.R, bg.G, bg.B, 255
+	}
+
+	// the title in large letters, the text lines in smaller ones below it
+	titleScale, textScale := 16, 8
+	if c.Kind == cardSection {
+		titleScale = 12
+	}
+	var lines []string
+	var scales []int
+	if c.Title != "" {
+		lines, scales = append(lines, c.Title), append(scales, titleScale)
+	}
+	for _, line := range strings.Split(c.Text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines, scales = append(lines, line), append(scales, textScale)
+		}
+	}
+
+	height := 0
+	for i, line := range lines {
+		// shrink lines which don't fit in 90% of the width
+		for scales[i] > 1 && 6*len(line)*scales[i] > cardWidth*9/10 {
+			scales[i]--
+		}
+		height += 10 * scales[i]
+	}
+	y := (cardHeight - height) / 2
+	for i, line := range lines {
+		x := (cardWidth - 6*len(line)*scales[i]) / 2
+		drawText(img, line, x, y, scales[i], fg)
+		y += 10 * scales[i]
+	}
+	return img
+}
+
+// drawText draws the text with the pixel font, each pixel scaled to a square
+// of scale pixels. Characters missing in the font are drawn as '?'.
+func drawText(img *image.RGBA, text string, x, y, scale int, c color.RGBA) {
+	for i, ch := range []byte(text) {
+		if ch < ' ' || ch > '~' {
+			ch = '?'
+		}
+		for col, bits := range font5x7[ch-' '] {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<uint(row)) == 0 {
+					continue
+				}
+				px, py := x+(6*i+col)*scale, y+row*scale
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						img.SetRGBA(px+dx, py+dy, c)
+					}
+				}
+			}
+		}
+	}
+}
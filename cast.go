@@ -0,0 +1,437 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Cast protocol namespaces
+const (
+	castNSConnection = "urn:x-cast:com.google.cast.tp.connection"
+	castNSHeartbeat  = "urn:x-cast:com.google.cast.tp.heartbeat"
+	castNSReceiver   = "urn:x-cast:com.google.cast.receiver"
+	castNSMedia      = "urn:x-cast:com.google.cast.media"
+
+	castSender       = "sender-0"
+	castReceiver     = "receiver-0"
+	castDefaultMedia = "CC1AD845" // app ID of the Default Media Receiver
+)
+
+// castDevice is a Chromecast found on the local network
+type castDevice struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Model   string `json:"model"`
+	Addr    string `json:"addr"`
+	Casting bool   `json:"casting"`
+}
+
+// castMessage is the CastMessage protobuf, with the string payload only
+type castMessage struct {
+	Source, Destination, Namespace, Payload string
+}
+
+// protoString appends a length-delimited protobuf field
+func protoString(b []byte, field int, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func (m *castMessage) marshal() []byte {
+	b := []byte{1<<3 | 0, 0} // protocol_version = CASTV2_1_0
+	b = protoString(b, 2, m.Source)
+	b = protoString(b, 3, m.Destination)
+	b = protoString(b, 4, m.Namespace)
+	b = append(b, 5<<3|0, 0) // payload_type = STRING
+	return protoString(b, 6, m.Payload)
+}
+
+func (m *castMessage) unmarshal(b []byte) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("cast: invalid message")
+		}
+		b = b[n:]
+
+		switch key & 7 {
+		case 0: // varint
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("cast: invalid message")
+			}
+			b = b[n:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("cast: invalid message")
+			}
+			s := string(b[n : n+int(l)])
+			b = b[n+int(l):]
+
+			switch key >> 3 {
+			case 2:
+				m.Source = s
+			case 3:
+				m.Destination = s
+			case 4:
+				m.Namespace = s
+			case 6:
+				m.Payload = s
+			}
+		default:
+			return errors.New("cast: unsupported wire type")
+		}
+	}
+	return nil
+}
+
+// castSession is an open connection to a Chromecast showing the photo show
+type castSession struct {
+	device castDevice
+
+	mu        sync.Mutex
+	conn      net.Conn
+	requestID int
+	transport string // of the launched receiver app
+	closed    bool
+}
+
+// send writes a JSON message to the given destination
+func (s *castSession) send(dest, namespace string, payload map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.conn == nil {
+		return errors.New("cast: not connected")
+	}
+	if _, ok := payload["requestId"]; ok {
+		s.requestID++
+		payload["requestId"] = s.requestID
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg := (&castMessage{Source: castSender, Destination: dest, Namespace: namespace, Payload: string(data)}).marshal()
+
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = s.conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(msg))), msg...))
+	return err
+}
+
+// load displays the photo with the given URL on the device
+func (s *castSession) load(photoURL, contentType string) error {
+	s.mu.Lock()
+	transport := s.transport
+	s.mu.Unlock()
+
+	if transport == "" {
+		return nil // not ready yet, the photo is loaded once the app runs
+	}
+	return s.send(transport, castNSMedia, map[string]interface{}{
+		"type":      "LOAD",
+		"requestId": 0,
+		"autoplay":  true,
+		"media": map[string]interface{}{
+			"contentId":   photoURL,
+			"contentType": contentType,
+			"streamType":  "NONE",
+		},
+	})
+}
+
+// close ends the session and stops the receiver app
+func (s *castSession) close() {
+	s.mu.Lock()
+	transport := s.transport
+	s.mu.Unlock()
+
+	if transport != "" {
+		s.send(castReceiver, castNSReceiver, map[string]interface{}{"type": "STOP", "requestId": 0})
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+// run connects to the device, launches the media receiver and keeps the
+// connection alive until it is closed
+func (s *castSession) run() {
+	defer func() {
+		castMu.Lock()
+		if castSessions[s.device.ID] == s {
+			delete(castSessions, s.device.ID)
+		}
+		castMu.Unlock()
+	}()
+
+	// Chromecasts use self-signed certificates
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", s.device.Addr,
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		log.Println("cast:", err)
+		return
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	s.send(castReceiver, castNSConnection, map[string]interface{}{"type": "CONNECT"})
+	s.send(castReceiver, castNSReceiver, map[string]interface{}{
+		"type": "LAUNCH", "requestId": 0, "appId": castDefaultMedia,
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.send(castReceiver, castNSHeartbeat, map[string]interface{}{"type": "PING"})
+			}
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			break
+		}
+		if size > 1<<16 {
+			break
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			break
+		}
+
+		var msg castMessage
+		if err := msg.unmarshal(buf); err != nil {
+			break
+		}
+		if !s.handle(&msg) {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	conn.Close()
+	s.mu.Unlock()
+	if !closed {
+		log.Println("cast: connection to", s.device.Name, "lost")
+	}
+}
+
+// handle processes a received message. It returns false if the session ended.
+func (s *castSession) handle(msg *castMessage) bool {
+	var payload struct {
+		Type   string `json:"type"`
+		Status struct {
+			Applications []struct {
+				AppID       string `json:"appId"`
+				TransportID string `json:"transportId"`
+			} `json:"applications"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(msg.Payload), &payload); err != nil {
+		return true
+	}
+
+	switch payload.Type {
+	case "PING":
+		s.send(msg.Source, castNSHeartbeat, map[string]interface{}{"type": "PONG"})
+
+	case "RECEIVER_STATUS":
+		running := false
+		for _, app := range payload.Status.Applications {
+			if app.AppID != castDefaultMedia {
+				continue
+			}
+			running = true
+
+			s.mu.Lock()
+			isNew := s.transport != app.TransportID
+			s.transport = app.TransportID
+			s.mu.Unlock()
+
+			if isNew {
+				s.send(app.TransportID, castNSConnection, map[string]interface{}{"type": "CONNECT"})
+				s.load(castPhotoURL())
+			}
+		}
+
+		// another app was started on the device
+		s.mu.Lock()
+		stopped := !running && s.transport != ""
+		s.mu.Unlock()
+		if stopped {
+			return false
+		}
+
+	case "CLOSE":
+		return msg.Source != castReceiver
+	}
+	return true
+}
+
+var (
+	castMu       sync.Mutex
+	castSessions = make(map[string]*castSession)
+)
+
+// castPhotoURL returns the URL and content type of the current photo as
+// reachable by devices on the local network
+func castPhotoURL() (string, string) {
+	name := currentPhoto()
+	ctype := imageTypes[strings.ToLower(path.Ext(name))]
+	if ctype == "" {
+		ctype = "image/jpeg"
+	}
+	return publicURL + "/photos/" + url.PathEscape(name) + photoQuery(""), ctype
+}
+
+// castSlide shows the current photo on all casting devices
+func castSlide() {
+	castMu.Lock()
+	sessions := make([]*castSession, 0, len(castSessions))
+	for _, s := range castSessions {
+		sessions = append(sessions, s)
+	}
+	castMu.Unlock()
+
+	if len(sessions) == 0 || currentPhoto() == "" {
+		return
+	}
+	u, ctype := castPhotoURL()
+	for _, s := range sessions {
+		if err := s.load(u, ctype); err != nil {
+			log.Println("cast:", err)
+		}
+	}
+}
+
+// discoverCast searches the local network for Chromecast devices
+func discoverCast() ([]castDevice, error) {
+	services, err := mdnsBrowse("_googlecast._tcp.local", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	castMu.Lock()
+	defer castMu.Unlock()
+
+	devices := make([]castDevice, 0, len(services))
+	for _, s := range services {
+		d := castDevice{
+			ID:    s.TXT["id"],
+			Name:  s.TXT["fn"],
+			Model: s.TXT["md"],
+			Addr:  s.Addr(),
+		}
+		if d.ID == "" {
+			d.ID = s.Instance
+		}
+		_, d.Casting = castSessions[d.ID]
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// CastDevices lists the Chromecast devices on the local network
+func CastDevices(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	devices, err := discoverCast()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// CastControl starts (action=start) or stops (action=stop) casting the photo
+// show to the device with the given id
+func CastControl(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id := r.PostFormValue("id")
+
+	switch r.PostFormValue("action") {
+	case "start":
+		devices, err := discoverCast()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, d := range devices {
+			if d.ID != id {
+				continue
+			}
+
+			castMu.Lock()
+			_, casting := castSessions[id]
+			s := &castSession{device: d}
+			if !casting {
+				castSessions[id] = s
+			}
+			castMu.Unlock()
+
+			if !casting {
+				go s.run()
+			}
+			return
+		}
+		http.Error(w, "device not found", http.StatusNotFound)
+
+	case "stop":
+		castMu.Lock()
+		s, ok := castSessions[id]
+		delete(castSessions, id)
+		castMu.Unlock()
+
+		if !ok {
+			http.Error(w, "not casting to this device", http.StatusNotFound)
+			return
+		}
+		go s.close()
+
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// photoMeta is the metadata of a single photo kept in the catalog
+type photoMeta struct {
+	Duration float64  `json:"duration,omitempty"` // display time in seconds, overrides the autoplay interval
+	Hidden   bool     `json:"hidden,omitempty"`   // excluded from the show, the file is kept
+	Favorite bool     `json:"favorite,omitempty"` // starred by the master
+	Stars    int      `json:"stars,omitempty"`    // number of viewers who starred the photo
+	Tags     []string `json:"tags,omitempty"`
+
+	// default caption if the playlist has none. AutoCaption is set if it was
+	// generated and not edited by the master yet.
+	Caption     string `json:"caption,omitempty"`
+	AutoCaption bool   `json:"autoCaption,omitempty"`
+	Place       string `json:"place,omitempty"` // where the photo was taken
+	Alt         string `json:"alt,omitempty"`   // description for screen readers
+
+	// set by the master, so that curation doesn't rely on the file names
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// set when scanning: the name of the photo with the same content and the
+	// file as it was last seen, to detect corrupted files
+	Duplicate string    `json:"duplicate,omitempty"`
+	File      *fileInfo `json:"file,omitempty"`
+	Faces     *faceInfo `json:"faces,omitempty"`
+	Text      *textInfo `json:"text,omitempty"` // recognized by OCR
+}
+
+// empty reports whether the photo has no metadata
+func (m *photoMeta) empty() bool {
+	return m.Duration == 0 && !m.Hidden && !m.Favorite && m.Stars == 0 && len(m.Tags) == 0 && m.Caption == "" && m.Place == "" && m.Alt == "" && m.Title == "" && m.Description == "" && m.Duplicate == "" && m.File == nil && m.Faces == nil && m.Text == nil
+}
+
+// catalog stores the photo metadata of all albums in a JSON file, which can
+// also be edited by hand while the server is stopped
+type catalog struct {
+	mu     sync.Mutex
+	albums map[string]map[string]*photoMeta
+}
+
+var meta = catalog{albums: make(map[string]map[string]*photoMeta)}
+
+// load reads the catalog file. A missing file is an empty catalog.
+func (c *catalog) load() error {
+	data, err := os.ReadFile(catalogPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err = json.Unmarshal(data, &c.albums); err == nil && c.albums == nil {
+		c.albums = make(map[string]map[string]*photoMeta)
+	}
+	return err
+}
+
+// save writes the catalog file.
+// It must be called with c.mu held.
+func (c *catalog) save() error {
+	data, err := json.MarshalIndent(c.albums, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := catalogPath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, catalogPath)
+}
+
+// get returns the metadata of the photo
+func (c *catalog) get(album, photo string) photoMeta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if m := c.albums[album][photo]; m != nil {
+		return *m
+	}
+	return photoMeta{}
+}
+
+// albumIDs returns the albums with metadata
+func (c *catalog) albumIDs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]string, 0, len(c.albums))
+	for id := range c.albums {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// album returns the metadata of all photos of the album which have any
+func (c *catalog) album(album string) map[string]photoMeta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	photos := make(map[string]photoMeta, len(c.albums[album]))
+	for name, m := range c.albums[album] {
+		photos[name] = *m
+	}
+	return photos
+}
+
+// update changes the metadata of the photo and saves the catalog
+func (c *catalog) update(album, photo string, f func(*photoMeta)) error {
+	return c.updatePhotos(album, []string{photo}, func(_ string, m *photoMeta) { f(m) })
+}
+
+// updatePhotos changes the metadata of the given photos, or of all photos of
+// the album with metadata if names is nil, and saves the catalog.
+// Slices in the metadata must be replaced, not modified in place.
+func (c *catalog) updatePhotos(album string, names []string, f func(string, *photoMeta)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	photos := c.albums[album]
+	if photos == nil {
+		photos = make(map[string]*photoMeta)
+		c.albums[album] = photos
+	}
+	if names == nil {
+		for name := range photos {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		m := photos[name]
+		if m == nil {
+			m = &photoMeta{}
+			photos[name] = m
+		}
+		f(name, m)
+
+		// don't keep empty entries
+		if m.empty() {
+			delete(photos, name)
+		}
+	}
+	if len(photos) == 0 {
+		delete(c.albums, album)
+	}
+	index.invalidate()
+	return c.save()
+}
+
+// displayDuration returns how long autoplay shows the current photo.
+// Durations set in the catalog take precedence over the playlist.
+func displayDuration(interval time.Duration) time.Duration {
+	snap := show.snapshot()
+	d := meta.get(snap.album, snap.photo()).Duration
+	if d <= 0 && snap.pos < uint64(len(snap.entries)) {
+		d = snap.entries[snap.pos].Duration
+	}
+	if d > 0 {
+		return time.Duration(d * float64(time.Second))
+	}
+	return interval
+}
+
+// hasPhoto reports whether the photo is part of the current album, hidden
+// photos included
+func hasPhoto(name string) bool {
+	snap := show.snapshot()
+	for _, p := range snap.photos {
+		if p == name {
+			return true
+		}
+	}
+	return meta.get(snap.album, name).Hidden
+}
+
+// withoutHidden removes the hidden photos of the album from the list and the
+// aligned playlist entries
+func withoutHidden(album string, names []string, entries []playlistEntry) ([]string, []playlistEntry) {
+	hidden := make(map[string]bool)
+	for name, m := range meta.album(album) {
+		if m.Hidden {
+			hidden[name] = true
+		}
+	}
+	if len(hidden) == 0 {
+		return names, entries
+	}
+
+	shown := make([]string, 0, len(names))
+	var shownEntries []playlistEntry
+	for i, name := range names {
+		if hidden[name] {
+			continue
+		}
+		shown = append(shown, name)
+		if entries != nil {
+			shownEntries = append(shownEntries, entries[i])
+		}
+	}
+	return shown, shownEntries
+}
+
+// PhotoCatalog returns the metadata of the photos of the current album
+func PhotoCatalog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(meta.album(show.currentAlbum()))
+}
+
+// PhotoUpdate changes the metadata of a photo in the current album.
+// Form values: duration (e.g. "30s", empty resets to the autoplay interval),
+// hidden (bool), favorite (bool), tags (comma-separated, replaces all tags),
+// caption, alt (the description for screen readers), title and description
+// (multiple lines)
+func PhotoUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("photo")
+	if !hasPhoto(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var duration float64
+	if v := r.PostFormValue("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d < 0 {
+			err = errors.New("invalid duration")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		duration = d.Seconds()
+	}
+
+	album := show.currentAlbum()
+	old := meta.get(album, name)
+	hide, fav := old.Hidden, old.Favorite
+	for field, v := range map[string]*bool{"hidden": &hide, "favorite": &fav} {
+		if s := r.PostFormValue(field); s != "" {
+			var err error
+			if *v, err = strconv.ParseBool(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	var tags []string
+	_, setTags := r.PostForm["tags"]
+	if setTags {
+		var err error
+		if tags, err = parseTags(r.PostFormValue("tags")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, setCaption := r.PostForm["caption"]
+	caption := cleanCaption(r.PostFormValue("caption"))
+	_, setAlt := r.PostForm["alt"]
+	alt := cleanCaption(r.PostFormValue("alt"))
+	_, setTitle := r.PostForm["title"]
+	title := cleanCaption(r.PostFormValue("title"))
+	_, setDescription := r.PostForm["description"]
+	description := cleanDescription(r.PostFormValue("description"))
+
+	err := meta.update(album, name, func(m *photoMeta) {
+		if setCaption {
+			m.Caption, m.AutoCaption = caption, false
+		}
+		if setAlt {
+			m.Alt = alt
+		}
+		if setTitle {
+			m.Title = title
+		}
+		if setDescription {
+			m.Description = description
+		}
+		if _, ok := r.PostForm["duration"]; ok {
+			m.Duration = duration
+		}
+		if setTags {
+			m.Tags = tags
+		}
+		m.Hidden = hide
+		m.Favorite = fav
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filter := show.filters()
+	if hide != old.Hidden || (filter.favorites && fav != old.Favorite) || (filter.tag != "" && setTags) {
+		// a hidden current photo is replaced by the next one
+		reload()
+		return
+	}
+	if (setCaption && caption != old.Caption) || (setAlt && alt != old.Alt) ||
+		(setTitle && title != old.Title) || (setDescription && description != old.Description) {
+		listChanged() // the clients fetch the captions, alt texts and titles with the list
+	}
+	if name == currentPhoto() {
+		// restart the countdown if the current photo was changed
+		player.slideChanged()
+	}
+}
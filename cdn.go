@@ -0,0 +1,245 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// cdnSigner signs the URLs of the photos on the CDN, so that it only serves
+// them until the URLs expire
+type cdnSigner interface {
+	Sign(u string, expires time.Time) (string, error)
+}
+
+// cdn is the signer selected in the config, nil if the URLs are not signed
+var cdn cdnSigner
+
+// newCDNSigner returns the signer selected in the config
+func newCDNSigner() (cdnSigner, error) {
+	if cdnURL == "" || cdnSigning == "" {
+		return nil, nil
+	}
+	// the unsigned photos could be pulled from /cdn/ of this server instead
+	if cdnOriginSecret == "" {
+		return nil, errors.New("cdnSigning requires cdnOriginSecret")
+	}
+	switch cdnSigning {
+	case "cloudfront":
+		if cdnKeyID == "" || cdnKeyFile == "" {
+			return nil, errors.New("cdnKeyID or cdnKeyFile not set")
+		}
+		key, err := readRSAKey(cdnKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &cloudFrontSigner{keyID: cdnKeyID, key: key, queries: make(map[string]string)}, nil
+	case "cloudflare":
+		if cdnSecret == "" {
+			return nil, errors.New("cdnSecret not set")
+		}
+		return cloudflareSigner(cdnSecret), nil
+	default:
+		return nil, errors.New("unknown CDN signing: " + cdnSigning)
+	}
+}
+
+// readRSAKey reads a PEM encoded RSA private key in PKCS #1 or PKCS #8 form
+func readRSAKey(file string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(file + ": no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New(file + ": not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// cloudFrontSigner signs the URLs with a custom policy of CloudFront covering
+// the photos of the album, so that only one signature is needed per album and
+// expiry time. The photos of the default album are signed one by one, a
+// policy for /cdn/* would cover all albums.
+type cloudFrontSigner struct {
+	keyID string
+	key   *rsa.PrivateKey
+
+	mu      sync.Mutex
+	expires int64             // of the queries
+	queries map[string]string // by policy resource
+}
+
+// cloudFrontPolicy is a custom policy of signed CloudFront URLs
+type cloudFrontPolicy struct {
+	Statement []cloudFrontStatement
+}
+
+type cloudFrontStatement struct {
+	Resource  string
+	Condition struct {
+		DateLessThan struct {
+			EpochTime int64 `json:"AWS:EpochTime"`
+		}
+	}
+}
+
+// cloudFrontEncoding is base64 with the characters CloudFront expects in
+// query strings
+var cloudFrontEncoding = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+func (s *cloudFrontSigner) Sign(u string, expires time.Time) (string, error) {
+	resource := u
+	if album, _, ok := strings.Cut(strings.TrimPrefix(u, cdnURL+"/cdn/"), "/"); ok {
+		resource = cdnURL + "/cdn/" + album + "/*"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expires != expires.Unix() {
+		// the older expiry times are no longer handed out
+		for r := range s.queries {
+			delete(s.queries, r)
+		}
+		s.expires = expires.Unix()
+	}
+	query, ok := s.queries[resource]
+	if !ok {
+		var st cloudFrontStatement
+		st.Resource = resource
+		st.Condition.DateLessThan.EpochTime = expires.Unix()
+		data, err := json.Marshal(cloudFrontPolicy{[]cloudFrontStatement{st}})
+		if err != nil {
+			return "", err
+		}
+		hash := sha1.Sum(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, hash[:])
+		if err != nil {
+			return "", err
+		}
+		query = "Policy=" + cloudFrontEncoding.Replace(base64.StdEncoding.EncodeToString(data)) +
+			"&Signature=" + cloudFrontEncoding.Replace(base64.StdEncoding.EncodeToString(sig)) +
+			"&Key-Pair-Id=" + url.QueryEscape(s.keyID)
+		s.queries[resource] = query
+	}
+	return u + "?" + query, nil
+}
+
+// cloudflareSigner signs the URLs with an HMAC-SHA256 of the path and the
+// expiry time in the verify parameter, like the signed URLs of Cloudflare
+// Workers
+type cloudflareSigner string
+
+func (s cloudflareSigner) Sign(u string, expires time.Time) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(s))
+	mac.Write([]byte(parsed.EscapedPath() + exp))
+	return u + "?verify=" + url.QueryEscape(exp+"-"+base64.StdEncoding.EncodeToString(mac.Sum(nil))), nil
+}
+
+// cdnPath returns the path under /cdn/ the CDN pulls the photo of the album
+// from. The photos of the default album have no album segment.
+func cdnPath(album, name string) string {
+	if album == "" {
+		return "/cdn/" + url.PathEscape(name)
+	}
+	return "/cdn/" + url.PathEscape(album) + "/" + url.PathEscape(name)
+}
+
+// cdnPhotoURLs returns the URLs of the photos of the album on the CDN, nil
+// without cdnURL. The expiry of signed URLs only changes every hour, so that
+// browsers and the CDN can cache the photos.
+func cdnPhotoURLs(album string, names []string) map[string]string {
+	if !cdnServes(album) {
+		return nil
+	}
+	expires := time.Now().Truncate(time.Hour).Add(cdnTTL)
+	urls := make(map[string]string, len(names))
+	for _, name := range names {
+		u := cdnURL + cdnPath(album, name)
+		if cdn != nil {
+			var err error
+			if u, err = cdn.Sign(u, expires); err != nil {
+				log.Println("cdn:", err)
+				return nil // the photos are served by this server then
+			}
+		}
+		urls[name] = u
+	}
+	return urls
+}
+
+// cdnServes reports whether the photos of the album are served by the CDN.
+// Only public albums are, with hotlink protection only by signed URLs, the
+// others are served by this server checking the access of each viewer.
+func cdnServes(album string) bool {
+	return cdnURL != "" && albumRule(album).Level == accessPublic &&
+		(cdn != nil || !hotlinkProtection)
+}
+
+// CDNPhoto serves a photo to the CDN pulling it, /cdn/photo.jpg for the
+// default album and /cdn/album/photo.jpg for the others. With cdnOriginSecret,
+// requests must carry it in the X-Origin-Secret header.
+func CDNPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if cdnURL == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if cdnOriginSecret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Origin-Secret")), []byte(cdnOriginSecret)) != 1 {
+		statusPage(w, r, http.StatusForbidden)
+		return
+	}
+
+	album, name, ok := strings.Cut(strings.TrimPrefix(ps.ByName("path"), "/"), "/")
+	if !ok {
+		album, name = "", album
+	}
+	if (album != "" && !validName(album)) || strings.Contains(name, "/") || !cdnServes(album) {
+		http.NotFound(w, r)
+		return
+	}
+	path, err := servedPath(r.Context(), album, name)
+	if err != nil || meta.get(album, name).Hidden {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
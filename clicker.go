@@ -0,0 +1,167 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The endpoints of the API under /remote are meant for a phone used as
+// clicker. Their replies are small and their status codes tell the outcome
+// without parsing the body, e.g. for a vibration pattern:
+//
+//	200 the show moved to the slide
+//	205 the show wrapped around to the first or last slide, without body
+//	    as required for the status, the phone gets the state with GET
+//	404 there is no slide at the requested position
+//	503 the show has no photos
+const statusWrapped = http.StatusResetContent
+
+// apiRemoteSlide is a slide of the show in the replies to the phone remote
+type apiRemoteSlide struct {
+	ID      uint64 `json:"id"`
+	Name    string `json:"name"`
+	Thumb   string `json:"thumb"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// apiRemote is the state of the show for the phone remote
+type apiRemote struct {
+	Count    int            `json:"count"`
+	Autoplay int64          `json:"autoplay"` // interval in seconds, 0 if paused
+	State    string         `json:"state"`
+	Current  apiRemoteSlide `json:"current"`
+	Next     apiRemoteSlide `json:"next"`
+}
+
+// apiRemoteGrid lists the thumbnails of all slides to jump to
+type apiRemoteGrid struct {
+	Version uint64   `json:"version"`
+	Current uint64   `json:"current"`
+	Thumbs  []string `json:"thumbs"` // URLs, by position
+}
+
+// apiRemoteJump is the request of APIRemoteJump
+type apiRemoteJump struct {
+	ID uint64 `json:"id"`
+}
+
+// errNoPhotos is returned to the phone remote if the show is empty
+var errNoPhotos = errors.New("no photos")
+
+// currentAPIRemote returns the state of the show for the client
+func currentAPIRemote(r *http.Request) (apiRemote, error) {
+	snap := show.snapshot()
+	if snap.err != nil {
+		return apiRemote{}, snap.err
+	}
+	if len(snap.photos) == 0 {
+		return apiRemote{}, errNoPhotos
+	}
+
+	query := photoQuery(clientIP(r))
+	captions, _ := playlistInfo(snap.photos, snap.entries)
+	slide := func(id uint64) apiRemoteSlide {
+		name := snap.photos[id]
+		return apiRemoteSlide{id, name, "/thumbs/" + url.PathEscape(name) + query, captions[id]}
+	}
+	return apiRemote{
+		Count:    len(snap.photos),
+		Autoplay: int64(player.playing().Seconds()),
+		State:    currentState().State,
+		Current:  slide(snap.pos),
+		Next:     slide((snap.pos + 1) % uint64(len(snap.photos))),
+	}, nil
+}
+
+// remoteReply sends the state of the show with the status code, or the error
+// if there is none to show
+func remoteReply(w http.ResponseWriter, r *http.Request, code int) {
+	state, err := currentAPIRemote(r)
+	if err != nil {
+		apiFail(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	apiReply(w, code, state)
+}
+
+// remoteCommand executes the command of the master like APICommand. The
+// reply tells whether the show wrapped around.
+func remoteCommand(w http.ResponseWriter, r *http.Request, form url.Values) {
+	if err := show.loadErr(); err != nil {
+		apiFail(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if len(show.snapshot().photos) == 0 {
+		apiFail(w, http.StatusServiceUnavailable, errNoPhotos)
+		return
+	}
+
+	from := show.current()
+	rec.command(form)
+	auditCommand(r, form)
+	if err := masterCommand(form.Get("cmd"), form); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	to := show.current()
+
+	if (form.Get("cmd") == "next" && to < from) || (form.Get("cmd") == "prev" && to > from) {
+		w.WriteHeader(statusWrapped)
+		return
+	}
+	remoteReply(w, r, http.StatusOK)
+}
+
+// APIRemote serves the current and the next slide for the phone remote
+func APIRemote(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	remoteReply(w, r, http.StatusOK)
+}
+
+// APIRemoteNext advances the show, like swiping left
+func APIRemoteNext(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	remoteCommand(w, r, url.Values{"cmd": {"next"}})
+}
+
+// APIRemotePrev goes back to the previous slide, like swiping right
+func APIRemotePrev(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	remoteCommand(w, r, url.Values{"cmd": {"prev"}})
+}
+
+// APIRemoteJump shows the slide picked in the thumbnail grid
+func APIRemoteJump(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body apiRemoteJump
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.ID >= uint64(len(show.snapshot().photos)) {
+		apiFail(w, http.StatusNotFound, errors.New("no slide at position "+strconv.FormatUint(body.ID, 10)))
+		return
+	}
+	remoteCommand(w, r, url.Values{"cmd": {"set"}, "id": {strconv.FormatUint(body.ID, 10)}})
+}
+
+// APIRemoteGrid serves the thumbnails of all slides
+func APIRemoteGrid(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	snap := show.snapshot()
+	if snap.err != nil {
+		apiFail(w, http.StatusServiceUnavailable, snap.err)
+		return
+	}
+
+	query := photoQuery(clientIP(r))
+	thumbs := make([]string, len(snap.photos))
+	for i, name := range snap.photos {
+		thumbs[i] = "/thumbs/" + url.PathEscape(name) + query
+	}
+	apiReply(w, http.StatusOK, apiRemoteGrid{snap.version, snap.pos, thumbs})
+}
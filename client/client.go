@@ -0,0 +1,195 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Package client controls a remotephotoshow server and receives the events of
+// its show, e.g. for automation tools and hardware remotes.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client talks to a photo show server. The credentials are those of the
+// master, they are only required for the commands.
+type Client struct {
+	BaseURL  string // e.g. "https://example.com", without trailing slash
+	User     string
+	Password string
+
+	HTTP *http.Client // http.DefaultClient if nil
+}
+
+// New returns a client for the server at baseURL
+func New(baseURL, user, password string) *Client {
+	return &Client{
+		BaseURL:  strings.TrimSuffix(baseURL, "/"),
+		User:     user,
+		Password: password,
+	}
+}
+
+// Show is the photo list and the position of the show, as in photos.json
+type Show struct {
+	Photos   []string `json:"photos"`
+	ID       uint64   `json:"id"`
+	Version  uint64   `json:"version"`
+	Autoplay int      `json:"autoplay"` // interval in seconds, 0 if paused
+	State    struct {
+		State string `json:"state"` // "live", "scheduled" or "ended"
+	} `json:"state"`
+}
+
+// UploadResult lists what happened to the uploaded photos
+type UploadResult struct {
+	Published []string `json:"published"`
+	Queued    []string `json:"queued"` // waiting for review
+	Skipped   []string `json:"skipped"`
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return http.DefaultClient
+}
+
+// do sends the request and checks the status of the response. The caller must
+// close the body.
+func (c *Client) do(req *http.Request, auth bool) (*http.Response, error) {
+	if auth {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+
+		// the API sends {"error": "..."}, the other pages plain text
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		s := strings.TrimSpace(string(msg))
+		if json.Unmarshal(msg, &apiErr) == nil && apiErr.Error != "" {
+			s = apiErr.Error
+		}
+		if s != "" && !strings.HasPrefix(s, "<") {
+			return nil, fmt.Errorf("%s: %s", resp.Status, s)
+		}
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+// Command sends a command of the master page, e.g. "autoplay" with the
+// parameter "interval", via the JSON API
+func (c *Client) Command(ctx context.Context, cmd string, params url.Values) error {
+	body := map[string]string{}
+	for k := range params {
+		body[k] = params.Get(k)
+	}
+	body["cmd"] = cmd
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/api/v1/commands", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req, true)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Next advances the show to the next photo
+func (c *Client) Next(ctx context.Context) error {
+	return c.Command(ctx, "next", nil)
+}
+
+// Prev goes back to the previous photo
+func (c *Client) Prev(ctx context.Context) error {
+	return c.Command(ctx, "prev", nil)
+}
+
+// Set shows the photo at the position id, counting from 0
+func (c *Client) Set(ctx context.Context, id uint64) error {
+	return c.Command(ctx, "set", url.Values{"id": {strconv.FormatUint(id, 10)}})
+}
+
+// Reset reloads the photos and starts the show over
+func (c *Client) Reset(ctx context.Context) error {
+	return c.Command(ctx, "reset", nil)
+}
+
+// Show returns the current photo list and position
+func (c *Client) Show(ctx context.Context) (*Show, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/photos.json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	show := new(Show)
+	if err = json.NewDecoder(resp.Body).Decode(show); err != nil {
+		return nil, err
+	}
+	return show, nil
+}
+
+// Upload uploads a photo as guest, which requires guest uploads to be enabled
+// on the server. The uploader is shown with the photo and may be empty.
+func (c *Client) Upload(ctx context.Context, filename string, photo io.Reader, uploader string) (*UploadResult, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if uploader != "" {
+		mw.WriteField("name", uploader)
+	}
+	fw, err := mw.CreateFormFile("photo", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(fw, photo); err != nil {
+		return nil, err
+	}
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/api/v1/uploads", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.do(req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	res := new(UploadResult)
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
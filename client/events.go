@@ -0,0 +1,128 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Event is a Server-Sent Event of the show, e.g. "set" when it advances,
+// "reset" and "list" when the photo list changed or "state" and "mode"
+type Event struct {
+	ID   string
+	Type string
+	Data string
+}
+
+// Slide is the data of a "set" event
+type Slide struct {
+	ID   uint64 `json:"id"`
+	Alt  string `json:"alt"`            // description of the photo for screen readers
+	Time int64  `json:"time,omitempty"` // server time sent, in ms
+	At   int64  `json:"at,omitempty"`   // server time to show it, in ms, if set
+
+	Layout     *Layout     `json:"layout,omitempty"`
+	Transition *Transition `json:"transition,omitempty"`
+}
+
+// Layout is the layout of the slide, if it is not the default one
+type Layout struct {
+	Type string `json:"type"`           // "full", "letterbox" or "two-up"
+	Pair string `json:"pair,omitempty"` // the second photo of "two-up"
+}
+
+// Transition is how the screens change to the slide
+type Transition struct {
+	Type     string `json:"type"`     // "fade", "slide" or "none"
+	Duration int64  `json:"duration"` // ms
+}
+
+// Slide parses the data of a "set" event. Older servers send only the
+// position.
+func (e Event) Slide() (Slide, error) {
+	var s Slide
+	if id, err := strconv.ParseUint(e.Data, 10, 0); err == nil {
+		s.ID = id
+		return s, nil
+	}
+	err := json.Unmarshal([]byte(e.Data), &s)
+	return s, err
+}
+
+// Subscribe listens to the events of the show and calls fn for each one,
+// except the "ping" events keeping the connection alive. It blocks until the
+// context is done or the server closes the stream.
+func (c *Client) Subscribe(ctx context.Context, fn func(Event)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/listen", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.do(req, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = ReadEvents(resp.Body, func(e Event) {
+		if e.Type != "ping" {
+			fn(e)
+		}
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ReadEvents parses a stream in the text/event-stream format and calls fn for
+// each event until the end of the stream
+func ReadEvents(r io.Reader, fn func(Event)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), 1<<20)
+
+	var e Event
+	var data []string
+	lastID := ""
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			// a blank line dispatches the event
+			if data != nil {
+				e.ID = lastID
+				if e.Type == "" {
+					e.Type = "message"
+				}
+				e.Data = strings.Join(data, "\n")
+				fn(e)
+			}
+			e, data = Event{}, nil
+			continue
+		}
+		if line[0] == ':' {
+			continue // comment, e.g. to keep the connection alive
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			e.Type = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			lastID = value
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,211 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// streamClient is a client connected to the event stream at /listen
+type streamClient struct {
+	id        uint64
+	ip        string
+	userAgent string
+	connected time.Time
+	channels  []string
+	tile      string             // of the video wall
+	kick      context.CancelFunc // ends the stream
+
+	lastEvent atomic.Uint64 // ID of the last event written to it
+	lastWrite atomic.Int64  // UnixNano
+}
+
+// clientInfo describes a connected client for the master
+type clientInfo struct {
+	ID        uint64     `json:"id"`
+	IP        string     `json:"ip"`
+	UserAgent string     `json:"userAgent"`
+	Connected time.Time  `json:"connected"`
+	Channels  []string   `json:"channels"` // empty for all
+	Tile      string     `json:"tile,omitempty"`
+	LastEvent uint64     `json:"lastEvent"`
+	LastWrite *time.Time `json:"lastWrite"` // nil if nothing was written yet
+}
+
+// clientList keeps the connected clients and the IP addresses blocked by the
+// master until the server restarts
+type clientList struct {
+	sync.Mutex
+	nextID  uint64
+	clients map[uint64]*streamClient
+	blocked map[string]bool
+}
+
+var streamClients = clientList{
+	clients: make(map[uint64]*streamClient),
+	blocked: make(map[string]bool),
+}
+
+// connect adds a client of the request, kick cancelling its stream
+func (l *clientList) connect(r *http.Request, channels map[string]bool, kick context.CancelFunc) *streamClient {
+	c := &streamClient{
+		ip:        clientIP(r),
+		userAgent: r.UserAgent(),
+		connected: time.Now(),
+		channels:  []string{},
+		tile:      r.URL.Query().Get("tile"),
+		kick:      kick,
+	}
+	for name := range channels {
+		c.channels = append(c.channels, name)
+	}
+	sort.Strings(c.channels)
+
+	l.Lock()
+	l.nextID++
+	c.id = l.nextID
+	l.clients[c.id] = c
+	l.Unlock()
+	return c
+}
+
+func (l *clientList) disconnect(c *streamClient) {
+	l.Lock()
+	delete(l.clients, c.id)
+	l.Unlock()
+}
+
+// kick disconnects the client with the ID. If block is set, all clients of its
+// IP address are disconnected and it may not reconnect.
+func (l *clientList) kick(id uint64, block bool) bool {
+	l.Lock()
+	defer l.Unlock()
+	c := l.clients[id]
+	if c == nil {
+		return false
+	}
+	c.kick()
+	if block {
+		l.blocked[c.ip] = true
+		for _, other := range l.clients {
+			if other.ip == c.ip {
+				other.kick()
+			}
+		}
+	}
+	return true
+}
+
+func (l *clientList) isBlocked(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.blocked[ip]
+}
+
+func (l *clientList) unblock(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if !l.blocked[ip] {
+		return false
+	}
+	delete(l.blocked, ip)
+	return true
+}
+
+// wrote records that the event with the ID was written to the client
+func (c *streamClient) wrote(id uint64) {
+	if id > 0 {
+		c.lastEvent.Store(id)
+	}
+	c.lastWrite.Store(time.Now().UnixNano())
+}
+
+func (c *streamClient) info() clientInfo {
+	info := clientInfo{
+		ID:        c.id,
+		IP:        c.ip,
+		UserAgent: c.userAgent,
+		Connected: c.connected,
+		Channels:  c.channels,
+		Tile:      c.tile,
+		LastEvent: c.lastEvent.Load(),
+	}
+	if ns := c.lastWrite.Load(); ns != 0 {
+		t := time.Unix(0, ns)
+		info.LastWrite = &t
+	}
+	return info
+}
+
+// Clients serves the list of clients connected to the event stream, the
+// longest connected first, and the blocked IP addresses
+func Clients(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	streamClients.Lock()
+	list := make([]clientInfo, 0, len(streamClients.clients))
+	for _, c := range streamClients.clients {
+		list = append(list, c.info())
+	}
+	blocked := make([]string, 0, len(streamClients.blocked))
+	for ip := range streamClients.blocked {
+		blocked = append(blocked, ip)
+	}
+	streamClients.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	sort.Strings(blocked)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(struct {
+		Seq     uint64       `json:"seq"` // ID of the last event sent
+		Clients []clientInfo `json:"clients"`
+		Blocked []string     `json:"blocked"`
+		Viewers followStats  `json:"viewers"` // as reported by the viewer pages
+	}{history.last(), list, blocked, followCounts()})
+}
+
+// KickClient disconnects a client. With block=true, its IP address can no
+// longer view the show until the server restarts or it is unblocked.
+func KickClient(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	block := false
+	if s := r.FormValue("block"); s != "" {
+		var err error
+		if block, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "invalid block", http.StatusBadRequest)
+			return
+		}
+	}
+	id, err := strconv.ParseUint(ps.ByName("id"), 10, 64)
+	if err != nil || !streamClients.kick(id, block) {
+		http.NotFound(w, r)
+	}
+}
+
+// UnblockIP allows a blocked IP address to view the show again
+func UnblockIP(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !streamClients.unblock(ps.ByName("ip")) {
+		http.NotFound(w, r)
+	}
+}
+
+// blockKicked rejects the requests of the blocked IP addresses, except for
+// the master pages
+func blockKicked(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMaster(r.URL.Path) && streamClients.isBlocked(clientIP(r)) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,177 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// photoshowctl controls a remotephotoshow server from the command line, e.g.
+// for scripted shows:
+//
+//	photoshowctl next
+//	photoshowctl set 12
+//	photoshowctl upload *.jpg
+//	photoshowctl status
+//
+// Photo numbers count from 1, as shown by status. The server and the master
+// credentials are taken from the flags or the environment variables
+// PHOTOSHOW_URL, PHOTOSHOW_USER and PHOTOSHOW_PASSWORD.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/remotephotoshow/client"
+)
+
+const usage = `usage: photoshowctl [flags] <command> [args]
+
+commands:
+  next             show the next photo
+  prev             show the previous photo
+  set <n>          show photo number n
+  reset            reload the photos and start over
+  status           print the current photo
+  upload <file>... upload photos as guest
+  listen           print the events of the show
+
+flags:
+`
+
+func main() {
+	baseURL := flag.String("url", envOr("PHOTOSHOW_URL", "http://localhost:8080"), "URL of the server")
+	user := flag.String("user", os.Getenv("PHOTOSHOW_USER"), "username of the master")
+	pass := flag.String("password", "", "password of the master, or else PHOTOSHOW_PASSWORD")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of each request, except listen")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if flag.Arg(0) != "listen" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if *pass == "" {
+		*pass = os.Getenv("PHOTOSHOW_PASSWORD")
+	}
+	c := client.New(*baseURL, *user, *pass)
+	if err := run(ctx, c, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "photoshowctl:", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// run executes the command with its arguments
+func run(ctx context.Context, c *client.Client, cmd string, args []string) error {
+	switch cmd {
+	case "next":
+		return c.Next(ctx)
+	case "prev":
+		return c.Prev(ctx)
+	case "reset":
+		return c.Reset(ctx)
+	case "set":
+		if len(args) != 1 {
+			return errors.New("usage: set <n>")
+		}
+		n, err := strconv.ParseUint(args[0], 10, 0)
+		if err != nil || n == 0 {
+			return errors.New("invalid photo number: " + args[0])
+		}
+		return c.Set(ctx, n-1)
+	case "status":
+		return status(ctx, c)
+	case "upload":
+		if len(args) == 0 {
+			return errors.New("usage: upload <file>...")
+		}
+		return upload(ctx, c, args)
+	case "listen":
+		err := c.Subscribe(ctx, func(e client.Event) {
+			fmt.Printf("%s\t%s\n", e.Type, e.Data)
+		})
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return err
+	default:
+		return errors.New("unknown command: " + cmd)
+	}
+}
+
+// status prints the current photo of the show
+func status(ctx context.Context, c *client.Client) error {
+	show, err := c.Show(ctx)
+	if err != nil {
+		return err
+	}
+	if len(show.Photos) == 0 {
+		fmt.Println("No photos in the show")
+		return nil
+	}
+
+	name := ""
+	if show.ID < uint64(len(show.Photos)) {
+		name = show.Photos[show.ID]
+	}
+	fmt.Printf("Showing photo %d / %d: %s\n", show.ID+1, len(show.Photos), name)
+	fmt.Println("State:", show.State.State)
+	if show.Autoplay > 0 {
+		fmt.Printf("Autoplay: every %ds\n", show.Autoplay)
+	}
+	return nil
+}
+
+// upload uploads the files one by one and prints what happened to them
+func upload(ctx context.Context, c *client.Client, files []string) error {
+	failed := false
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		res, err := c.Upload(ctx, filepath.Base(file), f, "")
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+
+		for _, name := range res.Published {
+			fmt.Println("published:", name)
+		}
+		for _, name := range res.Queued {
+			fmt.Println("waiting for review:", name)
+		}
+		for _, reason := range res.Skipped {
+			fmt.Println("skipped:", strings.TrimSpace(reason))
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("some photos were skipped")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Countdown states, empty without countdown or when it has run out
+const (
+	timerRunning = "running"
+	timerPaused  = "paused"
+)
+
+// countdownTimer is broadcast to the clients as "timer" event
+type countdownTimer struct {
+	State     string     `json:"state"`
+	Label     string     `json:"label,omitempty"` // e.g. "The show starts in"
+	End       *time.Time `json:"end,omitempty"`   // server time, if running
+	Remaining int64      `json:"remaining"`       // ms left when it was sent
+}
+
+var (
+	countdownMu    sync.Mutex
+	countdown      countdownTimer
+	countdownLeft  time.Duration // if paused
+	countdownGen   int           // invalidates the timers of replaced countdowns
+	countdownAlarm *time.Timer
+)
+
+// currentCountdown returns the countdown with the time remaining now
+func currentCountdown() countdownTimer {
+	countdownMu.Lock()
+	defer countdownMu.Unlock()
+	return countdownState()
+}
+
+// countdownState returns the countdown with the time remaining now.
+// It must be called with countdownMu held.
+func countdownState() countdownTimer {
+	c := countdown
+	switch c.State {
+	case timerRunning:
+		c.Remaining = time.Until(*c.End).Milliseconds()
+	case timerPaused:
+		c.Remaining = countdownLeft.Milliseconds()
+	}
+	return c
+}
+
+// startCountdown counts down d, e.g. for the holding period before the show,
+// replacing any running countdown
+func startCountdown(d time.Duration, label string) error {
+	if d <= 0 {
+		return errors.New("countdown must be positive")
+	}
+	countdownMu.Lock()
+	defer countdownMu.Unlock()
+	countdown = countdownTimer{Label: label}
+	runCountdown(d)
+	return nil
+}
+
+// pauseCountdown stops the countdown, keeping the time remaining
+func pauseCountdown() error {
+	countdownMu.Lock()
+	defer countdownMu.Unlock()
+	if countdown.State != timerRunning {
+		return errors.New("no running countdown")
+	}
+	stopCountdown()
+	countdownLeft = time.Until(*countdown.End)
+	countdown.State, countdown.End = timerPaused, nil
+	streamer.SendJSON("", "timer", countdownState())
+	return nil
+}
+
+// resumeCountdown continues a paused countdown
+func resumeCountdown() error {
+	countdownMu.Lock()
+	defer countdownMu.Unlock()
+	if countdown.State != timerPaused {
+		return errors.New("no paused countdown")
+	}
+	runCountdown(countdownLeft)
+	return nil
+}
+
+// cancelCountdown removes the countdown
+func cancelCountdown() {
+	countdownMu.Lock()
+	defer countdownMu.Unlock()
+	stopCountdown()
+	countdown = countdownTimer{}
+	streamer.SendJSON("", "timer", countdown)
+}
+
+// runCountdown lets the countdown run out in d and notifies the clients.
+// It must be called with countdownMu held.
+func runCountdown(d time.Duration) {
+	stopCountdown()
+	gen := countdownGen
+	end := time.Now().Add(d)
+	countdown.State, countdown.End = timerRunning, &end
+	countdownAlarm = time.AfterFunc(d, func() {
+		countdownMu.Lock()
+		defer countdownMu.Unlock()
+		if gen == countdownGen {
+			countdown = countdownTimer{}
+			streamer.SendJSON("", "timer", countdown)
+		}
+	})
+	streamer.SendJSON("", "timer", countdownState())
+}
+
+// stopCountdown stops the pending timer.
+// It must be called with countdownMu held.
+func stopCountdown() {
+	countdownGen++
+	if countdownAlarm != nil {
+		countdownAlarm.Stop()
+		countdownAlarm = nil
+	}
+}
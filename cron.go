@@ -0,0 +1,392 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// cronSpec is a parsed cron expression: minute hour day-of-month month
+// day-of-week, each field a bit set of the matching values
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var (
+	cronMonths = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// cronValue parses a single number or name of a field
+func cronValue(s string, names []string) (int, error) {
+	for i, name := range names {
+		if name != "" && strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+// parseCronField parses a comma-separated list of values, ranges (a-b), steps
+// (*/n, a-b/n) and wildcards into a bit set
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			var err error
+			if step, err = strconv.Atoi(s); err != nil || step < 1 {
+				return 0, errors.New("cron: invalid step in " + field)
+			}
+			rng = r
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = cronValue(a, names); err != nil {
+				return 0, errors.New("cron: invalid value in " + field)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = cronValue(b, names); err != nil {
+					return 0, errors.New("cron: invalid value in " + field)
+				}
+			} else if step > 1 {
+				hi = max // a/n means a-max/n
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.New("cron: value out of range in " + field)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// parseCron parses a standard 5-field cron expression like "0 18 * * fri"
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron: expected 5 fields: " + expr)
+	}
+
+	var c cronSpec
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 { // 7 is Sunday, too
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	return &c, nil
+}
+
+// matchDay reports whether the day of t matches. As in cron, if both days of
+// month and week are restricted, either one has to match.
+func (c *cronSpec) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// match reports whether the minute of t matches the expression
+func (c *cronSpec) match(t time.Time) bool {
+	return c.month&(1<<uint(t.Month())) != 0 && c.matchDay(t) &&
+		c.hour&(1<<uint(t.Hour())) != 0 && c.minute&(1<<uint(t.Minute())) != 0
+}
+
+// next returns the first matching minute after t, in the location of t.
+// It returns the zero time if there is none within the next five years.
+func (c *cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// recurringShow plays an album at the times given by a cron expression, e.g.
+// every Friday 18:00: {Cron: "0 18 * * fri", Album: "week-in-review",
+// Duration: time.Hour, Timezone: "Europe/Berlin"}.
+//
+// A show with a duration is not interrupted by other recurring shows; its end
+// has to be awaited. Shows without a duration run until the next one starts.
+type recurringShow struct {
+	ID       int           `json:"id"`
+	Cron     string        `json:"cron"`
+	Album    string        `json:"album"`
+	Duration time.Duration `json:"duration"`
+	Timezone string        `json:"timezone,omitempty"` // IANA name, local time if empty
+	Next     *time.Time    `json:"next,omitempty"`
+
+	spec    *cronSpec
+	loc     *time.Location
+	lastRun string // wall clock minute of the last run, avoids duplicates on DST changes
+	added   bool   // by the API, saved with the show state
+}
+
+var (
+	cronMu    sync.Mutex
+	cronShows []*recurringShow
+	cronNext  int
+)
+
+// savedRecurring are the recurring shows added by the API. They are guarded
+// by modeMu as part of the saved show state and added again on startup.
+var savedRecurring []recurringShow
+
+// saveRecurring saves the recurring shows added by the API with the show state.
+// It must be called with cronMu held.
+func saveRecurring() error {
+	var added []recurringShow
+	for _, s := range cronShows {
+		if s.added {
+			added = append(added, *s)
+		}
+	}
+
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	savedRecurring = added
+	return saveShow()
+}
+
+// addRecurringShow validates and adds a recurring show. The shows added by
+// the API are saved.
+func addRecurringShow(s recurringShow) (recurringShow, error) {
+	var err error
+	if s.spec, err = parseCron(s.Cron); err != nil {
+		return s, err
+	}
+	if s.Album != "" && !validName(s.Album) {
+		return s, errors.New("invalid album")
+	}
+	if s.Duration < 0 {
+		return s, errors.New("invalid duration")
+	}
+	if s.loc, err = time.LoadLocation(s.Timezone); err != nil {
+		return s, err
+	}
+
+	cronMu.Lock()
+	defer cronMu.Unlock()
+	cronNext++
+	s.ID = cronNext
+	cronShows = append(cronShows, &s)
+	if s.added {
+		return s, saveRecurring()
+	}
+	return s, nil
+}
+
+// removeRecurringShow removes the recurring show with the given ID.
+// It returns false if there is none.
+func removeRecurringShow(id int) (bool, error) {
+	cronMu.Lock()
+	defer cronMu.Unlock()
+
+	for i, s := range cronShows {
+		if s.ID == id {
+			cronShows = append(cronShows[:i], cronShows[i+1:]...)
+			if s.added {
+				return true, saveRecurring()
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// busy reports whether a scheduled show is pending or still running
+func busy(now time.Time) bool {
+	state := currentState()
+	return state.State == stateScheduled ||
+		(state.State == stateLive && state.End != nil && state.End.After(now))
+}
+
+// runCron checks every minute for recurring shows to start, until the
+// context is done
+func runCron(ctx context.Context) {
+	for {
+		now := time.Now()
+		if !sleep(ctx, now.Truncate(time.Minute).Add(time.Minute).Sub(now)) {
+			return
+		}
+		now = time.Now()
+
+		cronMu.Lock()
+		var due []*recurringShow
+		for _, s := range cronShows {
+			local := now.In(s.loc)
+			minute := local.Format("2006-01-02 15:04")
+			if s.spec.match(local) && s.lastRun != minute {
+				s.lastRun = minute
+				due = append(due, s)
+			}
+		}
+		cronMu.Unlock()
+
+		// the first show wins if several are due at the same time
+		for _, s := range due {
+			if busy(now) {
+				log.Printf("cron: skipping show %d (%s), another show is running", s.ID, s.Cron)
+				continue
+			}
+			if err := changeState(func() error { return startRecurringShow(s, now) }); err != nil {
+				log.Printf("cron: show %d: %v", s.ID, err)
+			}
+		}
+	}
+}
+
+// startRecurringShow switches to the album of the show and starts playing it
+func startRecurringShow(s *recurringShow, now time.Time) error {
+	if s.Album != "" {
+		if err := setAlbum(s.Album); err != nil {
+			return err
+		}
+	}
+	var end time.Time
+	if s.Duration > 0 {
+		end = now.Add(s.Duration)
+	}
+	return scheduleShow(now, end)
+}
+
+// startCron adds the configured and the saved recurring shows and runs the
+// scheduler
+func startCron(ctx context.Context) {
+	for _, s := range recurringShows {
+		if _, err := addRecurringShow(s); err != nil {
+			log.Println("cron:", err)
+		}
+	}
+
+	modeMu.Lock()
+	saved := savedRecurring
+	modeMu.Unlock()
+	for _, s := range saved {
+		s.added = true
+		if _, err := addRecurringShow(s); err != nil {
+			log.Println("cron:", err)
+		}
+	}
+	go runCron(ctx)
+}
+
+// RecurringShows lists all recurring shows with their next start
+func RecurringShows(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	now := time.Now()
+
+	cronMu.Lock()
+	shows := make([]recurringShow, 0, len(cronShows))
+	for _, s := range cronShows {
+		c := *s
+		if next := s.spec.next(now.In(s.loc)); !next.IsZero() {
+			c.Next = &next
+		}
+		shows = append(shows, c)
+	}
+	cronMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(shows)
+}
+
+// AddRecurringShow adds a recurring show given by the form values cron, album,
+// duration (e.g. "2h") and timezone
+func AddRecurringShow(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s := recurringShow{
+		Cron:     r.PostFormValue("cron"),
+		Album:    r.PostFormValue("album"),
+		Timezone: r.PostFormValue("timezone"),
+		added:    true,
+	}
+	if v := r.PostFormValue("duration"); v != "" {
+		var err error
+		if s.Duration, err = time.ParseDuration(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	added, err := addRecurringShow(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(added)
+}
+
+// DeleteRecurringShow removes a recurring show
+func DeleteRecurringShow(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	found, err := removeRecurringShow(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else if !found {
+		http.NotFound(w, r)
+	}
+}
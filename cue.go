@@ -0,0 +1,165 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxCues limits the length of the cue queue
+const maxCues = 500
+
+// showCue is a master command staged for a rehearsed presentation, fired by
+// the "go" command
+type showCue struct {
+	Label   string            `json:"label,omitempty"`
+	Command map[string]string `json:"command"`
+}
+
+// cueQueue is the staged cues and the position of the next one, kept in the
+// saved show state
+type cueQueue struct {
+	Cues []showCue `json:"cues"`
+	Next int       `json:"next"`
+}
+
+// cues is guarded by modeMu
+var cues cueQueue
+
+var errNoCues = errors.New("no cues left")
+
+// newCue checks the command of a cue. Cues can't stage other cues.
+func newCue(label string, form url.Values) (showCue, error) {
+	switch form.Get("cmd") {
+	case "":
+		return showCue{}, errors.New("missing cmd")
+	case "go", "cue":
+		return showCue{}, errors.New("invalid cue: " + form.Get("cmd"))
+	}
+	c := showCue{label, commandMap(form)}
+	delete(c.Command, "stateVersion") // of when the cue was staged
+	return c, nil
+}
+
+// currentCues returns the cue queue
+func currentCues() cueQueue {
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	return cueQueue{append([]showCue{}, cues.Cues...), cues.Next}
+}
+
+// setCues replaces the cue queue, starting again with the first cue
+func setCues(list []showCue) error {
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	cues = cueQueue{list, 0}
+	return saveShow()
+}
+
+// addCue appends a cue to the queue
+func addCue(c showCue) error {
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	if len(cues.Cues) >= maxCues {
+		return errors.New("too many cues")
+	}
+	cues.Cues = append(cues.Cues, c)
+	return saveShow()
+}
+
+// goCue fires the next cue.
+// It must be called with stateMu held.
+func goCue() error {
+	modeMu.Lock()
+	if cues.Next >= len(cues.Cues) {
+		modeMu.Unlock()
+		return errNoCues
+	}
+	c := cues.Cues[cues.Next]
+	cues.Next++
+	err := saveShow()
+	modeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	form := make(url.Values, len(c.Command))
+	for k, v := range c.Command {
+		form.Set(k, v)
+	}
+	return executeCommand(form.Get("cmd"), form)
+}
+
+// cueCommand stages the cue given as query string in command, e.g.
+// "cmd=set&id=12", or clears the queue without it
+func cueCommand(label, command string) error {
+	if command == "" {
+		return setCues(nil)
+	}
+	form, err := url.ParseQuery(command)
+	if err != nil {
+		return err
+	}
+	c, err := newCue(label, form)
+	if err != nil {
+		return err
+	}
+	return addCue(c)
+}
+
+// Cues serves the staged cues and the position of the next one
+func Cues(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(currentCues())
+}
+
+// SetCues replaces the cue queue with the list of {"label", "command"} in the
+// body, the commands given like those of the API
+func SetCues(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body []struct {
+		Label   string                 `json:"label"`
+		Command map[string]interface{} `json:"command"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list := make([]showCue, len(body))
+	for i, c := range body {
+		form, err := commandForm(c.Command)
+		if err == nil {
+			list[i], err = newCue(c.Label, form)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(list) > maxCues {
+		http.Error(w, "too many cues", http.StatusBadRequest)
+		return
+	}
+	if err := setCues(list); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Cues(w, r, nil)
+}
+
+// ClearCues empties the cue queue
+func ClearCues(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := setCues(nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const discordAPI = "https://discord.com/api/v10"
+
+// discordMessage is the subset of a Discord message object used by the bot
+type discordMessage struct {
+	ID     string `json:"id"`
+	Author struct {
+		Username string `json:"username"`
+		Bot      bool   `json:"bot"`
+	} `json:"author"`
+	Content     string `json:"content"`
+	Attachments []struct {
+		ID          string `json:"id"`
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+		URL         string `json:"url"`
+	} `json:"attachments"`
+}
+
+// discordBot polls the configured channels for commands and photos.
+// Polling the REST API avoids having to maintain a gateway websocket.
+type discordBot struct {
+	token   string
+	lastIDs map[string]string // last seen message ID per channel
+}
+
+// request performs an authenticated request against the Discord API
+func (b *discordBot) request(method, endpoint string, body, v interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, discordAPI+endpoint, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+b.token)
+	req.Header.Set("User-Agent", "DiscordBot (https://github.com/julienschmidt/remotephotoshow, 1)")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("discord %s %s: %s", method, endpoint, resp.Status)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+// messages returns the new messages in the channel, oldest first
+func (b *discordBot) messages(channel string) ([]discordMessage, error) {
+	endpoint := "/channels/" + channel + "/messages?limit=100"
+	last, seen := b.lastIDs[channel]
+	if seen {
+		endpoint += "&after=" + last
+	} else {
+		// Start with the latest message, ignoring the history
+		endpoint = "/channels/" + channel + "/messages?limit=1"
+	}
+
+	var msgs []discordMessage
+	if err := b.request("GET", endpoint, nil, &msgs); err != nil {
+		return nil, err
+	}
+
+	// message IDs are snowflakes, which increase over time
+	sort.Slice(msgs, func(i, j int) bool {
+		x, _ := strconv.ParseUint(msgs[i].ID, 10, 64)
+		y, _ := strconv.ParseUint(msgs[j].ID, 10, 64)
+		return x < y
+	})
+	if len(msgs) > 0 {
+		b.lastIDs[channel] = msgs[len(msgs)-1].ID
+	} else if !seen {
+		b.lastIDs[channel] = "0"
+	}
+	if !seen {
+		return nil, nil
+	}
+	return msgs, nil
+}
+
+// reply posts a message to the channel
+func (b *discordBot) reply(channel, content string) {
+	msg := map[string]string{"content": content}
+	if err := b.request("POST", "/channels/"+channel+"/messages", msg, nil); err != nil {
+		log.Println(err)
+	}
+}
+
+// command handles a "!photoshow <cmd>" message
+func (b *discordBot) command(channel string, msg discordMessage) {
+	text := strings.TrimSpace(strings.TrimPrefix(msg.Content, discordPrefix))
+	if text != "" && text != "status" {
+		if err := chatCommand(text); err != nil {
+			b.reply(channel, "Error: "+err.Error())
+			return
+		}
+	}
+	b.reply(channel, statusText())
+}
+
+// ingest downloads the image attachments of the message into the photo dir,
+// with stagePhotos into the staging area. It returns the names of the added
+// photos.
+func (b *discordBot) ingest(msg discordMessage) []string {
+	dir := albumDir(discordAlbum)
+	if stagePhotos {
+		if err := os.MkdirAll(stagingDir, 0755); err != nil {
+			log.Println("discord:", err)
+			return nil
+		}
+		tmp, err := os.MkdirTemp(stagingDir, "discord-")
+		if err != nil {
+			log.Println("discord:", err)
+			return nil
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("discord:", err)
+		return nil
+	}
+
+	var added []string
+	for _, a := range msg.Attachments {
+		if !strings.HasPrefix(a.ContentType, "image/") || a.Size > maxImportSize {
+			continue
+		}
+
+		// prefix with the attachment ID, phones tend to name all images the same
+		name := a.ID + "-" + path.Base(a.Filename)
+		if !validName(name) {
+			continue
+		}
+
+		err := func() error {
+			resp, err := remoteClient.Get(a.URL)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("download %s: %s", a.Filename, resp.Status)
+			}
+			dst := filepath.Join(dir, name)
+			if err = saveImage(resp.Body, dst); err != nil || !stagePhotos {
+				return err
+			}
+			_, err = stagePhoto(dst, discordAlbum, name, msg.Author.Username)
+			return err
+		}()
+		if err != nil {
+			log.Println("discord:", err)
+			continue
+		}
+		added = append(added, name)
+	}
+	return added
+}
+
+// poll processes all new messages once
+func (b *discordBot) poll() {
+	channels := []string{discordChannel}
+	if discordPhotoChannel != discordChannel {
+		channels = append(channels, discordPhotoChannel)
+	}
+
+	var added []string
+	for _, channel := range channels {
+		if channel == "" {
+			continue
+		}
+		msgs, err := b.messages(channel)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for _, msg := range msgs {
+			if msg.Author.Bot {
+				continue
+			}
+			if channel == discordChannel && strings.HasPrefix(msg.Content, discordPrefix) {
+				b.command(channel, msg)
+			}
+			if channel == discordPhotoChannel && sourceType == "dir" {
+				added = append(added, b.ingest(msg)...)
+			}
+		}
+	}
+
+	if len(added) > 0 && !stagePhotos {
+		sendWebhook(hookUpload, uploadData{Album: discordAlbum, Photos: added})
+		pushPhotosAdded(discordAlbum, len(added))
+		if discordAlbum == show.currentAlbum() {
+			rescan()
+		}
+	}
+}
+
+// startDiscord runs the Discord bot if a token is configured
+func startDiscord(ctx context.Context) {
+	if discordToken == "" {
+		return
+	}
+	if discordAlbum != "" && !validName(discordAlbum) {
+		log.Println("discord: invalid album", discordAlbum)
+		return
+	}
+
+	b := &discordBot{token: discordToken, lastIDs: make(map[string]string)}
+	go func() {
+		for {
+			b.poll()
+			if !sleep(ctx, discordPollInterval) {
+				return
+			}
+		}
+	}()
+}
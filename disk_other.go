@@ -0,0 +1,14 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// diskFree is not supported on this platform
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.New("free disk space unknown")
+}
@@ -0,0 +1,325 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const avTransport = "urn:schemas-upnp-org:service:AVTransport:1"
+
+// dlnaRenderer is a UPnP media renderer supporting AVTransport, e.g. a smart TV
+type dlnaRenderer struct {
+	ID         string `json:"id"` // the UDN of the device
+	Name       string `json:"name"`
+	ControlURL string `json:"-"`
+	Active     bool   `json:"active"`
+
+	// changed wakes up the worker pushing the photos to the active renderer.
+	// It holds at most one pending change, so that the renderer only gets
+	// the latest photo after quick changes, never an earlier one.
+	changed chan struct{}
+	stop    chan struct{}
+}
+
+// ssdpSearch sends an SSDP M-SEARCH for the search target and returns the
+// description locations of all responding devices
+func ssdpSearch(target string, timeout time.Duration) ([]string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: " + fmt.Sprint(int(timeout/time.Second)) + "\r\n" +
+		"ST: " + target + "\r\n\r\n"
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	if _, err = conn.WriteToUDP([]byte(req), group); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var locations []string
+	conn.SetReadDeadline(time.Now().Add(timeout + 500*time.Millisecond))
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // timeout
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		if loc := resp.Header.Get("Location"); loc != "" && !seen[loc] {
+			seen[loc] = true
+			locations = append(locations, loc)
+		}
+	}
+	return locations, nil
+}
+
+// upnpDevice is the relevant part of a UPnP device description
+type upnpDevice struct {
+	FriendlyName string `xml:"friendlyName"`
+	UDN          string `xml:"UDN"`
+	Services     []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// findAVTransport searches the device tree for the AVTransport service
+func (d *upnpDevice) findAVTransport() (*upnpDevice, string) {
+	for _, s := range d.Services {
+		if s.ServiceType == avTransport {
+			return d, s.ControlURL
+		}
+	}
+	for i := range d.Devices {
+		if dev, u := d.Devices[i].findAVTransport(); dev != nil {
+			return dev, u
+		}
+	}
+	return nil, ""
+}
+
+// describeRenderer fetches and parses the device description at location
+func describeRenderer(location string) (*dlnaRenderer, error) {
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+
+	resp, err := webhookClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return nil, err
+	}
+
+	dev, control := desc.Device.findAVTransport()
+	if dev == nil {
+		return nil, fmt.Errorf("%s: no AVTransport service", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if desc.URLBase != "" {
+		if base, err = url.Parse(desc.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	controlURL, err := base.Parse(control)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dlnaRenderer{
+		ID:         dev.UDN,
+		Name:       dev.FriendlyName,
+		ControlURL: controlURL.String(),
+	}, nil
+}
+
+// xmlEscape escapes s for use in XML text
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// soapCall invokes an AVTransport action on the renderer
+func (d *dlnaRenderer) soapCall(action, args string) error {
+	body := `<?xml version="1.0" encoding="utf-8"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + avTransport + `"><InstanceID>0</InstanceID>` + args +
+		`</u:` + action + `></s:Body></s:Envelope>`
+
+	req, err := http.NewRequest("POST", d.ControlURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+avTransport+"#"+action+`"`)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s failed: %s", d.Name, action, resp.Status)
+	}
+	return nil
+}
+
+// show displays the photo with the given URL on the renderer
+func (d *dlnaRenderer) show(photoURL, contentType, title string) error {
+	// Many TVs refuse URIs without DIDL-Lite metadata
+	meta := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" ` +
+		`xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+		`<item id="0" parentID="-1" restricted="1"><dc:title>` + xmlEscape(title) + `</dc:title>` +
+		`<upnp:class>object.item.imageItem.photo</upnp:class>` +
+		`<res protocolInfo="http-get:*:` + contentType + `:*">` + xmlEscape(photoURL) + `</res>` +
+		`</item></DIDL-Lite>`
+
+	err := d.soapCall("SetAVTransportURI",
+		"<CurrentURI>"+xmlEscape(photoURL)+"</CurrentURI>"+
+			"<CurrentURIMetaData>"+xmlEscape(meta)+"</CurrentURIMetaData>")
+	if err != nil {
+		return err
+	}
+	return d.soapCall("Play", "<Speed>1</Speed>")
+}
+
+var (
+	dlnaMu        sync.Mutex
+	dlnaRenderers = make(map[string]*dlnaRenderer) // active renderers by ID
+)
+
+// run pushes the current photo to the active renderer on each change until
+// it is stopped, then stops the playback on the renderer
+func (d *dlnaRenderer) run() {
+	for {
+		select {
+		case <-d.changed:
+			photo := currentPhoto()
+			if photo == "" {
+				continue
+			}
+			u, ctype := castPhotoURL()
+			if err := d.show(u, ctype, photo); err != nil {
+				log.Println("dlna:", err)
+			}
+		case <-d.stop:
+			if err := d.soapCall("Stop", ""); err != nil {
+				log.Println("dlna:", err)
+			}
+			return
+		}
+	}
+}
+
+// notify makes the worker push the current photo, unless a change is pending
+// anyway
+func (d *dlnaRenderer) notify() {
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// dlnaSlide pushes the current photo to all active renderers
+func dlnaSlide() {
+	dlnaMu.Lock()
+	defer dlnaMu.Unlock()
+	for _, d := range dlnaRenderers {
+		d.notify()
+	}
+}
+
+// discoverDLNA searches the local network for media renderers
+func discoverDLNA() ([]*dlnaRenderer, error) {
+	locations, err := ssdpSearch(avTransport, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	renderers := make([]*dlnaRenderer, 0, len(locations))
+	for _, loc := range locations {
+		d, err := describeRenderer(loc)
+		if err != nil {
+			log.Println("dlna:", err)
+			continue
+		}
+
+		dlnaMu.Lock()
+		_, d.Active = dlnaRenderers[d.ID]
+		dlnaMu.Unlock()
+		renderers = append(renderers, d)
+	}
+	return renderers, nil
+}
+
+// DLNARenderers lists the media renderers on the local network
+func DLNARenderers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	renderers, err := discoverDLNA()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(renderers)
+}
+
+// DLNAControl starts (action=start) or stops (action=stop) pushing the photo
+// show to the renderer with the given id
+func DLNAControl(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id := r.PostFormValue("id")
+
+	switch r.PostFormValue("action") {
+	case "start":
+		renderers, err := discoverDLNA()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, d := range renderers {
+			if d.ID == id {
+				dlnaMu.Lock()
+				if active, ok := dlnaRenderers[id]; ok {
+					d = active
+				} else {
+					d.changed, d.stop = make(chan struct{}, 1), make(chan struct{})
+					dlnaRenderers[id] = d
+					go d.run()
+				}
+				d.notify()
+				dlnaMu.Unlock()
+				return
+			}
+		}
+		http.Error(w, "device not found", http.StatusNotFound)
+
+	case "stop":
+		dlnaMu.Lock()
+		d, ok := dlnaRenderers[id]
+		delete(dlnaRenderers, id)
+		dlnaMu.Unlock()
+
+		if !ok {
+			http.Error(w, "device not active", http.StatusNotFound)
+			return
+		}
+		close(d.stop)
+
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/subtle"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// downloadsApproved is set by the master to allow viewers to download the
+// photos if downloadApproval is enabled
+var downloadsApproved atomic.Bool
+
+// setDownloads allows or forbids viewers to download the photos
+func setDownloads(allowed bool) {
+	downloadsApproved.Store(allowed)
+	streamer.SendString("", "downloads", strconv.FormatBool(allowed))
+}
+
+// canDownload checks whether the request may download the photos.
+// It returns the HTTP status code to respond with otherwise.
+func canDownload(r *http.Request) (bool, int) {
+	if noDownloads {
+		return false, http.StatusForbidden
+	}
+	if downloadApproval && !downloadsApproved.Load() {
+		return false, http.StatusForbidden
+	}
+	if downloadPIN != "" {
+		pin := r.FormValue("pin")
+		if subtle.ConstantTimeCompare([]byte(pin), []byte(downloadPIN)) != 1 {
+			return false, http.StatusUnauthorized
+		}
+	}
+	return true, 0
+}
+
+// clientIP returns the IP address of the client sending the request
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// rateLimiter limits the requests per key with a token bucket for each key
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// downloadLimiter limits the original downloads per IP address
+var downloadLimiter = rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow takes a token from the bucket of the key, which holds up to n tokens
+// and is refilled with n tokens per period. If the bucket is empty, it
+// returns the time until the next token is available.
+func (l *rateLimiter) allow(key string, n int, per time.Duration) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	rate := float64(n) / per.Seconds() // tokens per second
+	if len(l.buckets) > 10000 {
+		// forget the clients whose buckets are full again
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(n) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(n), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(n) {
+		b.tokens = float64(n)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// DownloadPhoto serves the untouched original file of a photo as attachment,
+// unlike /photos/:photo which serves the display variant. Downloads are
+// subject to the same approval and PIN as the ZIP download, and limited to
+// downloadRate per IP address and hour.
+func DownloadPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if ok, code := canDownload(r); !ok {
+		statusPage(w, r, code)
+		return
+	}
+	name := ps.ByName("photo")
+	album := show.currentAlbum()
+	path, err := source.Path(r.Context(), album, name)
+	if err != nil || !hasPhoto(name) || meta.get(album, name).Hidden {
+		http.NotFound(w, r)
+		return
+	}
+
+	if downloadRate > 0 {
+		if ok, wait := downloadLimiter.allow(clientIP(r), downloadRate, time.Hour); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+			statusPage(w, r, http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeFile(w, r, path)
+}
+
+// PhotosZIP streams all photos of the current album as a ZIP archive.
+// The archive is written on the fly, the photos are never buffered in memory.
+func PhotosZIP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if ok, code := canDownload(r); !ok {
+		statusPage(w, r, code)
+		return
+	}
+	if err := show.loadErr(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	snap := show.snapshot()
+	album, names := snap.album, withoutSlides(snap.photos)
+	filename := "photos.zip"
+	if album != "" {
+		filename = album + ".zip"
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		if err := writeZIPEntry(r.Context(), zw, album, name); err != nil {
+			// The response is already partially sent, thus the only thing
+			// left to do is aborting the archive
+			log.Println("ZIP download:", err)
+			return
+		}
+	}
+	zw.Close()
+}
+
+// writeZIPEntry adds the display variant of the given photo to the ZIP
+// archive. Photos are stored uncompressed, since images are usually
+// compressed already.
+func writeZIPEntry(ctx context.Context, zw *zip.Writer, album, name string) error {
+	path, err := servedPath(ctx, album, name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	fh, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	fh.Name = name
+	fh.Method = zip.Store
+
+	fw, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
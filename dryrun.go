@@ -0,0 +1,178 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// commandPlan is the reply to a dry run of a command: what it would do if it
+// was sent without dryRun
+type commandPlan struct {
+	Cmd        string           `json:"cmd"`
+	ID         *uint64          `json:"id,omitempty"` // the slide shown after it
+	Photo      string           `json:"photo,omitempty"`
+	Album      string           `json:"album,omitempty"`
+	Count      int              `json:"count,omitempty"` // photos of the album shown
+	Autoplay   int64            `json:"autoplay,omitempty"`
+	Mode       string           `json:"mode,omitempty"`
+	Transition *slideTransition `json:"transition,omitempty"`
+	Cue        *commandPlan     `json:"cue,omitempty"` // the command fired by "go"
+}
+
+// isDryRun reports whether the command is only to be validated
+func isDryRun(form url.Values) bool {
+	dry, _ := strconv.ParseBool(form.Get("dryRun"))
+	return dry
+}
+
+// slide sets the slide at the position, to which the show would change. Its
+// photo must exist and be readable.
+func (p *commandPlan) slide(ctx context.Context, id uint64) error {
+	snap := show.snapshot()
+	if snap.err != nil {
+		return snap.err
+	}
+	if id >= uint64(len(snap.photos)) {
+		return errors.New("invalid ID")
+	}
+	name := snap.photos[id]
+	path, err := source.Path(ctx, snap.album, name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	p.ID, p.Photo = &id, name
+	return nil
+}
+
+// dryRun checks the command and returns what it would do, without changing
+// the show or notifying anyone. Only the commands which change the slide, the
+// album or how the slides are shown can be checked.
+func dryRun(ctx context.Context, cmd string, form url.Values) (*commandPlan, error) {
+	p := &commandPlan{Cmd: cmd}
+	switch cmd {
+	case "set":
+		id, err := strconv.ParseUint(form.Get("id"), 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		if p.Transition, err = formTransition(form); err != nil {
+			return nil, err
+		}
+		return p, p.slide(ctx, id)
+
+	case "next", "prev":
+		var err error
+		if p.Transition, err = formTransition(form); err != nil {
+			return nil, err
+		}
+		snap := show.snapshot()
+		n := uint64(len(snap.photos))
+		if n == 0 {
+			return nil, errNoPhotos
+		}
+		id := (snap.pos + 1) % n
+		if cmd == "prev" {
+			id = (snap.pos + n - 1) % n
+		}
+		return p, p.slide(ctx, id)
+
+	case "transition":
+		var err error
+		p.Transition, err = formTransition(form)
+		return p, err
+
+	case "album", "preset":
+		p.Album = form.Get("id")
+		if cmd == "preset" {
+			presetsMu.Lock()
+			presets, err := readPresets()
+			presetsMu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			preset, ok := presets[form.Get("name")]
+			if !ok {
+				return nil, errUnknownPreset
+			}
+			p.Album, p.Autoplay, p.Mode, p.Transition = preset.Album, preset.Autoplay, preset.Mode, preset.Transition
+		}
+		if p.Album != "" && !validName(p.Album) {
+			return nil, errors.New("invalid album")
+		}
+		names, _, _, err := albumShow(ctx, p.Album)
+		if err != nil {
+			return nil, err
+		}
+		p.Count = len(names)
+		return p, nil
+
+	case "autoplay":
+		play, err := strconv.ParseBool(form.Get("enabled"))
+		if err != nil || !play {
+			return p, err
+		}
+		interval := autoplayInterval
+		if v := form.Get("interval"); v != "" {
+			secs, err := strconv.ParseUint(v, 10, 0)
+			if err != nil {
+				return nil, err
+			}
+			interval = time.Duration(secs) * time.Second
+		}
+		if interval <= 0 {
+			return nil, errors.New("invalid interval")
+		}
+		p.Autoplay = int64(interval / time.Second)
+		return p, nil
+
+	case "mode":
+		p.Mode = form.Get("mode")
+		if _, ok := findMode(p.Mode); !ok && p.Mode != "" {
+			return nil, errors.New("unknown mode: " + p.Mode)
+		}
+		return p, nil
+
+	case "go":
+		q := currentCues()
+		if q.Next >= len(q.Cues) {
+			return nil, errNoCues
+		}
+		c := make(url.Values)
+		for k, v := range q.Cues[q.Next].Command {
+			c.Set(k, v)
+		}
+		var err error
+		p.Cue, err = dryRun(ctx, c.Get("cmd"), c)
+		return p, err
+
+	case "undo":
+		undos.Lock()
+		n := len(undos.points)
+		var last undoPoint
+		if n > 0 {
+			last = undos.points[n-1]
+		}
+		undos.Unlock()
+		if n == 0 {
+			return nil, errNothingToUndo
+		}
+		p.Album, p.Photo, p.Autoplay, p.Mode, p.Transition = last.album, last.photo, int64(last.autoplay/time.Second), last.mode, last.transition
+		return p, nil
+
+	default:
+		return nil, errors.New("no dry run for command: " + cmd)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"math/bits"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// photoHash identifies the content of a photo
+type photoHash struct {
+	content    [sha256.Size]byte
+	perceptual uint64 // difference hash of the image, if decoded is set
+	decoded    bool
+	size       int64
+	modTime    time.Time
+}
+
+// hashCache caches the hashes per file, invalidated by the modification time
+var hashCache = struct {
+	sync.Mutex
+	entries map[string]hashCacheEntry
+}{entries: make(map[string]hashCacheEntry)}
+
+type hashCacheEntry struct {
+	modTime time.Time
+	hash    photoHash
+}
+
+// differenceHash computes a perceptual hash of the image: each bit tells
+// whether a pixel of a 9x8 grayscale thumbnail is brighter than its right
+// neighbour. Similar images have hashes differing in few bits only.
+func differenceHash(path string) (uint64, error) {
+	img, err := decodeImage(path)
+	if err != nil {
+		return 0, err
+	}
+	small := resize(img, 9, 8)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if gray(small.Pix[small.PixOffset(x, y):]) > gray(small.Pix[small.PixOffset(x+1, y):]) {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash, nil
+}
+
+// gray returns the luminance of an RGBA pixel
+func gray(pix []uint8) uint32 {
+	return (299*uint32(pix[0]) + 587*uint32(pix[1]) + 114*uint32(pix[2])) / 1000
+}
+
+// hashFile returns the SHA-256 hash of the file content
+func hashFile(r io.Reader) (sum [sha256.Size]byte, err error) {
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return sum, err
+	}
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+// hashPhoto returns the (cached) hashes of a photo of the album
+func hashPhoto(ctx context.Context, album, name string) (photoHash, error) {
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return photoHash{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return photoHash{}, err
+	}
+
+	hashCache.Lock()
+	entry, ok := hashCache.entries[path]
+	hashCache.Unlock()
+	if ok && entry.modTime.Equal(fi.ModTime()) {
+		return entry.hash, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return photoHash{}, err
+	}
+	defer f.Close()
+	h := photoHash{size: fi.Size(), modTime: fi.ModTime()}
+	if h.content, err = hashFile(f); err != nil {
+		return photoHash{}, err
+	}
+	if perceptualHashes {
+		// formats which can't be decoded are compared by content only
+		h.perceptual, err = differenceHash(path)
+		h.decoded = err == nil
+	}
+
+	hashCache.Lock()
+	hashCache.entries[path] = hashCacheEntry{modTime: fi.ModTime(), hash: h}
+	hashCache.Unlock()
+	return h, nil
+}
+
+// flagDuplicates hashes the photos of the album and flags the duplicates in
+// the catalog. Of photos with the same content, the first one by name is
+// kept as the original. It reports whether any flags changed.
+func flagDuplicates(ctx context.Context, album string, names []string) (bool, error) {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	type original struct {
+		name string
+		hash photoHash
+	}
+	var originals []original
+	byContent := make(map[[sha256.Size]byte]string)
+	duplicateOf := make(map[string]string)
+	for _, name := range sorted {
+		h, err := hashPhoto(ctx, album, name)
+		if err != nil {
+			continue // unreadable photos are never flagged
+		}
+		if orig, ok := byContent[h.content]; ok {
+			duplicateOf[name] = orig
+			continue
+		}
+		byContent[h.content] = name
+
+		if h.decoded {
+			for _, o := range originals {
+				if o.hash.decoded && bits.OnesCount64(o.hash.perceptual^h.perceptual) <= duplicateDistance {
+					duplicateOf[name] = o.name
+					break
+				}
+			}
+		}
+		if duplicateOf[name] == "" {
+			originals = append(originals, original{name: name, hash: h})
+		}
+	}
+
+	// only touch the catalog if flags changed, including those of photos
+	// which don't exist anymore
+	var changed []string
+	all := meta.album(album)
+	for name, m := range all {
+		if m.Duplicate != duplicateOf[name] {
+			changed = append(changed, name)
+		}
+	}
+	for name := range duplicateOf {
+		if _, ok := all[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 {
+		return false, nil
+	}
+	err := meta.updatePhotos(album, changed, func(name string, m *photoMeta) {
+		m.Duplicate = duplicateOf[name]
+	})
+	return true, err
+}
+
+// withoutDuplicates removes the photos flagged as duplicates from the list
+// and the aligned playlist entries
+func withoutDuplicates(album string, names []string, entries []playlistEntry) ([]string, []playlistEntry) {
+	all := meta.album(album)
+	unique := make([]string, 0, len(names))
+	var uniqueEntries []playlistEntry
+	for i, name := range names {
+		if all[name].Duplicate != "" {
+			continue
+		}
+		unique = append(unique, name)
+		if entries != nil {
+			uniqueEntries = append(uniqueEntries, entries[i])
+		}
+	}
+	return unique, uniqueEntries
+}
+
+// duplicateGroup is an original photo with its duplicates
+type duplicateGroup struct {
+	Original   string   `json:"original"`
+	Duplicates []string `json:"duplicates"`
+}
+
+// Duplicates lists the duplicate photos of the current album by original
+func Duplicates(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	byOriginal := make(map[string][]string)
+	for name, m := range meta.album(show.currentAlbum()) {
+		if m.Duplicate != "" {
+			byOriginal[m.Duplicate] = append(byOriginal[m.Duplicate], name)
+		}
+	}
+
+	groups := make([]duplicateGroup, 0, len(byOriginal))
+	for orig, names := range byOriginal {
+		sort.Strings(names)
+		groups = append(groups, duplicateGroup{Original: orig, Duplicates: names})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Original < groups[j].Original })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// DuplicateAction handles the duplicates of the current album (form values
+// photo, default: all duplicates). The form value action is one of
+// skip (hide them), show (unhide them) or remove (move them to the trash).
+func DuplicateAction(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	action := r.PostFormValue("action")
+	switch action {
+	case "skip", "show":
+	case "remove":
+		if sourceType != "dir" {
+			http.Error(w, "Removing photos is only supported for the dir photo source", http.StatusNotImplemented)
+			return
+		}
+	default:
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+
+	album := show.currentAlbum()
+	all := meta.album(album)
+	names := r.PostForm["photo"]
+	if names == nil {
+		for name, m := range all {
+			if m.Duplicate != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, name := range names {
+		// never touch originals by mistake
+		if all[name].Duplicate == "" {
+			http.Error(w, "not a duplicate: "+name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	if action == "remove" {
+		for _, name := range names {
+			if err = trashPhoto(r.Context(), album, name); err != nil {
+				break
+			}
+		}
+	} else {
+		err = meta.updatePhotos(album, names, func(_ string, m *photoMeta) {
+			m.Hidden = action == "skip"
+		})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(names) > 0 {
+		rescan()
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// historyEvent is an event sent to the viewers, numbered in order
+type historyEvent struct {
+	Seq   uint64 `json:"seq"`
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+// eventsReply is the response of /events and /poll. If Missed is set, events
+// after the requested one are no longer known and the client must reload the
+// show.
+type eventsReply struct {
+	Seq    uint64         `json:"seq"`
+	Events []historyEvent `json:"events"`
+	Missed bool           `json:"missed,omitempty"`
+}
+
+// eventChannels maps the event types to the channels clients can subscribe
+// to, e.g. /listen?channels=slides,reactions. The other events are in the
+// "show" channel, only the pings are sent to all.
+var eventChannels = map[string]string{
+	"set":       "slides",
+	"reset":     "slides",
+	"list":      "slides",
+	"state":     "slides",
+	"mode":      "slides",
+	"wall":      "slides",
+	"timer":     "slides",
+	"narration": "slides",
+	"browsing":  "slides",
+	"sync":      "slides",
+	"filter":    "slides",
+	"autoplay":  "slides",
+	"batch":     "slides",
+	"reaction":  "reactions",
+	"chat":      "chat",
+	"pointer":   "pointer",
+	"music":     "music",
+}
+
+// parseChannels parses the comma-separated list of channels, nil meaning all
+func parseChannels(list string) (map[string]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	channels := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		switch name {
+		case "slides", "reactions", "chat", "pointer", "music", "show":
+			channels[name] = true
+		default:
+			return nil, errors.New("unknown channel: " + name)
+		}
+	}
+	return channels, nil
+}
+
+// subscribed reports whether events of the type are sent to clients of the
+// channels
+func subscribed(channels map[string]bool, event string) bool {
+	if channels == nil || event == "ping" {
+		return true
+	}
+	channel, ok := eventChannels[event]
+	if !ok {
+		channel = "show"
+	}
+	return channels[channel]
+}
+
+// filterEvents returns the events the channels are subscribed to
+func filterEvents(list []historyEvent, channels map[string]bool) []historyEvent {
+	if channels == nil {
+		return list
+	}
+	filtered := []historyEvent{}
+	for _, e := range list {
+		if subscribed(channels, e.Event) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// eventHistory keeps the last historySize events in a ring buffer, for
+// /events, the long-polling clients and the event streams resumed with
+// Last-Event-ID
+type eventHistory struct {
+	mu   sync.Mutex
+	seq  uint64
+	ring []historyEvent // event seq at index seq % len(ring)
+	wait chan struct{}  // closed when the next event is added
+}
+
+var history = eventHistory{
+	ring: make([]historyEvent, historySize),
+	wait: make(chan struct{}),
+}
+
+// add appends the event and returns its sequence number
+func (h *eventHistory) add(event string, data []byte) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	h.ring[h.seq%uint64(len(h.ring))] = historyEvent{h.seq, event, string(data)}
+	close(h.wait)
+	h.wait = make(chan struct{})
+	return h.seq
+}
+
+// since returns the events after seq and a channel closed by the next event
+func (h *eventHistory) since(seq uint64) (eventsReply, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	reply := eventsReply{Seq: h.seq, Events: []historyEvent{}}
+	n := uint64(len(h.ring))
+	switch {
+	case seq > h.seq: // from before a restart
+		reply.Missed = true
+	case h.seq-seq > n:
+		reply.Missed = true
+	default:
+		for s := seq + 1; s <= h.seq; s++ {
+			reply.Events = append(reply.Events, h.ring[s%n])
+		}
+	}
+	return reply, h.wait
+}
+
+// last returns the sequence number of the last event
+func (h *eventHistory) last() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seq
+}
+
+// oldest returns the sequence number before the oldest known event
+func (h *eventHistory) oldest() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := uint64(len(h.ring)); h.seq > n {
+		return h.seq - n
+	}
+	return 0
+}
+
+// Events serves the known events after the sequence number in the since
+// parameter, all of them without it, of the channels parameter if given
+func Events(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	channels, err := parseChannels(q.Get("channels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since uint64
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	} else {
+		since = history.oldest()
+	}
+
+	reply, _ := history.since(since)
+	reply.Events = requestAccess(r).filter(filterEvents(reply.Events, channels))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(reply)
+}
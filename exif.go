@@ -0,0 +1,306 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EXIF tags
+const (
+	exifMake             = 0x010F
+	exifModel            = 0x0110
+	exifDateTime         = 0x0132
+	exifIFDPointer       = 0x8769
+	exifGPSPointer       = 0x8825
+	exifDateTimeOriginal = 0x9003
+
+	// in the GPS IFD
+	gpsLatitudeRef  = 0x0001
+	gpsLatitude     = 0x0002
+	gpsLongitudeRef = 0x0003
+	gpsLongitude    = 0x0004
+)
+
+// exifData is the subset of the EXIF metadata of a photo used by the show
+type exifData struct {
+	Make  string
+	Model string
+	Taken time.Time
+
+	Location *geoPoint // nil if the photo is not geotagged
+}
+
+// geoPoint is a position in decimal degrees
+type geoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Camera returns the camera make and model
+func (e *exifData) Camera() string {
+	// the model often contains the make already, e.g. "Canon EOS 5D"
+	if e.Make == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+// readEXIF reads the EXIF metadata of a JPEG file. Files without EXIF data
+// return empty metadata.
+func readEXIF(path string) (*exifData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var marker [2]byte
+	if _, err = io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return &exifData{}, nil // not a JPEG
+	}
+
+	// walk the segments up to the APP1 segment with the EXIF data
+	for {
+		if _, err = io.ReadFull(r, marker[:]); err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xFF || marker[1] == 0xDA { // start of scan, no more metadata
+			return &exifData{}, nil
+		}
+
+		var size uint16
+		if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if size < 2 {
+			return nil, errors.New("exif: invalid segment")
+		}
+		if marker[1] != 0xE1 {
+			if _, err = r.Discard(int(size) - 2); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		seg := make([]byte, size-2)
+		if _, err = io.ReadFull(r, seg); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return parseEXIF(seg[6:])
+		}
+	}
+}
+
+// tiff is the TIFF structure holding the EXIF data
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ifd reads the entries of the image file directory at off
+func (t *tiff) ifd(off uint32, f func(tag, typ uint16, count uint32, value []byte)) error {
+	if uint64(off)+2 > uint64(len(t.data)) {
+		return errors.New("exif: invalid IFD offset")
+	}
+	n := int(t.order.Uint16(t.data[off:]))
+	entries := t.data[off+2:]
+	if len(entries) < n*12 {
+		return errors.New("exif: truncated IFD")
+	}
+
+	for i := 0; i < n; i++ {
+		e := entries[i*12 : i*12+12]
+		tag, typ, count := t.order.Uint16(e), t.order.Uint16(e[2:]), t.order.Uint32(e[4:])
+
+		size := uint64(count) * uint64(exifTypeSize(typ))
+		value := e[8:12]
+		if size > 4 {
+			voff := uint64(t.order.Uint32(e[8:]))
+			if voff+size > uint64(len(t.data)) {
+				continue
+			}
+			value = t.data[voff : voff+size]
+		} else {
+			value = value[:size]
+		}
+		f(tag, typ, count, value)
+	}
+	return nil
+}
+
+// exifTypeSize returns the size of a value of the given TIFF type in bytes
+func exifTypeSize(typ uint16) int {
+	switch typ {
+	case 1, 2, 6, 7: // BYTE, ASCII, SBYTE, UNDEFINED
+		return 1
+	case 3, 8: // SHORT, SSHORT
+		return 2
+	case 4, 9, 11: // LONG, SLONG, FLOAT
+		return 4
+	case 5, 10, 12: // RATIONAL, SRATIONAL, DOUBLE
+		return 8
+	}
+	return 0
+}
+
+// exifString decodes a NUL-terminated ASCII value
+func exifString(value []byte) string {
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// exifTime parses an EXIF date like "2014:12:24 18:30:00" in local time
+func exifTime(value []byte) time.Time {
+	t, _ := time.ParseInLocation("2006:01:02 15:04:05", exifString(value), time.Local)
+	return t
+}
+
+// exifDegrees converts the three RATIONAL degrees, minutes and seconds of a
+// GPS coordinate into decimal degrees
+func exifDegrees(t *tiff, value []byte) (float64, bool) {
+	if len(value) != 24 {
+		return 0, false
+	}
+	var deg float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num, den := t.order.Uint32(value[i*8:]), t.order.Uint32(value[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		deg += float64(num) / float64(den) / unit
+	}
+	return deg, true
+}
+
+// parseEXIF parses the TIFF structure of an EXIF segment
+func parseEXIF(data []byte) (*exifData, error) {
+	if len(data) < 8 {
+		return nil, errors.New("exif: truncated header")
+	}
+	t := &tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("exif: invalid byte order")
+	}
+
+	e := &exifData{}
+	var exifIFD, gpsIFD uint32
+	err := t.ifd(t.order.Uint32(data[4:]), func(tag, typ uint16, count uint32, value []byte) {
+		switch tag {
+		case exifMake:
+			e.Make = exifString(value)
+		case exifModel:
+			e.Model = exifString(value)
+		case exifDateTime:
+			e.Taken = exifTime(value)
+		case exifIFDPointer:
+			if typ == 4 && len(value) == 4 {
+				exifIFD = t.order.Uint32(value)
+			}
+		case exifGPSPointer:
+			if typ == 4 && len(value) == 4 {
+				gpsIFD = t.order.Uint32(value)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if exifIFD != 0 {
+		t.ifd(exifIFD, func(tag, typ uint16, count uint32, value []byte) {
+			if tag == exifDateTimeOriginal {
+				if taken := exifTime(value); !taken.IsZero() {
+					e.Taken = taken
+				}
+			}
+		})
+	}
+
+	if gpsIFD != 0 {
+		var lat, lon float64
+		var latOK, lonOK bool
+		latRef, lonRef := "N", "E"
+		t.ifd(gpsIFD, func(tag, typ uint16, count uint32, value []byte) {
+			switch tag {
+			case gpsLatitudeRef:
+				latRef = exifString(value)
+			case gpsLatitude:
+				lat, latOK = exifDegrees(t, value)
+			case gpsLongitudeRef:
+				lonRef = exifString(value)
+			case gpsLongitude:
+				lon, lonOK = exifDegrees(t, value)
+			}
+		})
+		if latOK && lonOK && !(lat == 0 && lon == 0) {
+			if latRef == "S" {
+				lat = -lat
+			}
+			if lonRef == "W" {
+				lon = -lon
+			}
+			e.Location = &geoPoint{Lat: lat, Lon: lon}
+		}
+	}
+	return e, nil
+}
+
+// exifCache caches the EXIF data per file, invalidated by the modification time
+var exifCache = struct {
+	sync.Mutex
+	entries map[string]exifCacheEntry
+}{entries: make(map[string]exifCacheEntry)}
+
+type exifCacheEntry struct {
+	modTime time.Time
+	data    *exifData
+}
+
+// photoEXIF returns the (cached) EXIF data of a photo of the album
+func photoEXIF(ctx context.Context, album, name string) (*exifData, error) {
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	exifCache.Lock()
+	entry, ok := exifCache.entries[path]
+	exifCache.Unlock()
+	if ok && entry.modTime.Equal(fi.ModTime()) {
+		return entry.data, nil
+	}
+
+	data, err := readEXIF(path)
+	if err != nil {
+		return nil, err
+	}
+	exifCache.Lock()
+	exifCache.entries[path] = exifCacheEntry{modTime: fi.ModTime(), data: data}
+	exifCache.Unlock()
+	return data, nil
+}
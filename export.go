@@ -0,0 +1,392 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Status of an export job
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// exportOptions configures the rendering of a slideshow video
+type exportOptions struct {
+	Duration   time.Duration `json:"duration"`   // display time per photo
+	Transition string        `json:"transition"` // "none" or an ffmpeg xfade transition
+	Width      int           `json:"width"`
+	Height     int           `json:"height"`
+	music      string        // path of the optional music track
+}
+
+// exportJob is a slideshow video export, its status is reported via the
+// "export" event
+type exportJob struct {
+	ID       string        `json:"id"`
+	Status   string        `json:"status"`
+	Progress int           `json:"progress"` // in percent
+	Error    string        `json:"error,omitempty"`
+	Options  exportOptions `json:"options"`
+
+	paths []string
+}
+
+var (
+	exportMu    sync.Mutex
+	exportJobs  = make(map[string]*exportJob)
+	exportNext  uint64
+	exportQueue = make(chan *exportJob, 16)
+)
+
+// exportTransitions are the supported transitions between two photos
+var exportTransitions = map[string]bool{
+	"none": true, "fade": true, "dissolve": true, "fadeblack": true,
+	"wipeleft": true, "wiperight": true, "slideleft": true, "slideright": true,
+}
+
+// update changes the job status and notifies the clients.
+// It must be called with exportMu held.
+func (job *exportJob) update(status string, progress int, err error) {
+	job.Status = status
+	job.Progress = progress
+	if err != nil {
+		job.Error = err.Error()
+	}
+	streamer.SendJSON("", "export", job)
+}
+
+// videoPath returns the path of the rendered video of the job
+func (job *exportJob) videoPath() string {
+	return filepath.Join(exportDir, job.ID+".mp4")
+}
+
+// exportWorker renders the queued export jobs one after another, until the
+// context is done
+func exportWorker(ctx context.Context) {
+	for {
+		var job *exportJob
+		select {
+		case <-ctx.Done():
+			return
+		case job = <-exportQueue:
+		}
+
+		exportMu.Lock()
+		job.update(jobRunning, 0, nil)
+		exportMu.Unlock()
+
+		err := job.render(ctx)
+
+		exportMu.Lock()
+		if err != nil {
+			job.update(jobFailed, job.Progress, err)
+		} else {
+			job.update(jobDone, 100, nil)
+		}
+		exportMu.Unlock()
+
+		if job.Options.music != "" {
+			os.Remove(job.Options.music)
+		}
+	}
+}
+
+// ffmpegArgs builds the ffmpeg command line rendering the job
+func (job *exportJob) ffmpegArgs() (args []string, total time.Duration) {
+	opts := job.Options
+	n := len(job.paths)
+	secs := opts.Duration.Seconds()
+
+	const fade = time.Second // duration of a transition
+	total = time.Duration(n) * opts.Duration
+	if opts.Transition != "none" {
+		total -= time.Duration(n-1) * fade
+	}
+
+	args = []string{"-y", "-nostats", "-progress", "pipe:1"}
+	for _, path := range job.paths {
+		args = append(args, "-loop", "1", "-t", strconv.FormatFloat(secs, 'f', 3, 64), "-i", path)
+	}
+	if opts.music != "" {
+		args = append(args, "-stream_loop", "-1", "-i", opts.music)
+	}
+
+	// scale all photos into the frame and chain them together
+	var filter strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&filter, "[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,"+
+			"pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=30,format=yuv420p[v%d];",
+			i, opts.Width, opts.Height, opts.Width, opts.Height, i)
+	}
+	if opts.Transition == "none" || n == 1 {
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&filter, "[v%d]", i)
+		}
+		fmt.Fprintf(&filter, "concat=n=%d:v=1:a=0[out]", n)
+	} else {
+		prev := "v0"
+		for i := 1; i < n; i++ {
+			offset := time.Duration(i) * (opts.Duration - fade)
+			next := "x" + strconv.Itoa(i)
+			if i == n-1 {
+				next = "out"
+			}
+			fmt.Fprintf(&filter, "[%s][v%d]xfade=transition=%s:duration=%.3f:offset=%.3f[%s];",
+				prev, i, opts.Transition, fade.Seconds(), offset.Seconds(), next)
+			prev = next
+		}
+	}
+
+	args = append(args, "-filter_complex", strings.TrimSuffix(filter.String(), ";"), "-map", "[out]")
+	if opts.music != "" {
+		args = append(args, "-map", strconv.Itoa(n)+":a", "-c:a", "aac")
+	}
+	args = append(args, "-c:v", "libx264", "-pix_fmt", "yuv420p",
+		"-t", strconv.FormatFloat(total.Seconds(), 'f', 3, 64),
+		"-movflags", "+faststart", job.videoPath())
+	return args, total
+}
+
+// render runs ffmpeg and reports its progress. ffmpeg is killed when the
+// context is done.
+func (job *exportJob) render(ctx context.Context) error {
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return err
+	}
+
+	args, total := job.ffmpegArgs()
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &tailBuffer{}
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	// ffmpeg writes key=value progress lines to stdout
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "out_time_us=") {
+			continue
+		}
+		us, err := strconv.ParseInt(line[len("out_time_us="):], 10, 64)
+		if err != nil || total <= 0 {
+			continue
+		}
+		progress := int(time.Duration(us) * time.Microsecond * 100 / total)
+		if progress > 99 {
+			progress = 99
+		}
+
+		exportMu.Lock()
+		if progress > job.Progress {
+			job.update(jobRunning, progress, nil)
+		}
+		exportMu.Unlock()
+	}
+
+	if err = cmd.Wait(); err != nil {
+		os.Remove(job.videoPath())
+		return fmt.Errorf("ffmpeg: %v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// tailBuffer keeps the last bytes written to it, e.g. the end of an error log
+type tailBuffer struct {
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	const max = 1024
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > max {
+		t.buf = t.buf[len(t.buf)-max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return strings.TrimSpace(string(t.buf))
+}
+
+// parseExportOptions reads the export options from the request form
+func parseExportOptions(r *http.Request) (opts exportOptions, err error) {
+	opts = exportOptions{
+		Duration:   exportDuration,
+		Transition: exportTransition,
+		Width:      exportWidth,
+		Height:     exportHeight,
+	}
+
+	if v := r.FormValue("duration"); v != "" {
+		if opts.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+	if opts.Duration < 2*time.Second {
+		return opts, errors.New("duration must be at least 2s")
+	}
+
+	if v := r.FormValue("transition"); v != "" {
+		opts.Transition = v
+	}
+	if !exportTransitions[opts.Transition] {
+		return opts, errors.New("unsupported transition: " + opts.Transition)
+	}
+
+	if v := r.FormValue("resolution"); v != "" {
+		if _, err = fmt.Sscanf(v, "%dx%d", &opts.Width, &opts.Height); err != nil {
+			return opts, errors.New("invalid resolution")
+		}
+	}
+	if opts.Width <= 0 || opts.Height <= 0 || opts.Width%2 != 0 || opts.Height%2 != 0 {
+		return opts, errors.New("resolution must be positive and even")
+	}
+	return opts, nil
+}
+
+// saveMusic stores the uploaded music track, if any, in a temporary file
+func saveMusic(r *http.Request) (string, error) {
+	file, _, err := r.FormFile("music")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	tmp, err := os.CreateTemp("", "photoshow-music-")
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(tmp, file); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), tmp.Close()
+}
+
+// ExportStart queues the rendering of the current album into a video.
+// Options are the form fields duration (e.g. "5s"), transition, resolution
+// (e.g. "1280x720") and music (an uploaded audio file).
+func ExportStart(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	opts, err := parseExportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snap := show.snapshot()
+	paths := make([]string, 0, len(snap.photos))
+	for _, name := range snap.photos {
+		if isTextSlide(name) {
+			continue // rendered by the browser only
+		}
+		path, err := servedPath(r.Context(), snap.album, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		paths = append(paths, path)
+	}
+	if snap.err != nil || len(paths) == 0 {
+		http.Error(w, "no photos to export", http.StatusBadRequest)
+		return
+	}
+
+	if opts.music, err = saveMusic(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	exportMu.Lock()
+	exportNext++
+	job := &exportJob{
+		ID:      strconv.FormatUint(exportNext, 10),
+		Status:  jobQueued,
+		Options: opts,
+		paths:   paths,
+	}
+	select {
+	case exportQueue <- job:
+		exportJobs[job.ID] = job
+		job.update(jobQueued, 0, nil)
+	default:
+		job = nil
+	}
+	exportMu.Unlock()
+
+	if job == nil {
+		if opts.music != "" {
+			os.Remove(opts.music)
+		}
+		http.Error(w, "too many queued exports", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	exportMu.Lock()
+	json.NewEncoder(w).Encode(job)
+	exportMu.Unlock()
+}
+
+// ExportStatus returns the status of an export job
+func ExportStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	exportMu.Lock()
+	defer exportMu.Unlock()
+
+	job, ok := exportJobs[ps.ByName("id")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(job)
+}
+
+// ExportDownload serves the rendered video of a finished export job
+func ExportDownload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	exportMu.Lock()
+	job, ok := exportJobs[ps.ByName("id")]
+	done := ok && job.Status == jobDone
+	exportMu.Unlock()
+
+	if !done {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="slideshow-`+job.ID+`.mp4"`)
+	http.ServeFile(w, r, job.videoPath())
+}
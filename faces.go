@@ -0,0 +1,428 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// detectedFace is a face found by the face detector. The embedding is a
+// vector describing the face, the closer two embeddings the more likely they
+// show the same person.
+type detectedFace struct {
+	Box       [4]int    `json:"box"` // x, y, width, height in pixels
+	Embedding []float64 `json:"embedding"`
+}
+
+// faceDetector finds the faces in a photo
+type faceDetector interface {
+	// Faces detects the faces in the image file at the given path
+	Faces(ctx context.Context, path string) ([]detectedFace, error)
+}
+
+// faceDetection is the face detector selected in the config, nil if disabled
+var faceDetection faceDetector
+
+// newFaceDetector returns the face detector selected in the config
+func newFaceDetector() (faceDetector, error) {
+	switch faceType {
+	case "":
+		return nil, nil
+	case "command":
+		if faceCommand == "" {
+			return nil, errors.New("faceCommand not set")
+		}
+		return commandDetector(faceCommand), nil
+	case "api":
+		if faceURL == "" {
+			return nil, errors.New("faceURL not set")
+		}
+		return &apiDetector{url: faceURL, token: faceToken}, nil
+	default:
+		return nil, errors.New("unknown face detector: " + faceType)
+	}
+}
+
+// faceResult is the output of the face detection command and API:
+//
+//	{"faces": [{"box": [120, 80, 64, 64], "embedding": [0.12, -0.03, ...]}]}
+type faceResult struct {
+	Faces []detectedFace `json:"faces"`
+}
+
+// commandDetector runs a local program with the path of the photo as last
+// argument, which writes a faceResult to stdout
+type commandDetector string
+
+func (c commandDetector) Faces(ctx context.Context, path string) ([]detectedFace, error) {
+	out, err := runCommand(ctx, string(c), path)
+	if err != nil {
+		return nil, err
+	}
+	var res faceResult
+	err = json.Unmarshal(out, &res)
+	return res.Faces, err
+}
+
+// apiDetector posts the photo to an HTTP API, which responds with a
+// faceResult
+type apiDetector struct {
+	url   string
+	token string // sent as bearer token if set
+}
+
+func (d *apiDetector) Faces(ctx context.Context, path string) ([]detectedFace, error) {
+	var res faceResult
+	err := postImage(ctx, d.url, d.token, path, &res)
+	return res.Faces, err
+}
+
+// face is a face in a photo, assigned to a person
+type face struct {
+	Box    [4]int `json:"box"`
+	Person int    `json:"person"` // 0 if unknown
+}
+
+// faceInfo holds the faces of a photo as detected in the file version with
+// the given modification time
+type faceInfo struct {
+	ModTime time.Time `json:"modified"`
+	Faces   []face    `json:"faces"`
+}
+
+// person is a cluster of similar faces, hopefully all of the same person.
+// The master can name them.
+type person struct {
+	ID       int       `json:"id"`
+	Name     string    `json:"name,omitempty"`
+	Centroid []float64 `json:"centroid"` // mean embedding of the faces
+	Count    int       `json:"count"`    // number of faces
+}
+
+// people holds the face clusters of all albums, stored in peoplePath
+var people = struct {
+	sync.Mutex
+	list []*person
+	next int
+}{next: 1}
+
+// loadPeople reads the face clusters. A missing file means there are none.
+func loadPeople() error {
+	data, err := os.ReadFile(peoplePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	people.Lock()
+	defer people.Unlock()
+	if err = json.Unmarshal(data, &people.list); err != nil {
+		return err
+	}
+	for _, p := range people.list {
+		if p.ID >= people.next {
+			people.next = p.ID + 1
+		}
+	}
+	return nil
+}
+
+// savePeople writes the face clusters.
+// It must be called with people held.
+func savePeople() error {
+	data, err := json.MarshalIndent(people.list, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(peoplePath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(peoplePath+".tmp", peoplePath)
+}
+
+// findPerson returns the person with the ID.
+// It must be called with people held.
+func findPerson(id int) *person {
+	for _, p := range people.list {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// distance returns the euclidean distance of two embeddings
+func distance(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return math.Inf(1)
+	}
+	var sum float64
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// assignFace returns the ID of the person closest to the embedding, if within
+// faceDistance, and moves its centroid towards it. Otherwise a new person is
+// added.
+// It must be called with people held.
+func assignFace(embedding []float64) int {
+	var closest *person
+	best := faceDistance
+	for _, p := range people.list {
+		if d := distance(p.Centroid, embedding); d <= best {
+			closest, best = p, d
+		}
+	}
+
+	if closest == nil {
+		closest = &person{ID: people.next, Centroid: append([]float64{}, embedding...)}
+		people.next++
+		people.list = append(people.list, closest)
+	} else {
+		n := float64(closest.Count)
+		for i := range closest.Centroid {
+			closest.Centroid[i] = (closest.Centroid[i]*n + embedding[i]) / (n + 1)
+		}
+	}
+	closest.Count++
+	return closest.ID
+}
+
+// detectFaces finds the faces in a photo and assigns them to people, unless
+// that was done for the current version of the file already. It reports
+// whether any faces were found.
+func detectFaces(ctx context.Context, album, name string) (bool, error) {
+	if faceDetection == nil {
+		return false, nil
+	}
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if f := meta.get(album, name).Faces; f != nil && f.ModTime.Equal(fi.ModTime()) {
+		return false, nil
+	}
+
+	detected, err := faceDetection.Faces(ctx, path)
+	if err != nil {
+		return false, err
+	}
+
+	info := &faceInfo{ModTime: fi.ModTime(), Faces: make([]face, 0, len(detected))}
+	people.Lock()
+	for _, d := range detected {
+		f := face{Box: d.Box} // person 0 if it can't be recognized
+		if len(d.Embedding) > 0 {
+			f.Person = assignFace(d.Embedding)
+		}
+		info.Faces = append(info.Faces, f)
+	}
+	err = savePeople()
+	people.Unlock()
+	if err != nil {
+		return false, err
+	}
+	err = meta.update(album, name, func(m *photoMeta) { m.Faces = info })
+	return len(detected) > 0 && err == nil, err
+}
+
+// hasPerson reports whether the person is in the photo
+func hasPerson(m photoMeta, id int) bool {
+	if m.Faces == nil {
+		return false
+	}
+	for _, f := range m.Faces.Faces {
+		if f.Person == id {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyPerson filters the photos by person
+func onlyPerson(album string, id int, names []string, entries []playlistEntry) ([]string, []playlistEntry) {
+	all := meta.album(album)
+	shown := make([]string, 0)
+	var shownEntries []playlistEntry
+	for i, name := range names {
+		if !hasPerson(all[name], id) {
+			continue
+		}
+		shown = append(shown, name)
+		if entries != nil {
+			shownEntries = append(shownEntries, entries[i])
+		}
+	}
+	return shown, shownEntries
+}
+
+// setPersonFilter plays only the photos of the person given by name or ID, or
+// all photos if it is empty
+func setPersonFilter(who string) error {
+	id := 0
+	if who != "" {
+		people.Lock()
+		for _, p := range people.list {
+			if strconv.Itoa(p.ID) == who || (p.Name != "" && strings.EqualFold(p.Name, who)) {
+				id = p.ID
+			}
+		}
+		people.Unlock()
+		if id == 0 {
+			return errors.New("unknown person: " + who)
+		}
+	}
+
+	show.setFilter(func(f *showFilter) { f.person = id })
+	reload()
+	streamer.SendUint("", "person", uint64(id))
+	return nil
+}
+
+// personInfo is an entry of the list of people
+type personInfo struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name,omitempty"`
+	Faces  int      `json:"faces"`
+	Photos []string `json:"photos"` // of the current album
+}
+
+// People lists the people recognized in photos, the most frequent first
+func People(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	byPerson := make(map[int][]string)
+	for name, m := range meta.album(show.currentAlbum()) {
+		if m.Faces == nil {
+			continue
+		}
+		seen := make(map[int]bool)
+		for _, f := range m.Faces.Faces {
+			if !seen[f.Person] {
+				seen[f.Person] = true
+				byPerson[f.Person] = append(byPerson[f.Person], name)
+			}
+		}
+	}
+
+	people.Lock()
+	list := make([]personInfo, 0, len(people.list))
+	for _, p := range people.list {
+		photos := byPerson[p.ID]
+		if photos == nil {
+			photos = make([]string, 0)
+		}
+		sort.Strings(photos)
+		list = append(list, personInfo{ID: p.ID, Name: p.Name, Faces: p.Count, Photos: photos})
+	}
+	people.Unlock()
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Faces > list[j].Faces })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(list)
+}
+
+// NamePerson names a person (form value name). If another person has this
+// name already, both are merged, e.g. if the faces of someone were split
+// into two clusters.
+func NamePerson(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.PostFormValue("name"))
+
+	people.Lock()
+	defer people.Unlock()
+	p := findPerson(id)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var into *person
+	for _, o := range people.list {
+		if o != p && name != "" && strings.EqualFold(o.Name, name) {
+			into = o
+		}
+	}
+	if into == nil {
+		p.Name = name
+		if err = savePeople(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// merge p into the person with the name
+	n, m := float64(into.Count), float64(p.Count)
+	for i := range into.Centroid {
+		if i < len(p.Centroid) {
+			into.Centroid[i] = (into.Centroid[i]*n + p.Centroid[i]*m) / (n + m)
+		}
+	}
+	into.Count += p.Count
+	for i, o := range people.list {
+		if o == p {
+			people.list = append(people.list[:i:i], people.list[i+1:]...)
+			break
+		}
+	}
+	if err = savePeople(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, album := range meta.albumIDs() {
+		err = meta.updatePhotos(album, nil, func(_ string, m *photoMeta) {
+			if !hasPerson(*m, p.ID) {
+				return
+			}
+			faces := make([]face, len(m.Faces.Faces))
+			for i, f := range m.Faces.Faces {
+				if f.Person == p.ID {
+					f.Person = into.ID
+				}
+				faces[i] = f
+			}
+			m.Faces = &faceInfo{ModTime: m.Faces.ModTime, Faces: faces}
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	merged := false
+	show.setFilter(func(f *showFilter) {
+		if merged = f.person == p.ID; merged {
+			f.person = into.ID
+		}
+	})
+	if merged {
+		reload()
+		streamer.SendUint("", "person", uint64(into.ID))
+	}
+}
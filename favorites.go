@@ -0,0 +1,109 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// starred reports whether the photo was starred by the master or a viewer
+func (m *photoMeta) starred() bool {
+	return m.Favorite || m.Stars > 0
+}
+
+// onlyFavorites removes all photos which are not starred from the list and
+// the aligned playlist entries
+func onlyFavorites(album string, names []string, entries []playlistEntry) ([]string, []playlistEntry) {
+	starred := meta.album(album)
+	favs := make([]string, 0)
+	var favEntries []playlistEntry
+	for i, name := range names {
+		if m, ok := starred[name]; !ok || !m.starred() {
+			continue
+		}
+		favs = append(favs, name)
+		if entries != nil {
+			favEntries = append(favEntries, entries[i])
+		}
+	}
+	return favs, favEntries
+}
+
+// setFavoritesOnly switches between playing all photos and only favorites
+func setFavoritesOnly(enabled bool) {
+	show.setFilter(func(f *showFilter) { f.favorites = enabled })
+	reload()
+	streamer.SendString("", "favorites", strconv.FormatBool(enabled))
+}
+
+// viewerStars remembers which viewer starred which photo, one star each
+var viewerStars = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// favorite is a starred photo in the list of favorites
+type favorite struct {
+	Photo    string `json:"photo"`
+	Favorite bool   `json:"favorite"` // starred by the master
+	Stars    int    `json:"stars"`    // number of viewers who starred it
+}
+
+// Favorites lists the starred photos of the current album, the most starred
+// first
+func Favorites(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	favs := make([]favorite, 0)
+	for name, m := range meta.album(show.currentAlbum()) {
+		if m.starred() {
+			favs = append(favs, favorite{Photo: name, Favorite: m.Favorite, Stars: m.Stars})
+		}
+	}
+	sort.Slice(favs, func(i, j int) bool {
+		if favs[i].Favorite != favs[j].Favorite {
+			return favs[i].Favorite
+		}
+		if favs[i].Stars != favs[j].Stars {
+			return favs[i].Stars > favs[j].Stars
+		}
+		return favs[i].Photo < favs[j].Photo
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(favs)
+}
+
+// StarPhoto lets viewers star a photo, if enabled in the config
+func StarPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !viewerFavorites {
+		errorPage(w, r, "Starring is disabled", http.StatusForbidden)
+		return
+	}
+	album, name := show.currentAlbum(), ps.ByName("photo")
+	if !hasPhoto(name) || meta.get(album, name).Hidden {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := album + "/" + name + "/" + clientIP(r)
+
+	viewerStars.Lock()
+	seen := viewerStars.seen[key]
+	viewerStars.seen[key] = true
+	viewerStars.Unlock()
+	if seen {
+		return // starred already
+	}
+
+	if err := meta.update(album, name, func(m *photoMeta) { m.Stars++ }); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
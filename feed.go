@@ -0,0 +1,143 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// atomFeed is the Atom feed of the newest photos
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Summary string      `xml:"summary,omitempty"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feedPhoto is a photo of the feed
+type feedPhoto struct {
+	album, name string
+	meta        photoMeta
+	added       time.Time
+}
+
+// newestPhotos returns the feedSize photos of the public albums added last,
+// the newest first, or those of the album if it is not nil. They are known
+// from the catalog once they were scanned, the modification time of their
+// files tells when they were added.
+func newestPhotos(album *string) []feedPhoto {
+	var photos []feedPhoto
+	for _, id := range meta.albumIDs() {
+		if (album != nil && id != *album) || albumRule(id).Level != accessPublic {
+			continue
+		}
+		for name, m := range meta.album(id) {
+			if m.File == nil || m.Hidden || strings.HasPrefix(name, webPrefix) {
+				continue
+			}
+			photos = append(photos, feedPhoto{id, name, m, m.File.ModTime})
+		}
+	}
+	sort.Slice(photos, func(i, j int) bool { return photos[i].added.After(photos[j].added) })
+	if len(photos) > feedSize {
+		photos = photos[:feedSize]
+	}
+	return photos
+}
+
+// Feed serves an Atom feed of the photos added last, e.g. for relatives who
+// missed the show, or of the album in the album parameter. The photos are
+// linked by shared links, which change once a day.
+func Feed(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var album *string
+	self := publicURL + "/feed.atom"
+	if a, ok := r.URL.Query()["album"]; ok {
+		if a[0] != "" && !validName(a[0]) {
+			http.NotFound(w, r)
+			return
+		}
+		album = &a[0]
+		self += "?album=" + url.QueryEscape(a[0])
+	}
+	photos := newestPhotos(album)
+
+	feed := atomFeed{
+		ID:    self,
+		Title: pageTitle,
+		Links: []atomLink{{Rel: "self", Type: "application/atom+xml", Href: self}, {Href: publicURL + "/"}},
+	}
+	updated := time.Unix(0, 0)
+	if len(photos) > 0 {
+		updated = photos[0].added
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	expires := time.Now().Truncate(24 * time.Hour).Add(maxShareTTL)
+	for _, p := range photos {
+		link := shareURL(p.album, p.name, expires)
+		title := p.meta.Title
+		if title == "" {
+			title = p.name
+		}
+		summary := p.meta.Caption
+		body := `<p><img src="` + html.EscapeString(link) + `" alt="` + html.EscapeString(p.meta.Alt) + `"></p>`
+		if summary != "" {
+			body += "<p>" + html.EscapeString(summary) + "</p>"
+		}
+		if p.meta.Description != "" {
+			body += "<p>" + strings.ReplaceAll(html.EscapeString(p.meta.Description), "\n", "<br>") + "</p>"
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      publicURL + "/#" + url.PathEscape(p.album) + "/" + url.PathEscape(p.name) + "/" + p.meta.File.Hash,
+			Title:   title,
+			Updated: p.added.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Href: publicURL + "/"},
+				{Rel: "enclosure", Type: mime.TypeByExtension(strings.ToLower(path.Ext(p.name))), Href: link},
+			},
+			Summary: summary,
+			Content: atomContent{Type: "html", Body: body},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	enc.Encode(feed)
+}
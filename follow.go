@@ -0,0 +1,146 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// followTTL is how long the report of a viewer counts. The viewers
+	// report again every minute.
+	followTTL = 2 * time.Minute
+
+	// maxFollowViewers limits the number of viewers tracked at once
+	maxFollowViewers = 10000
+)
+
+// followers tracks which viewers follow the show and which browse on their
+// own, by the random ID of their page
+var followers = struct {
+	sync.Mutex
+	viewers map[string]followReport
+}{viewers: make(map[string]followReport)}
+
+// followReport is the last report of a viewer
+type followReport struct {
+	following bool
+	seen      time.Time
+}
+
+// followStats counts the viewers following the show and those browsing
+type followStats struct {
+	Following int `json:"following"`
+	Browsing  int `json:"browsing"`
+}
+
+// validViewerID reports whether the ID chosen by a viewer page is acceptable
+func validViewerID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// reportFollow records whether the viewer follows the show.
+// It returns false if too many viewers are tracked already.
+func reportFollow(viewer string, following bool) bool {
+	followers.Lock()
+	defer followers.Unlock()
+	if _, ok := followers.viewers[viewer]; !ok && len(followers.viewers) >= maxFollowViewers {
+		pruneFollowers(time.Now())
+		if len(followers.viewers) >= maxFollowViewers {
+			return false
+		}
+	}
+	followers.viewers[viewer] = followReport{following, time.Now()}
+	return true
+}
+
+// pruneFollowers forgets the viewers which did not report for followTTL.
+// It must be called with followers held.
+func pruneFollowers(now time.Time) {
+	for id, r := range followers.viewers {
+		if now.Sub(r.seen) > followTTL {
+			delete(followers.viewers, id)
+		}
+	}
+}
+
+// followCounts returns how many viewers follow the show and how many browse
+func followCounts() followStats {
+	followers.Lock()
+	defer followers.Unlock()
+	pruneFollowers(time.Now())
+	var s followStats
+	for _, r := range followers.viewers {
+		if r.following {
+			s.Following++
+		} else {
+			s.Browsing++
+		}
+	}
+	return s
+}
+
+// syncFollowers marks all viewers as following after the master synced them.
+// It returns how many were browsing.
+func syncFollowers() int {
+	followers.Lock()
+	defer followers.Unlock()
+	pruneFollowers(time.Now())
+	n := 0
+	for id, r := range followers.viewers {
+		if !r.following {
+			r.following = true
+			followers.viewers[id] = r
+			n++
+		}
+	}
+	return n
+}
+
+// FollowReport takes the report of a viewer page whether it follows the show,
+// given by the form values viewer (its ID) and following
+func FollowReport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	viewer := r.PostFormValue("viewer")
+	if !validViewerID(viewer) {
+		http.Error(w, "invalid viewer", http.StatusBadRequest)
+		return
+	}
+	following, err := strconv.ParseBool(r.PostFormValue("following"))
+	if err != nil {
+		http.Error(w, "invalid following", http.StatusBadRequest)
+		return
+	}
+	if !reportFollow(viewer, following) {
+		http.Error(w, "too many viewers", http.StatusServiceUnavailable)
+	}
+}
+
+// SyncViewers snaps all viewers back to the current slide like the "sync"
+// command and responds with the number of screens which were browsing
+func SyncViewers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rec.command(url.Values{"cmd": {"sync"}})
+	masterActed("sync")
+	n := syncViewers()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Synced int `json:"synced"`
+	}{n})
+}
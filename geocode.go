@@ -0,0 +1,208 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geocoder resolves coordinates to a place name like "Lake Garda, Italy"
+type geocoder interface {
+	// Place returns the name of the place at the position, empty if unknown
+	Place(ctx context.Context, p geoPoint) (string, error)
+}
+
+// geocoding is the geocoder selected in the config, nil if disabled
+var geocoding geocoder
+
+// newGeocoder returns the geocoder selected in the config
+func newGeocoder() (geocoder, error) {
+	switch geocodeType {
+	case "":
+		return nil, nil
+	case "nominatim":
+		return &nominatimGeocoder{url: geocodeURL}, nil
+	case "api":
+		if geocodeURL == "" {
+			return nil, errors.New("geocodeURL not set")
+		}
+		return &apiGeocoder{url: geocodeURL, token: geocodeToken}, nil
+	default:
+		return nil, errors.New("unknown geocoder: " + geocodeType)
+	}
+}
+
+var geocodeClient = &http.Client{Timeout: 30 * time.Second}
+
+// getJSON requests the URL and decodes the JSON response into v
+func getJSON(ctx context.Context, u, token string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "remotephotoshow")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := geocodeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(req.URL.Host + ": " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// coords returns the query parameters lat and lon of the position
+func coords(p geoPoint) url.Values {
+	return url.Values{
+		"lat": {strconv.FormatFloat(p.Lat, 'f', 6, 64)},
+		"lon": {strconv.FormatFloat(p.Lon, 'f', 6, 64)},
+	}
+}
+
+// nominatimGeocoder uses the reverse geocoding of an OpenStreetMap Nominatim
+// server. The public one allows at most one request per second.
+type nominatimGeocoder struct {
+	url string // e.g. https://nominatim.openstreetmap.org
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (g *nominatimGeocoder) Place(ctx context.Context, p geoPoint) (string, error) {
+	g.mu.Lock()
+	if wait := time.Second - time.Since(g.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	g.last = time.Now()
+	g.mu.Unlock()
+
+	q := coords(p)
+	q.Set("format", "jsonv2")
+	q.Set("zoom", "10") // city level
+	var res struct {
+		Name    string            `json:"name"`
+		Address map[string]string `json:"address"`
+	}
+	if err := getJSON(ctx, strings.TrimSuffix(g.url, "/")+"/reverse?"+q.Encode(), "", &res); err != nil {
+		return "", err
+	}
+
+	name := res.Name
+	for _, field := range []string{"city", "town", "village", "municipality", "county", "state"} {
+		if name != "" {
+			break
+		}
+		name = res.Address[field]
+	}
+	country := res.Address["country"]
+	if name == "" || name == country {
+		return country, nil
+	}
+	if country == "" {
+		return name, nil
+	}
+	return name + ", " + country, nil
+}
+
+// apiGeocoder requests url?lat=...&lon=..., which responds with a JSON object
+// like {"place": "Lake Garda, Italy"}
+type apiGeocoder struct {
+	url   string
+	token string // sent as bearer token if set
+}
+
+func (g *apiGeocoder) Place(ctx context.Context, p geoPoint) (string, error) {
+	var res struct {
+		Place string `json:"place"`
+	}
+	sep := "?"
+	if strings.Contains(g.url, "?") {
+		sep = "&"
+	}
+	err := getJSON(ctx, g.url+sep+coords(p).Encode(), g.token, &res)
+	return res.Place, err
+}
+
+// placeCache stores the resolved place names in cacheDir/places.json. The
+// positions are rounded to about 100 m, so that the photos of a trip need only
+// a few requests.
+var placeCache = struct {
+	sync.Mutex
+	loaded bool
+	places map[string]string
+}{places: make(map[string]string)}
+
+// placeKey returns the cache key of the position
+func placeKey(p geoPoint) string {
+	return strconv.FormatFloat(p.Lat, 'f', 3, 64) + "," + strconv.FormatFloat(p.Lon, 'f', 3, 64)
+}
+
+// lookupPlace returns the (cached) place name of the position
+func lookupPlace(ctx context.Context, p geoPoint) (string, error) {
+	key := placeKey(p)
+	path := filepath.Join(cacheDir, "places.json")
+
+	placeCache.Lock()
+	if !placeCache.loaded {
+		placeCache.loaded = true
+		if data, err := os.ReadFile(path); err == nil {
+			json.Unmarshal(data, &placeCache.places)
+		}
+	}
+	place, ok := placeCache.places[key]
+	placeCache.Unlock()
+	if ok {
+		return place, nil
+	}
+
+	place, err := geocoding.Place(ctx, p)
+	if err != nil {
+		return "", err
+	}
+
+	placeCache.Lock()
+	defer placeCache.Unlock()
+	placeCache.places[key] = place
+	data, err := json.Marshal(placeCache.places)
+	if err == nil {
+		if err = os.MkdirAll(cacheDir, 0755); err == nil {
+			err = os.WriteFile(path, data, 0644)
+		}
+	}
+	return place, err
+}
+
+// locatePhoto stores the place name of a geotagged photo in the catalog. It
+// reports whether the place changed.
+func locatePhoto(ctx context.Context, album, name string) (bool, error) {
+	if geocoding == nil {
+		return false, nil
+	}
+	exif, err := photoEXIF(ctx, album, name)
+	if err != nil || exif.Location == nil {
+		return false, err
+	}
+	place, err := lookupPlace(ctx, *exif.Location)
+	if err != nil || place == "" || place == meta.get(album, name).Place {
+		return false, err
+	}
+	err = meta.update(album, name, func(m *photoMeta) { m.Place = place })
+	return err == nil, err
+}
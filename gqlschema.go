@@ -0,0 +1,519 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The GraphQL schema of the catalog:
+//
+//	type Query {
+//	  show: Show
+//	  albums: [Album]        # the current one and those with metadata
+//	  album(id: String): Album
+//	  photos(album: String, tag: String, favorite: Boolean, hidden: Boolean, first: Int, offset: Int): [Photo]
+//	  photo(name: String!, album: String): Photo
+//	  tags(album: String): [Tag]
+//	}
+//	type Subscription { slide: Slide }
+//	type Show { album id count version autoplay state start end mode photo: Photo }
+//	type Slide { id alt photo: Photo show: Show }
+//	type Album { id current count photos(tag, favorite, hidden, first, offset): [Photo] tags: [Tag] }
+//	type Tag { name count photos: [Photo] }
+//	type Photo { name album url thumb position caption alt title description duration
+//	             hidden favorite stars tags place text duplicate size modified sha256 faces }
+//
+// Omitted album arguments mean the current album. URLs are only set for
+// photos of the current album, position only for those in the show.
+
+// gqlPhoto is a photo in the GraphQL schema
+type gqlPhoto struct {
+	album string
+	name  string
+	m     photoMeta
+}
+
+var photoType = &gqlType{name: "Photo", fields: map[string]gqlResolver{
+	"name":  func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlPhoto).name, nil },
+	"album": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlPhoto).album, nil },
+	"url": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		return gqlPhotoURL(ex, v.(gqlPhoto), "/photos/"), nil
+	},
+	"thumb": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		return gqlPhotoURL(ex, v.(gqlPhoto), "/thumbs/"), nil
+	},
+	"position": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		if i := ex.position(v.(gqlPhoto)); i >= 0 {
+			return i, nil
+		}
+		return nil, nil
+	},
+	"caption": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		p := v.(gqlPhoto)
+		if i := ex.position(p); i >= 0 {
+			return photoCaption(p.m, ex.snapshot().entries, i), nil
+		}
+		return photoCaption(p.m, nil, 0), nil
+	},
+	"alt": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		p := v.(gqlPhoto)
+		if i := ex.position(p); i >= 0 {
+			return photoAlt(p.m, p.album, p.name, ex.snapshot().entries, i), nil
+		}
+		return photoAlt(p.m, p.album, p.name, nil, 0), nil
+	},
+	"title": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlPhoto).m.Title, nil },
+	"description": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		return v.(gqlPhoto).m.Description, nil
+	},
+	"duration": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlPhoto).m.Duration, nil },
+	"hidden":   func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlPhoto).m.Hidden, nil },
+	"favorite": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlPhoto).m.Favorite, nil },
+	"stars":    func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlPhoto).m.Stars, nil },
+	"tags": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		if tags := v.(gqlPhoto).m.Tags; tags != nil {
+			return tags, nil
+		}
+		return []string{}, nil
+	},
+	"place":     func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlPhoto).m.Place, nil },
+	"duplicate": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlPhoto).m.Duplicate, nil },
+	"text": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		if t := v.(gqlPhoto).m.Text; t != nil {
+			return t.Text, nil
+		}
+		return nil, nil
+	},
+	"size": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		if f := v.(gqlPhoto).m.File; f != nil {
+			return f.Size, nil
+		}
+		return nil, nil
+	},
+	"modified": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		if f := v.(gqlPhoto).m.File; f != nil {
+			return f.ModTime.Format(time.RFC3339), nil
+		}
+		return nil, nil
+	},
+	"sha256": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		if f := v.(gqlPhoto).m.File; f != nil {
+			return f.Hash, nil
+		}
+		return nil, nil
+	},
+	"faces": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		if f := v.(gqlPhoto).m.Faces; f != nil {
+			return len(f.Faces), nil
+		}
+		return nil, nil
+	},
+}}
+
+// gqlTag is a tag with its photos in an album
+type gqlTag struct {
+	name   string
+	photos []gqlObject
+}
+
+var tagType = &gqlType{name: "Tag", fields: map[string]gqlResolver{
+	"name":   func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlTag).name, nil },
+	"count":  func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return len(v.(gqlTag).photos), nil },
+	"photos": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(gqlTag).photos, nil },
+}}
+
+var albumType = &gqlType{name: "Album", fields: map[string]gqlResolver{
+	"id": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(string), nil },
+	"current": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		return v.(string) == ex.snapshot().album, nil
+	},
+	"count": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		names, err := ex.albumPhotos(v.(string))
+		return len(names), err
+	},
+	"photos": func(ex *gqlExec, v interface{}, args gqlArgs) (interface{}, error) {
+		return gqlPhotos(ex, v.(string), args)
+	},
+	"tags": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		return gqlTags(ex, v.(string))
+	},
+}}
+
+var showType = &gqlType{name: "Show", fields: map[string]gqlResolver{
+	"album":    func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).Album, nil },
+	"id":       func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).ID, nil },
+	"count":    func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).Count, nil },
+	"version":  func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).Version, nil },
+	"autoplay": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).Autoplay, nil },
+	"state":    func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).State.State, nil },
+	"start":    func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).State.Start, nil },
+	"end":      func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).State.End, nil },
+	"mode":     func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).Mode.Name, nil },
+	"photo": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		s := v.(apiShow)
+		if s.Photo == "" {
+			return nil, nil
+		}
+		return gqlObject{photoType, gqlPhoto{s.Album, s.Photo, meta.get(s.Album, s.Photo)}}, nil
+	},
+}}
+
+var slideType = &gqlType{name: "Slide", fields: map[string]gqlResolver{
+	"id": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return v.(apiShow).ID, nil },
+	"alt": func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) {
+		return newSlideEvent(v.(apiShow).ID).Alt, nil
+	},
+	"photo": showType.fields["photo"],
+	"show":  func(ex *gqlExec, v interface{}, _ gqlArgs) (interface{}, error) { return gqlObject{showType, v}, nil },
+}}
+
+var queryType = &gqlType{name: "Query", fields: map[string]gqlResolver{
+	"show": func(ex *gqlExec, _ interface{}, _ gqlArgs) (interface{}, error) {
+		return gqlObject{showType, currentAPIShow()}, nil
+	},
+	"albums": func(ex *gqlExec, _ interface{}, _ gqlArgs) (interface{}, error) {
+		ids, current := meta.albumIDs(), ex.snapshot().album
+		if i := sort.SearchStrings(ids, current); i == len(ids) || ids[i] != current {
+			ids = append(ids, current)
+			sort.Strings(ids)
+		}
+		albums := make([]gqlObject, len(ids))
+		for i, id := range ids {
+			albums[i] = gqlObject{albumType, id}
+		}
+		return albums, nil
+	},
+	"album": func(ex *gqlExec, _ interface{}, args gqlArgs) (interface{}, error) {
+		album, err := gqlAlbum(ex, args, "id")
+		if err != nil {
+			return nil, err
+		}
+		return gqlObject{albumType, album}, nil
+	},
+	"photos": func(ex *gqlExec, _ interface{}, args gqlArgs) (interface{}, error) {
+		album, err := gqlAlbum(ex, args, "album")
+		if err != nil {
+			return nil, err
+		}
+		return gqlPhotos(ex, album, args)
+	},
+	"photo": func(ex *gqlExec, _ interface{}, args gqlArgs) (interface{}, error) {
+		album, err := gqlAlbum(ex, args, "album")
+		if err != nil {
+			return nil, err
+		}
+		name, err := args.str("name", "")
+		if err != nil || name == "" {
+			return nil, errors.New("argument name is required")
+		}
+		names, err := ex.albumPhotos(album)
+		if err != nil {
+			return nil, err
+		}
+		if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+			return nil, nil
+		}
+		return gqlObject{photoType, gqlPhoto{album, name, meta.get(album, name)}}, nil
+	},
+	"tags": func(ex *gqlExec, _ interface{}, args gqlArgs) (interface{}, error) {
+		album, err := gqlAlbum(ex, args, "album")
+		if err != nil {
+			return nil, err
+		}
+		return gqlTags(ex, album)
+	},
+}}
+
+var subscriptionType = &gqlType{name: "Subscription", fields: map[string]gqlResolver{
+	"slide": func(ex *gqlExec, _ interface{}, _ gqlArgs) (interface{}, error) {
+		return gqlObject{slideType, currentAPIShow()}, nil
+	},
+}}
+
+// gqlAlbum returns the album argument with the name, the current album if it
+// is omitted
+func gqlAlbum(ex *gqlExec, args gqlArgs, name string) (string, error) {
+	album, err := args.str(name, ex.snapshot().album)
+	if err == nil && album != "" && !validName(album) {
+		err = errors.New("invalid album")
+	}
+	return album, err
+}
+
+// gqlPhotoURL returns the URL of the photo below prefix, nil if it is not in
+// the current album and thus not served
+func gqlPhotoURL(ex *gqlExec, p gqlPhoto, prefix string) interface{} {
+	if p.album != ex.snapshot().album {
+		return nil
+	}
+	return prefix + url.PathEscape(p.name)
+}
+
+// snapshot returns the show state, the same during the execution
+func (ex *gqlExec) snapshot() slideshowSnapshot {
+	if snap, ok := ex.cache["show"].(slideshowSnapshot); ok {
+		return snap
+	}
+	snap := show.snapshot()
+	ex.cache["show"] = snap
+	return snap
+}
+
+// position returns the position of the photo in the show or -1
+func (ex *gqlExec) position(p gqlPhoto) int {
+	if p.album != ex.snapshot().album {
+		return -1
+	}
+	positions, ok := ex.cache["positions"].(map[string]int)
+	if !ok {
+		names := ex.snapshot().photos
+		positions = make(map[string]int, len(names))
+		for i, name := range names {
+			positions[name] = i
+		}
+		ex.cache["positions"] = positions
+	}
+	if i, ok := positions[p.name]; ok {
+		return i
+	}
+	return -1
+}
+
+// albumPhotos returns the names of all photos of the album, sorted
+func (ex *gqlExec) albumPhotos(album string) ([]string, error) {
+	key := "album:" + album
+	if names, ok := ex.cache[key].([]string); ok {
+		return names, nil
+	}
+	names, err := source.Photos(ex.ctx, album)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	ex.cache[key] = names
+	return names, nil
+}
+
+// gqlPhotos returns the photos of the album matching the arguments tag,
+// favorite and hidden, paginated by first and offset
+func gqlPhotos(ex *gqlExec, album string, args gqlArgs) ([]gqlObject, error) {
+	tag, err := args.str("tag", "")
+	if err != nil {
+		return nil, err
+	}
+	favorite, err := args.bool("favorite")
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := args.bool("hidden")
+	if err != nil {
+		return nil, err
+	}
+	first, err := args.int("first", -1)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := args.int("offset", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := ex.albumPhotos(album)
+	if err != nil {
+		return nil, err
+	}
+	all := meta.album(album)
+	photos := make([]gqlObject, 0)
+	for _, name := range names {
+		m := all[name]
+		if tag != "" && !hasTag(m.Tags, tag) ||
+			favorite != nil && m.Favorite != *favorite ||
+			hidden != nil && m.Hidden != *hidden {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if first >= 0 && len(photos) >= first {
+			break
+		}
+		photos = append(photos, gqlObject{photoType, gqlPhoto{album, name, m}})
+	}
+	return photos, nil
+}
+
+// gqlTags returns the tags of the photos of the album
+func gqlTags(ex *gqlExec, album string) ([]gqlObject, error) {
+	names, err := ex.albumPhotos(album)
+	if err != nil {
+		return nil, err
+	}
+	all := meta.album(album)
+	byTag := make(map[string][]gqlObject)
+	for _, name := range names {
+		m := all[name]
+		for _, tag := range m.Tags {
+			byTag[tag] = append(byTag[tag], gqlObject{photoType, gqlPhoto{album, name, m}})
+		}
+	}
+
+	tags := make([]gqlObject, 0, len(byTag))
+	for tag, photos := range byTag {
+		tags = append(tags, gqlObject{tagType, gqlTag{tag, photos}})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].v.(gqlTag).name < tags[j].v.(gqlTag).name })
+	return tags, nil
+}
+
+// subscribers are notified of changes, possibly coalesced
+type subscribers struct {
+	mu    sync.Mutex
+	chans map[chan struct{}]bool
+}
+
+// slideSubscribers are notified when the slide changes
+var slideSubscribers = subscribers{chans: make(map[chan struct{}]bool)}
+
+func (s *subscribers) add() chan struct{} {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.chans[ch] = true
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *subscribers) remove(ch chan struct{}) {
+	s.mu.Lock()
+	delete(s.chans, ch)
+	s.mu.Unlock()
+}
+
+func (s *subscribers) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.chans {
+		select {
+		case ch <- struct{}{}:
+		default: // a notification is pending already
+		}
+	}
+}
+
+// gqlRequest is the body of a GraphQL request
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// gqlResponse is the body of a GraphQL response
+type gqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+func gqlFail(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(gqlResponse{Errors: []gqlError{{Message: err.Error()}}})
+}
+
+// GraphQL executes a GraphQL request, given as JSON in the body or as URL
+// parameters. Subscriptions are answered with an event stream of "next"
+// events, one for each slide change.
+func GraphQL(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !graphqlEnabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req gqlRequest
+	if r.Method == "GET" {
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				gqlFail(w, err)
+				return
+			}
+		}
+	} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		gqlFail(w, err)
+		return
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		gqlFail(w, err)
+		return
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		gqlFail(w, err)
+		return
+	}
+	ex, err := newGQLExec(r.Context(), doc, op, req.Variables)
+	if err != nil {
+		gqlFail(w, err)
+		return
+	}
+
+	switch op.kind {
+	case "query":
+		data := ex.execute(op.sel, gqlObject{queryType, nil})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(gqlResponse{data, ex.errs})
+	case "subscription":
+		gqlSubscribe(w, r, doc, op, req.Variables)
+	default:
+		gqlFail(w, errors.New(op.kind+" is not supported"))
+	}
+}
+
+// gqlSubscribe executes the subscription on every slide change until the
+// client disconnects
+func gqlSubscribe(w http.ResponseWriter, r *http.Request, doc *gqlDocument, op *gqlOperation, vars map[string]interface{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := slideSubscribers.add()
+	defer slideSubscribers.remove(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-ch:
+			ex, _ := newGQLExec(r.Context(), doc, op, vars) // checked before
+			data := ex.execute(op.sel, gqlObject{subscriptionType, nil})
+			payload, _ := json.Marshal(gqlResponse{data, ex.errs})
+			fmt.Fprintf(w, "event: next\ndata: %s\n\n", payload)
+		}
+		flusher.Flush()
+	}
+}
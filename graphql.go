@@ -0,0 +1,891 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file implements the subset of GraphQL needed for the catalog queries
+// of gqlschema.go: queries and subscriptions with arguments, variables,
+// aliases, fragments and the @skip and @include directives. The schema is not
+// introspectable apart from __typename.
+
+// gqlMaxDepth limits the nesting of selections
+const gqlMaxDepth = 12
+
+// gqlDocument is a parsed GraphQL request
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+// gqlOperation is a query, mutation or subscription of a document
+type gqlOperation struct {
+	kind string
+	name string
+	vars []gqlVarDef
+	sel  []*gqlSelection
+}
+
+// gqlVarDef declares a variable of an operation
+type gqlVarDef struct {
+	name     string
+	required bool
+	def      interface{} // default value, nil if there is none
+}
+
+// gqlFragment is a named fragment
+type gqlFragment struct {
+	on  string
+	sel []*gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread or an inline fragment
+type gqlSelection struct {
+	alias      string
+	name       string // of the field or the spread fragment
+	args       map[string]interface{}
+	directives []gqlDirective
+	sel        []*gqlSelection
+
+	spread bool   // ...name
+	inline bool   // ... on Type { }
+	on     string // type condition of an inline fragment
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]interface{}
+}
+
+// gqlVar refers to a variable in a value
+type gqlVar string
+
+// gqlEnum is an enum value
+type gqlEnum string
+
+// gqlError is an error in a GraphQL response
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlMap is a JSON object keeping the order of the selected fields
+type gqlMap []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (m gqlMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, e := range m {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(e.key)
+		b.Write(key)
+		b.WriteByte(':')
+		value, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// gqlType is an object type of the schema
+type gqlType struct {
+	name   string
+	fields map[string]gqlResolver
+}
+
+// gqlResolver resolves a field of the object v. It returns a scalar, a
+// gqlObject, a slice of them or nil.
+type gqlResolver func(ex *gqlExec, v interface{}, args gqlArgs) (interface{}, error)
+
+// gqlObject is a value of an object type
+type gqlObject struct {
+	typ *gqlType
+	v   interface{}
+}
+
+// gqlArgs are the arguments of a field with the variables substituted
+type gqlArgs map[string]interface{}
+
+// str returns the string argument or def if it is missing
+func (a gqlArgs) str(name, def string) (string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return def, nil
+	case string:
+		return v, nil
+	default:
+		return "", errors.New("argument " + name + " must be a string")
+	}
+}
+
+// int returns the integer argument or def if it is missing
+func (a gqlArgs) int(name string, def int) (int, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		return int(v), nil
+	case float64: // from the JSON variables
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	}
+	return 0, errors.New("argument " + name + " must be an integer")
+}
+
+// bool returns the boolean argument, nil if it is missing
+func (a gqlArgs) bool(name string) (*bool, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		return &v, nil
+	default:
+		return nil, errors.New("argument " + name + " must be a boolean")
+	}
+}
+
+// parseGraphQL parses a GraphQL document
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.tok.kind != gqlEOF {
+		switch {
+		case p.is("{"):
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", sel: sel})
+		case p.isName("query"), p.isName("mutation"), p.isName("subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.isName("fragment"):
+			if err := p.fragment(doc); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, errors.New("no operation")
+	}
+	return doc, nil
+}
+
+// operation returns the operation with the name. The name may be empty if the
+// document has only one operation.
+func (doc *gqlDocument) operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, errors.New("operationName is required")
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, errors.New("unknown operation: " + name)
+}
+
+const (
+	gqlEOF = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind int
+	val  string
+}
+
+type gqlParser struct {
+	src string
+	pos int
+	tok gqlToken
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	line := 1 + strings.Count(p.src[:p.pos], "\n")
+	return fmt.Errorf("syntax error on line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.tok.kind == gqlEOF {
+		return p.errorf("unexpected end of document")
+	}
+	return p.errorf("unexpected %q", p.tok.val)
+}
+
+// is reports whether the current token is the punctuator
+func (p *gqlParser) is(punct string) bool {
+	return p.tok.kind == gqlPunct && p.tok.val == punct
+}
+
+// isName reports whether the current token is the name
+func (p *gqlParser) isName(name string) bool {
+	return p.tok.kind == gqlName && p.tok.val == name
+}
+
+// expect skips the punctuator, which must be the current token
+func (p *gqlParser) expect(punct string) error {
+	if !p.is(punct) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+// name returns the current token, which must be a name, and skips it
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", p.unexpected()
+	}
+	name := p.tok.val
+	return name, p.next()
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// next reads the next token
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = gqlToken{kind: gqlEOF}
+		return nil
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{gqlPunct, "..."}
+	case strings.IndexByte("!$()=:@[]{}|&", c) >= 0:
+		p.pos++
+		p.tok = gqlToken{gqlPunct, string(c)}
+	case isNameStart(c):
+		for p.pos < len(p.src) && (isNameStart(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = gqlToken{gqlName, p.src[start:p.pos]}
+	case c == '-' || isDigit(c):
+		kind := gqlInt
+		p.pos++
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+		}
+		if p.pos < len(p.src) && p.src[p.pos] == '.' {
+			kind = gqlFloat
+			p.pos++
+			for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+				p.pos++
+			}
+		}
+		if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			kind = gqlFloat
+			p.pos++
+			if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+				p.pos++
+			}
+			for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+				p.pos++
+			}
+		}
+		p.tok = gqlToken{kind, p.src[start:p.pos]}
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			return p.errorf("unterminated string")
+		}
+		p.tok = gqlToken{gqlString, strings.TrimSpace(p.src[p.pos+3 : p.pos+3+end])}
+		p.pos += end + 6
+	case c == '"':
+		s, err := p.stringValue()
+		if err != nil {
+			return err
+		}
+		p.tok = gqlToken{gqlString, s}
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		return p.errorf("unexpected character %q", r)
+	}
+	return nil
+}
+
+// stringValue reads a quoted string with escape sequences
+func (p *gqlParser) stringValue() (string, error) {
+	var b strings.Builder
+	p.pos++ // opening quote
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return b.String(), nil
+		case c == '\n' || c == '\r':
+			return "", p.errorf("unterminated string")
+		case c == '\\' && p.pos+1 < len(p.src):
+			e := p.src[p.pos+1]
+			p.pos += 2
+			switch e {
+			case '"', '\\', '/':
+				b.WriteByte(e)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return "", p.errorf("invalid escape sequence")
+				}
+				r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid escape sequence")
+				}
+				b.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				return "", p.errorf("invalid escape sequence")
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.tok.val}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == gqlName {
+		op.name = p.tok.val
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.is("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.is(")") {
+			var v gqlVarDef
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			var err error
+			if v.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if v.required, err = p.varType(); err != nil {
+				return nil, err
+			}
+			if p.is("=") {
+				if err = p.next(); err != nil {
+					return nil, err
+				}
+				if v.def, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			if _, err = p.directives(); err != nil {
+				return nil, err
+			}
+			op.vars = append(op.vars, v)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.sel, err = p.selectionSet()
+	return op, err
+}
+
+// varType skips the type of a variable and reports whether it is non-null.
+// The values are checked by the resolvers.
+func (p *gqlParser) varType() (bool, error) {
+	if p.is("[") {
+		if err := p.next(); err != nil {
+			return false, err
+		}
+		if _, err := p.varType(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.is("!") {
+		return true, p.next()
+	}
+	return false, nil
+}
+
+func (p *gqlParser) fragment(doc *gqlDocument) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	if !p.isName("on") {
+		return p.unexpected()
+	}
+	if err = p.next(); err != nil {
+		return err
+	}
+	f := new(gqlFragment)
+	if f.on, err = p.name(); err != nil {
+		return err
+	}
+	if _, err = p.directives(); err != nil {
+		return err
+	}
+	if f.sel, err = p.selectionSet(); err != nil {
+		return err
+	}
+	doc.fragments[name] = f
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.is("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 0 {
+		return nil, p.errorf("empty selection")
+	}
+	return sels, p.next()
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	sel := new(gqlSelection)
+	var err error
+	if p.is("...") {
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == gqlName && !p.isName("on") {
+			sel.spread = true
+			sel.name = p.tok.val
+			if err = p.next(); err != nil {
+				return nil, err
+			}
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+
+		sel.inline = true
+		if p.isName("on") {
+			if err = p.next(); err != nil {
+				return nil, err
+			}
+			if sel.on, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		sel.sel, err = p.selectionSet()
+		return sel, err
+	}
+
+	if sel.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.is(":") {
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is("(") {
+		if sel.args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.is("{") {
+		sel.sel, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	args := make(map[string]interface{})
+	for !p.is(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.next()
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var ds []gqlDirective
+	for p.is("@") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		var d gqlDirective
+		var err error
+		if d.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if p.is("(") {
+			if d.args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// value parses a value. Constant values must not contain variables.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	switch {
+	case p.is("$") && !constant:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVar(name), err
+	case tok.kind == gqlInt:
+		i, err := strconv.ParseInt(tok.val, 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid integer %s", tok.val)
+		}
+		return i, p.next()
+	case tok.kind == gqlFloat:
+		f, err := strconv.ParseFloat(tok.val, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", tok.val)
+		}
+		return f, p.next()
+	case tok.kind == gqlString:
+		return tok.val, p.next()
+	case tok.kind == gqlName:
+		var v interface{}
+		switch tok.val {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+		default:
+			v = gqlEnum(tok.val)
+		}
+		return v, p.next()
+	case p.is("["):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, 0)
+		for !p.is("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.next()
+	case p.is("{"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		obj := make(map[string]interface{})
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.next()
+	default:
+		return nil, p.unexpected()
+	}
+}
+
+// gqlExec executes an operation
+type gqlExec struct {
+	ctx   context.Context
+	doc   *gqlDocument
+	vars  map[string]interface{}
+	errs  []gqlError
+	cache map[string]interface{} // for the resolvers, per execution
+}
+
+// newGQLExec prepares the execution of the operation with the variables
+func newGQLExec(ctx context.Context, doc *gqlDocument, op *gqlOperation, vars map[string]interface{}) (*gqlExec, error) {
+	ex := &gqlExec{ctx: ctx, doc: doc, vars: make(map[string]interface{}), cache: make(map[string]interface{})}
+	for _, v := range op.vars {
+		val, ok := vars[v.name]
+		if !ok || val == nil {
+			val = v.def
+		}
+		if val == nil && v.required {
+			return nil, errors.New("variable $" + v.name + " is required")
+		}
+		if f, ok := val.(float64); ok && f == float64(int64(f)) {
+			val = int64(f) // JSON numbers
+		}
+		ex.vars[v.name] = val
+	}
+	return ex, nil
+}
+
+// execute resolves the selections on the root object and returns the data of
+// the response. The errors are collected in ex.errs.
+func (ex *gqlExec) execute(sel []*gqlSelection, root gqlObject) gqlMap {
+	return ex.object(sel, root, nil)
+}
+
+// substitute replaces the variables in the value
+func (ex *gqlExec) substitute(v interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlVar:
+		return ex.vars[string(v)]
+	case gqlEnum:
+		return string(v)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, e := range v {
+			list[i] = ex.substitute(e)
+		}
+		return list
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			obj[k] = ex.substitute(e)
+		}
+		return obj
+	default:
+		return v
+	}
+}
+
+// included evaluates the @skip and @include directives
+func (ex *gqlExec) included(ds []gqlDirective) bool {
+	for _, d := range ds {
+		cond, _ := ex.substitute(d.args["if"]).(bool)
+		if d.name == "skip" && cond || d.name == "include" && !cond {
+			return false
+		}
+	}
+	return true
+}
+
+// collect returns the fields of the selection set for the type by response
+// key, resolving the fragments
+func (ex *gqlExec) collect(sels []*gqlSelection, typ *gqlType, keys *[]string, fields map[string][]*gqlSelection, depth int) {
+	if depth > gqlMaxDepth {
+		return
+	}
+	for _, sel := range sels {
+		if !ex.included(sel.directives) {
+			continue
+		}
+		switch {
+		case sel.spread:
+			f := ex.doc.fragments[sel.name]
+			if f != nil && f.on == typ.name {
+				ex.collect(f.sel, typ, keys, fields, depth+1)
+			}
+		case sel.inline:
+			if sel.on == "" || sel.on == typ.name {
+				ex.collect(sel.sel, typ, keys, fields, depth+1)
+			}
+		default:
+			key := sel.name
+			if sel.alias != "" {
+				key = sel.alias
+			}
+			if _, ok := fields[key]; !ok {
+				*keys = append(*keys, key)
+			}
+			fields[key] = append(fields[key], sel)
+		}
+	}
+}
+
+func (ex *gqlExec) fail(path []interface{}, err error) {
+	ex.errs = append(ex.errs, gqlError{Message: err.Error(), Path: append([]interface{}(nil), path...)})
+}
+
+// object resolves the selected fields of the object
+func (ex *gqlExec) object(sels []*gqlSelection, obj gqlObject, path []interface{}) gqlMap {
+	if len(path) > gqlMaxDepth {
+		ex.fail(path, errors.New("query is nested too deeply"))
+		return nil
+	}
+
+	var keys []string
+	fields := make(map[string][]*gqlSelection)
+	ex.collect(sels, obj.typ, &keys, fields, 0)
+
+	m := make(gqlMap, 0, len(keys))
+	for _, key := range keys {
+		same := fields[key]
+		sel := same[0]
+		fieldPath := append(path, key)
+		if sel.name == "__typename" {
+			m = append(m, gqlEntry{key, obj.typ.name})
+			continue
+		}
+
+		resolve := obj.typ.fields[sel.name]
+		if resolve == nil {
+			ex.fail(fieldPath, fmt.Errorf("unknown field %s on %s", sel.name, obj.typ.name))
+			m = append(m, gqlEntry{key, nil})
+			continue
+		}
+		args := make(gqlArgs, len(sel.args))
+		for k, v := range sel.args {
+			args[k] = ex.substitute(v)
+		}
+		v, err := resolve(ex, obj.v, args)
+		if err != nil {
+			ex.fail(fieldPath, err)
+			m = append(m, gqlEntry{key, nil})
+			continue
+		}
+
+		// fields requested more than once are merged
+		var sub []*gqlSelection
+		for _, s := range same {
+			sub = append(sub, s.sel...)
+		}
+		m = append(m, gqlEntry{key, ex.complete(sub, v, fieldPath)})
+	}
+	return m
+}
+
+// complete resolves the selections of a field value
+func (ex *gqlExec) complete(sels []*gqlSelection, v interface{}, path []interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case gqlObject:
+		if len(sels) == 0 {
+			ex.fail(path, fmt.Errorf("field of type %s needs a selection", v.typ.name))
+			return nil
+		}
+		return ex.object(sels, v, path)
+	case []gqlObject:
+		list := make([]interface{}, len(v))
+		for i, obj := range v {
+			list[i] = ex.complete(sels, obj, append(path, i))
+		}
+		return list
+	default:
+		if len(sels) > 0 {
+			ex.fail(path, errors.New("scalar field has no selection"))
+			return nil
+		}
+		return v
+	}
+}
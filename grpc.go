@@ -0,0 +1,343 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// grpcService is the path of the PhotoShow service of photoshow.proto. Its
+// methods are served by GRPC, the messages are encoded by hand.
+const grpcService = "/photoshow.v1.PhotoShow/"
+
+// gRPC status codes
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcAborted         = 10
+	grpcUnimplemented   = 12
+	grpcUnavailable     = 14
+)
+
+// maxGRPCMessage is the maximum size of a received message
+const maxGRPCMessage = 1 << 20
+
+var errInvalidMessage = errors.New("invalid protobuf message")
+
+// showEvent is an event sent to the viewers
+type showEvent struct {
+	typ  string
+	data string
+}
+
+// eventFeed passes the events sent to the viewers on to the gRPC streams.
+// Slow streams lose events instead of holding up the show.
+type eventFeed struct {
+	mu    sync.Mutex
+	chans map[chan showEvent]bool
+}
+
+var grpcEvents = eventFeed{chans: make(map[chan showEvent]bool)}
+
+func (f *eventFeed) add() chan showEvent {
+	ch := make(chan showEvent, 64)
+	f.mu.Lock()
+	f.chans[ch] = true
+	f.mu.Unlock()
+	return ch
+}
+
+func (f *eventFeed) remove(ch chan showEvent) {
+	f.mu.Lock()
+	delete(f.chans, ch)
+	f.mu.Unlock()
+}
+
+func (f *eventFeed) publish(typ string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.chans) == 0 {
+		return
+	}
+	e := showEvent{typ, string(data)}
+	for ch := range f.chans {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// GRPC serves the methods of the PhotoShow service
+func GRPC(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !grpcEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	method := ps.ByName("method")
+	if method == "ShowEvents" {
+		grpcShowEvents(w, r)
+		return
+	}
+
+	msg, err := grpcRead(r.Body)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	switch method {
+	case "GetShow":
+	case "Next":
+		err = changeState(next)
+	case "Prev":
+		err = changeState(prev)
+	case "Set":
+		var id uint64
+		err = pbFields(msg, func(field int, v uint64, _ []byte) error {
+			if field == 1 {
+				id = v
+			}
+			return nil
+		})
+		if err == nil {
+			err = changeState(func() error { return setID(id, nil) })
+		}
+	case "Command":
+		var form url.Values
+		if form, err = parseCommandRequest(msg); err == nil {
+			rec.command(form)
+			auditCommand(r, form)
+			err = masterCommand(form.Get("cmd"), form)
+		}
+	default:
+		grpcStatus(w, grpcUnimplemented, "unknown method: "+method)
+		return
+	}
+
+	if err != nil {
+		code := grpcInvalidArgument
+		switch err {
+		case errUnknownCommand:
+			code = grpcUnimplemented
+		case errVersionConflict:
+			code = grpcAborted
+		}
+		grpcStatus(w, code, err.Error())
+		return
+	}
+	grpcWrite(w, encodeShow(currentAPIShow()))
+	grpcStatus(w, grpcOK, "")
+}
+
+// grpcShowEvents streams the events until the client disconnects or the
+// server shuts down
+func grpcShowEvents(w http.ResponseWriter, r *http.Request) {
+	if _, err := grpcRead(r.Body); err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		grpcStatus(w, grpcUnimplemented, "streaming unsupported")
+		return
+	}
+
+	ch := grpcEvents.add()
+	defer grpcEvents.remove(ch)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			grpcStatus(w, grpcUnavailable, "server shutting down")
+			return
+		case e := <-ch:
+			var msg []byte
+			msg = pbString(msg, 1, e.typ)
+			msg = pbString(msg, 2, e.data)
+			if err := grpcWrite(w, msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// grpcStatus sets the status trailers of the response
+func grpcStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(msg))
+	}
+}
+
+// grpcEscape percent-encodes the status message as required by gRPC
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7E || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcRead reads a length-prefixed message of the request
+func grpcRead(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxGRPCMessage {
+		return nil, errors.New("message too large")
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// grpcWrite writes a length-prefixed message of the response
+func grpcWrite(w io.Writer, msg []byte) error {
+	hdr := [5]byte{}
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// encodeShow encodes the Show message
+func encodeShow(s apiShow) []byte {
+	var msg []byte
+	msg = pbString(msg, 1, s.Album)
+	msg = pbVarint(msg, 2, s.ID)
+	msg = pbVarint(msg, 3, uint64(s.Count))
+	msg = pbString(msg, 4, s.Photo)
+	msg = pbVarint(msg, 5, s.Version)
+	msg = pbVarint(msg, 6, uint64(s.Autoplay))
+	msg = pbString(msg, 7, s.State.State)
+	msg = pbString(msg, 8, s.Mode.Name)
+	return msg
+}
+
+// parseCommandRequest decodes the CommandRequest message as form values
+func parseCommandRequest(msg []byte) (url.Values, error) {
+	form := url.Values{}
+	err := pbFields(msg, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			form.Set("cmd", string(data))
+		case 2: // map entry
+			var key, value string
+			err := pbFields(data, func(field int, _ uint64, data []byte) error {
+				switch field {
+				case 1:
+					key = string(data)
+				case 2:
+					value = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if key != "cmd" {
+				form.Set(key, value)
+			}
+		}
+		return nil
+	})
+	if err == nil && form.Get("cmd") == "" {
+		err = errors.New("missing cmd")
+	}
+	return form, err
+}
+
+// pbVarint appends a varint field, omitting the default value 0
+func pbVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// pbString appends a string field, omitting the default value ""
+func pbString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// pbFields calls fn for each field of the protobuf message with its value,
+// v for numeric and data for length-delimited fields
+func pbFields(msg []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errInvalidMessage
+		}
+		msg = msg[n:]
+
+		field := int(key >> 3)
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0: // varint
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return errInvalidMessage
+			}
+			msg = msg[n:]
+		case 1: // 64 bit
+			if len(msg) < 8 {
+				return errInvalidMessage
+			}
+			v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return errInvalidMessage
+			}
+			data, msg = msg[n:n+int(l)], msg[n+int(l):]
+		case 5: // 32 bit
+			if len(msg) < 4 {
+				return errInvalidMessage
+			}
+			v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		default:
+			return errInvalidMessage
+		}
+		if err := fn(field, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// haDevice groups all entities of the photo show in Home Assistant
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// haEntity is the MQTT discovery config of a single Home Assistant entity.
+// See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+type haEntity struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	Device            haDevice `json:"device"`
+	AvailabilityTopic string   `json:"availability_topic,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+
+	// sensors
+	StateTopic          string `json:"state_topic,omitempty"`
+	ValueTemplate       string `json:"value_template,omitempty"`
+	JSONAttributesTopic string `json:"json_attributes_topic,omitempty"`
+	PayloadOn           string `json:"payload_on,omitempty"`
+	PayloadOff          string `json:"payload_off,omitempty"`
+
+	// buttons and switches
+	CommandTopic string `json:"command_topic,omitempty"`
+	PayloadPress string `json:"payload_press,omitempty"`
+}
+
+// haPublishDiscovery announces the photo show entities to Home Assistant
+func haPublishDiscovery(c *mqttClient) {
+	if !haDiscovery {
+		return
+	}
+
+	device := haDevice{
+		Identifiers:  []string{mqttClientID},
+		Name:         "Remote Photo Show",
+		Manufacturer: "remotephotoshow",
+	}
+	status := mqttTopic + "/status"
+	slide := mqttTopic + "/slide"
+	command := mqttTopic + "/command"
+
+	entities := map[string]haEntity{
+		"binary_sensor/running": {
+			Name:       "Show running",
+			StateTopic: status,
+			PayloadOn:  "online",
+			PayloadOff: "offline",
+			Icon:       "mdi:projector",
+		},
+		"sensor/slide": {
+			Name:                "Slide",
+			StateTopic:          slide,
+			ValueTemplate:       "{{ value_json.id + 1 }}",
+			JSONAttributesTopic: slide,
+			Icon:                "mdi:image-multiple",
+		},
+		"sensor/photo": {
+			Name:          "Photo",
+			StateTopic:    slide,
+			ValueTemplate: "{{ value_json.photo }}",
+			Icon:          "mdi:image",
+		},
+		"sensor/viewers": {
+			Name:       "Viewers",
+			StateTopic: mqttTopic + "/viewers",
+			Icon:       "mdi:account-group",
+		},
+		"switch/autoplay": {
+			Name:         "Autoplay",
+			StateTopic:   mqttTopic + "/autoplay",
+			CommandTopic: command,
+			PayloadOn:    "play",
+			PayloadOff:   "pause",
+			Icon:         "mdi:play-pause",
+		},
+		"button/next": {
+			Name:         "Next",
+			CommandTopic: command,
+			PayloadPress: "next",
+			Icon:         "mdi:skip-next",
+		},
+		"button/prev": {
+			Name:         "Previous",
+			CommandTopic: command,
+			PayloadPress: "prev",
+			Icon:         "mdi:skip-previous",
+		},
+		"button/reset": {
+			Name:         "Reset",
+			CommandTopic: command,
+			PayloadPress: "reset",
+			Icon:         "mdi:restart",
+		},
+	}
+
+	for key, e := range entities {
+		component, object, _ := strings.Cut(key, "/")
+		e.UniqueID = mqttClientID + "_" + object
+		e.Device = device
+		e.AvailabilityTopic = status
+		if component == "binary_sensor" {
+			// the status topic is both, state and availability
+			e.AvailabilityTopic = ""
+		}
+
+		payload, _ := json.Marshal(e)
+		topic := haPrefix + "/" + component + "/" + mqttClientID + "/" + object + "/config"
+		c.Publish(topic, payload, true)
+	}
+}
+
+// mqttPublishViewers publishes the number of connected viewers
+func mqttPublishViewers(n int) {
+	if mqtt == nil {
+		return
+	}
+	mqtt.Publish(mqttTopic+"/viewers", []byte(strconv.Itoa(n)), true)
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// photoTokenTTL is the validity of the tokens required to load the photos
+// with hotlink protection. Viewers renew their token every hour.
+const photoTokenTTL = 24 * time.Hour
+
+var (
+	tokenSecretOnce sync.Once
+	tokenSecret     []byte
+)
+
+// photoTokenSecret returns the key signing the photo tokens. Without a
+// configured hotlinkSecret, tokens are only valid until the server restarts.
+func photoTokenSecret() []byte {
+	tokenSecretOnce.Do(func() {
+		if hotlinkSecret != "" {
+			tokenSecret = []byte(hotlinkSecret)
+			return
+		}
+		tokenSecret = make([]byte, 32)
+		if _, err := rand.Read(tokenSecret); err != nil {
+			panic(err)
+		}
+	})
+	return tokenSecret
+}
+
+// tokenMAC signs the expiry time of a token for the client IP address
+func tokenMAC(expires, ip string) string {
+	mac := hmac.New(sha256.New, photoTokenSecret())
+	mac.Write([]byte(expires + "|" + ip))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// photoToken returns a token allowing the client with the given IP address to
+// load photos. An empty ip allows any client, e.g. casting devices.
+// It is empty if hotlink protection is disabled.
+func photoToken(ip string) string {
+	if !hotlinkProtection {
+		return ""
+	}
+	expires := strconv.FormatInt(time.Now().Add(photoTokenTTL).Unix(), 36)
+	return expires + "." + tokenMAC(expires, ip)
+}
+
+// photoQuery returns the query string adding a token for the client to a
+// photo URL
+func photoQuery(ip string) string {
+	if token := photoToken(ip); token != "" {
+		return "?t=" + token
+	}
+	return ""
+}
+
+// validPhotoToken checks the token of a photo request by the client
+func validPhotoToken(token, ip string) bool {
+	expires, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	t, err := strconv.ParseInt(expires, 36, 64)
+	if err != nil || time.Now().Unix() > t {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(tokenMAC(expires, ip))) ||
+		hmac.Equal([]byte(mac), []byte(tokenMAC(expires, "")))
+}
+
+// hotlinked reports whether a photo request has to be refused because it
+// lacks a valid token or was linked from another site
+func hotlinked(r *http.Request) bool {
+	if !hotlinkProtection {
+		return false
+	}
+	if ref := r.Referer(); ref != "" {
+		u, err := url.Parse(ref)
+		if err != nil || u.Host != r.Host {
+			return true
+		}
+	}
+	return !validPhotoToken(r.FormValue("t"), clientIP(r))
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sourceLanguage is the language of the strings in the code and pages
+const sourceLanguage = "en"
+
+// bundles holds the translations per language, mapping the English strings to
+// the translated ones. They are read from langDir/<lang>.json on startup,
+// which take precedence over the built-in ones.
+var bundles = make(map[string]map[string]string)
+
+// loadBundles reads the translation bundles
+func loadBundles() error {
+	for _, fsys := range []fs.FS{embedded("lang"), os.DirFS(langDir)} {
+		files, err := fs.Glob(fsys, "*.json")
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			data, err := fs.ReadFile(fsys, file)
+			if err != nil {
+				return err
+			}
+			var strs map[string]string
+			if err = json.Unmarshal(data, &strs); err != nil {
+				return &fs.PathError{Op: "load", Path: file, Err: err}
+			}
+			bundles[strings.ToLower(strings.TrimSuffix(file, ".json"))] = strs
+		}
+	}
+	if len(bundles) > 0 {
+		log.Printf("loaded %d translation bundles", len(bundles))
+	}
+	return nil
+}
+
+// hasLanguage reports whether the UI can be shown in the language
+func hasLanguage(lang string) bool {
+	_, ok := bundles[lang]
+	return ok || lang == sourceLanguage
+}
+
+// requestLanguage selects the language for the client, either the configured
+// language or the most preferred available one of its Accept-Language header
+func requestLanguage(r *http.Request) string {
+	if language != "" {
+		return language
+	}
+
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		if tag != "" && q > 0 {
+			prefs = append(prefs, weighted{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	for _, p := range prefs {
+		// e.g. de-at falls back to de
+		base, _, _ := strings.Cut(p.lang, "-")
+		for _, lang := range []string{p.lang, base} {
+			if hasLanguage(lang) {
+				return lang
+			}
+		}
+	}
+	return sourceLanguage
+}
+
+// tr translates the string into the language. Strings without translation
+// are returned as they are.
+func tr(lang, s string) string {
+	if t, ok := bundles[lang][s]; ok && t != "" {
+		return t
+	}
+	return s
+}
+
+// errorPage replies with the error message in the client's language
+func errorPage(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	w.Header().Add("Vary", "Accept-Language")
+	http.Error(w, tr(requestLanguage(r), msg), code)
+}
+
+// statusPage replies with the translated status text of the code
+func statusPage(w http.ResponseWriter, r *http.Request, code int) {
+	errorPage(w, r, http.StatusText(code), code)
+}
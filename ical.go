@@ -0,0 +1,139 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// calendarEvent is a show in the iCalendar feed
+type calendarEvent struct {
+	uid        string
+	album      string
+	start, end time.Time // end is zero if the show runs until the next one
+}
+
+// upcomingShows returns the shows starting within calendarDays, the earliest
+// first: the scheduled show and the occurrences of the recurring shows. Like
+// runCron, recurring shows starting while a show with a duration is running
+// are left out.
+func upcomingShows(now time.Time) []calendarEvent {
+	limit := now.AddDate(0, 0, calendarDays)
+	var events []calendarEvent
+	if state := currentState(); state.Start != nil &&
+		(state.State == stateScheduled || (state.State == stateLive && state.End != nil && state.End.After(now))) {
+		e := calendarEvent{uid: "scheduled-" + strconv.FormatInt(state.Start.Unix(), 10), album: show.currentAlbum(), start: *state.Start}
+		if state.End != nil {
+			e.end = *state.End
+		}
+		events = append(events, e)
+	}
+
+	cronMu.Lock()
+	for _, s := range cronShows {
+		for t := s.spec.next(now.In(s.loc)); !t.IsZero() && t.Before(limit); t = s.spec.next(t) {
+			e := calendarEvent{uid: "cron-" + strconv.Itoa(s.ID) + "-" + strconv.FormatInt(t.Unix(), 10), album: s.Album, start: t}
+			if s.Duration > 0 {
+				e.end = t.Add(s.Duration)
+			}
+			events = append(events, e)
+		}
+	}
+	cronMu.Unlock()
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].start.Before(events[j].start) })
+	kept := events[:0]
+	var busyUntil time.Time
+	for _, e := range events {
+		if e.start.Before(busyUntil) {
+			continue
+		}
+		if len(kept) > 0 && kept[len(kept)-1].end.IsZero() {
+			kept[len(kept)-1].end = e.start
+		}
+		busyUntil = e.end
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// icalEscape escapes a text value of iCalendar
+var icalEscape = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// icalLine writes a content line, folded after 75 octets as required by
+// RFC 5545, without splitting UTF-8 sequences
+func icalLine(b *strings.Builder, line string) {
+	for len(line) > 75 {
+		n := 75
+		for n > 0 && line[n]&0xC0 == 0x80 {
+			n--
+		}
+		b.WriteString(line[:n] + "\r\n ")
+		line = line[n:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// Calendar serves an iCalendar feed of the upcoming shows, or of those of the
+// album in the album parameter, so that viewers can add them to their
+// calendars. Shows without a duration last until the next show, the last
+// of them has no end.
+func Calendar(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var album *string
+	if a, ok := r.URL.Query()["album"]; ok {
+		if a[0] != "" && !validName(a[0]) {
+			http.NotFound(w, r)
+			return
+		}
+		album = &a[0]
+	}
+
+	now := time.Now()
+	host := publicURL
+	if u, err := url.Parse(publicURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	const layout = "20060102T150405Z"
+	access := requestAccess(r)
+
+	var b strings.Builder
+	icalLine(&b, "BEGIN:VCALENDAR")
+	icalLine(&b, "VERSION:2.0")
+	icalLine(&b, "PRODID:-//remotephotoshow//"+host+"//EN")
+	icalLine(&b, "CALSCALE:GREGORIAN")
+	icalLine(&b, "METHOD:PUBLISH")
+	icalLine(&b, "X-WR-CALNAME:"+icalEscape.Replace(pageTitle))
+	for _, e := range upcomingShows(now) {
+		if (album != nil && e.album != *album) || !access.allowed(e.album) {
+			continue
+		}
+		summary := pageTitle
+		if e.album != "" {
+			summary += ": " + e.album
+		}
+		icalLine(&b, "BEGIN:VEVENT")
+		icalLine(&b, "UID:"+e.uid+"@"+host)
+		icalLine(&b, "DTSTAMP:"+now.UTC().Format(layout))
+		icalLine(&b, "DTSTART:"+e.start.UTC().Format(layout))
+		if !e.end.IsZero() {
+			icalLine(&b, "DTEND:"+e.end.UTC().Format(layout))
+		}
+		icalLine(&b, "SUMMARY:"+icalEscape.Replace(summary))
+		icalLine(&b, "URL:"+publicURL+"/")
+		icalLine(&b, "END:VEVENT")
+	}
+	icalLine(&b, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// idle switches to autoplay when the master did not issue a command for
+// idleAutoplay, and back when the master acts again
+var idle struct {
+	sync.Mutex
+	timer   *time.Timer
+	playing bool // autoplay was started by the timer
+}
+
+// startIdle starts waiting for the master's first command
+func startIdle() {
+	if idleAutoplay <= 0 {
+		return
+	}
+	idle.Lock()
+	idle.timer = time.AfterFunc(idleAutoplay, idleTimeout)
+	idle.Unlock()
+}
+
+// idleTimeout starts autoplay, unless the show is already playing or not live
+func idleTimeout() {
+	idle.Lock()
+	defer idle.Unlock()
+	if player.playing() > 0 || currentState().State != stateLive {
+		return
+	}
+	if err := player.start(autoplayInterval); err != nil {
+		log.Println("idle:", err)
+		return
+	}
+	idle.playing = true
+}
+
+// masterActed restarts the inactivity timer after a command of the master.
+// Autoplay started by the timer is paused again, unless the command is about
+// autoplay itself.
+func masterActed(cmd string) {
+	if idleAutoplay <= 0 {
+		return
+	}
+	idle.Lock()
+	defer idle.Unlock()
+	if idle.timer != nil {
+		idle.timer.Reset(idleAutoplay)
+	}
+	if !idle.playing {
+		return
+	}
+	idle.playing = false
+	switch cmd {
+	case "autoplay", "play", "pause":
+	default:
+		player.pause()
+	}
+}
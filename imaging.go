@@ -0,0 +1,92 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"image/draw"
+	_ "image/gif" // register decoders
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+)
+
+// decodeImage decodes the image file at the given path
+func decodeImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// thumbnail scales the image down to fit into a size x size box.
+// Each destination pixel is the average of the source pixels it covers.
+func thumbnail(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w > h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return resize(img, w, h)
+}
+
+// resize scales the image to w x h pixels using a box filter
+func resize(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					bl += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(bl / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,198 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// imageTypes maps the accepted photo file extensions to their content type
+var imageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// isImage reports whether the file content matches the type indicated by the
+// extension of the given filename
+func isImage(name string, head []byte) bool {
+	ctype, ok := imageTypes[strings.ToLower(path.Ext(name))]
+	return ok && http.DetectContentType(head) == ctype
+}
+
+// importResult is the response of the import endpoint
+type importResult struct {
+	Album    string   `json:"album"`
+	Imported []string `json:"imported"`
+	Skipped  []string `json:"skipped"`
+	Staged   bool     `json:"staged,omitempty"` // waiting to be published
+}
+
+// importZIP extracts all images in the given ZIP archive into the given album
+// directory. Existing files are never overwritten. The extraction stops once
+// the images would exceed maxImportExtracted, the remaining files are skipped.
+func importZIP(zr *zip.Reader, dir string) (imported, skipped []string, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	imported = make([]string, 0)
+	skipped = make([]string, 0)
+	var extracted uint64
+	for i, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		// Flatten the archive, only the base name of each file is kept.
+		// This also protects against path traversal in entry names.
+		name := path.Base(strings.Replace(f.Name, `\`, "/", -1))
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+
+		// archive/zip fails reading more than the declared size
+		if extracted += f.UncompressedSize64; extracted > uint64(maxImportExtracted) {
+			for _, f := range zr.File[i:] {
+				if !f.FileInfo().IsDir() {
+					skipped = append(skipped, f.Name+": archive too large when extracted")
+				}
+			}
+			break
+		}
+		if err = extractImage(f, filepath.Join(dir, name)); err != nil {
+			skipped = append(skipped, f.Name+": "+err.Error())
+			continue
+		}
+		imported = append(imported, name)
+	}
+	return imported, skipped, nil
+}
+
+// extractImage writes a single archive entry to dst if it is a valid image
+func extractImage(f *zip.File, dst string) error {
+	if f.UncompressedSize64 > uint64(maxImportSize) {
+		return errors.New("file too large")
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return saveImage(rc, dst)
+}
+
+// saveImage writes the image read from r to the new file dst.
+// Files which are not valid images or too large are rejected.
+func saveImage(r io.Reader, dst string) error {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if !isImage(dst, head[:n]) {
+		return errors.New("not a supported image")
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return errors.New("file exists")
+		}
+		return err
+	}
+
+	if _, err = out.Write(head[:n]); err == nil {
+		var written int64
+		written, err = io.Copy(out, io.LimitReader(r, maxImportSize-int64(n)+1))
+		if err == nil && written > maxImportSize-int64(n) {
+			err = errors.New("file too large")
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// PhotoImport accepts a ZIP archive in the "archive" form field and extracts
+// the contained images into the album given in the "album" form field
+// (default: the current album), which is created if it does not exist yet.
+// With stagePhotos, they are staged instead.
+func PhotoImport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if sourceType != "dir" {
+		http.Error(w, "Import is only supported for the dir photo source", http.StatusNotImplemented)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	album := show.currentAlbum()
+	if _, ok := r.MultipartForm.Value["album"]; ok {
+		album = r.FormValue("album")
+	}
+	if album != "" && !validName(album) {
+		http.Error(w, "invalid album", http.StatusBadRequest)
+		return
+	}
+
+	zr, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var imported, skipped []string
+	if stagePhotos {
+		imported, skipped, err = importStaged(zr, album)
+	} else {
+		imported, skipped, err = importZIP(zr, albumDir(album))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(imported) > 0 && !stagePhotos {
+		sendWebhook(hookUpload, uploadData{Album: album, Photos: imported})
+		pushPhotosAdded(album, len(imported))
+
+		// Refresh the photo show if photos were added to the current album
+		if album == show.currentAlbum() {
+			rescan()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(importResult{
+		Album:    album,
+		Imported: imported,
+		Skipped:  skipped,
+		Staged:   stagePhotos,
+	})
+}
@@ -0,0 +1,211 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// fieldGap separates the positions of the indexed fields, so that phrases
+// never match across two fields
+const fieldGap = 1000
+
+// posting lists the positions of a term in a document
+type posting struct {
+	doc int
+	pos []int
+}
+
+// textIndex is an inverted index of the names, captions, tags, cameras,
+// places and recognized text of the photos in the show. A document is a photo, identified by its position.
+type textIndex struct {
+	mu     sync.Mutex
+	album  string
+	names  []string
+	terms  map[string][]posting
+	sorted []string // all terms, for prefix lookups
+	dirty  bool     // the catalog changed since the index was built
+}
+
+var index textIndex
+
+// tokenize splits text into lower case words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// build indexes the photos of the album. The index is left as it is if the
+// context is done before.
+func (ix *textIndex) build(ctx context.Context, album string, names []string, entries []playlistEntry) {
+	all := meta.album(album)
+	terms := make(map[string][]posting)
+	for doc, name := range names {
+		fields := []string{name, photoCaption(all[name], entries, doc), strings.Join(all[name].Tags, " "), "", all[name].Place, ""}
+		if exif, err := photoEXIF(ctx, album, name); err == nil {
+			fields[3] = exif.Camera()
+		}
+		if t := all[name].Text; t != nil {
+			fields[5] = t.Text // last, as it may exceed fieldGap words
+		}
+
+		positions := make(map[string][]int)
+		for f, text := range fields {
+			for i, word := range tokenize(text) {
+				positions[word] = append(positions[word], f*fieldGap+i)
+			}
+		}
+		for word, pos := range positions {
+			terms[word] = append(terms[word], posting{doc: doc, pos: pos})
+		}
+	}
+
+	if ctx.Err() != nil {
+		return // incomplete, it is built again next time
+	}
+
+	sorted := make([]string, 0, len(terms))
+	for word := range terms {
+		sorted = append(sorted, word)
+	}
+	sort.Strings(sorted)
+
+	ix.mu.Lock()
+	ix.album, ix.names, ix.terms, ix.sorted, ix.dirty = album, names, terms, sorted, false
+	ix.mu.Unlock()
+}
+
+// invalidate marks the index as outdated, it is rebuilt on the next search
+func (ix *textIndex) invalidate() {
+	ix.mu.Lock()
+	ix.dirty = true
+	ix.mu.Unlock()
+}
+
+// current rebuilds the index if it does not match the show anymore
+func (ix *textIndex) current(ctx context.Context) {
+	snap := show.snapshot()
+	album, names, entries := snap.album, snap.photos, snap.entries
+
+	ix.mu.Lock()
+	outdated := ix.dirty || ix.album != album || len(ix.names) != len(names)
+	for i := 0; !outdated && i < len(names); i++ {
+		outdated = ix.names[i] != names[i]
+	}
+	ix.mu.Unlock()
+
+	if outdated {
+		ix.build(ctx, album, names, entries)
+	}
+}
+
+// lookup returns the positions of the word per document. If prefix is set,
+// all words starting with it match.
+// It must be called with ix.mu held.
+func (ix *textIndex) lookup(word string, prefix bool) map[int][]int {
+	docs := make(map[int][]int)
+	if !prefix {
+		for _, p := range ix.terms[word] {
+			docs[p.doc] = p.pos
+		}
+		return docs
+	}
+
+	for i := sort.SearchStrings(ix.sorted, word); i < len(ix.sorted) && strings.HasPrefix(ix.sorted[i], word); i++ {
+		for _, p := range ix.terms[ix.sorted[i]] {
+			docs[p.doc] = append(docs[p.doc], p.pos...)
+		}
+	}
+	return docs
+}
+
+// searchPhrase is a word or a sequence of words which must appear in this
+// order. If prefix is set, the last word may be the prefix of a longer word.
+type searchPhrase struct {
+	words  []string
+	prefix bool
+}
+
+// parsePhrases splits a query into phrases: words, "quoted phrases" and
+// prefixes like cer*. Words starting with '#' are returned as tags.
+func parsePhrases(query string) ([]searchPhrase, []string) {
+	var phrases []searchPhrase
+	var tags []string
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 { // inside quotes
+			p := searchPhrase{prefix: strings.HasSuffix(strings.TrimSpace(part), "*")}
+			if p.words = tokenize(part); len(p.words) > 0 {
+				phrases = append(phrases, p)
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			if strings.HasPrefix(field, "#") {
+				tags = append(tags, field)
+				continue
+			}
+			prefix := strings.HasSuffix(field, "*")
+			// split like the indexed text, e.g. IMG_1234 into a phrase
+			if words := tokenize(field); len(words) > 0 {
+				phrases = append(phrases, searchPhrase{words: words, prefix: prefix})
+			}
+		}
+	}
+	return phrases, tags
+}
+
+// search returns the names of the photos matching all phrases
+func (ix *textIndex) search(ctx context.Context, phrases []searchPhrase) map[string]bool {
+	ix.current(ctx)
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	var result map[int]bool
+	for _, p := range phrases {
+		// positions where the phrase could start, per document
+		var starts map[int][]int
+		for i, word := range p.words {
+			docs := ix.lookup(word, p.prefix && i == len(p.words)-1)
+			if i == 0 {
+				starts = docs
+				continue
+			}
+
+			next := make(map[int][]int)
+			for doc, begin := range starts {
+				at := make(map[int]bool, len(docs[doc]))
+				for _, pos := range docs[doc] {
+					at[pos] = true
+				}
+				for _, b := range begin {
+					if at[b+i] {
+						next[doc] = append(next[doc], b)
+					}
+				}
+			}
+			starts = next
+		}
+
+		matched := make(map[int]bool, len(starts))
+		for doc, pos := range starts {
+			if len(pos) > 0 && (result == nil || result[doc]) {
+				matched[doc] = true
+			}
+		}
+		result = matched
+	}
+
+	names := make(map[string]bool, len(result))
+	for doc := range result {
+		names[ix.names[doc]] = true
+	}
+	return names
+}
@@ -0,0 +1,182 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// fileInfo is a photo file as it was seen when scanning
+type fileInfo struct {
+	Hash    string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+// recordFiles stores the hashes of new and modified photos of the album in
+// the catalog. Files which differ but still have the recorded size and
+// modification time are left alone, these are reported by verifyCatalog.
+func recordFiles(ctx context.Context, album string, names []string) error {
+	all := meta.album(album)
+	files := make(map[string]*fileInfo)
+	var changed []string
+	for _, name := range names {
+		h, err := hashPhoto(ctx, album, name)
+		if err != nil {
+			continue
+		}
+		if f := all[name].File; f != nil && f.Size == h.size && f.ModTime.Equal(h.modTime) {
+			continue
+		}
+		files[name] = &fileInfo{Hash: hex.EncodeToString(h.content[:]), Size: h.size, ModTime: h.modTime}
+		changed = append(changed, name)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return meta.updatePhotos(album, changed, func(name string, m *photoMeta) {
+		m.File = files[name]
+	})
+}
+
+// integrityIssue is a problem with a photo referenced by the catalog
+type integrityIssue struct {
+	Album   string `json:"album"`
+	Photo   string `json:"photo"`
+	Problem string `json:"problem"` // "missing", "corrupted", "changed" or an error
+}
+
+// integrityReport is the result of a catalog verification
+type integrityReport struct {
+	Status   string           `json:"status"`
+	Started  time.Time        `json:"started"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	Checked  int              `json:"checked"`
+	Issues   []integrityIssue `json:"issues"`
+}
+
+var (
+	verifyMu     sync.Mutex
+	verifyReport *integrityReport // of the last or running verification
+)
+
+// checkFile verifies a photo of the catalog by hashing it again, bypassing
+// the cache. It returns the problem, if any.
+func checkFile(ctx context.Context, album, name string, file *fileInfo) string {
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return err.Error()
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "missing"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	if file == nil {
+		return "" // not scanned yet, nothing to compare
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err.Error()
+	}
+	sum, err := hashFile(f)
+	if err != nil {
+		return err.Error()
+	}
+	if hex.EncodeToString(sum[:]) != file.Hash {
+		if fi.Size() != file.Size || !fi.ModTime().Equal(file.ModTime) {
+			return "changed" // modified since the last scan
+		}
+		return "corrupted"
+	}
+	return ""
+}
+
+// verifyCatalog checks all photos referenced by the catalog and logs the
+// problems found. It stops early when the context is done.
+func verifyCatalog(ctx context.Context, report *integrityReport) {
+	log.Println("verify: checking the catalog")
+	for _, album := range meta.albumIDs() {
+		all := meta.album(album)
+		names := make([]string, 0, len(all))
+		for name := range all {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if ctx.Err() != nil {
+				break
+			}
+			problem := checkFile(ctx, album, name, all[name].File)
+			if problem != "" {
+				log.Printf("verify: %s/%s: %s", album, name, problem)
+			}
+
+			verifyMu.Lock()
+			report.Checked++
+			if problem != "" {
+				report.Issues = append(report.Issues, integrityIssue{Album: album, Photo: name, Problem: problem})
+			}
+			verifyMu.Unlock()
+		}
+	}
+
+	verifyMu.Lock()
+	now := time.Now()
+	report.Status = jobDone
+	report.Finished = &now
+	log.Printf("verify: checked %d photos, %d problems", report.Checked, len(report.Issues))
+	verifyMu.Unlock()
+}
+
+// writeReport writes the verification report as JSON.
+// It must be called with verifyMu held.
+func writeReport(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(verifyReport)
+}
+
+// VerifyStart starts verifying the files of all photos in the catalog
+func VerifyStart(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	verifyMu.Lock()
+	defer verifyMu.Unlock()
+
+	if verifyReport != nil && verifyReport.Status == jobRunning {
+		http.Error(w, "verification is running already", http.StatusConflict)
+		return
+	}
+	verifyReport = &integrityReport{Status: jobRunning, Started: time.Now(), Issues: make([]integrityIssue, 0)}
+	go verifyCatalog(rootCtx, verifyReport)
+	writeReport(w, http.StatusAccepted)
+}
+
+// VerifyStatus returns the report of the last verification
+func VerifyStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	verifyMu.Lock()
+	defer verifyMu.Unlock()
+
+	if verifyReport == nil {
+		http.Error(w, "no verification run yet", http.StatusNotFound)
+		return
+	}
+	writeReport(w, http.StatusOK)
+}
@@ -0,0 +1,320 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Delivery states of invitations
+const (
+	inviteQueued = "queued"
+	inviteSent   = "sent"
+	inviteFailed = "failed"
+)
+
+const (
+	// maxInvites limits the addresses invited at once
+	maxInvites = 200
+
+	// keptInvites limits the invitations kept for their delivery state
+	keptInvites = 1000
+)
+
+// invite is an invitation to the show sent by email
+type invite struct {
+	ID     int        `json:"id"`
+	Email  string     `json:"email"`
+	Album  string     `json:"album"`
+	Status string     `json:"status"` // queued, sent or failed
+	Error  string     `json:"error,omitempty"`
+	Sent   *time.Time `json:"sent,omitempty"`
+}
+
+// invites are the invitations sent since the start, the oldest first
+var invites = struct {
+	sync.Mutex
+	list []*invite
+	next int
+}{}
+
+// inviteSending lets the invitations be sent one batch after another
+var inviteSending sync.Mutex
+
+// inviteTemplate is the HTML part of the invitations
+var inviteTemplate = template.Must(template.New("invite").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<body style="margin: 0; padding: 24px; background: {{.Background}}; color: {{.Text}}; font-family: sans-serif; text-align: center">
+{{if .logo}}<p><img src="cid:logo" alt="" style="max-width: 240px; max-height: 120px"></p>
+{{end}}<h1>{{.Heading}}</h1>
+{{if .Description}}<p>{{.Description}}</p>
+{{end}}<p><a href="{{.Link}}" style="display: inline-block; padding: 12px 24px; background: {{.Accent}}; color: {{.Text}}; text-decoration: none">{{.Join}}</a></p>
+{{if .PIN}}<p>{{.PIN}}</p>
+{{end}}{{if .qr}}<p>{{.Scan}}</p>
+<p><img src="cid:qr" alt="{{.Link}}" width="200" height="200"></p>
+{{end}}{{if .Footer}}<p><small>{{.Footer}}</small></p>
+{{end}}</body>
+</html>
+`))
+
+// parseAddresses parses the email addresses, which may be given separated by
+// commas, semicolons or newlines
+func parseAddresses(lists []string) ([]*mail.Address, error) {
+	var addrs []*mail.Address
+	for _, list := range lists {
+		for _, s := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ';' || r == '\n' }) {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			addr, err := mail.ParseAddress(s)
+			if err != nil {
+				return nil, errors.New("invalid address: " + s)
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses")
+	}
+	if len(addrs) > maxInvites {
+		return nil, errors.New("too many addresses")
+	}
+	return addrs, nil
+}
+
+// queueInvites queues invitations to the album in the language and sends
+// them in the background
+func queueInvites(addrs []*mail.Address, album, lang string) ([]invite, error) {
+	if smtpAddr == "" || mailFrom == "" {
+		return nil, errors.New("invitations are not configured")
+	}
+	if album != "" && !validName(album) {
+		return nil, errors.New("invalid album")
+	}
+	if albumRule(album).Level == accessPrivate {
+		return nil, errors.New("album is private")
+	}
+	if !hasLanguage(lang) {
+		return nil, errors.New("unknown language: " + lang)
+	}
+
+	invites.Lock()
+	queued := make([]*invite, len(addrs))
+	for i, addr := range addrs {
+		invites.next++
+		queued[i] = &invite{ID: invites.next, Email: addr.Address, Album: album, Status: inviteQueued}
+	}
+	invites.list = append(invites.list, queued...)
+	if n := len(invites.list) - keptInvites; n > 0 {
+		invites.list = append(invites.list[:0:0], invites.list[n:]...)
+	}
+	copies := make([]invite, len(queued))
+	for i, inv := range queued {
+		copies[i] = *inv
+	}
+	invites.Unlock()
+
+	go deliverInvites(addrs, queued, album, lang)
+	return copies, nil
+}
+
+// deliverInvites sends the queued invitations to the addresses and records
+// their delivery state
+func deliverInvites(addrs []*mail.Address, queued []*invite, album, lang string) {
+	inviteSending.Lock()
+	defer inviteSending.Unlock()
+
+	link := publicURL + "/"
+	var images []mailImage
+	if qr, err := qrPNG(link, 8); err == nil {
+		images = append(images, mailImage{"qr", "image/png", qr})
+	} else {
+		log.Println("invite:", err)
+	}
+	if logoFile != "" {
+		if logo, err := os.ReadFile(logoFile); err == nil {
+			images = append(images, mailImage{"logo", mime.TypeByExtension(strings.ToLower(filepath.Ext(logoFile))), logo})
+		} else {
+			log.Println("invite:", err)
+		}
+	}
+
+	for i, addr := range addrs {
+		msg, err := inviteMail(addr, link, album, lang, images)
+		if err == nil {
+			err = sendMail(addr.Address, msg)
+		}
+
+		invites.Lock()
+		if inv := queued[i]; err != nil {
+			inv.Status, inv.Error = inviteFailed, err.Error()
+		} else {
+			now := time.Now()
+			inv.Status, inv.Sent = inviteSent, &now
+		}
+		invites.Unlock()
+		if err != nil {
+			log.Printf("invite %s: %v", addr.Address, err)
+		}
+	}
+}
+
+// inviteMail returns the invitation to the album in the language, branded
+// like the show, with the link to it, the PIN of the album if it has one, and
+// the embedded images qr, the QR code of the link, and logo
+func inviteMail(to *mail.Address, link, album, lang string, images []mailImage) ([]byte, error) {
+	t := func(s string) string { return tr(lang, s) }
+	heading := strings.ReplaceAll(t("You are invited to {title}"), "{title}", pageTitle)
+	var pin string
+	if rule := albumRule(album); rule.Level == accessPIN {
+		pin = strings.ReplaceAll(t("PIN to view the photos: {pin}"), "{pin}", rule.PIN)
+	}
+
+	text := heading + "\n\n"
+	if pageDescription != "" {
+		text += pageDescription + "\n\n"
+	}
+	text += t("Join the show") + ": " + link + "\n"
+	if pin != "" {
+		text += pin + "\n"
+	}
+	if footerText != "" {
+		text += "\n" + footerText + "\n"
+	}
+
+	data := map[string]interface{}{
+		"Lang":        lang,
+		"Background":  template.CSS(backgroundColor),
+		"Text":        template.CSS(textColor),
+		"Accent":      template.CSS(accentColor),
+		"Heading":     heading,
+		"Description": pageDescription,
+		"Link":        link,
+		"Join":        t("Join the show"),
+		"PIN":         pin,
+		"Scan":        t("Or scan the code with your phone:"),
+		"Footer":      footerText,
+	}
+	for _, img := range images {
+		data[img.id] = true
+	}
+	var body bytes.Buffer
+	if err := inviteTemplate.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	return composeMail(to, heading, text, body.String(), images)
+}
+
+// inviteList returns the invitations with their delivery state, the oldest
+// first
+func inviteList() []invite {
+	invites.Lock()
+	defer invites.Unlock()
+	list := make([]invite, len(invites.list))
+	for i, inv := range invites.list {
+		list[i] = *inv
+	}
+	return list
+}
+
+// Invites lists the invitations with their delivery state
+func Invites(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(inviteList())
+}
+
+// SendInvites invites the email addresses in the emails parameters, separated
+// by commas or newlines, to the album in the album parameter, by default the
+// current one. The emails are in the language in the lang parameter, by
+// default that of the config. It responds with the queued invitations.
+func SendInvites(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+	addrs, err := parseAddresses(r.PostForm["emails"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	album := show.currentAlbum()
+	if _, ok := r.PostForm["album"]; ok {
+		album = r.PostForm.Get("album")
+	}
+	lang := r.PostForm.Get("lang")
+	if lang == "" {
+		lang = inviteLanguage()
+	}
+
+	queued, err := queueInvites(addrs, album, lang)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(queued)
+}
+
+// inviteLanguage returns the default language of the invitations
+func inviteLanguage() string {
+	if language != "" {
+		return language
+	}
+	return sourceLanguage
+}
+
+// apiInviteBody is the request of APISendInvites
+type apiInviteBody struct {
+	Emails   []string `json:"emails"`
+	Album    *string  `json:"album,omitempty"`    // the current one if not given
+	Language string   `json:"language,omitempty"` // that of the config if empty
+}
+
+// APIInvites lists the invitations with their delivery state
+func APIInvites(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	apiReply(w, http.StatusOK, inviteList())
+}
+
+// APISendInvites invites the email addresses like SendInvites, e.g.
+// {"emails": ["Jane <jane@example.com>"], "album": "party"}
+func APISendInvites(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body apiInviteBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	addrs, err := parseAddresses(body.Emails)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	album := show.currentAlbum()
+	if body.Album != nil {
+		album = *body.Album
+	}
+	if body.Language == "" {
+		body.Language = inviteLanguage()
+	}
+
+	queued, err := queueInvites(addrs, album, body.Language)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiReply(w, http.StatusAccepted, queued)
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// Layouts of a slide. Without one, the photo is fitted to the screen.
+const (
+	layoutFull      = "full"      // full-bleed, cropped to fill the screen
+	layoutLetterbox = "letterbox" // fitted next to a panel with the caption
+	layoutTwoUp     = "two-up"    // side by side with a second photo, e.g. before and after
+)
+
+// slideLayout is the layout of a slide, sent with the "set" event
+type slideLayout struct {
+	Type string `json:"type"`
+	Pair string `json:"pair,omitempty"` // the second photo of a two-up layout
+}
+
+// checkLayout validates the layout of the playlist entry. Only photos can
+// have one.
+func checkLayout(e playlistEntry, exists map[string]bool) error {
+	switch e.Layout {
+	case "":
+		if e.Pair != "" {
+			return errors.New("second photo without the two-up layout")
+		}
+		return nil
+	case layoutFull, layoutLetterbox:
+		if e.Pair != "" {
+			return errors.New("second photo without the two-up layout")
+		}
+	case layoutTwoUp:
+		if e.Pair == "" {
+			return errors.New("two-up layout without second photo")
+		}
+		if !exists[e.Pair] {
+			return errors.New("photo " + e.Pair + " not found")
+		}
+	default:
+		return errors.New("unknown layout: " + e.Layout)
+	}
+	if e.Card != nil || e.Markdown != "" || isTextSlide(e.Photo) {
+		return errors.New("layouts are only supported for photos")
+	}
+	return nil
+}
+
+// withLayout returns the playlist entry without its layout if it is invalid
+func withLayout(album string, e playlistEntry, exists map[string]bool) playlistEntry {
+	if err := checkLayout(e, exists); err != nil {
+		log.Printf("playlist %q: %s: %v", album, e.Photo, err)
+		e.Layout, e.Pair = "", ""
+	}
+	return e
+}
+
+// layoutOf returns the layout of the photo at position i, nil for the default
+// one
+func layoutOf(entries []playlistEntry, i int) *slideLayout {
+	if i >= len(entries) || entries[i].Layout == "" {
+		return nil
+	}
+	return &slideLayout{Type: entries[i].Layout, Pair: entries[i].Pair}
+}
+
+// layouts returns the layouts of all photos
+func layouts(names []string, entries []playlistEntry) []*slideLayout {
+	l := make([]*slideLayout, len(names))
+	for i := range names {
+		l[i] = layoutOf(entries, i)
+	}
+	return l
+}
+
+// setLayout changes the layout of the photo in the playlist. The second photo
+// of a two-up layout must be one of the show.
+func setLayout(name, layout, pair string) error {
+	show.loading.Lock()
+	defer show.loading.Unlock()
+	snap := show.snapshot()
+
+	exists := make(map[string]bool, len(snap.photos))
+	for _, p := range snap.photos {
+		exists[p] = true
+	}
+	if !exists[name] {
+		return errors.New("unknown photo: " + name)
+	}
+
+	entries := make([]playlistEntry, len(snap.photos))
+	for i, p := range snap.photos {
+		e := playlistEntry{Photo: p}
+		if i < len(snap.entries) {
+			e = snap.entries[i]
+		}
+		if p == name {
+			e.Layout, e.Pair = layout, pair
+			if err := checkLayout(e, exists); err != nil {
+				return err
+			}
+		}
+		entries[i] = e
+	}
+
+	show.swap(snap.album, snap.photos, entries, snap.photo())
+	listChanged()
+	return savePlaylist(snap.album, entries)
+}
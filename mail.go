@@ -0,0 +1,186 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mailTimeout limits the delivery of an email to the SMTP server
+const mailTimeout = time.Minute
+
+// mailImage is an image embedded in an email, referenced as cid:<id> by its
+// HTML part
+type mailImage struct {
+	id, ctype string
+	data      []byte
+}
+
+// composeMail returns the email from mailFrom with the text and, if not empty,
+// the HTML part with the images
+func composeMail(to *mail.Address, subject, text, htmlBody string, images []mailImage) ([]byte, error) {
+	from, err := mail.ParseAddress(mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	return buildMail(from, to, subject, text, htmlBody, images)
+}
+
+// buildMail returns the email with the text and, if not empty, the HTML part
+// with the images
+func buildMail(from, to *mail.Address, subject, text, htmlBody string, images []mailImage) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMessage-ID: <%s@%s>\r\nMIME-Version: 1.0\r\n",
+		from, to, mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z),
+		strconv.FormatInt(time.Now().UnixNano(), 36), domainOf(from.Address))
+
+	if htmlBody == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuoted(&buf, text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	// multipart/related with the alternatives and the images
+	related := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/related; boundary=%s\r\n\r\n", related.Boundary())
+
+	var alt bytes.Buffer
+	alternative := multipart.NewWriter(&alt)
+	for _, part := range []struct{ ctype, body string }{{"text/plain", text}, {"text/html", htmlBody}} {
+		w, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.ctype + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuoted(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := alternative.Close(); err != nil {
+		return nil, err
+	}
+	w, err := related.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.Write(alt.Bytes())
+
+	for _, img := range images {
+		w, err := related.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {img.ctype},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<" + img.id + ">"},
+			"Content-Disposition":       {"inline"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		data := base64.StdEncoding.EncodeToString(img.data)
+		for len(data) > 76 {
+			w.Write([]byte(data[:76] + "\r\n"))
+			data = data[76:]
+		}
+		w.Write([]byte(data + "\r\n"))
+	}
+	if err = related.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeQuoted writes s quoted-printable encoded
+func writeQuoted(w io.Writer, s string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// domainOf returns the domain of the email address
+func domainOf(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[i+1:]
+	}
+	return "localhost"
+}
+
+// sendMail delivers the email to the recipient via smtpAddr. The connection
+// is upgraded with STARTTLS if the server offers it; smtp.PlainAuth refuses
+// to send the credentials without TLS, except to localhost.
+func sendMail(to string, msg []byte) error {
+	if smtpAddr == "" {
+		return errors.New("smtpAddr not set")
+	}
+	from, err := mail.ParseAddress(mailFrom)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(smtpAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", smtpAddr, mailTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if smtpUser != "" {
+		if err = c.Auth(smtp.PlainAuth("", smtpUser, smtpPassword, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,119 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+var (
+	testFrom = &mail.Address{Name: "Photo Show", Address: "show@example.com"}
+	testTo   = &mail.Address{Address: "ops@example.com"}
+)
+
+// readBody returns the decoded body of the part with the given headers, with
+// the line breaks of the mail back to \n
+func readBody(t *testing.T, header map[string][]string, body io.Reader) (ctype, text string) {
+	t.Helper()
+	ctype, _, err := mime.ParseMediaType(mail.Header(header).Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc := mail.Header(header).Get("Content-Transfer-Encoding"); enc != "quoted-printable" {
+		t.Fatalf("Content-Transfer-Encoding of %s = %q, want quoted-printable", ctype, enc)
+	}
+	data, err := io.ReadAll(quotedprintable.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctype, strings.ReplaceAll(string(data), "\r\n", "\n")
+}
+
+func TestComposeTextMail(t *testing.T) {
+	// like the notices of the operator
+	text := "There were 5 or more failed logins of masters within 10 minutes, the last one from 192.0.2.1. Grüße\n\nhttp://192.168.0.2:8080/\n"
+	msg, err := buildMail(testFrom, testTo, "[Remote Photo Show] Repeated failed logins", text, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || subject != "[Remote Photo Show] Repeated failed logins" {
+		t.Errorf("Subject = %q, %v", subject, err)
+	}
+	ctype, body := readBody(t, m.Header, m.Body)
+	if ctype != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", ctype)
+	}
+	if body != text {
+		t.Errorf("body = %q, want %q", body, text)
+	}
+}
+
+func TestComposeHTMLMail(t *testing.T) {
+	text := "You are invited to the photo show.\n"
+	html := `<p>You are invited to the <b>photo show</b>.</p><img src="cid:cover">`
+	images := []mailImage{{id: "cover", ctype: "image/png", data: []byte("\x89PNG\r\n\x1a\n")}}
+	msg, err := buildMail(testFrom, testTo, "Invitation", text, html, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctype, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || ctype != "multipart/related" {
+		t.Fatalf("Content-Type = %q, %v", ctype, err)
+	}
+	related := multipart.NewReader(m.Body, params["boundary"])
+
+	part, err := related.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctype, params, err = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if err != nil || ctype != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, %v", ctype, err)
+	}
+	alternative := multipart.NewReader(part, params["boundary"])
+	for _, want := range []struct{ ctype, body string }{{"text/plain", text}, {"text/html", html}} {
+		// NextPart would decode the quoted-printable itself
+		p, err := alternative.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctype, body := readBody(t, p.Header, p)
+		if ctype != want.ctype || body != want.body {
+			t.Errorf("%s part = %q, want %s part %q", ctype, body, want.ctype, want.body)
+		}
+	}
+	if _, err = alternative.NextRawPart(); err != io.EOF {
+		t.Errorf("more than 2 alternatives: %v", err)
+	}
+
+	part, err = related.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := part.Header.Get("Content-ID"); id != "<cover>" {
+		t.Errorf("Content-ID = %q, want <cover>", id)
+	}
+	if _, err = related.NextPart(); err != io.EOF {
+		t.Errorf("more than 2 related parts: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// albumChanges are the photos of an album added, changed or removed since
+// the last scan
+type albumChanges struct {
+	Album   string   `json:"album"`
+	Added   []string `json:"added,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Error   string   `json:"error,omitempty"` // the photos could not be listed
+}
+
+// maintenanceReport is the result of a maintenance run
+type maintenanceReport struct {
+	Status   string         `json:"status"`
+	Started  time.Time      `json:"started"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Albums   []albumChanges `json:"albums"` // with changes only
+}
+
+var (
+	maintenanceMu   sync.Mutex
+	lastMaintenance *maintenanceReport // of the last or running maintenance
+)
+
+// scanNow scans the photos of the album and waits for it, superseding the
+// scan in the background
+func (s *scanner) scanNow(ctx context.Context, album string, names []string) error {
+	s.mu.Lock()
+	s.gen++
+	gen := s.gen
+	s.mu.Unlock()
+	return s.scan(ctx, gen, album, names)
+}
+
+// albumDiff compares the photos of the album with those the catalog knows
+// the files of
+func albumDiff(ctx context.Context, album string, names []string) albumChanges {
+	c := albumChanges{Album: album}
+	known := meta.album(album)
+	listed := make(map[string]bool, len(names))
+	for _, name := range names {
+		listed[name] = true
+		f := known[name].File
+		if f == nil {
+			c.Added = append(c.Added, name)
+			continue
+		}
+		path, err := source.Path(ctx, album, name)
+		if err != nil {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && (fi.Size() != f.Size || !fi.ModTime().Equal(f.ModTime)) {
+			c.Changed = append(c.Changed, name)
+		}
+	}
+	for name, m := range known {
+		if m.File != nil && !listed[name] {
+			c.Removed = append(c.Removed, name)
+		}
+	}
+	sort.Strings(c.Added)
+	sort.Strings(c.Changed)
+	sort.Strings(c.Removed)
+	return c
+}
+
+// maintainAlbum scans the photos of the album again, regenerates the
+// thumbnails of the new and changed ones, and forgets the files and deletes
+// the thumbnails of the removed ones
+func maintainAlbum(ctx context.Context, album string) albumChanges {
+	names, err := source.Photos(ctx, album)
+	if err != nil {
+		return albumChanges{Album: album, Error: err.Error()}
+	}
+	names = withoutSlides(names)
+	c := albumDiff(ctx, album, names)
+
+	if len(c.Removed) > 0 {
+		if err = meta.updatePhotos(album, c.Removed, func(_ string, m *photoMeta) { m.File = nil }); err != nil {
+			log.Println("maintenance:", err)
+		}
+		for _, name := range c.Removed {
+			os.Remove(filepath.Join(cacheDir, "thumbs", album, name+".jpg"))
+		}
+	}
+	if album == show.currentAlbum() {
+		rescan() // scans the current album in the background
+	} else if err = scan.scanNow(ctx, album, names); err != nil {
+		log.Println("maintenance:", err)
+	}
+	for _, list := range [][]string{c.Added, c.Changed} {
+		for _, name := range list {
+			if ctx.Err() != nil {
+				return c
+			}
+			if _, err := thumbPath(ctx, album, name); err != nil {
+				log.Printf("maintenance: thumbnail of %s/%s: %v", album, name, err)
+			}
+		}
+	}
+	return c
+}
+
+// maintain rescans all albums known to the catalog, the current one last, and
+// reports the changes
+func maintain(ctx context.Context, report *maintenanceReport) {
+	log.Println("maintenance: rescanning the albums")
+	current := show.currentAlbum()
+	var albums []string
+	for _, id := range meta.albumIDs() {
+		if id != current {
+			albums = append(albums, id)
+		}
+	}
+	albums = append(albums, current)
+
+	added, removed := 0, 0
+	for _, album := range albums {
+		if ctx.Err() != nil {
+			break
+		}
+		c := maintainAlbum(ctx, album)
+		if c.Error != "" {
+			log.Printf("maintenance: album %q: %s", album, c.Error)
+		}
+		added += len(c.Added)
+		removed += len(c.Removed)
+		if len(c.Added)+len(c.Changed)+len(c.Removed) > 0 || c.Error != "" {
+			maintenanceMu.Lock()
+			report.Albums = append(report.Albums, c)
+			maintenanceMu.Unlock()
+		}
+	}
+
+	maintenanceMu.Lock()
+	now := time.Now()
+	report.Status = jobDone
+	report.Finished = &now
+	maintenanceMu.Unlock()
+	log.Printf("maintenance: %d photos added, %d removed", added, removed)
+}
+
+// startMaintenance starts a maintenance run unless one is running already.
+// It must be called with maintenanceMu held.
+func startMaintenance(ctx context.Context) bool {
+	if lastMaintenance != nil && lastMaintenance.Status == jobRunning {
+		return false
+	}
+	lastMaintenance = &maintenanceReport{Status: jobRunning, Started: time.Now(), Albums: make([]albumChanges, 0)}
+	go maintain(ctx, lastMaintenance)
+	return true
+}
+
+// runMaintenance starts the maintenance at the times of maintenanceCron,
+// until the context is done
+func runMaintenance(ctx context.Context) {
+	if maintenanceCron == "" {
+		return
+	}
+	spec, err := parseCron(maintenanceCron)
+	if err != nil {
+		log.Println("maintenance:", err)
+		return
+	}
+	for {
+		next := spec.next(time.Now())
+		if next.IsZero() || !sleep(ctx, time.Until(next)) {
+			return
+		}
+		maintenanceMu.Lock()
+		if !startMaintenance(ctx) {
+			log.Println("maintenance: skipped, the last run is not done yet")
+		}
+		maintenanceMu.Unlock()
+	}
+}
+
+// writeMaintenance writes the maintenance report as JSON.
+// It must be called with maintenanceMu held.
+func writeMaintenance(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(lastMaintenance)
+}
+
+// MaintenanceStart starts the maintenance right away
+func MaintenanceStart(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+
+	if !startMaintenance(rootCtx) {
+		http.Error(w, "maintenance is running already", http.StatusConflict)
+		return
+	}
+	writeMaintenance(w, http.StatusAccepted)
+}
+
+// MaintenanceStatus returns the report of the last maintenance
+func MaintenanceStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+
+	if lastMaintenance == nil {
+		http.Error(w, "no maintenance run yet", http.StatusNotFound)
+		return
+	}
+	writeMaintenance(w, http.StatusOK)
+}
@@ -0,0 +1,226 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxSlideSize limits the size of the Markdown files shown as slides
+const maxSlideSize = 1 << 20
+
+// textPrefix starts the names of the text slides defined in playlists
+const textPrefix = "_text-"
+
+// isTextSlide reports whether the photo list entry is a Markdown slide
+func isTextSlide(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".md")
+}
+
+// inlineSlides holds the Markdown of the text slides defined in playlists
+var inlineSlides = struct {
+	sync.Mutex
+	byName map[string]string
+}{byName: make(map[string]string)}
+
+// addTextSlide registers the Markdown of the playlist entry e and returns the
+// entry with the name of the slide
+func addTextSlide(e playlistEntry) playlistEntry {
+	h := sha256.Sum256([]byte(e.Markdown))
+	e.Photo = textPrefix + hex.EncodeToString(h[:6]) + ".md"
+	inlineSlides.Lock()
+	inlineSlides.byName[e.Photo] = e.Markdown
+	inlineSlides.Unlock()
+	return e
+}
+
+// textSlide returns the Markdown of the slide of the current album
+func textSlide(r *http.Request, name string) (string, error) {
+	inlineSlides.Lock()
+	text, ok := inlineSlides.byName[name]
+	inlineSlides.Unlock()
+	if ok {
+		return text, nil
+	}
+
+	path, err := source.Path(r.Context(), show.currentAlbum(), name)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxSlideSize))
+	return string(data), err
+}
+
+// TextSlide renders a Markdown slide as page in the theme's style. The show
+// displays it in place of a photo.
+func TextSlide(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if hotlinked(r) {
+		statusPage(w, r, http.StatusForbidden)
+		return
+	}
+	name := ps.ByName("name")
+	if !isTextSlide(name) || meta.get(show.currentAlbum(), name).Hidden {
+		http.NotFound(w, r)
+		return
+	}
+	text, err := textSlide(r, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := newPageData(r)
+	data.Slide = renderMarkdown(text)
+	writePage(w, "textslide.html", data)
+}
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdRule    = regexp.MustCompile(`^(\*\s*){3,}$|^(-\s*){3,}$|^(_\s*){3,}$`)
+	mdBullet  = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+	mdNumber  = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+	mdLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdStrong  = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	mdEm      = regexp.MustCompile(`\*([^*]+)\*`)
+)
+
+// renderMarkdown converts the subset of Markdown suitable for slides to HTML:
+// headings, paragraphs, lists, quotes, rules, emphasis, code spans and links.
+// HTML in the source is escaped.
+func renderMarkdown(src string) template.HTML {
+	var b strings.Builder
+	var para []string
+	list := "" // "ul" or "ol" while in a list
+	quote := false
+
+	flush := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + strings.Join(para, "\n") + "</p>\n")
+			para = nil
+		}
+	}
+	closeBlocks := func() {
+		flush()
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+		if quote {
+			b.WriteString("</blockquote>\n")
+			quote = false
+		}
+	}
+
+	for _, line := range strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n") {
+		trimmed := strings.TrimSpace(line)
+		isQuote := strings.HasPrefix(trimmed, ">")
+		if isQuote {
+			trimmed = strings.TrimSpace(trimmed[1:])
+		}
+		if isQuote != quote && trimmed != "" {
+			closeBlocks()
+			if isQuote {
+				b.WriteString("<blockquote>\n")
+				quote = true
+			}
+		}
+
+		switch m := mdHeading.FindStringSubmatch(trimmed); {
+		case trimmed == "":
+			closeBlocks()
+		case m != nil:
+			closeBlocks()
+			n := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + n + ">" + renderInline(m[2]) + "</h" + n + ">\n")
+		case mdRule.MatchString(trimmed):
+			closeBlocks()
+			b.WriteString("<hr>\n")
+		case mdBullet.MatchString(trimmed), mdNumber.MatchString(trimmed):
+			flush()
+			kind, item := "ul", mdBullet.FindStringSubmatch(trimmed)
+			if item == nil {
+				kind, item = "ol", mdNumber.FindStringSubmatch(trimmed)
+			}
+			if list != kind {
+				if list != "" {
+					b.WriteString("</" + list + ">\n")
+				}
+				b.WriteString("<" + kind + ">\n")
+				list = kind
+			}
+			b.WriteString("<li>" + renderInline(item[1]) + "</li>\n")
+		default:
+			if list != "" {
+				b.WriteString("</" + list + ">\n")
+				list = ""
+			}
+			text := renderInline(trimmed)
+			if strings.HasSuffix(line, "  ") {
+				text += "<br>" // hard line break
+			}
+			para = append(para, text)
+		}
+	}
+	closeBlocks()
+	return template.HTML(b.String())
+}
+
+// renderInline converts the emphasis, code spans and links of a line
+func renderInline(s string) string {
+	// code spans are the odd parts between backticks and kept as they are
+	parts := strings.Split(s, "`")
+	if len(parts)%2 == 0 { // unmatched backtick
+		parts[len(parts)-2] += "`" + parts[len(parts)-1]
+		parts = parts[:len(parts)-1]
+	}
+	for i, part := range parts {
+		part = html.EscapeString(part)
+		if i%2 == 1 {
+			parts[i] = "<code>" + part + "</code>"
+			continue
+		}
+		part = mdLink.ReplaceAllStringFunc(part, func(link string) string {
+			m := mdLink.FindStringSubmatch(link)
+			if !safeURL(html.UnescapeString(m[2])) {
+				return m[1]
+			}
+			return `<a href="` + m[2] + `">` + m[1] + `</a>`
+		})
+		part = mdStrong.ReplaceAllString(part, "<strong>$1$2</strong>")
+		parts[i] = mdEm.ReplaceAllString(part, "<em>$1</em>")
+	}
+	return strings.Join(parts, "")
+}
+
+// safeURL reports whether the link target is a web or mail address or a
+// relative URL, and not e.g. a javascript: URL
+func safeURL(u string) bool {
+	scheme, _, found := strings.Cut(u, ":")
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		return true
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// masterAccount is the credentials of a master. The changes of a master lock
+// out those of masters with lower priority for masterLock.
+type masterAccount struct {
+	Username string
+	Password string
+	Priority int
+}
+
+// masterKey is the context key of the master account of a request
+type masterKey struct{}
+
+// withMaster returns the request with the master account in its context
+func withMaster(r *http.Request, m masterAccount) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), masterKey{}, m))
+}
+
+// requestMaster returns the master account of an authenticated request
+func requestMaster(r *http.Request) (masterAccount, bool) {
+	m, ok := r.Context().Value(masterKey{}).(masterAccount)
+	return m, ok
+}
+
+// commandLock is held by the master with the highest priority who changed the
+// show last, until it times out
+var commandLock struct {
+	sync.Mutex
+	holder   string
+	priority int
+	until    time.Time
+}
+
+// lockState is the response of MasterLock
+type lockState struct {
+	Holder   string     `json:"holder,omitempty"`
+	Priority int        `json:"priority"`
+	Until    *time.Time `json:"until,omitempty"` // nil if not locked
+}
+
+// acquireLock takes the lock for the master, unless a master with higher
+// priority holds it. It returns how long it is still held otherwise.
+func acquireLock(m masterAccount) (bool, time.Duration) {
+	commandLock.Lock()
+	defer commandLock.Unlock()
+	now := time.Now()
+	if now.Before(commandLock.until) && m.Priority < commandLock.priority {
+		return false, commandLock.until.Sub(now)
+	}
+	commandLock.holder, commandLock.priority, commandLock.until = m.Username, m.Priority, now.Add(masterLock)
+	return true, 0
+}
+
+// lockCommands rejects the changes of masters with lower priority than the
+// one holding the lock with 423 Locked. Only requests reading the state are
+// always allowed.
+func lockCommands(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || len(masters) == 0 {
+		return true
+	}
+	m, ok := requestMaster(r)
+	if !ok {
+		return true
+	}
+	if ok, left := acquireLock(m); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+		http.Error(w, "locked by a master with higher priority", http.StatusLocked)
+		return false
+	}
+	return true
+}
+
+// MasterLock serves which master holds the lock
+func MasterLock(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	commandLock.Lock()
+	s := lockState{Holder: commandLock.holder, Priority: commandLock.priority}
+	if until := commandLock.until; time.Now().Before(until) {
+		s.Until = &until
+	} else {
+		s = lockState{}
+	}
+	commandLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(s)
+}
+
+// ReleaseLock releases the lock early, e.g. when the master with the higher
+// priority hands back control. Masters with lower priority are rejected
+// before by lockCommands.
+func ReleaseLock(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	commandLock.Lock()
+	commandLock.holder, commandLock.priority, commandLock.until = "", 0, time.Time{}
+	commandLock.Unlock()
+}
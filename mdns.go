@@ -0,0 +1,201 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS record types used by service discovery
+const (
+	dnsTypeA   uint16 = 1
+	dnsTypePTR uint16 = 12
+	dnsTypeTXT uint16 = 16
+	dnsTypeSRV uint16 = 33
+)
+
+// mdnsService is a service instance found via DNS-SD over multicast DNS
+type mdnsService struct {
+	Instance string
+	Host     string
+	IP       net.IP
+	Port     uint16
+	TXT      map[string]string
+}
+
+// Addr returns the host:port address of the service
+func (s *mdnsService) Addr() string {
+	return net.JoinHostPort(s.IP.String(), strconv.Itoa(int(s.Port)))
+}
+
+// dnsName appends the encoded domain name to b
+func dnsName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readDNSName decodes the (possibly compressed) domain name at off.
+// It returns the name and the offset after it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("dns: name out of bounds")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xC0 == 0xC0: // compression pointer
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errors.New("dns: invalid pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("dns: label out of bounds")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// mdnsBrowse queries the local network for instances of the given service,
+// e.g. "_googlecast._tcp.local", and collects the answers until the timeout.
+func mdnsBrowse(service string, timeout time.Duration) ([]*mdnsService, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Queries from a port other than 5353 are answered by unicast
+	query := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(query[4:], 1) // one question
+	query = dnsName(query, service)
+	query = binary.BigEndian.AppendUint16(query, dnsTypePTR)
+	query = binary.BigEndian.AppendUint16(query, 1) // class IN
+
+	group := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	if _, err = conn.WriteToUDP(query, group); err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]*mdnsService)
+	hosts := make(map[string]net.IP)
+	get := func(instance string) *mdnsService {
+		s, ok := services[instance]
+		if !ok {
+			s = &mdnsService{Instance: instance, TXT: make(map[string]string)}
+			services[instance] = s
+		}
+		return s
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // timeout
+		}
+		parseMDNSResponse(buf[:n], service, get, hosts)
+	}
+
+	var result []*mdnsService
+	for _, s := range services {
+		if s.IP == nil {
+			s.IP = hosts[s.Host]
+		}
+		if s.IP != nil && s.Port != 0 {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// parseMDNSResponse extracts service records from a DNS response message
+func parseMDNSResponse(msg []byte, service string, get func(string) *mdnsService, hosts map[string]net.IP) {
+	if len(msg) < 12 {
+		return
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rr := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return
+		}
+		off = next + 4
+	}
+
+	for i := 0; i < rr; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		data := next + 10
+		if data+length > len(msg) {
+			return
+		}
+		rdata := msg[data : data+length]
+		off = data + length
+
+		switch typ {
+		case dnsTypePTR:
+			if strings.EqualFold(name, service) {
+				if instance, _, err := readDNSName(msg, data); err == nil {
+					get(instance)
+				}
+			}
+		case dnsTypeSRV:
+			if length >= 7 && strings.HasSuffix(name, service) {
+				s := get(name)
+				s.Port = binary.BigEndian.Uint16(rdata[4:])
+				s.Host, _, _ = readDNSName(msg, data+6)
+			}
+		case dnsTypeTXT:
+			if strings.HasSuffix(name, service) {
+				s := get(name)
+				for j := 0; j < len(rdata); {
+					n := int(rdata[j])
+					if j+1+n > len(rdata) {
+						break
+					}
+					if k, v, ok := strings.Cut(string(rdata[j+1:j+1+n]), "="); ok {
+						s.TXT[k] = v
+					}
+					j += 1 + n
+				}
+			}
+		case dnsTypeA:
+			if length == 4 {
+				hosts[name] = net.IP(append([]byte(nil), rdata...))
+			}
+		}
+	}
+}
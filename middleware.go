@@ -0,0 +1,278 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Middleware wraps the handler of all requests
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h in the middleware, the first one being the outermost
+func chain(h http.Handler, mws []Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// newMiddleware returns the middleware named in the config. The master pages
+// are always protected, auth is added last if it is not listed. The IP
+// addresses blocked by the master are always rejected, as are viewers of
+// albums they may not view.
+func newMiddleware(names []string, user, pass []byte) ([]Middleware, error) {
+	var mws []Middleware
+	auth := false
+	for _, name := range names {
+		switch name {
+		case "recovery":
+			mws = append(mws, recovery)
+		case "logging":
+			mws = append(mws, logging)
+		case "metrics":
+			mws = append(mws, metrics.record)
+		case "ratelimit":
+			mws = append(mws, rateLimit(requestRate, time.Minute))
+		case "auth":
+			mws = append(mws, basicAuth(user, pass))
+			auth = true
+		default:
+			return nil, errors.New("unknown middleware: " + name)
+		}
+	}
+	if !auth {
+		mws = append(mws, basicAuth(user, pass))
+	}
+	return append(mws, blockKicked, albumGate(masterAccounts(user, pass))), nil
+}
+
+// statusWriter records the status code and size of a response. It passes
+// through flushing for the event streams.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// code returns the status code sent, 200 if the handler wrote nothing
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// recovery responds with an internal server error if the handler panics,
+// instead of dropping the connection
+func recovery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("panic serving %s: %v\n%s", r.URL.Path, err, debug.Stack())
+			if sw.status == 0 {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(sw, r)
+	})
+}
+
+// logging logs each request when it is done
+func logging(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		log.Printf("%s %s %s %d %d %s", clientIP(r), r.Method, r.URL.Path, sw.code(), sw.size, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// rateLimit limits the requests to n per IP address and period
+func rateLimit(n int, per time.Duration) Middleware {
+	limiter := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, wait := limiter.allow(clientIP(r), n, per); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+				statusPage(w, r, http.StatusTooManyRequests)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isMaster reports whether the path belongs to the master pages, the commands
+// of the API or the gRPC service
+func isMaster(path string) bool {
+	return path == "/master" || strings.HasPrefix(path, "/master/") || isAPIMaster(path) ||
+		strings.HasPrefix(path, grpcService)
+}
+
+// basicAuth requires Basic HTTP Authentication for the master pages, with the
+// credentials of the main master or one of masters. The changes of masters
+// with lower priority are rejected while one with higher priority holds the
+// lock, see lockCommands. Their changes are recorded in the audit log.
+func basicAuth(user, pass []byte) Middleware {
+	accounts := masterAccounts(user, pass)
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isMaster(r.URL.Path) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if m, ok := masterCredentials(r, accounts); ok {
+				// Delegate request to the given handler
+				audited(w, withMaster(r, m), func(w http.ResponseWriter, r *http.Request) {
+					if lockCommands(w, r) {
+						h.ServeHTTP(w, r)
+					}
+				})
+				return
+			}
+
+			// Request Basic Authentication otherwise
+			if r.Header.Get("Authorization") != "" {
+				authFailed(clientIP(r))
+			}
+			w.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		})
+	}
+}
+
+// masterAccounts returns the accounts of the main master and the further
+// masters
+func masterAccounts(user, pass []byte) []masterAccount {
+	return append([]masterAccount{{string(user), string(pass), masterPriority}}, masters...)
+}
+
+// masterCredentials returns the account whose Basic Authentication
+// credentials the request carries, if any
+func masterCredentials(r *http.Request, accounts []masterAccount) (masterAccount, bool) {
+	const basicAuthPrefix string = "Basic "
+
+	// Get the Basic Authentication credentials
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, basicAuthPrefix) {
+		return masterAccount{}, false
+	}
+	// Check credentials
+	payload, err := base64.StdEncoding.DecodeString(auth[len(basicAuthPrefix):])
+	if err != nil {
+		return masterAccount{}, false
+	}
+	pair := bytes.SplitN(payload, []byte(":"), 2)
+	for _, m := range accounts {
+		if len(pair) == 2 && bytes.Equal(pair[0], []byte(m.Username)) && bytes.Equal(pair[1], []byte(m.Password)) {
+			return m, true
+		}
+	}
+	return masterAccount{}, false
+}
+
+// requestMetrics counts the requests by status code
+type requestMetrics struct {
+	sync.Mutex
+	requests map[int]uint64
+	seconds  float64 // total time spent serving them, without event streams
+}
+
+var metrics = requestMetrics{requests: make(map[int]uint64)}
+
+// record is the middleware collecting the metrics
+func (m *requestMetrics) record(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+
+		m.Lock()
+		m.requests[sw.code()]++
+		if r.URL.Path != "/listen" && r.URL.Path != "/poll" {
+			m.seconds += time.Since(start).Seconds()
+		}
+		m.Unlock()
+	})
+}
+
+// Metrics serves the request metrics in the Prometheus text format
+func Metrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	metrics.Lock()
+	codes := make([]int, 0, len(metrics.requests))
+	for code := range metrics.requests {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	var b bytes.Buffer
+	b.WriteString("# TYPE photoshow_requests_total counter\n")
+	for _, code := range codes {
+		fmt.Fprintf(&b, "photoshow_requests_total{code=\"%d\"} %d\n", code, metrics.requests[code])
+	}
+	b.WriteString("# TYPE photoshow_request_seconds_total counter\n")
+	fmt.Fprintf(&b, "photoshow_request_seconds_total %g\n", metrics.seconds)
+	metrics.Unlock()
+
+	b.WriteString("# TYPE photoshow_viewers gauge\n")
+	fmt.Fprintf(&b, "photoshow_viewers %d\n", stats.connected(0))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// colorMode is a color scheme the master can switch all viewers to
+type colorMode struct {
+	Name       string `json:"name"`
+	Background string `json:"background"`
+	Text       string `json:"text"`
+}
+
+// savedShow is the part of the show state kept across restarts
+type savedShow struct {
+	Mode       string           `json:"mode,omitempty"`
+	Wall       *videoWall       `json:"wall,omitempty"`
+	Transition *slideTransition `json:"transition,omitempty"`
+	Cues       *cueQueue        `json:"cues,omitempty"`
+	Recurring  []recurringShow  `json:"recurring,omitempty"` // added by the API
+}
+
+var (
+	modeMu sync.Mutex // guards the saved show state
+	mode   string     // name of the current color mode, "" for the theme colors
+)
+
+// findMode returns the configured color mode with the name
+func findMode(name string) (colorMode, bool) {
+	for _, m := range colorModes {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return colorMode{}, false
+}
+
+// currentMode returns the current color mode, the theme colors if none is
+// selected
+func currentMode() colorMode {
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	if m, ok := findMode(mode); ok {
+		return m
+	}
+	return colorMode{Background: backgroundColor, Text: textColor}
+}
+
+// modeNames returns the names of the configured color modes
+func modeNames() []string {
+	names := make([]string, 0, len(colorModes))
+	for _, m := range colorModes {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// setMode switches all viewers to the color mode, an empty name restores the
+// theme colors
+func setMode(name string) error {
+	if _, ok := findMode(name); !ok && name != "" {
+		return errors.New("unknown mode: " + name)
+	}
+	modeMu.Lock()
+	mode = name
+	err := saveShow()
+	modeMu.Unlock()
+
+	streamer.SendJSON("", "mode", currentMode())
+	return err
+}
+
+// loadShow restores the saved show state. A missing file means there is none.
+func loadShow() error {
+	data, err := os.ReadFile(showStatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved savedShow
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	if _, ok := findMode(saved.Mode); ok {
+		mode = saved.Mode
+	}
+	wall = saved.Wall
+	showTransition = saved.Transition
+	if saved.Cues != nil {
+		cues = *saved.Cues
+	}
+	savedRecurring = saved.Recurring
+	return nil
+}
+
+// saveShow writes the show state.
+// It must be called with modeMu held.
+func saveShow() error {
+	s := savedShow{Mode: mode, Wall: wall, Transition: showTransition, Recurring: savedRecurring}
+	if len(cues.Cues) > 0 {
+		s.Cues = &cues
+	}
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(showStatePath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(showStatePath+".tmp", showStatePath)
+}
@@ -0,0 +1,415 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect    byte = 0x10
+	mqttConnAck    byte = 0x20
+	mqttPublish    byte = 0x30
+	mqttSubscribe  byte = 0x82 // including the required flags
+	mqttSubAck     byte = 0x90
+	mqttPingReq    byte = 0xC0
+	mqttPingResp   byte = 0xD0
+	mqttDisconnect byte = 0xE0
+)
+
+const (
+	mqttKeepAlive    = 60 * time.Second
+	mqttMaxBackoff   = time.Minute
+	mqttMaxPacketLen = 1 << 20
+)
+
+// mqttClient is a minimal MQTT 3.1.1 client supporting QoS 0 only.
+// It reconnects automatically; onConnect is called after each (re)connect.
+type mqttClient struct {
+	broker   string // tcp://host:port or ssl://host:port
+	clientID string
+	username string
+	password string
+
+	willTopic   string // retained "offline" message on connection loss
+	willPayload string
+
+	onConnect func(c *mqttClient)
+	onMessage func(topic string, payload []byte)
+
+	mu     sync.Mutex
+	conn   net.Conn
+	nextID uint16
+	closed bool // by Close, no more reconnects
+}
+
+// mqttString encodes a string with its 2 byte length prefix
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket builds a control packet with fixed header and remaining length
+func mqttPacket(header byte, body []byte) []byte {
+	p := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		p = append(p, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+// readMQTTPacket reads a single control packet
+func readMQTTPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	if header, err = r.ReadByte(); err != nil {
+		return
+	}
+
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(digit&0x7F) * mult
+		if digit&0x80 == 0 {
+			break
+		}
+		if mult *= 128; i == 3 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+	}
+	if n > mqttMaxPacketLen {
+		return 0, nil, errors.New("mqtt: packet too large")
+	}
+
+	body = make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// write sends a packet on the current connection
+func (c *mqttClient) write(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return errors.New("mqtt: not connected")
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(p)
+	return err
+}
+
+// Publish sends a message with QoS 0
+func (c *mqttClient) Publish(topic string, payload []byte, retain bool) error {
+	header := mqttPublish
+	if retain {
+		header |= 0x01
+	}
+	return c.write(mqttPacket(header, append(mqttString(nil, topic), payload...)))
+}
+
+// Subscribe subscribes to the topic filter with QoS 0
+func (c *mqttClient) Subscribe(filter string) error {
+	c.mu.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	c.mu.Unlock()
+
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = append(mqttString(body, filter), 0) // requested QoS
+	return c.write(mqttPacket(mqttSubscribe, body))
+}
+
+// dial opens the network connection to the broker
+func (c *mqttClient) dial() (net.Conn, error) {
+	u, err := url.Parse(c.broker)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return d.Dial("tcp", u.Host)
+	case "ssl", "tls", "mqtts":
+		return tls.DialWithDialer(d, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, errors.New("mqtt: unsupported scheme " + u.Scheme)
+	}
+}
+
+// connect establishes and authenticates a new session
+func (c *mqttClient) connect() (*bufio.Reader, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0x02) // clean session
+	if c.willTopic != "" {
+		flags |= 0x04 | 0x20 // will flag, will retain
+	}
+	if c.username != "" {
+		flags |= 0x80
+		if c.password != "" {
+			flags |= 0x40
+		}
+	}
+
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4, flags) // protocol level 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = mqttString(body, c.clientID)
+	if c.willTopic != "" {
+		body = mqttString(body, c.willTopic)
+		body = mqttString(body, c.willPayload)
+	}
+	if c.username != "" {
+		body = mqttString(body, c.username)
+		if c.password != "" {
+			body = mqttString(body, c.password)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = conn.Write(mqttPacket(mqttConnect, body)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	header, ack, err := readMQTTPacket(r)
+	if err == nil && (header != mqttConnAck || len(ack) != 2) {
+		err = errors.New("mqtt: unexpected packet")
+	}
+	if err == nil && ack[1] != 0 {
+		err = errors.New("mqtt: connection refused, code " + strconv.Itoa(int(ack[1])))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return nil, errors.New("mqtt: client closed")
+	}
+	c.conn = conn
+	return r, nil
+}
+
+// run keeps the client connected until the context is done or the client is
+// closed
+func (c *mqttClient) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	backoff := time.Second
+	for {
+		r, err := c.connect()
+		if err != nil {
+			if c.isClosed() {
+				return
+			}
+			log.Println("mqtt:", err)
+			if !sleep(ctx, backoff) {
+				return
+			}
+			if backoff *= 2; backoff > mqttMaxBackoff {
+				backoff = mqttMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+
+		if c.onConnect != nil {
+			c.onConnect(c)
+		}
+		err = c.serve(r)
+
+		c.mu.Lock()
+		c.conn.Close()
+		c.conn = nil
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		log.Println("mqtt: connection lost:", err)
+	}
+}
+
+// isClosed reports whether Close was called
+func (c *mqttClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// serve reads incoming packets and sends keep-alive pings
+func (c *mqttClient) serve(r *bufio.Reader) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(mqttKeepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.write([]byte{mqttPingReq, 0})
+			}
+		}
+	}()
+
+	for {
+		c.mu.Lock()
+		c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		c.mu.Unlock()
+
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+
+		if header&0xF0 == mqttPublish && c.onMessage != nil {
+			if len(body) < 2 || header&0x06 != 0 {
+				continue // malformed or QoS > 0, which was never requested
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			if len(body) < 2+n {
+				continue
+			}
+			c.onMessage(string(body[2:2+n]), body[2+n:])
+		}
+		// SUBACK and PINGRESP need no handling
+	}
+}
+
+// Close disconnects cleanly from the broker and stops reconnecting. The broker
+// drops the will on a clean disconnect, so it is published retained before.
+func (c *mqttClient) Close() {
+	if c.isClosed() {
+		return
+	}
+	if c.willTopic != "" {
+		c.Publish(c.willTopic, []byte(c.willPayload), true)
+	}
+	c.write([]byte{mqttDisconnect, 0})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Close() // ends serve
+	}
+}
+
+var mqtt *mqttClient
+
+// mqttSlide is the retained payload of the slide topic
+type mqttSlide struct {
+	Album string `json:"album"`
+	ID    uint64 `json:"id"`
+	Photo string `json:"photo"`
+	Count int    `json:"count"`
+}
+
+// startMQTT connects to the configured broker, publishes the show state and
+// accepts commands on <topic>/command, until the context is done
+func startMQTT(ctx context.Context) {
+	if mqttBroker == "" {
+		return
+	}
+	if mqttPassword != "" && mqttUser == "" {
+		log.Println("mqtt: mqttPassword requires mqttUser")
+		return
+	}
+
+	mqtt = &mqttClient{
+		broker:      mqttBroker,
+		clientID:    mqttClientID,
+		username:    mqttUser,
+		password:    mqttPassword,
+		willTopic:   mqttTopic + "/status",
+		willPayload: "offline",
+		onConnect: func(c *mqttClient) {
+			haPublishDiscovery(c)
+			c.Publish(mqttTopic+"/status", []byte("online"), true)
+			mqttPublishSlide()
+			mqttPublishViewers(stats.connected(0))
+			mqttPublishAutoplay(player.playing() > 0)
+			if err := c.Subscribe(mqttTopic + "/command"); err != nil {
+				log.Println("mqtt:", err)
+			}
+		},
+		onMessage: func(topic string, payload []byte) {
+			if topic == mqttTopic+"/command" {
+				if err := textCommand(string(payload)); err != nil {
+					log.Println("mqtt command:", err)
+				}
+			}
+		},
+	}
+	go mqtt.run(ctx)
+}
+
+// mqttPublishSlide publishes the current slide as retained message
+func mqttPublishSlide() {
+	if mqtt == nil {
+		return
+	}
+	snap := show.snapshot()
+	payload, _ := json.Marshal(mqttSlide{
+		Album: snap.album,
+		ID:    snap.pos,
+		Photo: snap.photo(),
+		Count: len(snap.photos),
+	})
+	mqtt.Publish(mqttTopic+"/slide", payload, true)
+}
+
+// mqttPublishAutoplay publishes whether the show advances automatically
+func mqttPublishAutoplay(playing bool) {
+	if mqtt == nil {
+		return
+	}
+	state := "pause"
+	if playing {
+		state = "play"
+	}
+	mqtt.Publish(mqttTopic+"/autoplay", []byte(state), true)
+}
@@ -0,0 +1,303 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// musicPlaylist is the optional playlist of musicDir, with the durations of
+// the tracks in #EXTINF lines
+const musicPlaylist = "playlist.m3u"
+
+// maxTrackDuration bounds the durations reported by the clients
+const maxTrackDuration = 3 * time.Hour
+
+// audioTypes are the extensions of the music files
+var audioTypes = map[string]bool{
+	".mp3": true, ".ogg": true, ".oga": true, ".opus": true, ".m4a": true,
+	".aac": true, ".flac": true, ".wav": true, ".webm": true,
+}
+
+// isAudio reports whether the file is an audio file, e.g. a narration
+func isAudio(name string) bool {
+	return audioTypes[strings.ToLower(filepath.Ext(name))]
+}
+
+// musicTrack is a file of the background music
+type musicTrack struct {
+	Name     string  `json:"name"`
+	Title    string  `json:"title,omitempty"`
+	Duration float64 `json:"duration,omitempty"` // seconds, 0 if not known yet
+}
+
+// musicState is broadcast to the clients as "music" event. Playing clients
+// seek to the position the track has at the server time now.
+type musicState struct {
+	Playing  bool         `json:"playing"`
+	Track    int          `json:"track"`             // index in Tracks
+	Started  int64        `json:"started,omitempty"` // server time in ms the track started at, if playing
+	Position int64        `json:"position"`          // ms, when sent
+	Volume   float64      `json:"volume"`            // 0 to 1
+	Viewers  bool         `json:"viewers"`           // whether all viewers play it, see musicOnViewers
+	Tracks   []musicTrack `json:"tracks"`
+}
+
+// music is the state of the background music. Its timer advances to the next
+// track at the end of the current one, if its duration is known.
+var music struct {
+	sync.Mutex
+	tracks  []musicTrack
+	track   int
+	playing bool
+	started time.Time     // if playing
+	offset  time.Duration // if paused
+	volume  float64
+	gen     int // invalidates the timers of replaced tracks
+	alarm   *time.Timer
+}
+
+// loadMusic reads the tracks of musicDir, in the order of its playlist or by
+// name
+func loadMusic() error {
+	tracks, err := readMusicPlaylist(filepath.Join(musicDir, musicPlaylist))
+	if os.IsNotExist(err) {
+		tracks, err = musicFiles(musicDir)
+	}
+	if err != nil {
+		return err
+	}
+	if len(tracks) == 0 {
+		return errors.New("no music in " + musicDir)
+	}
+
+	music.Lock()
+	music.tracks, music.track, music.volume = tracks, 0, musicVolume
+	music.Unlock()
+	return nil
+}
+
+// musicFiles returns the audio files of the directory sorted by name
+func musicFiles(dir string) ([]musicTrack, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var tracks []musicTrack
+	for _, e := range entries {
+		if !e.IsDir() && isAudio(e.Name()) {
+			tracks = append(tracks, musicTrack{Name: e.Name()})
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Name < tracks[j].Name })
+	return tracks, nil
+}
+
+// readMusicPlaylist reads an M3U playlist of music files:
+//
+//	#EXTM3U
+//	#EXTINF:215,Artist - Title
+//	song.mp3
+func readMusicPlaylist(path string) ([]musicTrack, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tracks []musicTrack
+	var next musicTrack
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			duration, title, _ := strings.Cut(line[len("#EXTINF:"):], ",")
+			if d, err := strconv.ParseFloat(strings.TrimSpace(duration), 64); err == nil && d > 0 {
+				next.Duration = d
+			}
+			next.Title = strings.TrimSpace(title)
+		case strings.HasPrefix(line, "#"):
+		default:
+			if !validName(line) {
+				return nil, errors.New("invalid track: " + line)
+			}
+			next.Name = line
+			tracks = append(tracks, next)
+			next = musicTrack{}
+		}
+	}
+	return tracks, s.Err()
+}
+
+// currentMusic returns the state of the background music, nil if disabled
+func currentMusic() *musicState {
+	music.Lock()
+	defer music.Unlock()
+	if len(music.tracks) == 0 {
+		return nil
+	}
+	return musicStatus()
+}
+
+// musicStatus returns the state of the background music.
+// It must be called with music held.
+func musicStatus() *musicState {
+	m := &musicState{
+		Playing:  music.playing,
+		Track:    music.track,
+		Position: musicPosition().Milliseconds(),
+		Volume:   music.volume,
+		Viewers:  musicOnViewers,
+		Tracks:   music.tracks,
+	}
+	if music.playing {
+		m.Started = music.started.UnixMilli()
+	}
+	return m
+}
+
+// musicPosition returns how far the current track has been played.
+// It must be called with music held.
+func musicPosition() time.Duration {
+	if music.playing {
+		return time.Since(music.started)
+	}
+	return music.offset
+}
+
+// musicChanged schedules the end of the current track and notifies the
+// clients. It must be called with music held.
+func musicChanged() {
+	music.gen++
+	if music.alarm != nil {
+		music.alarm.Stop()
+		music.alarm = nil
+	}
+	if d := music.tracks[music.track].Duration; music.playing && d > 0 {
+		gen := music.gen
+		left := time.Duration(d*float64(time.Second)) - musicPosition()
+		music.alarm = time.AfterFunc(left, func() {
+			music.Lock()
+			defer music.Unlock()
+			if gen == music.gen {
+				// the next track starts exactly at the end, not when the timer fired
+				music.track = (music.track + 1) % len(music.tracks)
+				music.started = music.started.Add(time.Duration(d * float64(time.Second)))
+				musicChanged()
+			}
+		})
+	}
+	streamer.SendJSON("", "music", musicStatus())
+}
+
+// musicCommand controls the background music with the action "play",
+// "pause", "next", "prev", "track" (with the index) or "volume" (0 to 1)
+func musicCommand(action, value string) error {
+	music.Lock()
+	defer music.Unlock()
+	if len(music.tracks) == 0 {
+		return errors.New("no music configured")
+	}
+
+	switch action {
+	case "", "play":
+		if music.playing {
+			return nil
+		}
+		music.playing, music.started = true, time.Now().Add(-music.offset)
+	case "pause":
+		if !music.playing {
+			return nil
+		}
+		music.playing, music.offset = false, time.Since(music.started)
+	case "next", "prev":
+		delta := 1
+		if action == "prev" {
+			delta = len(music.tracks) - 1
+		}
+		setTrack((music.track + delta) % len(music.tracks))
+	case "track":
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 || i >= len(music.tracks) {
+			return errors.New("invalid track")
+		}
+		setTrack(i)
+	case "volume":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v < 0 || v > 1 {
+			return errors.New("volume must be between 0 and 1")
+		}
+		music.volume = v
+	default:
+		return errors.New("unknown music action")
+	}
+	musicChanged()
+	return nil
+}
+
+// setTrack starts the track from the beginning.
+// It must be called with music held.
+func setTrack(i int) {
+	music.track, music.started, music.offset = i, time.Now(), 0
+}
+
+// MusicFile serves a track of the background music
+func MusicFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if hotlinked(r) {
+		statusPage(w, r, http.StatusForbidden)
+		return
+	}
+	name := ps.ByName("track")
+	if musicDir == "" || !validName(name) || !isAudio(name) {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(musicDir, name))
+}
+
+// MusicDuration takes the duration of the current track from the first client
+// which loaded it, if the playlist doesn't give it, so that the server can
+// advance to the next track in time
+func MusicDuration(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	track, err := strconv.Atoi(r.PostFormValue("track"))
+	if err != nil {
+		http.Error(w, "invalid track", http.StatusBadRequest)
+		return
+	}
+	secs, err := strconv.ParseFloat(r.PostFormValue("seconds"), 64)
+	if err != nil || secs < 1 || secs > maxTrackDuration.Seconds() {
+		http.Error(w, "invalid seconds", http.StatusBadRequest)
+		return
+	}
+
+	music.Lock()
+	defer music.Unlock()
+	if len(music.tracks) == 0 || track != music.track || r.PostFormValue("name") != music.tracks[track].Name {
+		http.Error(w, "not the current track", http.StatusConflict)
+		return
+	}
+	if music.tracks[track].Duration > 0 {
+		return // reported already
+	}
+
+	// copy the list, it is shared with the states sent before
+	tracks := append([]musicTrack(nil), music.tracks...)
+	tracks[track].Duration = secs
+	music.tracks = tracks
+	musicChanged()
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxNarrationSize limits the size of uploaded narrations
+const maxNarrationSize = 50 << 20
+
+// narrationMuted is set by the master to silence the narrations on all clients
+var narrationMuted atomic.Bool
+
+// narrationState is sent as "narration" event when the master (un)mutes the
+// narrations
+type narrationState struct {
+	Muted   bool `json:"muted"`
+	Viewers bool `json:"viewers"` // whether all viewers play them, see musicOnViewers
+}
+
+// narrationPath returns the path of the audio sidecar file of the photo with
+// its narration, e.g. IMG_0001.jpg.mp3, or "" if it has none. Only photos of
+// the "dir" source can have narrations.
+func narrationPath(album, name string) string {
+	d, ok := baseSource().(dirSource)
+	if !ok {
+		return ""
+	}
+	path, err := d.Path(context.Background(), album, name)
+	if err != nil {
+		return ""
+	}
+	exts := make([]string, 0, len(audioTypes))
+	for ext := range audioTypes {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts) // the same one if there are several
+	for _, ext := range exts {
+		if fi, err := os.Stat(path + ext); err == nil && fi.Mode().IsRegular() {
+			return path + ext
+		}
+	}
+	return ""
+}
+
+// narrationURL returns the URL of the narration of the photo, "" if it has
+// none
+func narrationURL(album, name string) string {
+	if narrationPath(album, name) == "" {
+		return ""
+	}
+	return "/narration/" + name
+}
+
+// setNarrationMuted (un)mutes the narrations on all clients
+func setNarrationMuted(muted bool) {
+	narrationMuted.Store(muted)
+	streamer.SendJSON("", "narration", narrationState{muted, musicOnViewers})
+}
+
+// Narration serves the narration of a photo of the current album
+func Narration(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if hotlinked(r) {
+		statusPage(w, r, http.StatusForbidden)
+		return
+	}
+	name := ps.ByName("photo")
+	album := show.currentAlbum()
+	path := narrationPath(album, name)
+	if path == "" || meta.get(album, name).Hidden {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// NarrationUpload attaches the audio clip in the "audio" form field to the
+// photo as its narration, replacing the existing one
+func NarrationUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if sourceType != "dir" {
+		http.Error(w, "Narrations are only supported for the dir photo source", http.StatusNotImplemented)
+		return
+	}
+	name := ps.ByName("photo")
+	album := show.currentAlbum()
+	photo := filepath.Join(albumDir(album), name)
+	if fi, err := os.Stat(photo); !validName(name) || err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxNarrationSize)
+	file, header, err := r.FormFile("audio")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	if !isAudio(ext) {
+		http.Error(w, "unsupported audio type", http.StatusBadRequest)
+		return
+	}
+
+	// write to a temporary file first, so that clients never get partial clips.
+	// With the extension, it is not listed as photo either.
+	tmp, err := os.CreateTemp(filepath.Dir(photo), ".narration-*"+ext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = io.Copy(tmp, file)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		removeNarration(album, name)
+		err = os.Rename(tmp.Name(), photo+ext)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DeleteNarration removes the narration of a photo
+func DeleteNarration(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("photo")
+	album := show.currentAlbum()
+	if narrationPath(album, name) == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := removeNarration(album, name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// removeNarration deletes all audio sidecar files of the photo
+func removeNarration(album, name string) error {
+	for path := narrationPath(album, name); path != ""; path = narrationPath(album, name) {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
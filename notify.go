@@ -0,0 +1,118 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"sync"
+	"time"
+)
+
+// Notices emailed to the operator, see notifyEvents
+const (
+	noticeShowStart = "show.start" // the server started or a scheduled show went live
+	noticeUploads   = "uploads"    // more than notifyUploads uploads wait for moderation
+	noticeDisk      = "disk"       // less than notifyDiskFree bytes are left
+	noticeAuth      = "auth"       // notifyAuthFailures failed logins of masters in 10 minutes
+)
+
+const (
+	// noticeInterval suppresses repeated notices of the same kind
+	noticeInterval = time.Hour
+
+	// diskCheckInterval is how often the free disk space is checked
+	diskCheckInterval = 10 * time.Minute
+)
+
+// noticesSent holds when each kind of notice was sent last
+var noticesSent = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// authFailures counts the failed logins of masters
+var authFailures = rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// notify emails the notice to notifyEmail, if its kind is in notifyEvents and
+// it was not sent within noticeInterval. It is sent in the background.
+func notify(kind, subject, text string) {
+	if notifyEmail == "" {
+		return
+	}
+	enabled := false
+	for _, e := range notifyEvents {
+		enabled = enabled || e == kind
+	}
+	if !enabled {
+		return
+	}
+
+	noticesSent.Lock()
+	if last, ok := noticesSent.last[kind]; ok && time.Since(last) < noticeInterval {
+		noticesSent.Unlock()
+		return
+	}
+	noticesSent.last[kind] = time.Now()
+	noticesSent.Unlock()
+
+	go func() {
+		to, err := mail.ParseAddress(notifyEmail)
+		if err != nil {
+			log.Println("notify:", err)
+			return
+		}
+		msg, err := composeMail(to, "["+pageTitle+"] "+subject, text+"\n\n"+publicURL+"/\n", "", nil)
+		if err == nil {
+			err = sendMail(to.Address, msg)
+		}
+		if err != nil {
+			log.Printf("notify %s: %v", kind, err)
+		}
+	}()
+}
+
+// authFailed records a failed login of a master, notifying the operator when
+// there are notifyAuthFailures within 10 minutes
+func authFailed(ip string) {
+	if ok, _ := authFailures.allow("", notifyAuthFailures, 10*time.Minute); !ok {
+		notify(noticeAuth, "Repeated failed logins",
+			fmt.Sprintf("There were %d or more failed logins of masters within 10 minutes, the last one from %s.", notifyAuthFailures, ip))
+	}
+}
+
+// uploadsPending notifies the operator when more than notifyUploads uploads
+// wait for moderation
+func uploadsPending(n int) {
+	if notifyUploads > 0 && n > notifyUploads {
+		notify(noticeUploads, "Uploads waiting for moderation",
+			fmt.Sprintf("%d uploads wait for moderation on the master page.", n))
+	}
+}
+
+// watchDisk checks the free space of the directories the server writes to,
+// until the context is done
+func watchDisk(ctx context.Context) {
+	if notifyEmail == "" || notifyDiskFree <= 0 {
+		return
+	}
+	for {
+		for _, dir := range []string{photoDir, cacheDir, uploadDir, stagingDir} {
+			free, err := diskFree(dir)
+			if err != nil {
+				continue // not created yet or not supported
+			}
+			if free < uint64(notifyDiskFree) {
+				notify(noticeDisk, "Disk nearly full",
+					fmt.Sprintf("Only %d MiB are left on the disk of %s.", free>>20, dir))
+			}
+		}
+		if !sleep(ctx, diskCheckInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxTextLength limits the recognized text stored per photo in bytes
+const maxTextLength = 10000
+
+// textRecognizer reads the text in a photo, e.g. on signs, menus or slides
+type textRecognizer interface {
+	// Text returns the text found in the image file at the given path
+	Text(ctx context.Context, path string) (string, error)
+}
+
+// ocr is the text recognizer selected in the config, nil if disabled
+var ocr textRecognizer
+
+// newTextRecognizer returns the text recognizer selected in the config
+func newTextRecognizer() (textRecognizer, error) {
+	switch ocrType {
+	case "":
+		return nil, nil
+	case "command":
+		if ocrCommand == "" {
+			return nil, errors.New("ocrCommand not set")
+		}
+		return commandRecognizer(ocrCommand), nil
+	case "api":
+		if ocrURL == "" {
+			return nil, errors.New("ocrURL not set")
+		}
+		return &apiRecognizer{url: ocrURL, token: ocrToken}, nil
+	default:
+		return nil, errors.New("unknown text recognizer: " + ocrType)
+	}
+}
+
+// commandRecognizer runs a local OCR program like tesseract, which writes the
+// text to stdout
+type commandRecognizer string
+
+func (c commandRecognizer) Text(ctx context.Context, path string) (string, error) {
+	out, err := runCommand(ctx, string(c), path)
+	return string(out), err
+}
+
+// apiRecognizer posts the photo to an HTTP API, which responds with a JSON
+// object like {"text": "Menu of the day"}
+type apiRecognizer struct {
+	url   string
+	token string // sent as bearer token if set
+}
+
+func (c *apiRecognizer) Text(ctx context.Context, path string) (string, error) {
+	var res struct {
+		Text string `json:"text"`
+	}
+	err := postImage(ctx, c.url, c.token, path, &res)
+	return res.Text, err
+}
+
+// textInfo holds the text recognized in the file version with the given
+// modification time
+type textInfo struct {
+	ModTime time.Time `json:"modified"`
+	Text    string    `json:"text,omitempty"`
+}
+
+// recognizeText runs the OCR on a photo, unless that was done for the
+// current version of the file already. It reports whether the text changed.
+func recognizeText(ctx context.Context, album, name string) (bool, error) {
+	if ocr == nil {
+		return false, nil
+	}
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	old := meta.get(album, name).Text
+	if old != nil && old.ModTime.Equal(fi.ModTime()) {
+		return false, nil
+	}
+
+	text, err := ocr.Text(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	text = truncateBytes(strings.Join(strings.Fields(text), " "), maxTextLength)
+
+	err = meta.update(album, name, func(m *photoMeta) {
+		m.Text = &textInfo{ModTime: fi.ModTime(), Text: text}
+	})
+	return err == nil && (old == nil || old.Text != text), err
+}
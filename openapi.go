@@ -0,0 +1,173 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// jsonObject is a JSON object of the OpenAPI document
+type jsonObject map[string]interface{}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
+)
+
+// OpenAPI serves the OpenAPI document of the API, generated from apiRoutes
+func OpenAPI(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	openAPIOnce.Do(func() {
+		openAPIDoc, _ = json.MarshalIndent(openAPI(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // for online tools
+	w.Write(openAPIDoc)
+}
+
+// openAPI returns the OpenAPI 3 document of apiRoutes
+func openAPI() jsonObject {
+	paths := jsonObject{}
+	for _, rt := range apiRoutes {
+		op := jsonObject{
+			"summary":     rt.summary,
+			"operationId": operationID(rt),
+			"responses": jsonObject{
+				"200": jsonObject{
+					"description": "OK",
+					"content":     jsonObject{"application/json": jsonObject{"schema": jsonSchema(reflect.TypeOf(rt.reply))}},
+				},
+				"default": jsonObject{
+					"description": "Error",
+					"content":     jsonObject{"application/json": jsonObject{"schema": jsonSchema(reflect.TypeOf(apiError{}))}},
+				},
+			},
+		}
+		if rt.master {
+			op["security"] = []jsonObject{{"master": []string{}}}
+		}
+		switch {
+		case rt.body != nil:
+			schema := jsonSchema(reflect.TypeOf(rt.body))
+			if rt.extra {
+				schema["additionalProperties"] = true
+			}
+			op["requestBody"] = jsonObject{
+				"required": true,
+				"content":  jsonObject{"application/json": jsonObject{"schema": schema}},
+			}
+		case rt.form != nil:
+			props := jsonObject{}
+			for _, field := range rt.form {
+				props[field] = jsonObject{"type": "string"}
+			}
+			props[rt.form[0]] = jsonObject{"type": "array", "items": jsonObject{"type": "string", "format": "binary"}}
+			op["requestBody"] = jsonObject{
+				"required": true,
+				"content": jsonObject{"multipart/form-data": jsonObject{"schema": jsonObject{
+					"type":       "object",
+					"properties": props,
+					"required":   []string{rt.form[0]},
+				}}},
+			}
+		}
+
+		item, _ := paths[apiPrefix+rt.path].(jsonObject)
+		if item == nil {
+			item = jsonObject{}
+			paths[apiPrefix+rt.path] = item
+		}
+		item[strings.ToLower(rt.method)] = op
+	}
+
+	return jsonObject{
+		"openapi": "3.0.3",
+		"info": jsonObject{
+			"title":   pageTitle + " API",
+			"version": strings.TrimPrefix(apiPrefix, "/api/"),
+		},
+		"servers": []jsonObject{{"url": publicURL}},
+		"paths":   paths,
+		"components": jsonObject{
+			"securitySchemes": jsonObject{
+				"master": jsonObject{"type": "http", "scheme": "basic"},
+			},
+		},
+	}
+}
+
+// operationID derives the operation ID from the route, e.g. "getShow"
+func operationID(rt apiRoute) string {
+	id := strings.ToLower(rt.method)
+	for _, seg := range strings.Split(rt.path, "/") {
+		if seg != "" {
+			id += strings.ToUpper(seg[:1]) + seg[1:]
+		}
+	}
+	return id
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema returns the JSON schema of the values of t as encoded by
+// encoding/json
+func jsonSchema(t reflect.Type) jsonObject {
+	if t == timeType {
+		return jsonObject{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := jsonSchema(t.Elem())
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return jsonObject{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return jsonObject{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := jsonObject{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchema(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		s := jsonObject{"type": "object", "properties": props}
+		if required != nil {
+			s["required"] = required
+		}
+		return s
+	default:
+		return jsonObject{}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// listChanged notifies the clients about a changed photo list
+func listChanged() {
+	version := show.changed()
+	mqttPublishSlide()
+	streamer.SendUint("", "list", version)
+}
+
+// writeM3U writes the playlist in the format read by parseM3U. Images of web
+// servers are written by their URL, not by their generated names.
+func writeM3U(w io.Writer, entries []playlistEntry) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	section := ""
+	for _, e := range entries {
+		if e.Section != section {
+			section = e.Section
+			fmt.Fprintf(&b, "#SECTION:%s\n", section)
+		}
+		if e.Duration > 0 || e.Caption != "" {
+			duration := "-1"
+			if e.Duration > 0 {
+				duration = strconv.FormatFloat(e.Duration, 'f', -1, 64)
+			}
+			fmt.Fprintf(&b, "#EXTINF:%s,%s\n", duration, e.Caption)
+		}
+		if e.Card != nil {
+			text := strings.Replace(e.Card.Text, "\n", `\n`, -1)
+			fmt.Fprintf(&b, "#CARD:%s,%s|%s\n", e.Card.Kind, e.Card.Title, text)
+			continue
+		}
+		if e.Markdown != "" {
+			b.WriteString("#MARKDOWN:" + strings.Replace(e.Markdown, "\n", `\n`, -1) + "\n")
+			continue
+		}
+		if e.Pair != "" {
+			fmt.Fprintf(&b, "#LAYOUT:%s,%s\n", e.Layout, e.Pair)
+		} else if e.Layout != "" {
+			fmt.Fprintf(&b, "#LAYOUT:%s\n", e.Layout)
+		}
+		if e.URL != "" {
+			b.WriteString(e.URL + "\n")
+		} else {
+			b.WriteString(e.Photo + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// savePlaylist writes the playlist to the album's playlist file, keeping the
+// format of an existing file. Ad hoc title cards are not saved.
+func savePlaylist(album string, playlist []playlistEntry) error {
+	entries := make([]playlistEntry, 0, len(playlist))
+	for _, e := range playlist {
+		if e.Card == nil || !e.Card.adHoc {
+			entries = append(entries, e)
+		}
+	}
+
+	path := playlistFile(album)
+	if path == "" {
+		name := album
+		if name == "" {
+			name = "default"
+		}
+		if err := os.MkdirAll(playlistDir, 0755); err != nil {
+			return err
+		}
+		path = filepath.Join(playlistDir, name+".json")
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(path) == ".m3u" {
+		err = writeM3U(f, entries)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(entries)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// setOrder changes the order of the photos. The new order must contain
+// exactly the photos of the album. The current photo stays displayed.
+func setOrder(order []string) error {
+	show.loading.Lock()
+	defer show.loading.Unlock()
+	snap := show.snapshot()
+	if len(order) != len(snap.photos) {
+		return errors.New("order must contain all photos")
+	}
+
+	// keep the playlist entries of the photos
+	entries := make(map[string][]playlistEntry, len(snap.photos))
+	for i, name := range snap.photos {
+		e := playlistEntry{Photo: name}
+		if i < len(snap.entries) {
+			e = snap.entries[i]
+		}
+		entries[name] = append(entries[name], e)
+	}
+
+	newPlaylist := make([]playlistEntry, 0, len(order))
+	for _, name := range order {
+		if len(entries[name]) == 0 {
+			return errors.New("unknown or duplicate photo: " + name)
+		}
+		newPlaylist = append(newPlaylist, entries[name][0])
+		entries[name] = entries[name][1:]
+	}
+
+	// stay at the displayed photo in the new order
+	show.swap(snap.album, order, newPlaylist, snap.photo())
+	listChanged()
+	return savePlaylist(snap.album, newPlaylist)
+}
+
+// movePhoto moves the photo to the given position
+func movePhoto(name string, pos int) error {
+	photos := show.snapshot().photos
+	if pos < 0 || pos >= len(photos) {
+		return errors.New("invalid position")
+	}
+
+	from := -1
+	for i, p := range photos {
+		if p == name {
+			from = i
+			break
+		}
+	}
+	if from < 0 {
+		return errors.New("unknown photo: " + name)
+	}
+
+	order := make([]string, 0, len(photos))
+	order = append(order, photos[:from]...)
+	order = append(order, photos[from+1:]...)
+	order = append(order[:pos], append([]string{name}, order[pos:]...)...)
+	return setOrder(order)
+}
+
+// PhotoOrder changes the order of the photos of the current album.
+// Either a photo and its new position are given, or the new order as a list
+// of order values.
+func PhotoOrder(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+
+	err := changeState(func() error {
+		if order := r.PostForm["order"]; len(order) > 0 {
+			return setOrder(order)
+		}
+		pos, err := strconv.Atoi(r.PostFormValue("position"))
+		if err != nil {
+			return err
+		}
+		return movePhoto(r.PostFormValue("photo"), pos)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestM3URoundTrip(t *testing.T) {
+	// as loaded by applyPlaylist, with the generated names of the slides
+	entries := []playlistEntry{
+		{Photo: "a.jpg", Duration: 2.5, Caption: "Arrival"},
+		{Photo: "_card-1.png", Card: &titleCard{Kind: "title", Title: "Day 1", Text: "on the\nbeach"}, Section: "Day 1"},
+		{Photo: "b.jpg", Layout: "two-up", Pair: "c.jpg", Section: "Day 1"},
+		{Photo: "_web-0123abcd.jpg", URL: "https://example.com/map.jpg", Caption: "Map", Section: "Day 1"},
+		{Photo: "_text-1.md", Markdown: "# Thanks\nfor watching", Section: "End"},
+		{Photo: "d.jpg", Section: "End"},
+	}
+	want := []playlistEntry{
+		{Photo: "a.jpg", Duration: 2.5, Caption: "Arrival"},
+		{Card: &titleCard{Kind: "title", Title: "Day 1", Text: "on the\nbeach"}, Section: "Day 1"},
+		{Photo: "b.jpg", Layout: "two-up", Pair: "c.jpg", Section: "Day 1"},
+		{URL: "https://example.com/map.jpg", Caption: "Map", Section: "Day 1"},
+		{Markdown: "# Thanks\nfor watching", Section: "End"},
+		{Photo: "d.jpg", Section: "End"},
+	}
+
+	var b strings.Builder
+	if err := writeM3U(&b, entries); err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseM3U(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseM3U(writeM3U()) =\n%+v\nwant\n%+v\nfrom\n%s", got, want, b.String())
+	}
+}
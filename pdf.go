@@ -0,0 +1,219 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// pdfDoc is a minimal PDF writer, just capable enough for contact sheets
+type pdfDoc struct {
+	buf     bytes.Buffer
+	offsets []int // byte offset of each object, indexed by object number
+}
+
+func newPDFDoc() *pdfDoc {
+	d := &pdfDoc{offsets: []int{0}}
+	d.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	return d
+}
+
+// reserve allocates a new object number
+func (d *pdfDoc) reserve() int {
+	d.offsets = append(d.offsets, 0)
+	return len(d.offsets) - 1
+}
+
+// object writes the object with the given number
+func (d *pdfDoc) object(n int, format string, a ...interface{}) {
+	d.offsets[n] = d.buf.Len()
+	fmt.Fprintf(&d.buf, "%d 0 obj\n", n)
+	fmt.Fprintf(&d.buf, format, a...)
+	d.buf.WriteString("\nendobj\n")
+}
+
+// stream writes a stream object with the given dictionary entries
+func (d *pdfDoc) stream(n int, dict string, data []byte) {
+	d.offsets[n] = d.buf.Len()
+	fmt.Fprintf(&d.buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", n, dict, len(data))
+	d.buf.Write(data)
+	d.buf.WriteString("\nendstream\nendobj\n")
+}
+
+// finish writes the cross-reference table and the trailer
+func (d *pdfDoc) finish(root int) []byte {
+	xref := d.buf.Len()
+	fmt.Fprintf(&d.buf, "xref\n0 %d\n0000000000 65535 f \n", len(d.offsets))
+	for _, off := range d.offsets[1:] {
+		fmt.Fprintf(&d.buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&d.buf, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(d.offsets), root, xref)
+	return d.buf.Bytes()
+}
+
+// pdfString escapes a string for use as a PDF string literal.
+// The standard fonts only cover Latin-1, other characters are replaced.
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 255:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// Contact sheet layout in points on an A4 page
+const (
+	sheetWidth   = 595
+	sheetHeight  = 842
+	sheetMargin  = 36
+	sheetCols    = 4
+	sheetRows    = 5
+	sheetThumb   = 120 // thumbnail box size
+	sheetCaption = 14  // space for the caption below each thumbnail
+	sheetTitle   = 24  // space for the page title
+)
+
+// truncate shortens s to at most n characters
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-3]) + "..."
+}
+
+// contactSheet renders a PDF with a grid of thumbnails of the given photos.
+// Rendering is aborted when the context is done.
+func contactSheet(ctx context.Context, title, album string, names []string) ([]byte, error) {
+	d := newPDFDoc()
+	catalog, pages, font := d.reserve(), d.reserve(), d.reserve()
+	d.object(font, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+
+	cellW := float64(sheetWidth-2*sheetMargin) / sheetCols
+	cellH := float64(sheetHeight-2*sheetMargin-sheetTitle) / sheetRows
+	perPage := sheetCols * sheetRows
+	numPages := (len(names) + perPage - 1) / perPage
+	if numPages == 0 {
+		numPages = 1
+	}
+
+	var kids []string
+	for p := 0; p < numPages; p++ {
+		page, contents := d.reserve(), d.reserve()
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+
+		var content, xobjects bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 12 Tf %d %d Td %s Tj ET\n",
+			sheetMargin, sheetHeight-sheetMargin-12,
+			pdfString(fmt.Sprintf("%s (%d/%d)", title, p+1, numPages)))
+
+		for i := p * perPage; i < len(names) && i < (p+1)*perPage; i++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			col, row := (i%perPage)%sheetCols, (i%perPage)/sheetCols
+			x := sheetMargin + float64(col)*cellW
+			y := float64(sheetHeight-sheetMargin-sheetTitle) - float64(row+1)*cellH
+
+			if img := d.thumbnail(ctx, album, names[i]); img != nil {
+				// scale the thumbnail into the box, keeping its aspect ratio
+				w, h := float64(img.w), float64(img.h)
+				scale := sheetThumb / w
+				if h > w {
+					scale = sheetThumb / h
+				}
+				w, h = w*scale, h*scale
+				ix := x + (cellW-w)/2
+				iy := y + sheetCaption + (sheetThumb-h)/2
+				fmt.Fprintf(&content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", w, h, ix, iy, img.obj)
+				fmt.Fprintf(&xobjects, "/Im%d %d 0 R ", img.obj, img.obj)
+			}
+			fmt.Fprintf(&content, "BT /F1 7 Tf %.2f %.2f Td %s Tj ET\n",
+				x+4, y+4, pdfString(fmt.Sprintf("%d: %s", i+1, truncate(names[i], 30))))
+		}
+
+		d.stream(contents, "", content.Bytes())
+		d.object(page, "<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %d %d] /Contents %d 0 R "+
+			"/Resources << /Font << /F1 %d 0 R >> /XObject << %s>> >> >>",
+			pages, sheetWidth, sheetHeight, contents, font, xobjects.String())
+	}
+
+	d.object(pages, "<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+	d.object(catalog, "<< /Type /Catalog /Pages %d 0 R >>", pages)
+	return d.finish(catalog), nil
+}
+
+type pdfImage struct {
+	obj  int
+	w, h int
+}
+
+// thumbnail embeds a JPEG thumbnail of the given photo as an image object.
+// It returns nil if the photo can not be decoded.
+func (d *pdfDoc) thumbnail(ctx context.Context, album, name string) *pdfImage {
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return nil
+	}
+	img, err := decodeImage(path)
+	if err != nil {
+		log.Println("contact sheet:", name+":", err)
+		return nil
+	}
+
+	// render at twice the size for a sharp print
+	thumb := thumbnail(img, 2*sheetThumb)
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return nil
+	}
+
+	b := thumb.Bounds()
+	n := d.reserve()
+	d.stream(n, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d "+
+		"/ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode", b.Dx(), b.Dy()), buf.Bytes())
+	return &pdfImage{obj: n, w: b.Dx(), h: b.Dy()}
+}
+
+// ContactSheet renders a printable PDF contact sheet of the current album
+func ContactSheet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := show.loadErr(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	snap := show.snapshot()
+	title := "Remote Photo Show"
+	if snap.album != "" {
+		title += ": " + snap.album
+	}
+
+	pdf, err := contactSheet(r.Context(), title, snap.album, snap.photos)
+	if err != nil {
+		return // the client is gone
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="contactsheet.pdf"`)
+	w.Write(pdf)
+}
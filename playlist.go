@@ -0,0 +1,255 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// playlistEntry is a photo of a playlist
+type playlistEntry struct {
+	Photo    string  `json:"photo"`
+	Duration float64 `json:"duration,omitempty"` // display time in seconds
+	Caption  string  `json:"caption,omitempty"`
+	Section  string  `json:"section,omitempty"`
+
+	// Layout of the photo, see slideLayout. Pair is the second photo of the
+	// two-up layout.
+	Layout string `json:"layout,omitempty"`
+	Pair   string `json:"pair,omitempty"`
+
+	// Card makes the entry a title card instead of a photo, see titleCard
+	Card *titleCard `json:"card,omitempty"`
+	// Markdown makes the entry a text slide instead of a photo
+	Markdown string `json:"markdown,omitempty"`
+	// URL makes the entry an image fetched from a web server instead of a
+	// photo of the album
+	URL string `json:"url,omitempty"`
+}
+
+// playlistFile returns the path of the album's playlist file, if there is one.
+// The playlist of the album "party" is playlistDir/party.json or party.m3u,
+// the one of the default album default.json or default.m3u.
+func playlistFile(album string) string {
+	name := album
+	if name == "" {
+		name = "default"
+	}
+	for _, ext := range []string{".json", ".m3u"} {
+		path := filepath.Join(playlistDir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// loadPlaylist reads the playlist of the album.
+// It returns nil if the album has none.
+func loadPlaylist(album string) ([]playlistEntry, error) {
+	path := playlistFile(album)
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if filepath.Ext(path) == ".m3u" {
+		return parseM3U(f)
+	}
+
+	var entries []playlistEntry
+	if err = json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseM3U parses an M3U-like playlist:
+//
+//	#EXTM3U
+//	#SECTION:Ceremony
+//	#EXTINF:10,The rings
+//	rings.jpg
+//	#LAYOUT:two-up,dress-after.jpg
+//	dress-before.jpg
+//	#CARD:intermission,Back in 10 minutes|Drinks are served in the garden
+//	#MARKDOWN:## Schedule\n- 18:00 Dinner\n- 21:00 Dance
+//	https://example.com/venue.jpg
+//
+// #EXTINF sets the display duration in seconds (-1 for the default) and the
+// caption of the next photo, #SECTION starts a new section. #CARD adds a
+// title card of the given kind with the title and the text after "|", in
+// which \n starts a new line. #MARKDOWN adds a text slide, also with \n for
+// new lines. #LAYOUT sets the layout of the next photo, followed by the
+// second photo for "two-up". HTTP(S) URLs add images of web servers.
+func parseM3U(r io.Reader) ([]playlistEntry, error) {
+	var entries []playlistEntry
+	var next playlistEntry
+	section := ""
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#SECTION:"):
+			section = strings.TrimSpace(line[len("#SECTION:"):])
+		case strings.HasPrefix(line, "#EXTINF:"):
+			duration, caption, _ := strings.Cut(line[len("#EXTINF:"):], ",")
+			if d, err := strconv.ParseFloat(strings.TrimSpace(duration), 64); err == nil && d > 0 {
+				next.Duration = d
+			}
+			next.Caption = strings.TrimSpace(caption)
+		case strings.HasPrefix(line, "#LAYOUT:"):
+			layout, pair, _ := strings.Cut(line[len("#LAYOUT:"):], ",")
+			next.Layout, next.Pair = strings.TrimSpace(layout), strings.TrimSpace(pair)
+		case strings.HasPrefix(line, "#CARD:"):
+			kind, rest, _ := strings.Cut(line[len("#CARD:"):], ",")
+			title, text, _ := strings.Cut(rest, "|")
+			next.Card = &titleCard{
+				Kind:  strings.TrimSpace(kind),
+				Title: strings.TrimSpace(title),
+				Text:  strings.Replace(strings.TrimSpace(text), `\n`, "\n", -1),
+			}
+			next.Section = section
+			entries = append(entries, next)
+			next = playlistEntry{}
+		case strings.HasPrefix(line, "#MARKDOWN:"):
+			next.Markdown = strings.Replace(line[len("#MARKDOWN:"):], `\n`, "\n", -1)
+			next.Section = section
+			entries = append(entries, next)
+			next = playlistEntry{}
+		case strings.HasPrefix(line, "#"): // comment or unsupported directive
+		case strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://"):
+			next.URL = line
+			next.Section = section
+			entries = append(entries, next)
+			next = playlistEntry{}
+		default:
+			next.Photo = line
+			next.Section = section
+			entries = append(entries, next)
+			next = playlistEntry{}
+		}
+	}
+	return entries, s.Err()
+}
+
+// applyPlaylist orders the album's photos by the playlist. Entries of photos
+// which are not in the album are skipped, photos missing in the playlist (e.g.
+// new uploads or hidden photos when the order was saved) follow by name.
+// Title cards are listed by the names of their renderings, text slides and
+// images of web servers of the playlist by generated names.
+func applyPlaylist(album string, names []string, entries []playlistEntry) ([]string, []playlistEntry) {
+	exists := make(map[string]bool, len(names))
+	for _, name := range names {
+		exists[name] = true
+	}
+	listed := make(map[string]bool, len(entries))
+
+	ordered := make([]string, 0, len(entries))
+	valid := make([]playlistEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Card != nil {
+			c, err := newCard(e.Card.Kind, e.Card.Title, e.Card.Text, e.Section)
+			if err != nil {
+				log.Printf("playlist %q: %v", album, err)
+				continue
+			}
+			e = addCard(c, e)
+			ordered = append(ordered, e.Photo)
+			valid = append(valid, e)
+			continue
+		}
+		if e.Markdown != "" {
+			e = addTextSlide(e)
+			ordered = append(ordered, e.Photo)
+			valid = append(valid, e)
+			continue
+		}
+		if e.URL != "" {
+			var err error
+			if e, err = addWebImage(e); err != nil {
+				log.Printf("playlist %q: %v", album, err)
+				continue
+			}
+			ordered = append(ordered, e.Photo)
+			valid = append(valid, e)
+			continue
+		}
+		if !exists[e.Photo] {
+			log.Printf("playlist %q: photo %q not found", album, e.Photo)
+			continue
+		}
+		e = withLayout(album, e, exists)
+		ordered = append(ordered, e.Photo)
+		valid = append(valid, e)
+		listed[e.Photo] = true
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		if !listed[name] {
+			ordered = append(ordered, name)
+			valid = append(valid, playlistEntry{Photo: name})
+		}
+	}
+	return ordered, valid
+}
+
+// equalEntries reports whether a and b are the same playlist
+func equalEntries(a, b []playlistEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if (x.Card == nil) != (y.Card == nil) || (x.Card != nil && *x.Card != *y.Card) {
+			return false
+		}
+		x.Card, y.Card = nil, nil
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// playlistSection is the start of a section of the playlist
+type playlistSection struct {
+	Title string `json:"title"`
+	Start int    `json:"start"` // index of the first photo
+}
+
+// playlistInfo returns the captions of all photos and the sections of the
+// current playlist
+func playlistInfo(names []string, entries []playlistEntry) ([]string, []playlistSection) {
+	all := meta.album(show.currentAlbum())
+	captions := make([]string, len(names))
+	for i, name := range names {
+		captions[i] = photoCaption(all[name], entries, i)
+	}
+
+	sections := make([]playlistSection, 0)
+	for i, e := range entries {
+		if e.Section != "" && (i == 0 || entries[i-1].Section != e.Section) {
+			sections = append(sections, playlistSection{Title: e.Section, Start: i})
+		}
+	}
+	return captions, sections
+}
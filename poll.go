@@ -0,0 +1,72 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Poll serves the events after the sequence number in the after parameter,
+// waiting up to timeout seconds (at most pollTimeout) for one. Without after,
+// it returns the current sequence number right away. It is the fallback for
+// clients which cannot receive the event stream at /listen, with the same
+// channels parameter.
+func Poll(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	channels, err := parseChannels(q.Get("channels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout := pollTimeout
+	if s := q.Get("timeout"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs < 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		if d := time.Duration(secs) * time.Second; d < timeout {
+			timeout = d
+		}
+	}
+
+	var after uint64
+	wait := q.Get("after") != ""
+	if wait {
+		if after, err = strconv.ParseUint(q.Get("after"), 10, 64); err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+
+	access := requestAccess(r)
+	reply, next := history.since(after)
+	reply.Events = access.filter(filterEvents(reply.Events, channels))
+	if !wait {
+		reply = eventsReply{Seq: reply.Seq, Events: []historyEvent{}}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for wait && len(reply.Events) == 0 && !reply.Missed {
+		select {
+		case <-next:
+			reply, next = history.since(after)
+			reply.Events = access.filter(filterEvents(reply.Events, channels))
+		case <-timer.C:
+			wait = false
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store") // for proxies
+	json.NewEncoder(w).Encode(reply)
+}
@@ -0,0 +1,217 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// showPreset is a saved configuration of the show, restored with one call for
+// recurring shows
+type showPreset struct {
+	Name       string           `json:"name"`
+	Album      string           `json:"album"`
+	Order      []string         `json:"order,omitempty"`    // photos in show order
+	Autoplay   int64            `json:"autoplay,omitempty"` // interval in seconds, 0 if paused
+	Mode       string           `json:"mode,omitempty"`     // color mode, "" for the theme colors
+	Transition *slideTransition `json:"transition,omitempty"`
+	Saved      time.Time        `json:"saved"`
+}
+
+// presetsMu guards the presets file
+var presetsMu sync.Mutex
+
+// errUnknownPreset is returned by loadPreset if there is no preset with the
+// name
+var errUnknownPreset = errors.New("unknown preset")
+
+// readPresets reads all saved presets by name. A missing file means there are
+// none. It must be called with presetsMu held.
+func readPresets() (map[string]showPreset, error) {
+	presets := make(map[string]showPreset)
+	data, err := os.ReadFile(presetsPath)
+	if os.IsNotExist(err) {
+		return presets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &presets)
+	return presets, err
+}
+
+// writePresets replaces the presets file.
+// It must be called with presetsMu held.
+func writePresets(presets map[string]showPreset) error {
+	data, err := json.MarshalIndent(presets, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(presetsPath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(presetsPath+".tmp", presetsPath)
+}
+
+// savePreset saves the current album, order, autoplay interval, color mode
+// and transition as preset with the name, replacing an existing one
+func savePreset(name string) (showPreset, error) {
+	if !validName(name) {
+		return showPreset{}, errors.New("invalid preset name")
+	}
+
+	snap := show.snapshot()
+	modeMu.Lock()
+	p := showPreset{
+		Name:       name,
+		Album:      snap.album,
+		Order:      append([]string(nil), snap.photos...),
+		Autoplay:   int64(player.playing() / time.Second),
+		Mode:       mode,
+		Transition: showTransition,
+		Saved:      time.Now().UTC().Truncate(time.Second),
+	}
+	modeMu.Unlock()
+
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	presets, err := readPresets()
+	if err != nil {
+		return p, err
+	}
+	presets[name] = p
+	return p, writePresets(presets)
+}
+
+// loadPreset restores the show of the preset. Photos added to the album
+// since it was saved follow at the end.
+func loadPreset(name string) error {
+	presetsMu.Lock()
+	presets, err := readPresets()
+	presetsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	p, ok := presets[name]
+	if !ok {
+		return errUnknownPreset
+	}
+
+	if err = setAlbum(p.Album); err != nil {
+		return err
+	}
+	names := show.snapshot().photos
+	if order := presetOrder(p.Order, names); len(p.Order) > 0 && !equalNames(order, names) {
+		if err = setOrder(order); err != nil {
+			return err
+		}
+	}
+	if err = setMode(p.Mode); err != nil {
+		return err
+	}
+	if err = setTransition(p.Transition); err != nil {
+		return err
+	}
+	if p.Autoplay > 0 {
+		return player.start(time.Duration(p.Autoplay) * time.Second)
+	}
+	player.pause()
+	return nil
+}
+
+// presetOrder returns the photos in the saved order, skipping the photos
+// which no longer exist and appending the new ones
+func presetOrder(saved, names []string) []string {
+	left := make(map[string]int, len(names))
+	for _, name := range names {
+		left[name]++
+	}
+	order := make([]string, 0, len(names))
+	for _, name := range saved {
+		if left[name] > 0 {
+			left[name]--
+			order = append(order, name)
+		}
+	}
+	for _, name := range names {
+		if left[name] > 0 {
+			left[name]--
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// Presets lists the saved presets by name
+func Presets(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	presetsMu.Lock()
+	presets, err := readPresets()
+	presetsMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]showPreset, 0, len(presets))
+	for _, p := range presets {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(list)
+}
+
+// SavePreset saves the current show as preset
+func SavePreset(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	p, err := savePreset(ps.ByName("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// LoadPreset restores the show of a preset
+func LoadPreset(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := changeState(func() error { return loadPreset(ps.ByName("name")) })
+	switch err {
+	case nil:
+	case errUnknownPreset:
+		http.NotFound(w, r)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// DeletePreset removes a preset
+func DeletePreset(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	presets, err := readPresets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := ps.ByName("name")
+	if _, ok := presets[name]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	delete(presets, name)
+	if err = writePresets(presets); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,462 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Topics of push notifications. A newer notification with the same topic
+// replaces one the push service did not deliver yet.
+const (
+	pushShowLive = "show"
+	pushPhotos   = "photos"
+)
+
+const (
+	// maxPushSubscriptions limits the stored subscriptions
+	maxPushSubscriptions = 10000
+
+	// pushTTL is how long push services try to deliver a notification
+	pushTTL = 24 * time.Hour
+
+	// pushPhotosInterval suppresses notifications about further photos
+	pushPhotosInterval = 10 * time.Minute
+
+	// pushWorkers limits the notifications sent at the same time
+	pushWorkers = 8
+)
+
+// pushKeys are the keys of a push subscription, as the browser reports them
+type pushKeys struct {
+	P256dh string `json:"p256dh"` // public ECDH key of the browser
+	Auth   string `json:"auth"`   // authentication secret
+}
+
+// pushSubscription is a browser which opted in to push notifications
+type pushSubscription struct {
+	Endpoint string    `json:"endpoint"`
+	Keys     pushKeys  `json:"keys"`
+	Lang     string    `json:"lang,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// pushSubs are the subscriptions by endpoint, stored in pushSubsPath
+var pushSubs = struct {
+	sync.Mutex
+	byEndpoint map[string]*pushSubscription
+}{byEndpoint: make(map[string]*pushSubscription)}
+
+// pushKey is the VAPID key identifying the server to the push services
+var pushKey *ecdsa.PrivateKey
+
+// pushLimiter limits the subscriptions per IP address
+var pushLimiter = rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// lastPhotosPush is when the viewers were last notified about new photos
+var lastPhotosPush = struct {
+	sync.Mutex
+	t time.Time
+}{}
+
+// vapidTokens caches the signed tokens by the origin of the push services
+var vapidTokens = struct {
+	sync.Mutex
+	byAudience map[string]vapidToken
+}{byAudience: make(map[string]vapidToken)}
+
+type vapidToken struct {
+	jwt     string
+	expires time.Time
+}
+
+var pushClient = &http.Client{Timeout: 30 * time.Second}
+
+// loadPush reads the VAPID key from pushKeyFile, generating it on the first
+// start, and the subscriptions
+func loadPush() error {
+	if !webPush {
+		return nil
+	}
+	data, err := os.ReadFile(pushKeyFile)
+	if os.IsNotExist(err) {
+		if pushKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(pushKey)
+		if err != nil {
+			return err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err = os.WriteFile(pushKeyFile, data, 0600); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return errors.New(pushKeyFile + ": no PEM data")
+		}
+		if pushKey, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return err
+		}
+	}
+
+	data, err = os.ReadFile(pushSubsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var subs []*pushSubscription
+	if err = json.Unmarshal(data, &subs); err != nil {
+		return err
+	}
+	pushSubs.Lock()
+	defer pushSubs.Unlock()
+	for _, s := range subs {
+		pushSubs.byEndpoint[s.Endpoint] = s
+	}
+	return nil
+}
+
+// savePushSubs writes the subscriptions.
+// It must be called with pushSubs held.
+func savePushSubs() error {
+	subs := make([]*pushSubscription, 0, len(pushSubs.byEndpoint))
+	for _, s := range pushSubs.byEndpoint {
+		subs = append(subs, s)
+	}
+	data, err := json.MarshalIndent(subs, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(pushSubsPath+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(pushSubsPath+".tmp", pushSubsPath)
+}
+
+// pushPublicKey returns the public VAPID key for the browsers, "" without
+// webPush
+func pushPublicKey() string {
+	if pushKey == nil {
+		return ""
+	}
+	pub, err := pushKey.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+// vapidAuth returns the Authorization header of requests to the push service
+// at the endpoint, signed by the VAPID key
+func vapidAuth(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	aud := u.Scheme + "://" + u.Host
+
+	vapidTokens.Lock()
+	defer vapidTokens.Unlock()
+	t, ok := vapidTokens.byAudience[aud]
+	if !ok || time.Until(t.expires) < time.Hour {
+		sub := pushContact
+		if sub == "" {
+			sub = publicURL
+		}
+		expires := time.Now().Add(12 * time.Hour)
+		claims, _ := json.Marshal(map[string]interface{}{"aud": aud, "exp": expires.Unix(), "sub": sub})
+		unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString(claims)
+		hash := sha256.Sum256([]byte(unsigned))
+		r, s, err := ecdsa.Sign(rand.Reader, pushKey, hash[:])
+		if err != nil {
+			return "", err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		t = vapidToken{unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), expires}
+		vapidTokens.byAudience[aud] = t
+	}
+	return "vapid t=" + t.jwt + ", k=" + pushPublicKey(), nil
+}
+
+// hkdf derives n <= 32 bytes from the input keying material, see RFC 5869
+func hkdf(salt, ikm, info []byte, n int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	mac = hmac.New(sha256.New, mac.Sum(nil))
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:n]
+}
+
+// encryptPush encrypts the payload for the subscription as a single record
+// of aes128gcm, see RFC 8291
+func encryptPush(s *pushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s.Keys.P256dh, "="))
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s.Keys.Auth, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(authSecret) != 16 {
+		return nil, errors.New("invalid auth secret")
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(authSecret, secret, keyInfo, 32)
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// header: salt, record size and the public key of the server
+	body := append([]byte{}, salt...)
+	body = binary.BigEndian.AppendUint32(body, 4096)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	return gcm.Seal(body, nonce, append(payload, 2), nil), nil // 2 delimits the last record
+}
+
+// deliverPush sends the payload to the subscription. It reports whether the
+// subscription expired.
+func deliverPush(s *pushSubscription, topic string, payload []byte) (bool, error) {
+	body, err := encryptPush(s, payload)
+	if err != nil {
+		return false, err
+	}
+	auth, err := vapidAuth(s.Endpoint)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(rootCtx, "POST", s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTTL/time.Second)))
+	req.Header.Set("Topic", topic)
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return true, nil
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("%s: %s", req.URL.Host, resp.Status)
+	}
+	return false, nil
+}
+
+// sendPush notifies all subscribed viewers in the background, with the text
+// in their language. Expired subscriptions are removed.
+func sendPush(topic string, text func(lang string) string) {
+	if pushKey == nil {
+		return
+	}
+	pushSubs.Lock()
+	subs := make([]*pushSubscription, 0, len(pushSubs.byEndpoint))
+	for _, s := range pushSubs.byEndpoint {
+		subs = append(subs, s)
+	}
+	pushSubs.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	go func() {
+		var mu sync.Mutex
+		var expired []string
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, pushWorkers)
+		for _, s := range subs {
+			payload, _ := json.Marshal(map[string]string{
+				"title": pageTitle,
+				"body":  text(s.Lang),
+				"url":   publicURL + "/",
+				"tag":   topic,
+			})
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(s *pushSubscription) {
+				defer func() { <-sem; wg.Done() }()
+				gone, err := deliverPush(s, topic, payload)
+				if err != nil {
+					log.Println("push:", err)
+				}
+				if gone {
+					mu.Lock()
+					expired = append(expired, s.Endpoint)
+					mu.Unlock()
+				}
+			}(s)
+		}
+		wg.Wait()
+
+		if len(expired) > 0 {
+			pushSubs.Lock()
+			for _, e := range expired {
+				delete(pushSubs.byEndpoint, e)
+			}
+			if err := savePushSubs(); err != nil {
+				log.Println("push:", err)
+			}
+			pushSubs.Unlock()
+		}
+	}()
+}
+
+// pushShowStarted notifies the viewers that the show went live
+func pushShowStarted() {
+	sendPush(pushShowLive, func(lang string) string {
+		return tr(lang, "The show has started")
+	})
+}
+
+// pushPhotosAdded notifies the viewers about the photos published into the
+// album, unless it is not public, at most once per pushPhotosInterval
+func pushPhotosAdded(album string, n int) {
+	if pushKey == nil || n == 0 || albumRule(album).Level != accessPublic {
+		return
+	}
+	lastPhotosPush.Lock()
+	if time.Since(lastPhotosPush.t) < pushPhotosInterval {
+		lastPhotosPush.Unlock()
+		return
+	}
+	lastPhotosPush.t = time.Now()
+	lastPhotosPush.Unlock()
+
+	sendPush(pushPhotos, func(lang string) string {
+		if album == "" {
+			return strings.ReplaceAll(tr(lang, "{n} new photo(s)"), "{n}", strconv.Itoa(n))
+		}
+		return strings.NewReplacer("{n}", strconv.Itoa(n), "{album}", album).Replace(tr(lang, "{n} new photo(s) in {album}"))
+	})
+}
+
+// PushSubscribe stores the push subscription of a viewer in the body, as
+// reported by the browser
+func PushSubscribe(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if pushKey == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if ok, wait := pushLimiter.allow(clientIP(r), 10, time.Hour); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		statusPage(w, r, http.StatusTooManyRequests)
+		return
+	}
+
+	var s pushSubscription
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(s.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		http.Error(w, "invalid endpoint", http.StatusBadRequest)
+		return
+	}
+	if _, err := encryptPush(&s, nil); err != nil {
+		http.Error(w, "invalid keys", http.StatusBadRequest)
+		return
+	}
+	s.Lang = requestLanguage(r)
+	s.Created = time.Now()
+
+	pushSubs.Lock()
+	defer pushSubs.Unlock()
+	if _, ok := pushSubs.byEndpoint[s.Endpoint]; !ok && len(pushSubs.byEndpoint) >= maxPushSubscriptions {
+		http.Error(w, "too many subscriptions", http.StatusServiceUnavailable)
+		return
+	}
+	pushSubs.byEndpoint[s.Endpoint] = &s
+	if err := savePushSubs(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PushUnsubscribe removes the push subscription with the endpoint in the
+// endpoint parameter
+func PushUnsubscribe(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	pushSubs.Lock()
+	defer pushSubs.Unlock()
+	endpoint := r.URL.Query().Get("endpoint")
+	if _, ok := pushSubs.byEndpoint[endpoint]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	delete(pushSubs.byEndpoint, endpoint)
+	if err := savePushSubs(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
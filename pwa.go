@@ -0,0 +1,238 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// swVersion names the cache of the service worker, a new one is used after
+// each restart of the server
+var swVersion = strconv.FormatInt(time.Now().Unix(), 36)
+
+// appIconSizes are the sizes of the generated app icons in pixels
+var appIconSizes = []int{192, 512}
+
+// parseColor parses a CSS hex color like #FFF or #1E1E1E
+func parseColor(s string) (color.RGBA, bool) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if len(s) != 6 || err != nil {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, true
+}
+
+// appIcon draws the icon of the installed app: a camera lens in the accent
+// color on the background color
+func appIcon(size int) image.Image {
+	bg, ok := parseColor(backgroundColor)
+	if !ok {
+		bg = color.RGBA{0, 0, 0, 255}
+	}
+	fg, ok := parseColor(accentColor)
+	if !ok {
+		fg = color.RGBA{53, 53, 53, 255}
+	}
+	white := color.RGBA{255, 255, 255, 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	c := float64(size) / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x)+0.5-c, float64(y)+0.5-c
+			d2 := (dx*dx + dy*dy) / (c * c) // squared distance, relative
+			switch {
+			case d2 < 0.12:
+				img.SetRGBA(x, y, fg)
+			case d2 < 0.22:
+				img.SetRGBA(x, y, white)
+			case d2 < 0.5:
+				img.SetRGBA(x, y, fg)
+			default:
+				img.SetRGBA(x, y, bg)
+			}
+		}
+	}
+	return img
+}
+
+// AppIcon serves a generated app icon, e.g. /icons/192.png
+func AppIcon(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	size, err := strconv.Atoi(strings.TrimSuffix(ps.ByName("icon"), ".png"))
+	valid := false
+	for _, s := range appIconSizes {
+		valid = valid || s == size
+	}
+	if err != nil || !valid {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	png.Encode(w, appIcon(size))
+}
+
+// Manifest serves the web app manifest, so that viewers can install the show
+// on their phones
+func Manifest(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	icons := make([]map[string]string, 0, len(appIconSizes))
+	for _, s := range appIconSizes {
+		icons = append(icons, map[string]string{
+			"src":   "/icons/" + strconv.Itoa(s) + ".png",
+			"sizes": fmt.Sprintf("%dx%d", s, s),
+			"type":  "image/png",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":             pageTitle,
+		"short_name":       pageTitle,
+		"start_url":        "/",
+		"scope":            "/",
+		"display":          "fullscreen",
+		"background_color": backgroundColor,
+		"theme_color":      backgroundColor,
+		"icons":            icons,
+	})
+}
+
+// serviceWorker caches the show page and the photos, so that the show
+// survives short connection drops. The page and the photo list are loaded
+// from the network first, the photos according to config.strategy:
+// "cache-first", "network-first" or "none". At most config.maxPhotos photos
+// are kept in the cache. It also shows the push notifications.
+const serviceWorker = `
+var cacheName = "photoshow-" + config.version;
+
+self.addEventListener("install", function(e) {
+    e.waitUntil(caches.open(cacheName).then(function(cache) {
+        return cache.addAll(["/", "/photos.json"]);
+    }));
+    self.skipWaiting();
+});
+
+self.addEventListener("activate", function(e) {
+    e.waitUntil(caches.keys().then(function(keys) {
+        return Promise.all(keys.filter(function(key) {
+            return key != cacheName;
+        }).map(function(key) {
+            return caches.delete(key);
+        }));
+    }).then(function() {
+        return self.clients.claim();
+    }));
+});
+
+// put stores a response, removing the oldest photos if there are too many
+function put(req, resp, photo) {
+    if(!resp.ok) {
+        return;
+    }
+    caches.open(cacheName).then(function(cache) {
+        cache.put(req, resp).then(function() {
+            if(!photo) {
+                return;
+            }
+            cache.keys().then(function(keys) {
+                var photos = keys.filter(isPhoto);
+                for(var i=0; i<photos.length-config.maxPhotos; i++) {
+                    cache.delete(photos[i]);
+                }
+            });
+        });
+    });
+}
+
+function isPhoto(req) {
+    var path = new URL(req.url).pathname;
+    return path.indexOf("/photos/") == 0 || path.indexOf("/thumbs/") == 0;
+}
+
+function networkFirst(req, photo) {
+    return fetch(req).then(function(resp) {
+        put(req, resp.clone(), photo);
+        return resp;
+    }).catch(function() {
+        return caches.match(req, {ignoreSearch: photo}).then(function(resp) {
+            return resp || Response.error();
+        });
+    });
+}
+
+function cacheFirst(req) {
+    // the token in the query changes, the photo doesn't
+    return caches.match(req, {ignoreSearch: true}).then(function(resp) {
+        return resp || networkFirst(req, true);
+    });
+}
+
+self.addEventListener("fetch", function(e) {
+    var req = e.request;
+    var url = new URL(req.url);
+    if(req.method != "GET" || url.origin != location.origin) {
+        return;
+    }
+    var path = url.pathname;
+    if(isPhoto(req)) {
+        if(config.strategy == "cache-first") {
+            e.respondWith(cacheFirst(req));
+        } else if(config.strategy == "network-first") {
+            e.respondWith(networkFirst(req, true));
+        }
+    } else if(path == "/" || path == "/photos.json") {
+        e.respondWith(networkFirst(req, false));
+    }
+});
+
+self.addEventListener("push", function(e) {
+    var msg = e.data ? e.data.json() : {};
+    e.waitUntil(self.registration.showNotification(msg.title || "", {
+        body: msg.body,
+        tag: msg.tag,
+        icon: "/icons/192.png",
+        data: {url: msg.url || "/"}
+    }));
+});
+
+self.addEventListener("notificationclick", function(e) {
+    e.notification.close();
+    e.waitUntil(self.clients.matchAll({type: "window"}).then(function(windows) {
+        for(var i=0; i<windows.length; i++) {
+            if("focus" in windows[i]) {
+                return windows[i].focus();
+            }
+        }
+        return self.clients.openWindow(e.notification.data.url);
+    }));
+});
+`
+
+// ServiceWorker serves the service worker of the show page
+func ServiceWorker(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	config, _ := json.Marshal(map[string]interface{}{
+		"version":   swVersion,
+		"strategy":  photoCacheStrategy,
+		"maxPhotos": photoCacheSize,
+	})
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "\"use strict\";\nvar config = %s;\n%s", config, serviceWorker)
+}
@@ -0,0 +1,462 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// qrBlocks is the block structure of a QR code version with error correction
+// level M: the EC codewords per block, and the blocks with their number of
+// data codewords
+type qrBlocks struct {
+	ec     int
+	blocks []int
+}
+
+// qrVersions are the versions 1 to 10, enough for URLs of 213 bytes
+var qrVersions = []qrBlocks{
+	{10, []int{16}},
+	{16, []int{28}},
+	{26, []int{44}},
+	{18, []int{32, 32}},
+	{24, []int{43, 43}},
+	{16, []int{27, 27, 27, 27}},
+	{18, []int{31, 31, 31, 31}},
+	{22, []int{38, 38, 39, 39}},
+	{22, []int{36, 36, 36, 37, 37}},
+	{26, []int{43, 43, 43, 43, 44}},
+}
+
+// qrAlignment are the row and column positions of the alignment patterns
+var qrAlignment = [][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// qrCode is the module matrix of a QR code, true is dark
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // modules of the patterns, not of the data
+}
+
+// gfExp and gfLog are the exponentials and logarithms of GF(256) with the
+// polynomial of QR codes
+var gfExp, gfLog = func() (exp [512]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		if x <<= 1; x >= 256 {
+			x ^= 0x11D
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// reedSolomon returns the n error correction codewords of the data
+func reedSolomon(data []byte, n int) []byte {
+	gen := []byte{1}
+	for i := 0; i < n; i++ {
+		next := make([]byte, len(gen)+1)
+		for j, c := range gen {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, gfExp[i])
+		}
+		gen = next
+	}
+	rem := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for j := range rem {
+			rem[j] ^= gfMul(gen[j+1], factor)
+		}
+	}
+	return rem
+}
+
+// qrBits appends bits to bytes, the most significant first
+type qrBits struct {
+	bytes []byte
+	n     int // bits written
+}
+
+func (w *qrBits) write(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.bytes = append(w.bytes, 0)
+		}
+		w.bytes[len(w.bytes)-1] |= byte(v>>uint(i)&1) << uint(7-w.n%8)
+		w.n++
+	}
+}
+
+// newQRCode encodes the data in byte mode with error correction level M in
+// the smallest version it fits in
+func newQRCode(data []byte) (*qrCode, error) {
+	version, capacity, countBits := 0, 0, 8
+	for v, b := range qrVersions {
+		capacity = 0
+		for _, n := range b.blocks {
+			capacity += n
+		}
+		if v >= 9 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*capacity {
+			version = v + 1
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errors.New("too much data for a QR code")
+	}
+
+	var w qrBits
+	w.write(4, 4) // byte mode
+	w.write(len(data), countBits)
+	for _, b := range data {
+		w.write(int(b), 8)
+	}
+	terminator := 8*capacity - w.n
+	if terminator > 4 {
+		terminator = 4
+	}
+	w.write(0, terminator)
+	w.write(0, (8-w.n%8)%8)
+	for pad := 0xEC; len(w.bytes) < capacity; pad ^= 0xEC ^ 0x11 {
+		w.write(pad, 8)
+	}
+	bits := w.bytes
+
+	// split into blocks, add their error correction and interleave them
+	b := qrVersions[version-1]
+	var blocks, ecs [][]byte
+	for _, n := range b.blocks {
+		blocks = append(blocks, bits[:n])
+		ecs = append(ecs, reedSolomon(bits[:n], b.ec))
+		bits = bits[n:]
+	}
+	var codewords []byte
+	for i := 0; i <= b.blocks[len(b.blocks)-1]; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				codewords = append(codewords, block[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, ec := range ecs {
+			codewords = append(codewords, ec[i])
+		}
+	}
+
+	q := &qrCode{size: 17 + 4*version}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, q.size)
+		q.function[y] = make([]bool, q.size)
+	}
+	q.drawPatterns(version)
+	q.drawCodewords(codewords)
+
+	// apply the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+// set sets a module of the patterns
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawPatterns draws the finder, timing and alignment patterns and the
+// version information, and reserves the format information
+func (q *qrCode) drawPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					d := chebyshev(dx, dy)
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := qrAlignment[version-1]
+	for i, x := range pos {
+		for j, y := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue // overlaps a finder
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, chebyshev(dx, dy) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormat(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information for level M and
+// the mask
+func (q *qrCode) drawFormat(mask int) {
+	rem := mask
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (mask<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawCodewords places the codewords in the zigzag of two columns, from the
+// bottom right corner
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // the vertical timing pattern
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert // upwards
+				}
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.modules[y][x] = codewords[i>>3]>>uint(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the mask, applying it twice
+// removes it again
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty rates how hard the code is to scan, by the rules of the standard
+// for selecting the mask
+func (q *qrCode) penalty() int {
+	p, dark := 0, 0
+	finder := []bool{true, false, true, true, true, false, true}
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 0
+			for x := 0; x < q.size; x++ {
+				if x > 0 && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					p += 3
+				} else if run > 5 {
+					p++
+				}
+
+				// a finder like pattern with 4 light modules on one side
+				if x+7 > q.size {
+					continue
+				}
+				match := true
+				for i, d := range finder {
+					match = match && at(x+i, y, vertical) == d
+				}
+				if !match {
+					continue
+				}
+				light := func(from, to int) bool {
+					for i := from; i < to; i++ {
+						if i >= 0 && i < q.size && at(i, y, vertical) {
+							return false
+						}
+					}
+					return true
+				}
+				if light(x-4, x) || light(x+7, x+11) {
+					p += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			c := q.modules[y][x]
+			if c {
+				dark++
+			}
+			if x > 0 && y > 0 && c == q.modules[y-1][x] && c == q.modules[y][x-1] && c == q.modules[y-1][x-1] {
+				p += 3
+			}
+		}
+	}
+	total := q.size * q.size
+	return p + abs(dark*20-total*10)/total*10
+}
+
+// image returns the code with scale pixels per module and the quiet zone of
+// 4 modules
+func (q *qrCode) image(scale int) image.Image {
+	n := (q.size + 8) * scale
+	img := image.NewPaletted(image.Rect(0, 0, n, n), color.Palette{color.White, color.Black})
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+4)*scale+dx, (y+4)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// qrPNG returns a PNG image of the QR code of the text
+func qrPNG(text string, scale int) ([]byte, error) {
+	q, err := newQRCode([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, q.image(scale)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// chebyshev returns the distance of the module from the center of a pattern
+func chebyshev(dx, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
+
+// JoinQR serves a QR code of the link to the show, e.g. to print or to show
+// on screen for viewers joining with their phones
+func JoinQR(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	img, err := qrPNG(publicURL+"/", 8)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Write(img)
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Types of recorded entries
+const (
+	recordState   = "state"   // the show state when the recording started
+	recordCommand = "command" // a master command
+	recordEvent   = "event"   // a sent Server-Sent Event
+)
+
+// recordEntry is a single line of a show recording
+type recordEntry struct {
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`
+	Event   string            `json:"event,omitempty"`
+	Data    string            `json:"data,omitempty"`
+	Command map[string]string `json:"command,omitempty"`
+	Album   string            `json:"album,omitempty"`
+	ID      uint64            `json:"id,omitempty"`
+}
+
+// recorder writes show recordings as JSON lines, one file per recording
+type recorder struct {
+	mu   sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+	name string
+}
+
+var rec recorder
+
+// start begins a new recording and returns its name
+func (rec *recorder) start() (string, error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.f != nil {
+		return "", errors.New("already recording")
+	}
+	if err := os.MkdirAll(recordDir, 0755); err != nil {
+		return "", err
+	}
+
+	name := time.Now().Format("20060102-150405") + ".jsonl"
+	f, err := os.OpenFile(filepath.Join(recordDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	rec.f, rec.enc, rec.name = f, json.NewEncoder(f), name
+	rec.enc.Encode(recordEntry{
+		Time:  time.Now(),
+		Type:  recordState,
+		Album: show.currentAlbum(),
+		ID:    show.current(),
+	})
+	return name, nil
+}
+
+// stop ends the current recording
+func (rec *recorder) stop() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.f == nil {
+		return errors.New("not recording")
+	}
+	err := rec.f.Close()
+	rec.f, rec.enc, rec.name = nil, nil, ""
+	return err
+}
+
+// write appends an entry to the current recording, if any
+func (rec *recorder) write(e recordEntry) {
+	rec.mu.Lock()
+	if rec.enc != nil {
+		e.Time = time.Now()
+		rec.enc.Encode(e)
+	}
+	rec.mu.Unlock()
+}
+
+// command records a master command given by its form values
+func (rec *recorder) command(form url.Values) {
+	rec.write(recordEntry{Type: recordCommand, Command: commandMap(form)})
+}
+
+// commandMap returns the first value of each of the form values of a command
+func commandMap(form url.Values) map[string]string {
+	cmd := make(map[string]string, len(form))
+	for k := range form {
+		cmd[k] = form.Get(k)
+	}
+	return cmd
+}
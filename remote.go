@@ -0,0 +1,225 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var remoteClient = &http.Client{Timeout: 5 * time.Minute}
+
+// remoteGet performs a GET request against a remote photo library server,
+// which is canceled with the context.
+// If v is not nil, the JSON response body is decoded into it, otherwise it is
+// copied to w.
+func remoteGet(ctx context.Context, u string, header http.Header, v interface{}, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// remoteName returns the filename under which a remote asset is shown.
+// It consists of the asset ID and the extension of the original file.
+func remoteName(id, filename string) string {
+	return id + strings.ToLower(path.Ext(filename))
+}
+
+// remoteID extracts the asset ID from a filename created by remoteName
+func remoteID(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// remoteListingTTL is how long the listed photos of a remote album are used to
+// check the downloads, before the album is listed again
+const remoteListingTTL = time.Minute
+
+// remoteListings are the last listed photos of the remote albums. Only the
+// photos of the album are downloaded, not any other asset of the library
+// which a viewer asks for.
+type remoteListings struct {
+	mu     sync.Mutex
+	albums map[string]remoteListing
+}
+
+type remoteListing struct {
+	names  map[string]bool
+	listed time.Time
+}
+
+// record remembers the listed photos of the album
+func (l *remoteListings) record(album string, names []string) {
+	listing := remoteListing{names: make(map[string]bool, len(names)), listed: time.Now()}
+	for _, name := range names {
+		listing.names[name] = true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.albums == nil {
+		l.albums = make(map[string]remoteListing)
+	}
+	l.albums[album] = listing
+}
+
+// check returns os.ErrNotExist if the photo is not in the album. The album is
+// listed again with src if its listing is older than remoteListingTTL.
+func (l *remoteListings) check(ctx context.Context, src photoSource, album, name string) error {
+	l.mu.Lock()
+	listing, ok := l.albums[album]
+	l.mu.Unlock()
+	if !ok || (!listing.names[name] && time.Since(listing.listed) > remoteListingTTL) {
+		// records the new listing
+		if _, err := src.Photos(ctx, album); err != nil {
+			return err
+		}
+		l.mu.Lock()
+		listing = l.albums[album]
+		l.mu.Unlock()
+	}
+	if !listing.names[name] {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// immichSource serves the photos of an album on an Immich server
+type immichSource struct {
+	baseURL string
+	apiKey  string
+	listed  remoteListings
+}
+
+func (s *immichSource) header() http.Header {
+	return http.Header{"X-Api-Key": {s.apiKey}}
+}
+
+func (s *immichSource) Photos(ctx context.Context, album string) ([]string, error) {
+	if album == "" {
+		return nil, errors.New("no Immich album ID set")
+	}
+
+	var resp struct {
+		Assets []struct {
+			ID               string `json:"id"`
+			Type             string `json:"type"`
+			OriginalFileName string `json:"originalFileName"`
+		} `json:"assets"`
+	}
+	u := s.baseURL + "/api/albums/" + url.PathEscape(album)
+	if err := remoteGet(ctx, u, s.header(), &resp, nil); err != nil {
+		return nil, err
+	}
+
+	filenames := make([]string, 0, len(resp.Assets))
+	for _, asset := range resp.Assets {
+		if asset.Type == "IMAGE" {
+			filenames = append(filenames, remoteName(asset.ID, asset.OriginalFileName))
+		}
+	}
+	s.listed.record(album, filenames)
+	return filenames, nil
+}
+
+func (s *immichSource) Path(ctx context.Context, album, name string) (string, error) {
+	return cachedPath("immich", album, name, func(w io.Writer) error {
+		if err := s.listed.check(ctx, s, album, name); err != nil {
+			return err
+		}
+		u := s.baseURL + "/api/assets/" + url.PathEscape(remoteID(name)) + "/original"
+		return remoteGet(ctx, u, s.header(), nil, w)
+	})
+}
+
+// photoprismSource serves the photos of an album on a PhotoPrism server
+type photoprismSource struct {
+	baseURL       string
+	authToken     string
+	downloadToken string
+	listed        remoteListings
+}
+
+func (s *photoprismSource) Photos(ctx context.Context, album string) ([]string, error) {
+	if album == "" {
+		return nil, errors.New("no PhotoPrism album UID set")
+	}
+
+	const pageSize = 1000
+	header := http.Header{"X-Auth-Token": {s.authToken}}
+
+	filenames := make([]string, 0)
+	for offset := 0; ; offset += pageSize {
+		var photos []struct {
+			Type     string `json:"Type"`
+			Hash     string `json:"Hash"`
+			FileName string `json:"FileName"`
+		}
+		u := fmt.Sprintf("%s/api/v1/photos?count=%d&offset=%d&s=%s",
+			s.baseURL, pageSize, offset, url.QueryEscape(album))
+		if err := remoteGet(ctx, u, header, &photos, nil); err != nil {
+			return nil, err
+		}
+
+		for _, photo := range photos {
+			if photo.Type == "image" && photo.Hash != "" {
+				// the download API addresses files by their hash
+				filenames = append(filenames, remoteName(photo.Hash, photo.FileName))
+			}
+		}
+		if len(photos) < pageSize {
+			s.listed.record(album, filenames)
+			return filenames, nil
+		}
+	}
+}
+
+func (s *photoprismSource) Path(ctx context.Context, album, name string) (string, error) {
+	return cachedPath("photoprism", album, name, func(w io.Writer) error {
+		if err := s.listed.check(ctx, s, album, name); err != nil {
+			return err
+		}
+		u := s.baseURL + "/api/v1/dl/" + url.PathEscape(remoteID(name)) +
+			"?t=" + url.QueryEscape(s.downloadToken)
+		return remoteGet(ctx, u, nil, nil, w)
+	})
+}
+
+// watchSource periodically checks the current album for changes, until the
+// context is done
+func watchSource(ctx context.Context, interval time.Duration) {
+	for sleep(ctx, interval) {
+		rescan()
+	}
+}
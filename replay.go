@@ -0,0 +1,204 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// replayIgnored are events, which are not part of the presentation itself and
+// thus are not replayed
+var replayIgnored = map[string]bool{
+	"export": true,
+	"replay": true,
+}
+
+var (
+	replayMu   sync.Mutex
+	replayStop chan struct{} // closed to stop the running replay
+)
+
+// replayStatus is sent as the "replay" event when a replay starts or ends
+type replayStatus struct {
+	Name    string  `json:"name"`
+	Speed   float64 `json:"speed"`
+	Playing bool    `json:"playing"`
+}
+
+// loadRecording reads all entries of the named recording
+func loadRecording(name string) ([]recordEntry, error) {
+	if !validName(name) {
+		return nil, errors.New("invalid recording")
+	}
+
+	f, err := os.Open(filepath.Join(recordDir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []recordEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || entries[0].Type != recordState {
+		return nil, errors.New("invalid recording")
+	}
+	return entries, nil
+}
+
+// startReplay plays back the named recording with the given speed factor.
+// A running replay is stopped first.
+func startReplay(name string, speed float64) error {
+	if speed <= 0 {
+		return errors.New("invalid speed")
+	}
+	entries, err := loadRecording(name)
+	if err != nil {
+		return err
+	}
+
+	stopReplay()
+
+	replayMu.Lock()
+	stop := make(chan struct{})
+	replayStop = stop
+	replayMu.Unlock()
+
+	go replay(entries, speed, stop)
+	streamer.SendJSON("", "replay", replayStatus{Name: name, Speed: speed, Playing: true})
+	return nil
+}
+
+// stopReplay stops the running replay, if any
+func stopReplay() {
+	replayMu.Lock()
+	stop := replayStop
+	replayStop = nil
+	replayMu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		streamer.SendJSON("", "replay", replayStatus{Playing: false})
+	}
+}
+
+// replay restores the recorded start state and then re-applies the recorded
+// commands and events with their original timing, scaled by speed
+func replay(entries []recordEntry, speed float64, stop chan struct{}) {
+	state := entries[0]
+	changeState(func() error {
+		if state.Album != show.currentAlbum() {
+			setAlbum(state.Album)
+		}
+		return setID(state.ID, nil)
+	})
+
+	last := state.Time
+	for _, e := range entries[1:] {
+		delay := time.Duration(float64(e.Time.Sub(last)) / speed)
+		last = e.Time
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		stateMu.Lock()
+		switch e.Type {
+		case recordCommand:
+			// album switches are not visible as events of their own
+			if e.Command["cmd"] == "album" {
+				setAlbum(e.Command["id"])
+			}
+
+		case recordEvent:
+			replayEvent(e)
+		}
+		stateMu.Unlock()
+	}
+
+	replayMu.Lock()
+	finished := replayStop == stop
+	if finished {
+		replayStop = nil
+	}
+	replayMu.Unlock()
+
+	if finished {
+		streamer.SendJSON("", "replay", replayStatus{Playing: false})
+	}
+}
+
+// replayEvent re-broadcasts a recorded event. Events changing the show state
+// are applied to it, so that new clients see the replayed state as well.
+func replayEvent(e recordEntry) {
+	switch {
+	case replayIgnored[e.Event]:
+	case e.Event == "set":
+		if slide, err := parseSlideEvent(e.Data); err == nil {
+			if err = setID(slide.ID, slide.Transition); err != nil {
+				log.Println("replay:", err)
+			}
+		}
+	case e.Event == "reset":
+		reset()
+	case e.Event == "batch":
+		var events []batchEvent
+		if err := json.Unmarshal([]byte(e.Data), &events); err != nil {
+			log.Println("replay:", err)
+			return
+		}
+		streamer.hold()
+		for _, b := range events {
+			replayEvent(recordEntry{Type: recordEvent, Event: b.Event, Data: b.Data})
+		}
+		streamer.release(true)
+	default:
+		streamer.SendString("", e.Event, e.Data)
+	}
+}
+
+// Recordings lists the names of all show recordings
+func Recordings(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	names := make([]string, 0)
+	fis, err := os.ReadDir(recordDir)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".jsonl") {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(names)
+}
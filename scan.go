@@ -0,0 +1,173 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// scanProgress is sent as "scan" event while the photos of an album are
+// scanned. The scan is complete when Done equals Total.
+type scanProgress struct {
+	Album string `json:"album"`
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+}
+
+// scanner hashes the photos, reads their metadata and builds the search index
+// in the background, so that large albums don't delay loading the show.
+// Starting a new scan cancels the running one.
+type scanner struct {
+	mu    sync.Mutex
+	gen   uint64 // incremented for each scan
+	album string
+	names []string
+	wake  chan struct{}
+}
+
+var scan = scanner{wake: make(chan struct{}, 1)}
+
+// start scans the given photos of the album
+func (s *scanner) start(album string, names []string) {
+	s.mu.Lock()
+	s.gen++
+	s.album, s.names = album, names
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default: // the worker is woken up already
+	}
+}
+
+// latest reports whether the scan gen was not replaced by another one
+func (s *scanner) latest(gen uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen == gen
+}
+
+// run is the scan worker, which ends when the context is done
+func (s *scanner) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		}
+
+		s.mu.Lock()
+		gen, album, names := s.gen, s.album, s.names
+		s.mu.Unlock()
+
+		if err := s.scan(ctx, gen, album, names); err != nil {
+			log.Println("scan:", err)
+		}
+	}
+}
+
+// outdated returns the photos of the album which were not scanned yet or
+// whose files changed since
+func outdated(ctx context.Context, album string, names []string) []string {
+	var stale []string
+	for _, name := range names {
+		path, err := source.Path(ctx, album, name)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		hashCache.Lock()
+		h, hashed := hashCache.entries[path]
+		hashCache.Unlock()
+		exifCache.Lock()
+		e, read := exifCache.entries[path]
+		exifCache.Unlock()
+		if !hashed || !read || !h.modTime.Equal(fi.ModTime()) || !e.modTime.Equal(fi.ModTime()) {
+			stale = append(stale, name)
+		}
+	}
+	return stale
+}
+
+// scan processes the new and changed photos of the album, reporting the
+// progress. The catalog and the search index are updated for all photos.
+func (s *scanner) scan(ctx context.Context, gen uint64, album string, names []string) error {
+	stale := outdated(ctx, album, names)
+	progress := scanProgress{Album: album, Total: len(stale)}
+	if len(stale) > 0 {
+		log.Printf("scan: %d new or changed photos in album %q", len(stale), album)
+		streamer.SendJSON("", "scan", progress)
+	}
+
+	captioned, found := false, false
+	last := time.Now()
+	for i, name := range stale {
+		if !s.latest(gen) || ctx.Err() != nil {
+			return nil // superseded by a new scan or shut down
+		}
+
+		// fill the caches, errors are dealt with when the results are used
+		hashPhoto(ctx, album, name)
+		photoEXIF(ctx, album, name)
+		if ok, err := autoCaption(ctx, album, name); err != nil {
+			log.Printf("caption %q: %v", name, err)
+		} else if ok {
+			captioned = true
+		}
+		if ok, err := locatePhoto(ctx, album, name); err != nil {
+			log.Printf("geocode %q: %v", name, err)
+		} else if ok && placeCaptions {
+			captioned = true
+		}
+		if _, err := recognizeText(ctx, album, name); err != nil {
+			log.Printf("ocr %q: %v", name, err)
+		}
+		if ok, err := detectFaces(ctx, album, name); err != nil {
+			log.Printf("faces %q: %v", name, err)
+		} else if ok {
+			found = true
+		}
+
+		if time.Since(last) >= scanEventInterval {
+			last = time.Now()
+			progress.Done = i + 1
+			streamer.SendJSON("", "scan", progress)
+		}
+	}
+
+	if err := recordFiles(ctx, album, names); err != nil {
+		return err
+	}
+	changed, err := flagDuplicates(ctx, album, names)
+	if err != nil {
+		return err
+	}
+	if !s.latest(gen) {
+		return nil
+	}
+	if (changed && skipDuplicates) || (found && show.filters().person != 0) {
+		// apply the new flags or faces, this starts another (fast) scan
+		reload()
+		return nil
+	}
+	index.current(ctx)
+	if captioned && album == show.currentAlbum() {
+		listChanged()
+	}
+
+	if len(stale) > 0 {
+		progress.Done = progress.Total
+		streamer.SendJSON("", "scan", progress)
+	}
+	return nil
+}
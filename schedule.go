@@ -0,0 +1,142 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Show states
+const (
+	stateLive      = "live"
+	stateScheduled = "scheduled" // starting soon
+	stateEnded     = "ended"
+)
+
+// showState is broadcast to the clients as "state" event
+type showState struct {
+	State string     `json:"state"`
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+var (
+	scheduleMu     sync.Mutex
+	schedule       = showState{State: stateLive}
+	scheduleGen    int // invalidates the timers of replaced schedules
+	scheduleTimers []*time.Timer
+)
+
+// currentState returns the current show state
+func currentState() showState {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	return schedule
+}
+
+// setState changes the show state and notifies the clients.
+// It must be called with scheduleMu held.
+func setState(state string) {
+	schedule.State = state
+	streamer.SendJSON("", "state", schedule)
+}
+
+// parseTime parses a time given as RFC 3339 or as local time, e.g.
+// "2014-12-24 18:00"
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid time: " + s)
+}
+
+// scheduleShow lets the show start at the given time, holding it in the
+// "starting soon" state until then. If end is not zero, autoplay stops and the
+// show ends at that time.
+func scheduleShow(start, end time.Time) error {
+	if !end.IsZero() && !end.After(start) {
+		return errors.New("end must be after start")
+	}
+	if !end.IsZero() && !end.After(time.Now()) {
+		return errors.New("end is in the past")
+	}
+
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+
+	stopSchedule()
+	gen := scheduleGen
+	schedule = showState{Start: &start}
+	if !end.IsZero() {
+		schedule.End = &end
+	}
+
+	if wait := time.Until(start); wait > 0 {
+		player.pause()
+		setState(stateScheduled)
+		scheduleTimers = append(scheduleTimers, time.AfterFunc(wait, func() {
+			stateMu.Lock()
+			defer stateMu.Unlock()
+			scheduleMu.Lock()
+			defer scheduleMu.Unlock()
+			if gen == scheduleGen {
+				goLive()
+			}
+		}))
+	} else {
+		goLive()
+	}
+
+	if !end.IsZero() {
+		scheduleTimers = append(scheduleTimers, time.AfterFunc(time.Until(end), func() {
+			stateMu.Lock()
+			defer stateMu.Unlock()
+			scheduleMu.Lock()
+			defer scheduleMu.Unlock()
+			if gen == scheduleGen {
+				player.pause()
+				setState(stateEnded)
+			}
+		}))
+	}
+	return nil
+}
+
+// cancelSchedule removes the schedule, the show is live again
+func cancelSchedule() {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+
+	stopSchedule()
+	schedule = showState{}
+	setState(stateLive)
+}
+
+// stopSchedule stops all pending timers.
+// It must be called with scheduleMu held.
+func stopSchedule() {
+	scheduleGen++
+	for _, t := range scheduleTimers {
+		t.Stop()
+	}
+	scheduleTimers = nil
+}
+
+// goLive starts the show from the first photo with autoplay.
+// It must be called with scheduleMu held.
+func goLive() {
+	notify(noticeShowStart, "Show is live", "The scheduled show went live.")
+	pushShowStarted()
+	setState(stateLive)
+	reset()
+	player.start(autoplayInterval)
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// screenTimeout limits the time for analyzing a single photo, e.g. screening
+const screenTimeout = time.Minute
+
+// screenResult is the verdict of screening an uploaded photo
+type screenResult struct {
+	Suspect bool    `json:"suspect"`
+	Score   float64 `json:"score,omitempty"`
+	Reason  string  `json:"reason,omitempty"`
+}
+
+// screener checks guest uploads for inappropriate content, e.g. nudity.
+// Suspect uploads are held back in the moderation queue.
+type screener interface {
+	// Screen checks the image file at the given path
+	Screen(ctx context.Context, path string) (screenResult, error)
+}
+
+// screening is the screener selected in the config, nil if disabled
+var screening screener
+
+// newScreener returns the screener selected in the config
+func newScreener() (screener, error) {
+	switch screenType {
+	case "":
+		return nil, nil
+	case "command":
+		if screenCommand == "" {
+			return nil, errors.New("screenCommand not set")
+		}
+		return commandScreener(screenCommand), nil
+	case "api":
+		if screenURL == "" {
+			return nil, errors.New("screenURL not set")
+		}
+		return &apiScreener{url: screenURL, token: screenToken}, nil
+	default:
+		return nil, errors.New("unknown screener: " + screenType)
+	}
+}
+
+// commandScreener runs a local program, e.g. a wrapper around a classifier
+// model, with the path of the photo as last argument. Exit code 0 means the
+// photo is fine, 1 that it is suspect. The output is kept as reason.
+type commandScreener string
+
+func (c commandScreener) Screen(ctx context.Context, path string) (screenResult, error) {
+	out, err := runCommand(ctx, string(c), path)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return screenResult{Suspect: true, Reason: strings.TrimSpace(string(out))}, nil
+	}
+	if err != nil {
+		return screenResult{}, err
+	}
+	return screenResult{}, nil
+}
+
+// runCommand runs the command line with the path in place of the argument {}
+// or, if there is none, appended, and returns its output
+func runCommand(ctx context.Context, command, path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, screenTimeout)
+	defer cancel()
+
+	args := strings.Fields(command)
+	replaced := false
+	for i, arg := range args {
+		if arg == "{}" {
+			args[i], replaced = path, true
+		}
+	}
+	if !replaced {
+		args = append(args, path)
+	}
+	return exec.CommandContext(ctx, args[0], args[1:]...).Output()
+}
+
+// apiScreener posts the photo to an HTTP API, which responds with a JSON
+// screenResult. Photos are suspect if the API says so or if the score is at
+// least screenThreshold.
+type apiScreener struct {
+	url   string
+	token string // sent as bearer token if set
+}
+
+var screenClient = &http.Client{Timeout: screenTimeout}
+
+func (s *apiScreener) Screen(ctx context.Context, path string) (screenResult, error) {
+	var res screenResult
+	if err := postImage(ctx, s.url, s.token, path, &res); err != nil {
+		return res, err
+	}
+	if res.Score >= screenThreshold {
+		res.Suspect = true
+	}
+	return res, nil
+}
+
+// postImage posts the image file to an HTTP API and decodes its JSON
+// response into v
+func postImage(ctx context.Context, url, token, path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := screenClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(url + ": " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// screenUpload screens an upload if a screener is configured. Uploads which
+// can't be screened are treated as suspect.
+func screenUpload(ctx context.Context, u *guestUpload) *screenResult {
+	if screening == nil {
+		return nil
+	}
+	res, err := screening.Screen(ctx, u.path())
+	if err != nil {
+		res = screenResult{Suspect: true, Reason: "screening failed: " + err.Error()}
+	}
+	return &res
+}
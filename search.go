@@ -0,0 +1,142 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// searchResult is a photo matching a search query
+type searchResult struct {
+	Album   string     `json:"album"`
+	Photo   string     `json:"photo"`
+	ID      int        `json:"id"` // position in the show
+	URL     string     `json:"url"`
+	Caption string     `json:"caption,omitempty"`
+	Tags    []string   `json:"tags,omitempty"`
+	Camera  string     `json:"camera,omitempty"`
+	Place   string     `json:"place,omitempty"`
+	Taken   *time.Time `json:"taken,omitempty"`
+}
+
+// searchQuery is a parsed search request
+type searchQuery struct {
+	phrases  []searchPhrase // each has to match the name, caption, tags or camera
+	tags     []string
+	camera   string
+	from, to time.Time // date range of the capture time
+}
+
+// parseSearch parses the query parameters q, tag, camera, from and to.
+// The query q supports "quoted phrases" and prefixes (cer*), words in q
+// starting with '#' match tags only.
+func parseSearch(v url.Values) (*searchQuery, error) {
+	q := &searchQuery{camera: strings.ToLower(strings.TrimSpace(v.Get("camera")))}
+	phrases, tags := parsePhrases(v.Get("q"))
+	q.phrases = phrases
+	for _, t := range append(tags, v["tag"]...) {
+		tag, err := normalizeTag(t)
+		if err != nil {
+			return nil, err
+		}
+		q.tags = append(q.tags, tag)
+	}
+
+	var err error
+	if s := v.Get("from"); s != "" {
+		if q.from, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return nil, err
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.to, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return nil, err
+		}
+		q.to = q.to.AddDate(0, 0, 1) // inclusive
+	}
+	return q, nil
+}
+
+// match reports whether the photo matches the filters of the query
+func (q *searchQuery) match(m photoMeta, exif *exifData) bool {
+	for _, tag := range q.tags {
+		if !hasTag(m.Tags, tag) {
+			return false
+		}
+	}
+
+	camera := strings.ToLower(exif.Camera())
+	if q.camera != "" && !strings.Contains(camera, q.camera) {
+		return false
+	}
+	if !q.from.IsZero() && (exif.Taken.IsZero() || exif.Taken.Before(q.from)) {
+		return false
+	}
+	if !q.to.IsZero() && (exif.Taken.IsZero() || !exif.Taken.Before(q.to)) {
+		return false
+	}
+	return true
+}
+
+// Search finds photos of the current show by filename, caption, tag and EXIF
+// fields, e.g. /api/search?q=cake+%23party&camera=canon&from=2014-12-24
+func Search(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q, err := parseSearch(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	snap := show.snapshot()
+	album, names, entries := snap.album, snap.photos, snap.entries
+	var hits map[string]bool
+	if len(q.phrases) > 0 {
+		hits = index.search(r.Context(), q.phrases)
+	}
+
+	all := meta.album(album)
+	query := photoQuery(clientIP(r))
+	results := make([]searchResult, 0)
+	for i, name := range names {
+		if hits != nil && !hits[name] {
+			continue
+		}
+
+		exif, err := photoEXIF(r.Context(), album, name)
+		if err != nil {
+			exif = &exifData{}
+		}
+		m := all[name]
+		if !q.match(m, exif) {
+			continue
+		}
+
+		res := searchResult{
+			Album:   album,
+			Photo:   name,
+			ID:      i,
+			URL:     "/photos/" + url.PathEscape(name) + query,
+			Caption: photoCaption(m, entries, i),
+			Tags:    m.Tags,
+			Camera:  exif.Camera(),
+			Place:   m.Place,
+		}
+		if !exif.Taken.IsZero() {
+			taken := exif.Taken
+			res.Taken = &taken
+		}
+		results = append(results, res)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,379 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/julienschmidt/sse"
+)
+
+// rootCtx is canceled when the server shuts down, which ends the background
+// workers and the event streams
+var rootCtx = context.Background()
+
+// sleep pauses for d. It returns false if the context is done before.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Server is the photo show server. The show state is shared by the package,
+// so only one Server can run at a time.
+type Server struct {
+	photoDir string
+	user     []byte
+	pass     []byte
+	streamer *showStreamer
+	listener net.Listener
+	extra    []Middleware
+
+	handler http.Handler
+	http    *http.Server
+	cancel  context.CancelFunc // of rootCtx
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithPhotoDir sets the directory of the photos for the "dir" photo source,
+// photoDir by default
+func WithPhotoDir(dir string) Option {
+	return func(s *Server) {
+		s.photoDir = dir
+	}
+}
+
+// WithAuth sets the credentials of the master, username and password by
+// default
+func WithAuth(user, pass string) Option {
+	return func(s *Server) {
+		s.user, s.pass = []byte(user), []byte(pass)
+	}
+}
+
+// WithStreamer sets the streamer sending the events to the clients
+func WithStreamer(st *showStreamer) Option {
+	return func(s *Server) {
+		s.streamer = st
+	}
+}
+
+// WithMiddleware adds middleware after the one configured in middleware, in
+// the given order
+func WithMiddleware(mws ...Middleware) Option {
+	return func(s *Server) {
+		s.extra = append(s.extra, mws...)
+	}
+}
+
+// WithListener makes the server accept connections from l instead of
+// listening on host
+func WithListener(l net.Listener) Option {
+	return func(s *Server) {
+		s.listener = l
+	}
+}
+
+// NewServer returns a server configured by the options, the config above
+// providing the defaults
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{
+		photoDir: photoDir,
+		user:     []byte(username),
+		pass:     []byte(password),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.streamer == nil {
+		s.streamer = &showStreamer{Streamer: sse.New()}
+	}
+
+	mws, err := newMiddleware(middleware, s.user, s.pass)
+	if err != nil {
+		return nil, err
+	}
+	s.handler = chain(s.routes(), append(mws, s.extra...))
+	return s, nil
+}
+
+// Handler returns the handler of all routes, e.g. for tests with
+// net/http/httptest
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// routes registers the handlers
+func (s *Server) routes() *httprouter.Router {
+	router := httprouter.New()
+	router.GET("/", PhotoShow)
+	router.GET("/master", PhotoMaster)
+	router.POST("/master", PhotoMasterCMD)
+	router.POST("/master/import", PhotoImport)
+	router.GET("/master/contactsheet.pdf", ContactSheet)
+	router.GET("/master/analytics", Analytics)
+	router.GET("/master/analytics.csv", AnalyticsCSV)
+	router.GET("/master/cast", CastDevices)
+	router.POST("/master/cast", CastControl)
+	router.GET("/master/dlna", DLNARenderers)
+	router.POST("/master/dlna", DLNAControl)
+	router.GET("/master/schedules", RecurringShows)
+	router.POST("/master/schedules", AddRecurringShow)
+	router.DELETE("/master/schedules/:id", DeleteRecurringShow)
+	router.GET("/master/recordings", Recordings)
+	router.GET("/master/presets", Presets)
+	router.POST("/master/presets/:name", SavePreset)
+	router.POST("/master/presets/:name/load", LoadPreset)
+	router.DELETE("/master/presets/:name", DeletePreset)
+	router.POST("/master/export", ExportStart)
+	router.GET("/master/export/:id", ExportStatus)
+	router.GET("/master/export/:id/video.mp4", ExportDownload)
+	router.GET("/master/photos", PhotoCatalog)
+	router.POST("/master/photos/:photo", PhotoUpdate)
+	router.DELETE("/master/photos/:photo", DeletePhoto)
+	router.POST("/master/share/:photo", ShareLink)
+	router.GET("/master/invites", Invites)
+	router.POST("/master/invites", SendInvites)
+	router.POST("/master/narration/:photo", NarrationUpload)
+	router.DELETE("/master/narration/:photo", DeleteNarration)
+	router.GET("/master/uploads", Uploads)
+	router.GET("/master/uploads/:id", UploadPhoto)
+	router.POST("/master/uploads/:id", ReviewUpload)
+	router.GET("/master/staging", Staging)
+	router.POST("/master/staging", PublishStaged)
+	router.GET("/master/staging/:id", StagedPhoto)
+	router.DELETE("/master/staging/:id", DiscardStaged)
+	router.GET("/master/trash", Trash)
+	router.POST("/master/trash/:id", RestorePhoto)
+	router.DELETE("/master/trash/:id", PurgePhoto)
+	router.POST("/master/order", PhotoOrder)
+	router.GET("/master/favorites", Favorites)
+	router.GET("/master/duplicates", Duplicates)
+	router.POST("/master/duplicates", DuplicateAction)
+	router.GET("/master/verify", VerifyStatus)
+	router.POST("/master/verify", VerifyStart)
+	router.GET("/master/maintenance", MaintenanceStatus)
+	router.POST("/master/maintenance", MaintenanceStart)
+	router.GET("/master/tags", Tags)
+	router.POST("/master/tags", TagPhotos)
+	router.POST("/master/tags/:tag", RenameTag)
+	router.DELETE("/master/tags/:tag", DeleteTag)
+	router.GET("/master/people", People)
+	router.POST("/master/people/:id", NamePerson)
+	router.GET("/master/metrics", Metrics)
+	router.GET("/master/clients", Clients)
+	router.GET("/master/wall", VideoWall)
+	router.POST("/master/wall", SetVideoWall)
+	router.DELETE("/master/wall", DeleteVideoWall)
+	router.DELETE("/master/clients/:id", KickClient)
+	router.DELETE("/master/blocked/:ip", UnblockIP)
+	router.GET("/master/graphql", GraphQL)
+	router.POST("/master/graphql", GraphQL)
+	router.POST("/favorites/:photo", StarPhoto)
+	router.GET("/api/search", Search)
+	router.GET("/api/timeline", Timeline)
+	for _, rt := range apiRoutes {
+		router.Handle(rt.method, apiPrefix+rt.path, rt.handle)
+	}
+	router.GET("/api/openapi.json", OpenAPI)
+	router.GET("/photos.json", PhotosJSON)
+	router.GET("/events", Events)
+	router.GET("/poll", Poll)
+	router.GET("/time", Time)
+	router.GET("/photos/:photo", PhotosServer)
+	router.GET("/slides/:name", TextSlide)
+	router.GET("/narration/:photo", Narration)
+	router.GET("/music/:track", MusicFile)
+	router.POST("/music/duration", MusicDuration)
+	router.GET("/thumbs/:photo", ThumbServer)
+	router.GET("/theme/*filepath", ThemeFile)
+	router.GET("/photos.zip", PhotosZIP)
+	router.POST("/upload", GuestUpload)
+	router.GET("/download/:photo", DownloadPhoto)
+	router.GET("/shared/:photo", SharedPhoto)
+	router.GET("/feed.atom", Feed)
+	router.GET("/calendar.ics", Calendar)
+	router.GET("/qr.png", JoinQR)
+	router.GET("/cdn/*path", CDNPhoto)
+	router.POST("/reaction", Reaction)
+	router.POST("/follow", FollowReport)
+	router.POST("/unlock", Unlock)
+	router.POST("/push", PushSubscribe)
+	router.DELETE("/push", PushUnsubscribe)
+	router.POST("/master/sync", SyncViewers)
+	router.GET("/master/lock", MasterLock)
+	router.DELETE("/master/lock", ReleaseLock)
+	router.GET("/master/audit", AuditLog)
+	router.GET("/master/cues", Cues)
+	router.POST("/master/cues", SetCues)
+	router.DELETE("/master/cues", ClearCues)
+	router.POST("/slack", SlackCommand)
+	router.GET("/favicon.ico", Favicon)
+	router.GET("/branding/logo", Logo)
+	router.GET("/branding/og-image", OGImage)
+	router.GET("/manifest.webmanifest", Manifest)
+	router.GET("/sw.js", ServiceWorker)
+	router.GET("/icons/:icon", AppIcon)
+	router.POST(grpcService+":method", GRPC)
+
+	// Server-Sent Events
+	router.Handler("GET", "/listen", s.streamer)
+	return router
+}
+
+// init loads the photos and the saved state and starts the background jobs
+func (s *Server) init() error {
+	streamer = s.streamer
+	rootCtx, s.cancel = context.WithCancel(context.Background())
+	ctx := rootCtx
+
+	var err error
+	if source, err = newSource(s.photoDir); err != nil {
+		return err
+	}
+	source = cardSource{source}
+	if err = meta.load(); err != nil {
+		return err
+	}
+	if err = loadBundles(); err != nil {
+		return err
+	}
+	if err = loadCustomCode(); err != nil {
+		return err
+	}
+	if err = loadTemplates(); err != nil {
+		return err
+	}
+	startTrash(ctx)
+	if err = loadUploads(); err != nil {
+		return err
+	}
+	if err = loadStaging(); err != nil {
+		return err
+	}
+	if err = loadPush(); err != nil {
+		return err
+	}
+	if screening, err = newScreener(); err != nil {
+		return err
+	}
+	if cdn, err = newCDNSigner(); err != nil {
+		return err
+	}
+	if captioning, err = newCaptioner(); err != nil {
+		return err
+	}
+	if faceDetection, err = newFaceDetector(); err != nil {
+		return err
+	}
+	if ocr, err = newTextRecognizer(); err != nil {
+		return err
+	}
+	if geocoding, err = newGeocoder(); err != nil {
+		return err
+	}
+	if err = loadPeople(); err != nil {
+		return err
+	}
+	if err = checkTransitions(); err != nil {
+		return err
+	}
+	if err = loadShow(); err != nil {
+		return err
+	}
+	if musicDir != "" {
+		if err = loadMusic(); err != nil {
+			return err
+		}
+	}
+	browsing.Store(viewerBrowsing)
+	go scan.run(ctx)
+	setAlbum(defaultAlbum) // errors of loading the photos are shown to the clients
+
+	if sourceType != "dir" && pollInterval > 0 {
+		go watchSource(ctx, pollInterval)
+	}
+	go exportWorker(ctx)
+	startMQTT(ctx)
+	startDiscord(ctx)
+	startKiosk()
+	startIdle()
+	startCron(ctx)
+	if keepaliveInterval > 0 {
+		go s.streamer.keepalive(ctx, keepaliveInterval)
+	}
+
+	go watchDisk(ctx)
+	go runMaintenance(ctx)
+
+	sendWebhook(hookShowStart, nil)
+	notify(noticeShowStart, "Show started", "The photo show server started.")
+	return nil
+}
+
+// Start initializes the photo show and serves it in the background
+func (s *Server) Start() error {
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	l := s.listener
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", host); err != nil {
+			return err
+		}
+	}
+	s.http = &http.Server{
+		Handler:     s.handler,
+		BaseContext: func(net.Listener) context.Context { return rootCtx },
+	}
+	if grpcEnabled && !https {
+		s.http.Protocols = new(http.Protocols)
+		s.http.Protocols.SetHTTP1(true)
+		s.http.Protocols.SetUnencryptedHTTP2(true)
+	}
+	go func() {
+		var err error
+		if https {
+			err = s.http.ServeTLS(l, crtPath, keyPath)
+		} else {
+			err = s.http.Serve(l)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("HTTP server error: ", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown ends the photo show, stops the background workers and the server,
+// waiting for the pending requests until the context is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	shutdown()
+	if s.http == nil {
+		return nil
+	}
+	if err := s.http.Shutdown(ctx); err != nil {
+		return s.http.Close()
+	}
+	return nil
+}
@@ -7,19 +7,22 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"github.com/julienschmidt/sse"
 )
 
 // Set your config here
@@ -27,6 +30,305 @@ const (
 	host     string = ":8080"
 	photoDir string = "./photos/"
 
+	// URL under which the server is reachable by other devices, e.g. a
+	// Chromecast in the local network
+	publicURL string = "http://192.168.0.2:8080"
+
+	// Photo source: "dir" shows the photos in photoDir, "immich" and
+	// "photoprism" show an album of the respective photo library server
+	sourceType   string = "dir"
+	defaultAlbum string = "" // subdirectory of photoDir or remote album ID
+
+	// Remote photo library config
+	remoteURL           string        = "http://localhost:2283"
+	remoteToken         string        = "" // Immich API key or PhotoPrism auth token
+	remoteDownloadToken string        = "" // PhotoPrism only
+	cacheDir            string        = "./cache/"
+	pollInterval        time.Duration = time.Minute // check album for changes
+
+	// Images of web servers in playlists are fetched again after
+	// webImageRefresh, the cached copy is shown if that fails
+	webImageRefresh time.Duration = 24 * time.Hour
+	maxWebImageSize int64         = 32 << 20
+
+	// Maximum size of uploaded ZIP archives in bytes, and of all photos
+	// extracted from one
+	maxImportSize      int64 = 1 << 30
+	maxImportExtracted int64 = 4 << 30
+
+	// ZIP download of all photos for viewers.
+	// If downloadApproval is set, the master must allow downloads first.
+	// If downloadPIN is set, it must be given as the pin query parameter.
+	downloadApproval bool   = false
+	downloadPIN      string = ""
+
+	// Original photos can be downloaded via /download/:photo, limited to
+	// downloadRate per IP address and hour (0 is unlimited). The show itself
+	// displays variants scaled down to at most displaySize pixels (0 shows
+	// the originals).
+	downloadRate int = 60
+	displaySize  int = 2560
+
+	// Hotlink protection: photos are only served with a per-viewer token and
+	// not to other sites. Set hotlinkSecret to keep the tokens and shared
+	// links valid across restarts. In noDownloads mode, all downloads are disabled and the
+	// viewers' browsers are asked not to offer saving the photos.
+	hotlinkProtection bool   = false
+	hotlinkSecret     string = ""
+	noDownloads       bool   = false
+
+	// Validity of the signed links to single photos the master shares,
+	// by default and at most
+	shareTTL    time.Duration = 7 * 24 * time.Hour
+	maxShareTTL time.Duration = 30 * 24 * time.Hour
+
+	// Number of the photos added last in the Atom feed at /feed.atom
+	feedSize int = 50
+
+	// Days of upcoming shows in the iCalendar feed at /calendar.ics
+	calendarDays int = 60
+
+	// SMTP server sending the invitations and notices, e.g.
+	// smtpAddr = "smtp.example.com:587" and
+	// mailFrom = "Photo Show <show@example.com>". The connection is upgraded
+	// with STARTTLS if the server offers it.
+	smtpAddr     string = ""
+	smtpUser     string = ""
+	smtpPassword string = ""
+	mailFrom     string = ""
+
+	// Operator notified by email about the notices in notifyEvents: the start
+	// of the show, more than notifyUploads uploads waiting for moderation,
+	// less than notifyDiskFree bytes left on the disk and notifyAuthFailures
+	// failed logins of masters within 10 minutes. Each kind of notice is sent
+	// at most once an hour.
+	notifyEmail        string = ""
+	notifyUploads      int    = 20
+	notifyDiskFree     int64  = 1 << 30
+	notifyAuthFailures int    = 10
+
+	// Web Push notifications for viewers who opt in, when a scheduled show
+	// goes live and when photos are published into a public album. The VAPID
+	// key identifying the server is generated into pushKeyFile on the first
+	// start, the subscriptions are stored in pushSubsPath. pushContact is
+	// given to the push services, e.g. "mailto:ops@example.com", publicURL if
+	// empty.
+	webPush      bool   = false
+	pushKeyFile  string = "./push-key.pem"
+	pushSubsPath string = "./push.json"
+	pushContact  string = ""
+
+	// Maintenance at the quiet hours given by a cron expression, e.g.
+	// "0 3 * * *" every night at 3:00: all albums are scanned again, the
+	// thumbnails of new and changed photos are regenerated and removed photos
+	// are forgotten. The report of the last run is at /master/maintenance.
+	maintenanceCron string = ""
+
+	// Photos served by a CDN pulling them from /cdn/ of this server, e.g.
+	// cdnURL = "https://cdn.example.com", which still serves the pages, the
+	// API and the events. The CDN URLs are signed for cdnTTL if cdnSigning
+	// is "cloudfront", with the key pair cdnKeyID and its RSA private key in
+	// cdnKeyFile, or "cloudflare", with the HMAC secret cdnSecret. The CDN
+	// can send cdnOriginSecret in the X-Origin-Secret header, so that only
+	// it can pull photos, which signing requires. Only the photos of public
+	// albums are served by the CDN.
+	cdnURL          string        = ""
+	cdnSigning      string        = ""
+	cdnKeyID        string        = ""
+	cdnKeyFile      string        = ""
+	cdnSecret       string        = ""
+	cdnOriginSecret string        = ""
+	cdnTTL          time.Duration = 24 * time.Hour
+
+	// Slideshow video export defaults
+	ffmpegPath       string        = "ffmpeg"
+	exportDir        string        = "./exports/"
+	exportDuration   time.Duration = 5 * time.Second // per photo
+	exportTransition string        = "fade"
+	exportWidth      int           = 1920
+	exportHeight     int           = 1080
+
+	// Autoplay advances the show every autoplayInterval. In kiosk mode the
+	// show plays on startup without a master, looping through kioskPlaylist.
+	autoplayInterval time.Duration = 10 * time.Second
+	kioskMode        bool          = false
+
+	// Switch to autoplay if the master did not issue a command for this long,
+	// and back when the master acts again. Zero disables it.
+	idleAutoplay time.Duration = 0
+
+	// Allow viewers to star photos via POST /favorites/:photo
+	viewerFavorites bool = false
+
+	// Let the viewers browse the photos on their own devices, until the
+	// master syncs everyone back to the show. The master can change it.
+	viewerBrowsing bool = false
+
+	// Photos with the same content are flagged as duplicates when scanning.
+	// With perceptualHashes, also similar images are, e.g. resized copies,
+	// whose hashes differ in at most duplicateDistance of 64 bits.
+	// If skipDuplicates is set, they are left out of the show.
+	perceptualHashes  bool = false
+	duplicateDistance int  = 4
+	skipDuplicates    bool = false
+
+	// Captions generated for photos without one when scanning: "command"
+	// runs captionCommand with the photo path appended and takes its output,
+	// "api" posts the photo to captionURL. See captions.go for the protocols.
+	captionType    string = ""
+	captionCommand string = ""
+	captionURL     string = ""
+	captionToken   string = ""
+
+	// Face detection when scanning, to filter the show by person: "command"
+	// runs faceCommand with the photo path appended, "api" posts the photo to
+	// faceURL, see faces.go. Faces whose embeddings are at most faceDistance
+	// apart are considered the same person.
+	faceType     string  = ""
+	faceCommand  string  = ""
+	faceURL      string  = ""
+	faceToken    string  = ""
+	faceDistance float64 = 0.6
+	peoplePath   string  = "./people.json"
+
+	// Reverse geocoding of geotagged photos when scanning: "nominatim" uses
+	// the OpenStreetMap server at geocodeURL, "api" requests
+	// geocodeURL?lat=..&lon=.., see geocode.go. With placeCaptions, photos
+	// without caption show the place name.
+	geocodeType   string = ""
+	geocodeURL    string = "https://nominatim.openstreetmap.org"
+	geocodeToken  string = ""
+	placeCaptions bool   = true
+
+	// Text recognition when scanning, making text in photos searchable:
+	// "command" runs ocrCommand with the photo path in place of {} and takes
+	// its output, "api" posts the photo to ocrURL, see ocr.go.
+	ocrType    string = ""
+	ocrCommand string = "tesseract {} stdout"
+	ocrURL     string = ""
+	ocrToken   string = ""
+
+	// Minimum time between two progress events while scanning the photos
+	scanEventInterval time.Duration = 500 * time.Millisecond
+
+	// Viewers can upload photos via the show page if guestUploads is set,
+	// up to uploadRate per IP address and hour. With moderateUploads, the
+	// uploads wait in uploadDir until the master approves them.
+	guestUploads    bool   = false
+	moderateUploads bool   = true
+	uploadDir       string = "./uploads/"
+	uploadRate      int    = 20
+	maxUploadSize   int64  = 64 << 20
+
+	// Screening of guest uploads, e.g. for nudity: "command" runs
+	// screenCommand with the photo path appended, "api" posts the photo to
+	// screenURL. Suspect uploads are held back for review even if
+	// moderateUploads is not set. See screen.go for the protocols.
+	screenType      string  = ""
+	screenCommand   string  = ""
+	screenURL       string  = ""
+	screenToken     string  = ""
+	screenThreshold float64 = 0.8 // minimum suspect score of API results
+
+	// Deleted photos are kept in trashDir for trashRetention, during which
+	// they can be restored. It should be on the same file system as photoDir.
+	trashDir       string        = "./trash/"
+	trashRetention time.Duration = 30 * 24 * time.Hour
+
+	// With stagePhotos, imported photos, guest uploads and Discord photos wait
+	// in stagingDir, unseen by the viewers, until the master publishes them
+	// into their albums. It should be on the same file system as photoDir.
+	stagePhotos bool   = false
+	stagingDir  string = "./staging/"
+
+	// Watermark composited onto the served photos, the originals on disk are
+	// not changed. Set watermarkText or watermarkImage (a PNG file) to enable
+	// it. The position is top-left, top-right, bottom-left, bottom-right or
+	// center, the scale is the width of the watermark relative to the photo.
+	watermarkText     string  = ""
+	watermarkImage    string  = ""
+	watermarkPosition string  = "bottom-right"
+	watermarkOpacity  float64 = 0.6
+	watermarkScale    float64 = 0.2
+
+	// File storing the per-photo metadata like display durations
+	catalogPath string = "./catalog.json"
+
+	// File storing the show state kept across restarts, like the color mode
+	showStatePath string = "./show.json"
+
+	// File storing the presets of the show saved by the master
+	presetsPath string = "./presets.json"
+
+	// Look of the pages: the theme is a subdirectory of themeDir with page
+	// templates and assets, which are served under /theme/. Files missing in
+	// it are taken from the default theme.
+	theme           string = "default"
+	themeDir        string = "./themes/"
+	backgroundColor string = "#000"
+	textColor       string = "#FFF"
+	accentColor     string = "#353535" // buttons of the master page
+	footerText      string = ""
+
+	// Branding: the title and description of the event are shown in the
+	// pages and in previews of links to the show. The image files are served
+	// under /branding/. The favicon defaults to the one of the theme, the
+	// preview image (OpenGraph) to the logo.
+	pageTitle       string = "Remote Photo Show"
+	pageDescription string = ""
+	faviconFile     string = ""
+	logoFile        string = ""
+	ogImageFile     string = ""
+
+	// UI language, e.g. "de". If empty, it is selected by the browser's
+	// preferences. Translations are read from langDir/<language>.json.
+	language string = ""
+	langDir  string = "./lang/"
+
+	// Caching of the photos by the service worker of the installed show, so
+	// that it survives short connection drops: "cache-first", "network-first"
+	// or "none". At most photoCacheSize photos are kept on the device.
+	photoCacheStrategy string = "cache-first"
+	photoCacheSize     int    = 50
+
+	// Directory of playlist files defining the order, durations, captions and
+	// sections of an album's photos, named <album>.json or <album>.m3u
+	playlistDir string = "./playlists/"
+
+	// Directory for show recordings
+	recordDir string = "./recordings/"
+
+	// Append-only log of the changes made by the masters, who made them from
+	// where and the state of the show before. Leave empty to disable.
+	auditPath string = "./audit.jsonl"
+
+	// MQTT broker (e.g. "tcp://localhost:1883"), leave empty to disable.
+	// The show state is published to <mqttTopic>/slide and <mqttTopic>/status,
+	// commands are accepted on <mqttTopic>/command.
+	mqttBroker   string = ""
+	mqttUser     string = ""
+	mqttPassword string = ""
+	mqttClientID string = "remotephotoshow"
+	mqttTopic    string = "photoshow"
+
+	// Signing secret of the Slack app providing the slash command, which is
+	// served at /slack. Leave empty to disable.
+	slackSigningSecret string = ""
+
+	// Discord bot token, leave empty to disable the bot. Commands like
+	// "!photoshow next" are accepted in discordChannel, image attachments
+	// posted in discordPhotoChannel are added to discordAlbum.
+	discordToken        string        = ""
+	discordChannel      string        = ""
+	discordPhotoChannel string        = ""
+	discordAlbum        string        = ""
+	discordPrefix       string        = "!photoshow"
+	discordPollInterval time.Duration = 5 * time.Second
+
+	// Announce the show as device to Home Assistant via MQTT discovery
+	haDiscovery bool   = false
+	haPrefix    string = "homeassistant"
+
 	// HTTPS config
 	https   bool   = false
 	crtPath string = "/etc/ssl/http.pem"
@@ -35,165 +337,749 @@ const (
 	// Credentials for master site
 	username string = "gordon"
 	password string = "secret!"
+
+	// Priority of the master above among the further masters. The changes of
+	// a master lock out those of masters with lower priority for masterLock.
+	masterPriority int           = 10
+	masterLock     time.Duration = 2 * time.Minute
+
+	// Requests per IP address and minute with the "ratelimit" middleware
+	requestRate int = 600
+
+	// GraphQL endpoint at /master/graphql for querying the catalog, with
+	// subscriptions to the slide changes, see gqlschema.go
+	graphqlEnabled bool = false
+
+	// gRPC service of photoshow.proto on the same port, for native apps and
+	// embedded remotes. Without https, it is served as unencrypted HTTP/2.
+	grpcEnabled bool = false
+
+	// Screens show a new slide syncDelay after it was sent, at the same time
+	// by the server clock synchronized via /time, instead of on arrival.
+	// It should exceed the latency of the slowest screen, 0 disables it.
+	syncDelay time.Duration = 0
+
+	// Long polling at /poll for clients whose browsers or proxies break the
+	// event stream: requests wait up to pollTimeout for the next event
+	pollTimeout time.Duration = 25 * time.Second
+
+	// Number of recent events kept for /events, slow pollers and resumed
+	// event streams, at least 1
+	historySize int = 100
+
+	// Interval of the ping events keeping idle /listen connections open
+	// through proxies and mobile networks, 0 disables them
+	keepaliveInterval time.Duration = 30 * time.Second
+
+	// Background music: the audio files in musicDir, or the tracks of its
+	// playlist.m3u, played in a loop at musicVolume (0 to 1) in sync on the
+	// viewers' devices and controlled by the master. Leave empty to disable.
+	// Without musicOnViewers, only pages opened with ?music=1 play it and the
+	// narrations of the photos, e.g. a dedicated audio client at the speakers.
+	musicDir       string  = ""
+	musicVolume    float64 = 0.5
+	musicOnViewers bool    = true
+
+	// Transition of the screens to a new slide: "fade", "slide" or "none".
+	// The master can change it, also for single slide changes.
+	transition         string        = "none"
+	transitionDuration time.Duration = 500 * time.Millisecond
 )
 
 var (
-	streamer  *sse.Streamer
-	imgID     uint64
-	endID     uint64
-	photoJSON []byte
-	photoErr  error
+	// Middleware wrapping all requests, outermost first: "recovery",
+	// "logging", "metrics" (served at /master/metrics), "ratelimit" and
+	// "auth" (of the master pages, added last if missing)
+	middleware = []string{"recovery", "metrics", "ratelimit", "auth"}
+
+	// Further masters with their own credentials and priority, e.g.
+	// masters = []masterAccount{{Username: "tech", Password: "...", Priority: 20}}
+	masters = []masterAccount{}
+
+	// Reactions viewers can send to the current photo
+	reactions = []string{"heart", "laugh", "wow", "clap"}
+
+	// Albums played one after another in kiosk mode. If empty, defaultAlbum
+	// is played in a loop.
+	kioskPlaylist = []string{}
+
+	// Shows started automatically at the times given by cron expressions,
+	// e.g. {Cron: "0 18 * * fri", Album: "week-in-review", Duration: time.Hour}.
+	// Those added by the API are saved in showStatePath.
+	recurringShows = []recurringShow{}
+
+	// URLs notified about show events. If webhookSecret is set, the payloads
+	// are signed with HMAC-SHA256 in the X-Photoshow-Signature header.
+	webhooks      = []string{}
+	webhookSecret = ""
+
+	// Notices emailed to notifyEmail: "show.start", "uploads", "disk" and
+	// "auth"
+	notifyEvents = []string{"show.start", "uploads", "disk", "auth"}
+
+	// Extra stylesheets and scripts added to the show and master pages, to
+	// brand them without changing the theme. Entries ending in .css or .js
+	// are files read on startup, others are inline snippets, e.g.
+	// customCSS = []string{"branding.css", "#caption { font-size: 2em; }"}
+	customCSS = []string{}
+	customJS  = []string{}
+
+	// Transitions of albums differing from the default one, e.g.
+	// albumTransitions = map[string]slideTransition{"party": {Type: "slide", Duration: 300}}
+	// with the duration in ms
+	albumTransitions = map[string]slideTransition{}
+
+	// Albums only the masters or viewers entering a PIN may view, e.g.
+	// albumAccess = map[string]accessRule{"family": {Level: "pin", PIN: "2412"}, "drafts": {Level: "private"}}
+	// Other albums are public.
+	albumAccess = map[string]accessRule{}
+
+	// Color modes the master can switch all viewers to at once, e.g. for a
+	// dark venue or bright daylight. Without a mode, the theme colors are used.
+	colorModes = []colorMode{
+		{Name: "dark", Background: "#000", Text: "#FFF"},
+		{Name: "light", Background: "#FFF", Text: "#111"},
+	}
 )
 
-// BasicAuth is a httprouter.Handle wrapper for Basic HTTP Authentication
-func BasicAuth(h httprouter.Handle, user, pass []byte) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		const basicAuthPrefix string = "Basic "
+var (
+	streamer *showStreamer
+	source   photoSource
+)
+
+// reset reloads the photos and restarts the photo show from the first photo
+func reset() {
+	swapPhotos("")
+	slideChanged(hookReset)
+	streamer.SendString("", "reset", "")
+}
+
+// swapPhotos loads the photos of the current album and swaps them in, staying
+// at the photo with the name keep if it still exists, see slideshow.swap
+func swapPhotos(keep string) error {
+	show.loading.Lock()
+	defer show.loading.Unlock()
+	return swapAlbum(show.currentAlbum(), keep)
+}
+
+// swapAlbum loads the photos of the album and swaps them in.
+// It must be called with show.loading held.
+func swapAlbum(album, keep string) error {
+	names, entries, err := loadPhotos(album)
+	if err != nil {
+		show.fail(album, err)
+		return err
+	}
+	show.swap(album, names, entries, keep)
+	return nil
+}
+
+// setID sets the current photo show image ID and sends notifications to all
+// clients. A nil transition means the current one, see currentTransition.
+func setID(id uint64, t *slideTransition) error {
+	if err := show.set(id); err != nil {
+		return err
+	}
+	slideAdvanced(id, t)
+	return nil
+}
+
+// next advances the photo show to the next photo, wrapping around at the end
+func next() error {
+	return stepID(1, nil)
+}
+
+// prev goes back to the previous photo, wrapping around at the start
+func prev() error {
+	return stepID(-1, nil)
+}
+
+// stepID moves the photo show by delta photos
+func stepID(delta int64, t *slideTransition) error {
+	id, err := show.step(delta)
+	if err != nil {
+		return err
+	}
+	slideAdvanced(id, t)
+	return nil
+}
+
+// slideAdvanced sends notifications about the new photo to all clients, which
+// change to it with the transition or else the current one
+func slideAdvanced(id uint64, t *slideTransition) {
+	slideChanged(hookSlide)
+	e := newSlideEvent(id)
+	if e.Transition = t; t == nil {
+		e.Transition = currentTransition()
+	}
+	streamer.SendJSON("", "set", timed(e))
+}
+
+// textCommand executes a command given as text, e.g. received via MQTT or chat:
+// "next", "prev", "reset", "reload", "set <id>", "play [<seconds>]", "pause" or
+// "undo"
+func textCommand(cmd string) (err error) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return errors.New("empty command")
+	}
 
-		// Get the Basic Authentication credentials
-		auth := r.Header.Get("Authorization")
-		if strings.HasPrefix(auth, basicAuthPrefix) {
-			// Check credentials
-			payload, err := base64.StdEncoding.DecodeString(auth[len(basicAuthPrefix):])
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	name := strings.ToLower(fields[0])
+	masterActed(name)
+	if undoable(name) {
+		before := currentUndoPoint()
+		defer func() {
 			if err == nil {
-				pair := bytes.SplitN(payload, []byte(":"), 2)
-				if len(pair) == 2 && bytes.Equal(pair[0], user) && bytes.Equal(pair[1], pass) {
-					// Delegate request to the given handle
-					h(w, r, ps)
-					return
-				}
+				pushUndo(before)
+			}
+		}()
+	}
+	switch name {
+	case "next":
+		return next()
+	case "prev":
+		return prev()
+	case "reset":
+		reset()
+		return nil
+	case "reload":
+		rescan()
+		return nil
+	case "set":
+		if len(fields) != 2 {
+			return errors.New("usage: set <id>")
+		}
+		id, err := strconv.ParseUint(fields[1], 10, 0)
+		if err != nil {
+			return err
+		}
+		return setID(id, nil)
+	case "play":
+		interval := autoplayInterval
+		if len(fields) == 2 {
+			secs, err := strconv.ParseUint(fields[1], 10, 0)
+			if err != nil {
+				return err
 			}
+			interval = time.Duration(secs) * time.Second
 		}
+		return player.start(interval)
+	case "pause":
+		player.pause()
+		return nil
+	case "undo":
+		return undo()
+	default:
+		return errors.New("unknown command: " + cmd)
+	}
+}
 
-		// Request Basic Authentication otherwise
-		w.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+// chatCommand executes a text command typed by a human in a chat.
+// Unlike in textCommand, photo numbers count from 1.
+func chatCommand(cmd string) error {
+	if f := strings.Fields(cmd); len(f) == 2 && strings.ToLower(f[0]) == "set" {
+		if n, err := strconv.ParseUint(f[1], 10, 0); err == nil && n > 0 {
+			cmd = "set " + strconv.FormatUint(n-1, 10)
+		}
 	}
+	return textCommand(cmd)
 }
 
-// reset reloads the photos and restarts the photo show
-func reset() {
-	imgID = 0
-	photoJSON, photoErr = loadPhotos()
-	streamer.SendString("", "reset", "")
+// statusText describes the current slide for chat replies
+func statusText() string {
+	snap := show.snapshot()
+	if len(snap.photos) == 0 {
+		return "No photos in the show"
+	}
+	return fmt.Sprintf("Showing photo %d / %d: %s", snap.pos+1, len(snap.photos), snap.photo())
 }
 
-// setID sets the current photo show image ID and sends notifications to all clients
-func setID(id uint64) error {
-	if id > endID {
-		return errors.New("invalid ID")
+// slideChanged notifies all interested parties about the displayed photo
+func slideChanged(event string) {
+	snap := show.snapshot()
+	photo := snap.photo()
+	stats.show(snap.album, photo)
+	sendWebhook(event, slideData{Album: snap.album, ID: snap.pos, Photo: photo})
+	mqttPublishSlide()
+	slideSubscribers.notify()
+	castSlide()
+	dlnaSlide()
+	player.slideChanged()
+}
+
+// shutdown ends the photo show, waiting a few seconds for pending notifications
+func shutdown() {
+	player.pause()
+	rec.stop()
+	if mqtt != nil {
+		mqtt.Close() // publishes the status "offline"
 	}
 
-	imgID = id
-	streamer.SendUint("", "set", id)
+	done := make(chan struct{})
+	go func() {
+		sendWebhook(hookShowEnd, nil).Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+}
 
-	return nil
+// setAlbum switches the photo show to the given album
+func setAlbum(album string) error {
+	if album != "" && !validName(album) {
+		return errors.New("invalid album")
+	}
+
+	cards.Lock()
+	cards.adHoc = nil // shown after photos of the previous album
+	cards.Unlock()
+	show.loading.Lock()
+	err := swapAlbum(album, "")
+	show.loading.Unlock()
+	slideChanged(hookReset)
+	streamer.SendString("", "reset", "")
+	return err
 }
 
-// loadPhotos gets all files in the photo dir and saves them as a list in JSON
-func loadPhotos() ([]byte, error) {
-	dir, err := os.Open(photoDir)
-	if err != nil {
-		return nil, err
+// reload reloads the photos, staying at the current photo if it still exists.
+// The clients then only refetch the list. Otherwise the photo now at its
+// position is shown.
+func reload() {
+	current := currentPhoto()
+	if err := swapPhotos(current); err == nil && currentPhoto() == current {
+		listChanged() // the position may have changed
+		return
 	}
-	defer dir.Close()
+	slideChanged(hookReset)
+	streamer.SendString("", "reset", "")
+}
 
-	fi, err := dir.Stat()
+// rescan reloads the photos after files were added, removed or changed.
+// Only those files are scanned again. Unlike reload, the slide is not reset
+// if the current photo still exists, and nothing is sent at all if the show
+// did not change.
+func rescan() {
+	current := currentPhoto()
+	show.loading.Lock()
+	old := show.snapshot()
+	names, entries, err := loadPhotos(old.album)
 	if err != nil {
-		return nil, err
+		show.loading.Unlock()
+		log.Println("rescan:", err) // keep showing the photos loaded before
+		return
 	}
+	show.swap(old.album, names, entries, current)
+	show.loading.Unlock()
 
-	filenames := make([]string, 0)
-	if fi.IsDir() {
-		fis, err := dir.Readdir(-1) // -1 means return all the FileInfos
-		if err != nil {
-			return nil, err
+	if currentPhoto() == current {
+		// the position may have changed, which the clients fetch with the list
+		if !equalNames(names, old.photos) || !equalEntries(entries, old.entries) {
+			listChanged()
 		}
+		return
+	}
+	slideChanged(hookReset)
+	streamer.SendString("", "reset", "")
+}
 
-		for _, fileinfo := range fis {
-			if !fileinfo.IsDir() {
-				filenames = append(filenames, fileinfo.Name())
-			}
+// equalNames reports whether a and b contain the same names in the same order
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
+	return true
+}
+
+// loadPhotos gets all photos of the album in the order of the show and their
+// playlist entries. The caller swaps them in.
+func loadPhotos(album string) ([]string, []playlistEntry, error) {
+	filenames, entries, all, err := albumShow(rootCtx, album)
+	if err != nil {
+		return nil, nil, err
+	}
+	filenames, entries = withAdHocCards(filenames, entries)
 
-	endID = uint64(len(filenames)) - 1
-	return json.Marshal(filenames)
+	scan.start(album, withoutSlides(all))
+	return filenames, entries, nil
+}
+
+// albumShow returns the photos of the album shown in the order of the show,
+// without the ad hoc cards, their playlist entries, and all photos of the
+// album before the filters
+func albumShow(ctx context.Context, album string) (filenames []string, entries []playlistEntry, all []string, err error) {
+	if filenames, err = source.Photos(ctx, album); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if entries, err = loadPlaylist(album); err != nil {
+		return nil, nil, nil, err
+	}
+	if entries != nil {
+		filenames, entries = applyPlaylist(album, filenames, entries)
+	} else {
+		// Sort the photos by name if there is no playlist
+		sort.Strings(filenames)
+	}
+	all = filenames
+	if skipDuplicates {
+		filenames, entries = withoutDuplicates(album, filenames, entries)
+	}
+	filenames, entries = withoutHidden(album, filenames, entries)
+	filter := show.filters()
+	if filter.favorites {
+		filenames, entries = onlyFavorites(album, filenames, entries)
+	}
+	if filter.tag != "" {
+		filenames, entries = onlyTagged(album, filter.tag, filenames, entries)
+	}
+	if filter.person != 0 {
+		filenames, entries = onlyPerson(album, filter.person, filenames, entries)
+	}
+	return filenames, entries, all, nil
 }
 
 func PhotoShow(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	http.ServeFile(w, r, "remotephoto.html")
+	renderPage(w, r, "remotephoto.html")
 }
 
 func PhotoMaster(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	http.ServeFile(w, r, "remotemaster.html")
+	renderPage(w, r, "remotemaster.html")
 }
 
+// errUnknownCommand is returned for commands masterCommand does not know
+var errUnknownCommand = errors.New("unknown command")
+
+// PhotoMasterCMD executes the command of the master page given in the form
+// field "cmd", see masterCommand
 func PhotoMasterCMD(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	switch r.PostFormValue("cmd") {
+	r.ParseForm()
+	if isDryRun(r.PostForm) {
+		plan, err := dryRun(r.Context(), r.PostFormValue("cmd"), r.PostForm)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+		return
+	}
+	rec.command(r.PostForm)
+	err := masterCommand(r.PostFormValue("cmd"), r.PostForm)
+	if err == errVersionConflict {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(currentAPIShow())
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// masterCommand executes a command of the master with its parameters, if the
+// state of the show still has the stateVersion given in them
+func masterCommand(cmd string, form url.Values) error {
+	return expectVersion(form.Get("stateVersion"), func() error {
+		return executeCommand(cmd, form)
+	})
+}
+
+// executeCommand executes a command of the master, remembering the state before it
+// for undo.
+// It must be called with stateMu held.
+func executeCommand(cmd string, form url.Values) error {
+	masterActed(cmd)
+	if !undoable(cmd) {
+		return applyCommand(cmd, form)
+	}
+	before := currentUndoPoint()
+	if err := applyCommand(cmd, form); err != nil {
+		return err
+	}
+	pushUndo(before)
+	return nil
+}
+
+// applyCommand executes a command like masterCommand, without remembering the
+// state before it for undo
+func applyCommand(cmd string, form url.Values) error {
+	switch cmd {
 	case "set":
-		id, err := strconv.ParseUint(r.PostFormValue("id"), 10, 0)
+		id, err := strconv.ParseUint(form.Get("id"), 10, 0)
+		if err != nil {
+			return err
+		}
+		t, err := formTransition(form)
+		if err != nil {
+			return err
+		}
+		return setID(id, t)
 
-		if err == nil {
-			err = setID(uint64(id))
+	case "next", "prev":
+		t, err := formTransition(form)
+		if err != nil {
+			return err
 		}
+		if cmd == "prev" {
+			return stepID(-1, t)
+		}
+		return stepID(1, t)
 
+	case "transition":
+		t, err := formTransition(form)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			return err
 		}
-		return
+		return setTransition(t)
 
 	case "reset":
 		reset()
-		return
+		return nil
+
+	case "reload":
+		rescan()
+		return nil
+
+	case "favorites":
+		only, err := strconv.ParseBool(form.Get("enabled"))
+		if err != nil {
+			return err
+		}
+		setFavoritesOnly(only)
+		return nil
+
+	case "filter":
+		return setTagFilter(form.Get("tag"))
+
+	case "person":
+		return setPersonFilter(form.Get("person"))
+
+	case "downloads":
+		allowed, err := strconv.ParseBool(form.Get("enabled"))
+		if err != nil {
+			return err
+		}
+		setDownloads(allowed)
+		return nil
+
+	case "record":
+		start, err := strconv.ParseBool(form.Get("enabled"))
+		if err != nil {
+			return err
+		}
+		if start {
+			_, err = rec.start()
+			return err
+		}
+		return rec.stop()
+
+	case "replay":
+		name := form.Get("name")
+		if name == "" {
+			stopReplay()
+			return nil
+		}
+
+		speed := 1.0
+		if v := form.Get("speed"); v != "" {
+			var err error
+			if speed, err = strconv.ParseFloat(v, 64); err != nil {
+				return err
+			}
+		}
+		return startReplay(name, speed)
+
+	case "autoplay":
+		play, err := strconv.ParseBool(form.Get("enabled"))
+		if err != nil {
+			return err
+		}
+		if !play {
+			player.pause()
+			return nil
+		}
+
+		interval := autoplayInterval
+		if v := form.Get("interval"); v != "" {
+			secs, err := strconv.ParseUint(v, 10, 0)
+			if err != nil {
+				return err
+			}
+			interval = time.Duration(secs) * time.Second
+		}
+		return player.start(interval)
+
+	case "schedule":
+		start := form.Get("start")
+		if start == "" {
+			cancelSchedule()
+			return nil
+		}
+
+		var end time.Time
+		begin, err := parseTime(start)
+		if v := form.Get("end"); err == nil && v != "" {
+			end, err = parseTime(v)
+		}
+		if err != nil {
+			return err
+		}
+		return scheduleShow(begin, end)
+
+	case "mode":
+		return setMode(form.Get("mode"))
+
+	case "countdown":
+		switch form.Get("action") {
+		case "", "start":
+			secs, err := strconv.ParseUint(form.Get("seconds"), 10, 0)
+			if err != nil {
+				return err
+			}
+			return startCountdown(time.Duration(secs)*time.Second, form.Get("label"))
+		case "pause":
+			return pauseCountdown()
+		case "resume":
+			return resumeCountdown()
+		case "cancel":
+			cancelCountdown()
+			return nil
+		default:
+			return errors.New("unknown countdown action")
+		}
+
+	case "card":
+		if form.Get("title") == "" && form.Get("text") == "" && form.Get("kind") == "" {
+			return clearCards()
+		}
+		section := ""
+		if snap := show.snapshot(); snap.pos < uint64(len(snap.entries)) {
+			section = snap.entries[snap.pos].Section
+		}
+		c, err := newCard(form.Get("kind"), form.Get("title"), form.Get("text"), section)
+		if err != nil {
+			return err
+		}
+		return showCard(c)
+
+	case "layout":
+		name := form.Get("photo")
+		if name == "" {
+			name = currentPhoto()
+		}
+		return setLayout(name, form.Get("layout"), form.Get("pair"))
+
+	case "browsing":
+		enabled, err := strconv.ParseBool(form.Get("enabled"))
+		if err != nil {
+			return err
+		}
+		setBrowsing(enabled)
+		return nil
+
+	case "sync":
+		syncViewers()
+		return nil
+
+	case "narration":
+		muted, err := strconv.ParseBool(form.Get("muted"))
+		if err != nil {
+			return err
+		}
+		setNarrationMuted(muted)
+		return nil
+
+	case "music":
+		value := form.Get("track")
+		if form.Get("action") == "volume" {
+			value = form.Get("volume")
+		}
+		return musicCommand(form.Get("action"), value)
+
+	case "album":
+		return setAlbum(form.Get("id"))
+
+	case "preset":
+		return loadPreset(form.Get("name"))
+
+	case "undo":
+		return undo()
+
+	case "cue":
+		return cueCommand(form.Get("label"), form.Get("command"))
+
+	case "go":
+		return goCue()
 
 	default:
-		http.Error(w, "Invalid CMD", http.StatusInternalServerError)
-		return
+		return errUnknownCommand
 	}
 }
 
 func PhotosJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	if photoErr != nil {
-		http.Error(w, photoErr.Error(), http.StatusInternalServerError)
+	snap := show.snapshot()
+	if snap.err != nil {
+		http.Error(w, snap.err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
-	fmt.Fprintf(w, `{"photos": %s, "id": %d}`, photoJSON, imgID)
+	state, _ := json.Marshal(currentState())
+	modes, _ := json.Marshal(map[string]interface{}{"current": currentMode(), "names": modeNames()})
+	wallJSON, _ := json.Marshal(currentWall())
+	timer, _ := json.Marshal(currentCountdown())
+	musicJSON, _ := json.Marshal(currentMusic())
+	narration, _ := json.Marshal(narrationState{narrationMuted.Load(), musicOnViewers})
+	browsingJSON, _ := json.Marshal(browsingState{browsing.Load()})
+	captions, sections := playlistInfo(snap.photos, snap.entries)
+	titles, descriptions := photoTitles(snap.photos)
+	playlistJSON, _ := json.Marshal(map[string]interface{}{"captions": captions, "sections": sections, "alts": altTexts(snap.album, snap.photos, snap.entries),
+		"layouts": layouts(snap.photos, snap.entries), "titles": titles, "descriptions": descriptions})
+	cdnJSON, _ := json.Marshal(cdnPhotoURLs(snap.album, snap.photos))
+	fmt.Fprintf(w, `{"photos": %s, "id": %d, "version": %d, "stateVersion": %d, "autoplay": %d, "state": %s, "playlist": %s, "token": %q, "cdn": %s, "push": %q, "protected": %t, "uploads": %t, "mode": %s, "wall": %s, "timer": %s, "music": %s, "narration": %s, "browsing": %s}`,
+		snap.list, snap.pos, snap.version, stateVersion.Load(), player.playing()/time.Second, state, playlistJSON, photoToken(clientIP(r)), cdnJSON, pushPublicKey(), noDownloads,
+		guestUploads && sourceType == "dir", modes, wallJSON, timer, musicJSON, narration, browsingJSON)
 }
 
 func PhotosServer(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	http.ServeFile(w, r, photoDir+ps.ByName("photo"))
-}
-
-func Favicon(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	http.ServeFile(w, r, "favicon.ico")
+	if hotlinked(r) {
+		statusPage(w, r, http.StatusForbidden)
+		return
+	}
+	name := ps.ByName("photo")
+	album := show.currentAlbum()
+	path, err := servedPath(r.Context(), album, name)
+	if err != nil || meta.get(album, name).Hidden {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path)
 }
 
 func main() {
-	user := []byte(username)
-	pass := []byte(password)
-
-	router := httprouter.New()
-	router.GET("/", PhotoShow)
-	router.GET("/master", BasicAuth(PhotoMaster, user, pass))
-	router.POST("/master", BasicAuth(PhotoMasterCMD, user, pass))
-	router.GET("/photos.json", PhotosJSON)
-	router.GET("/photos/:photo", PhotosServer)
-	// router.GET("/favicon.ico", Favicon)
-
-	// Server-Sent Events
-	streamer = sse.New()
-	router.Handler("GET", "/listen", streamer)
-
-	// Initialize photo show
-	reset()
-
-	if https {
-		log.Fatal("HTTPS server error: ", http.ListenAndServeTLS(host, crtPath, keyPath, router))
-	} else {
-		log.Fatal("HTTP server error: ", http.ListenAndServe(host, router))
+	s, err := NewServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Println(err)
 	}
 }
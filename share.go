@@ -0,0 +1,104 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// shareLink is the response of ShareLink
+type shareLink struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// shareSignature signs the link to the photo of the album, valid until the
+// Unix time expires
+func shareSignature(album, name string, expires int64) string {
+	mac := hmac.New(sha256.New, photoTokenSecret())
+	mac.Write([]byte("share|" + album + "|" + name + "|" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// shareURL returns the signed link to the photo of the album, valid until
+// expires
+func shareURL(album, name string, expires time.Time) string {
+	q := url.Values{
+		"album":   {album},
+		"expires": {strconv.FormatInt(expires.Unix(), 10)},
+		"sig":     {shareSignature(album, name, expires.Unix())},
+	}
+	return publicURL + "/shared/" + url.PathEscape(name) + "?" + q.Encode()
+}
+
+// ShareLink creates a signed link to a photo, valid for ttl seconds (default
+// shareTTL, at most maxShareTTL), to share it with people who are not viewers
+// of the show. The album parameter defaults to the current album.
+func ShareLink(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ttl := shareTTL
+	if v := r.FormValue("ttl"); v != "" {
+		secs, err := strconv.ParseUint(v, 10, 0)
+		if err != nil || secs == 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+	if ttl > maxShareTTL {
+		ttl = maxShareTTL
+	}
+	album := show.currentAlbum()
+	if _, ok := r.Form["album"]; ok {
+		album = r.FormValue("album")
+	}
+	if album != "" && !validName(album) {
+		http.Error(w, "invalid album", http.StatusBadRequest)
+		return
+	}
+
+	name := ps.ByName("photo")
+	if _, err := servedPath(r.Context(), album, name); err != nil || meta.get(album, name).Hidden {
+		http.NotFound(w, r)
+		return
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shareLink{shareURL(album, name, expires), expires})
+}
+
+// SharedPhoto serves a photo via a link created by ShareLink, regardless of
+// the album shown and hotlink protection, until the link expires
+func SharedPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q := r.URL.Query()
+	album, name := q.Get("album"), ps.ByName("photo")
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || (album != "" && !validName(album)) ||
+		!hmac.Equal([]byte(q.Get("sig")), []byte(shareSignature(album, name, expires))) {
+		statusPage(w, r, http.StatusForbidden)
+		return
+	}
+	left := time.Until(time.Unix(expires, 0))
+	if left <= 0 {
+		statusPage(w, r, http.StatusGone)
+		return
+	}
+
+	path, err := servedPath(r.Context(), album, name)
+	if err != nil || meta.get(album, name).Hidden {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(left/time.Second)))
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// slackMaxAge is the maximum age of a request timestamp, protecting against
+// replayed requests
+const slackMaxAge = 5 * time.Minute
+
+// slackVerify checks the request signature computed with the signing secret.
+// See https://api.slack.com/authentication/verifying-requests-from-slack
+func slackVerify(header http.Header, body []byte) bool {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > slackMaxAge || age < -slackMaxAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(slackSigningSecret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
+
+// SlackCommand handles the slash command of a Slack app, e.g.
+// "/photoshow next", "/photoshow set 12" or "/photoshow status"
+func SlackCommand(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if slackSigningSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !slackVerify(r.Header, body) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	text := strings.TrimSpace(form.Get("text"))
+	var reply struct {
+		ResponseType string `json:"response_type"`
+		Text         string `json:"text"`
+	}
+	reply.ResponseType = "in_channel"
+
+	switch strings.ToLower(text) {
+	case "", "help":
+		reply.ResponseType = "ephemeral"
+		reply.Text = "Usage: " + form.Get("command") + " next | prev | set <number> | reset | reload | play [<seconds>] | pause | undo | status"
+	case "status":
+		reply.Text = statusText()
+	default:
+		if err := chatCommand(text); err != nil {
+			reply.ResponseType = "ephemeral"
+			reply.Text = "Error: " + err.Error()
+		} else {
+			reply.Text = form.Get("user_name") + ": " + statusText()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
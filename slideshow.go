@@ -0,0 +1,174 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// slideshow is the current album, the position of the photo show and the
+// loaded photo list, which are changed and read by concurrent requests. They
+// are read with snapshot or the accessors below.
+type slideshow struct {
+	mu      sync.RWMutex
+	album   string
+	pos     uint64          // position of the current photo
+	count   uint64          // number of photos
+	photos  []string        // in show order
+	entries []playlistEntry // aligned with photos, nil without a playlist
+	list    []byte          // the photos as JSON array
+	err     error           // of loading the photos
+	version uint64          // increased whenever the photo list changes
+	filter  showFilter      // restricts the photos loaded into the list
+
+	// loading serializes loading or changing the photo list and swapping it
+	// in, so that a reload does not swap back the photos of another album
+	loading sync.Mutex
+}
+
+var show slideshow
+
+// slideshowSnapshot is a consistent copy of the show
+type slideshowSnapshot struct {
+	album   string
+	pos     uint64
+	list    []byte
+	err     error
+	version uint64
+	photos  []string
+	entries []playlistEntry
+}
+
+// snapshot returns a copy of the show state
+func (s *slideshow) snapshot() slideshowSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slideshowSnapshot{s.album, s.pos, s.list, s.err, s.version, s.photos, s.entries}
+}
+
+// showFilter restricts the show to some photos of the album
+type showFilter struct {
+	favorites bool   // only the starred photos
+	tag       string // only the photos with this tag, if set
+	person    int    // only the photos of this person, if not 0
+}
+
+// filters returns the filter of the show
+func (s *slideshow) filters() showFilter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.filter
+}
+
+// setFilter changes the filter of the show. The photos are not reloaded.
+func (s *slideshow) setFilter(change func(f *showFilter)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change(&s.filter)
+}
+
+// currentAlbum returns the album of the show
+func (s *slideshow) currentAlbum() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.album
+}
+
+// photo returns the name of the current photo of the snapshot
+func (s slideshowSnapshot) photo() string {
+	if s.pos < uint64(len(s.photos)) {
+		return s.photos[s.pos]
+	}
+	return ""
+}
+
+// current returns the position of the current photo
+func (s *slideshow) current() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pos
+}
+
+// loadErr returns the error of loading the photos, if any
+func (s *slideshow) loadErr() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+// swap replaces the album, the photo list and the playlist at once, so that
+// no client sees the position of one list with the other. The show stays at the photo
+// with the name keep if it is still there, otherwise at its position, or
+// starts over if the list got shorter. An empty name starts over as well.
+func (s *slideshow) swap(album string, names []string, entries []playlistEntry, keep string) {
+	data, err := json.Marshal(names)
+	if err != nil {
+		s.fail(album, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.album, s.photos, s.entries = album, names, entries
+	s.list, s.count, s.err = data, uint64(len(names)), nil
+	s.version++
+
+	if keep == "" || s.pos >= s.count {
+		s.pos = 0
+	}
+	if keep == "" {
+		return
+	}
+	for i, name := range names {
+		if name == keep {
+			s.pos = uint64(i)
+			break
+		}
+	}
+}
+
+// fail records the error of loading the photos of the album. The clients get
+// it instead of the photo list until the next successful load.
+func (s *slideshow) fail(album string, err error) {
+	s.mu.Lock()
+	s.album, s.photos, s.entries = album, nil, nil
+	s.list, s.count, s.err = nil, 0, err
+	s.mu.Unlock()
+}
+
+// changed increases the list version and returns it. Clients refetch the list
+// on the "list" event.
+func (s *slideshow) changed() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	return s.version
+}
+
+// set goes to the photo at the position
+func (s *slideshow) set(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pos >= s.count {
+		return errors.New("invalid ID")
+	}
+	s.pos = pos
+	return nil
+}
+
+// step moves the position by delta photos, wrapping around at both ends. It
+// returns the new position.
+func (s *slideshow) step(delta int64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return 0, errors.New("no photos")
+	}
+	n := int64(s.count)
+	s.pos = uint64(((int64(s.pos)+delta)%n + n) % n)
+	return s.pos, nil
+}
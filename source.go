@@ -0,0 +1,137 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// photoSource provides the photos of the show.
+// An album is a named subset of the photos, e.g. a subdirectory of the photo
+// dir or the ID of an album on a remote photo library server.
+type photoSource interface {
+	// Photos returns the filenames of all photos in the given album
+	Photos(ctx context.Context, album string) ([]string, error)
+
+	// Path returns the path of a local copy of the given photo, which is
+	// downloaded first if necessary
+	Path(ctx context.Context, album, name string) (string, error)
+}
+
+// newSource returns the photo source selected in the config, dir being the
+// directory of the "dir" source
+func newSource(dir string) (photoSource, error) {
+	switch sourceType {
+	case "dir":
+		return dirSource(dir), nil
+	case "immich":
+		return &immichSource{baseURL: remoteURL, apiKey: remoteToken}, nil
+	case "photoprism":
+		return &photoprismSource{
+			baseURL:       remoteURL,
+			authToken:     remoteToken,
+			downloadToken: remoteDownloadToken,
+		}, nil
+	default:
+		return nil, errors.New("unknown photo source: " + sourceType)
+	}
+}
+
+// validName reports whether the given album or photo name can safely be used
+// as a path element
+func validName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// albumDir returns the directory of the album of the "dir" source, to which
+// new photos are added
+func albumDir(album string) string {
+	if d, ok := baseSource().(dirSource); ok {
+		return filepath.Join(string(d), album)
+	}
+	return filepath.Join(photoDir, album)
+}
+
+// dirSource serves the photos in a local directory.
+// Albums are subdirectories of it, the empty album is the directory itself.
+type dirSource string
+
+func (d dirSource) Photos(_ context.Context, album string) ([]string, error) {
+	if album != "" && !validName(album) {
+		return nil, errors.New("invalid album")
+	}
+
+	dir, err := os.Open(filepath.Join(string(d), album))
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	fi, err := dir.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	filenames := make([]string, 0)
+	if fi.IsDir() {
+		fis, err := dir.Readdir(-1) // -1 means return all the FileInfos
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fileinfo := range fis {
+			if !fileinfo.IsDir() && !strings.HasSuffix(fileinfo.Name(), altSuffix) && !isAudio(fileinfo.Name()) {
+				filenames = append(filenames, fileinfo.Name())
+			}
+		}
+	}
+	return filenames, nil
+}
+
+func (d dirSource) Path(_ context.Context, album, name string) (string, error) {
+	if (album != "" && !validName(album)) || !validName(name) {
+		return "", os.ErrNotExist
+	}
+	return filepath.Join(string(d), album, name), nil
+}
+
+// cachedPath returns the path of the cached copy of the given photo.
+// If it is not cached yet, fetch is called to download it.
+func cachedPath(source, album, name string, fetch func(w io.Writer) error) (string, error) {
+	if !validName(album) || !validName(name) {
+		return "", os.ErrNotExist
+	}
+
+	path := filepath.Join(cacheDir, source, album, name)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	// Download to a temporary file first, so that concurrent requests never
+	// see partial files
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = fetch(tmp); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
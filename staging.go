@@ -0,0 +1,303 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// stagedPhoto is an imported or uploaded photo waiting in the staging area
+// until the master publishes it into its album
+type stagedPhoto struct {
+	ID       string    `json:"id"`
+	Album    string    `json:"album"` // the photo is published into
+	Photo    string    `json:"photo"`
+	Uploader string    `json:"uploader,omitempty"` // of guest uploads
+	Staged   time.Time `json:"staged"`
+}
+
+// path returns the path of the photo file in the staging area
+func (p *stagedPhoto) path() string {
+	return filepath.Join(stagingDir, p.ID+"-"+p.Photo)
+}
+
+// staging is the list of staged photos, stored in stagingDir/staging.json
+var staging = struct {
+	sync.Mutex
+	photos []*stagedPhoto
+	next   uint64
+}{}
+
+// loadStaging reads the list of staged photos. A missing file is an empty
+// staging area.
+func loadStaging() error {
+	data, err := os.ReadFile(filepath.Join(stagingDir, "staging.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	staging.Lock()
+	defer staging.Unlock()
+	return json.Unmarshal(data, &staging.photos)
+}
+
+// saveStaging writes the list of staged photos and notifies the master about
+// their number.
+// It must be called with staging held.
+func saveStaging() error {
+	data, err := json.MarshalIndent(staging.photos, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(stagingDir, "staging.json")
+	if err = os.WriteFile(p+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(p+".tmp", p); err != nil {
+		return err
+	}
+	streamer.SendUint("", "staged", uint64(len(staging.photos)))
+	return nil
+}
+
+// stagePhoto moves the photo file at src into the staging area
+func stagePhoto(src, album, name, uploader string) (*stagedPhoto, error) {
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return nil, err
+	}
+
+	staging.Lock()
+	defer staging.Unlock()
+	staging.next++
+	p := &stagedPhoto{
+		ID:       strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatUint(staging.next, 36),
+		Album:    album,
+		Photo:    name,
+		Uploader: uploader,
+		Staged:   time.Now(),
+	}
+	if err := os.Rename(src, p.path()); err != nil {
+		return nil, err
+	}
+	staging.photos = append(staging.photos, p)
+	return p, saveStaging()
+}
+
+// importStaged extracts all images in the ZIP archive into the staging area,
+// to be published into the album
+func importStaged(zr *zip.Reader, album string) (imported, skipped []string, err error) {
+	if err = os.MkdirAll(stagingDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	tmp, err := os.MkdirTemp(stagingDir, "import-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	if imported, skipped, err = importZIP(zr, tmp); err != nil {
+		return nil, nil, err
+	}
+	for _, name := range imported {
+		if _, err = stagePhoto(filepath.Join(tmp, name), album, name, ""); err != nil {
+			return nil, nil, err
+		}
+	}
+	return imported, skipped, nil
+}
+
+// findStaged returns the staged photo with the given ID, nil if not found
+func findStaged(id string) *stagedPhoto {
+	staging.Lock()
+	defer staging.Unlock()
+	for _, p := range staging.photos {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// publishStaged moves the staged photos for which publish returns true into
+// their albums and adds them to the show. It returns the published photos
+// with their names in the albums.
+func publishStaged(publish func(*stagedPhoto) bool) ([]*stagedPhoto, error) {
+	staging.Lock()
+	var published []*stagedPhoto
+	kept := make([]*stagedPhoto, 0, len(staging.photos))
+	var err error
+	for _, p := range staging.photos {
+		if err != nil || !publish(p) {
+			kept = append(kept, p)
+			continue
+		}
+		dir := albumDir(p.Album)
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			kept = append(kept, p)
+			continue
+		}
+		name := uniqueName(dir, p.Photo)
+		if err = os.Rename(p.path(), filepath.Join(dir, name)); err != nil {
+			kept = append(kept, p)
+			continue
+		}
+		published = append(published, &stagedPhoto{p.ID, p.Album, name, p.Uploader, p.Staged})
+	}
+	if len(published) > 0 {
+		staging.photos = kept
+		if serr := saveStaging(); err == nil {
+			err = serr
+		}
+	}
+	staging.Unlock()
+
+	albums := make(map[string][]string)
+	for _, p := range published {
+		albums[p.Album] = append(albums[p.Album], p.Photo)
+	}
+	for album, names := range albums {
+		sendWebhook(hookUpload, uploadData{Album: album, Photos: names})
+		pushPhotosAdded(album, len(names))
+	}
+	current := show.currentAlbum()
+	if _, ok := albums[current]; ok {
+		rescan()
+		for _, p := range published {
+			if p.Album == current && p.Uploader != "" {
+				streamer.SendJSON("", "upload", map[string]string{"photo": p.Photo, "uploader": p.Uploader})
+			}
+		}
+	}
+	return published, err
+}
+
+// stagedIn returns a filter of publishStaged for the photos with the IDs, or
+// those of the album if it is not nil, or all photos
+func stagedIn(ids []string, album *string) func(*stagedPhoto) bool {
+	return func(p *stagedPhoto) bool {
+		if len(ids) > 0 {
+			for _, id := range ids {
+				if p.ID == id {
+					return true
+				}
+			}
+			return false
+		}
+		return album == nil || p.Album == *album
+	}
+}
+
+// stagedPhotos returns the staged photos, the oldest first
+func stagedPhotos() []*stagedPhoto {
+	staging.Lock()
+	photos := append([]*stagedPhoto{}, staging.photos...)
+	staging.Unlock()
+	sort.Slice(photos, func(i, j int) bool { return photos[i].Staged.Before(photos[j].Staged) })
+	return photos
+}
+
+// Staging lists the staged photos, the oldest first
+func Staging(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(stagedPhotos())
+}
+
+// StagedPhoto serves a staged photo for preview
+func StagedPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	p := findStaged(ps.ByName("id"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, p.path())
+}
+
+// PublishStaged publishes the staged photos with the IDs in the id parameters,
+// or all of the album in the album parameter, or all without either. It
+// responds with the published photos.
+func PublishStaged(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+	var album *string
+	if _, ok := r.PostForm["album"]; ok {
+		a := r.PostForm.Get("album")
+		album = &a
+	}
+	published, err := publishStaged(stagedIn(r.PostForm["id"], album))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiPublished{Published: append([]*stagedPhoto{}, published...)})
+}
+
+// DiscardStaged deletes a staged photo without publishing it
+func DiscardStaged(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	staging.Lock()
+	defer staging.Unlock()
+	for i, p := range staging.photos {
+		if p.ID != ps.ByName("id") {
+			continue
+		}
+		if err := os.Remove(p.path()); err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		staging.photos = append(staging.photos[:i:i], staging.photos[i+1:]...)
+		if err := saveStaging(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// apiPublishBody is the request of APIPublishStaged
+type apiPublishBody struct {
+	IDs   []string `json:"ids,omitempty"`
+	Album *string  `json:"album,omitempty"` // all photos of the album without ids
+}
+
+// apiPublished is the response of APIPublishStaged
+type apiPublished struct {
+	Published []*stagedPhoto `json:"published"` // with their names in the albums
+}
+
+// APIStaging lists the staged photos, the oldest first
+func APIStaging(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	apiReply(w, http.StatusOK, stagedPhotos())
+}
+
+// APIPublishStaged publishes the staged photos like PublishStaged, e.g.
+// {"ids": ["l9x2k1"]} or {"album": "party"}, all of them with an empty body
+func APIPublishStaged(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body apiPublishBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil && err != io.EOF {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	published, err := publishStaged(stagedIn(body.IDs, body.Album))
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiReply(w, http.StatusOK, apiPublished{Published: append([]*stagedPhoto{}, published...)})
+}
@@ -0,0 +1,283 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/sse"
+)
+
+// showStreamer wraps the SSE streamer, so that all sent events are recorded
+// and connected clients are counted. The events are numbered by the event
+// history, clients reconnecting with the Last-Event-ID header get the ones they
+// missed.
+type showStreamer struct {
+	*sse.Streamer
+	mu       sync.Mutex   // keeps the events in the order of their IDs
+	lastSent atomic.Int64 // UnixNano of the last event
+	holding  bool         // during a batch of commands
+	held     []batchEvent // the slide events held back meanwhile
+}
+
+// batchEvent is an event in the "batch" event, which combines the events of a
+// batch of commands
+type batchEvent struct {
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+func (s *showStreamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	channels, err := parseChannels(r.URL.Query().Get("channels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, kick := context.WithCancel(r.Context())
+	defer kick()
+	r = r.WithContext(ctx)
+	client := streamClients.connect(r, channels, kick)
+	mqttPublishViewers(stats.connected(1))
+	defer func() {
+		streamClients.disconnect(client)
+		mqttPublishViewers(stats.connected(-1))
+	}()
+	sw := &streamWriter{ResponseWriter: w, ctx: ctx, client: client, channels: channels, access: requestAccess(r)}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		h := w.Header()
+		h.Set("Cache-Control", "no-cache")
+		h.Set("Connection", "keep-alive")
+		h.Set("Content-Type", "text/event-stream")
+		seq, err := strconv.ParseUint(id, 10, 64)
+		sw.resume(seq, err != nil)
+	}
+	s.Streamer.ServeHTTP(sw, r)
+}
+
+// streamWriter ends the event stream when the request context is done, i.e.
+// when the client disconnects or the server shuts down. It drops the events
+// of channels the client did not subscribe to, and those of albums it may not
+// view. Of resumed streams, it tracks
+// the ID of the last event written, to skip the events which were already
+// replayed and replay those which were sent while connecting.
+type streamWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	client   *streamClient
+	channels map[string]bool // nil for all
+	access   viewerAccess
+	resumed  bool
+	last     uint64
+}
+
+// resume writes the events after seq, or a reset event if they are no longer
+// known, so that the client reloads the show
+func (w *streamWriter) resume(seq uint64, invalid bool) {
+	reply, _ := history.since(seq)
+	if invalid || reply.Missed {
+		reply.Events = []historyEvent{{Seq: reply.Seq, Event: "reset"}}
+	}
+	for _, e := range w.access.filter(filterEvents(reply.Events, w.channels)) {
+		if writeEvent(w.ResponseWriter, e) == nil {
+			w.client.wrote(e.Seq)
+		}
+	}
+	w.resumed, w.last = true, reply.Seq
+	w.Flush()
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if id, ok := eventID(b); ok && w.resumed {
+		if id <= w.last {
+			return len(b), nil // already replayed
+		}
+		if id > w.last+1 {
+			reply, _ := history.since(w.last)
+			for _, e := range w.access.filter(filterEvents(reply.Events, w.channels)) {
+				if e.Seq < id && writeEvent(w.ResponseWriter, e) == nil {
+					w.client.wrote(e.Seq)
+				}
+			}
+		}
+		w.last = id
+	}
+	event := eventField(b, "event")
+	if w.channels != nil && !subscribed(w.channels, event) {
+		return len(b), nil
+	}
+	if event != "reset" && event != "ping" && !w.access.allowed(show.currentAlbum()) {
+		return len(b), nil
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err == nil {
+		id, _ := eventID(b)
+		w.client.wrote(id)
+	}
+	return n, err
+}
+
+func (w *streamWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *streamWriter) CloseNotify() <-chan bool {
+	closed := make(chan bool, 1)
+	go func() {
+		<-w.ctx.Done()
+		closed <- true
+	}()
+	return closed
+}
+
+// eventID returns the ID of the formatted event
+func eventID(b []byte) (uint64, bool) {
+	id, err := strconv.ParseUint(eventField(b, "id"), 10, 64)
+	return id, err == nil
+}
+
+// eventField returns the value of the field of the formatted event, up to the
+// data
+func eventField(b []byte, name string) string {
+	for len(b) > 0 {
+		var line []byte
+		line, b, _ = bytes.Cut(b, []byte("\n"))
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		switch string(field) {
+		case name:
+			return string(bytes.TrimSpace(value))
+		case "data":
+			return ""
+		}
+	}
+	return ""
+}
+
+// writeEvent writes the event in the text/event-stream format
+func writeEvent(w io.Writer, e historyEvent) error {
+	b := strconv.AppendUint([]byte("id: "), e.Seq, 10)
+	b = append(b, "\nevent: "...)
+	b = append(b, e.Event...)
+	for _, line := range strings.Split(e.Data, "\n") {
+		b = append(b, "\ndata: "...)
+		b = append(b, line...)
+	}
+	b = append(b, "\n\n"...)
+	_, err := w.Write(b)
+	return err
+}
+
+// SendBytes sends the event with the next sequence number of the event history as
+// ID, the given ID is ignored. Events of the slides channel are held back
+// during a batch of commands.
+func (s *showStreamer) SendBytes(_, event string, data []byte) {
+	s.mu.Lock()
+	if s.holding && eventChannels[event] == "slides" {
+		s.held = append(s.held, batchEvent{event, string(data)})
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	grpcEvents.publish(event, data)
+	s.send(event, data)
+}
+
+// send records the event and sends it to the clients
+func (s *showStreamer) send(event string, data []byte) {
+	rec.write(recordEntry{Type: recordEvent, Event: event, Data: string(data)})
+	s.mu.Lock()
+	id := history.add(event, data)
+	if eventChannels[event] == "slides" {
+		stateVersion.Store(id)
+	}
+	s.Streamer.SendBytes(strconv.FormatUint(id, 10), event, data)
+	s.mu.Unlock()
+	s.lastSent.Store(time.Now().UnixNano())
+}
+
+// hold holds back the slide events until release.
+// It must be called with stateMu held, so that only the events of the batch
+// are held back.
+func (s *showStreamer) hold() {
+	s.mu.Lock()
+	s.holding = true
+	s.mu.Unlock()
+}
+
+// release sends the events held back, unless they are dropped, as a single
+// "batch" event with the last event of each type in the order they were
+// last sent, so that the clients skip the intermediate states
+func (s *showStreamer) release(send bool) {
+	s.mu.Lock()
+	held := s.held
+	s.holding, s.held = false, nil
+	s.mu.Unlock()
+	if !send || len(held) == 0 {
+		return
+	}
+
+	var events []batchEvent
+	seen := make(map[string]bool)
+	for i := len(held) - 1; i >= 0; i-- {
+		if e := held[i]; !seen[e.Event] {
+			seen[e.Event] = true
+			events = append([]batchEvent{e}, events...)
+		}
+	}
+	for _, e := range events {
+		grpcEvents.publish(e.Event, []byte(e.Data))
+	}
+	data, _ := json.Marshal(events)
+	s.send("batch", data)
+}
+
+// keepalive sends a ping event if no other event was sent for the interval.
+// Pings are not recorded and ignored by the clients.
+func (s *showStreamer) keepalive(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if now.UnixNano()-s.lastSent.Load() >= int64(interval) {
+				s.Streamer.SendBytes("", "ping", nil)
+				s.lastSent.Store(now.UnixNano())
+			}
+		}
+	}
+}
+
+func (s *showStreamer) SendInt(id, event string, i int64) {
+	s.SendBytes(id, event, strconv.AppendInt(nil, i, 10))
+}
+
+func (s *showStreamer) SendJSON(id, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.SendBytes(id, event, data)
+	return nil
+}
+
+func (s *showStreamer) SendString(id, event, data string) {
+	s.SendBytes(id, event, []byte(data))
+}
+
+func (s *showStreamer) SendUint(id, event string, i uint64) {
+	s.SendBytes(id, event, strconv.AppendUint(nil, i, 10))
+}
@@ -0,0 +1,236 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// normalizeTag returns the canonical form of a tag: lower case, without a
+// leading '#'
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+	if tag == "" || len(tag) > 64 {
+		return "", errors.New("invalid tag")
+	}
+	for _, r := range tag {
+		if unicode.IsSpace(r) || r == ',' || r == '#' || r == '/' {
+			return "", errors.New("invalid tag: " + tag)
+		}
+	}
+	return tag, nil
+}
+
+// parseTags parses a comma-separated list of tags into a sorted set
+func parseTags(list string) ([]string, error) {
+	var tags []string
+	for _, t := range strings.Split(list, ",") {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		tag, err := normalizeTag(t)
+		if err != nil {
+			return nil, err
+		}
+		tags = addTag(tags, tag)
+	}
+	return tags, nil
+}
+
+// hasTag reports whether tag is in the sorted set tags
+func hasTag(tags []string, tag string) bool {
+	i := sort.SearchStrings(tags, tag)
+	return i < len(tags) && tags[i] == tag
+}
+
+// addTag returns a new sorted set with the tag added
+func addTag(tags []string, tag string) []string {
+	if hasTag(tags, tag) {
+		return tags
+	}
+	added := append(append(make([]string, 0, len(tags)+1), tags...), tag)
+	sort.Strings(added)
+	return added
+}
+
+// removeTag returns a new sorted set without the tag
+func removeTag(tags []string, tag string) []string {
+	removed := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t != tag {
+			removed = append(removed, t)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	return removed
+}
+
+// onlyTagged removes all photos without the tag from the list and the aligned
+// playlist entries
+func onlyTagged(album, tag string, names []string, entries []playlistEntry) ([]string, []playlistEntry) {
+	all := meta.album(album)
+	tagged := make([]string, 0)
+	var taggedEntries []playlistEntry
+	for i, name := range names {
+		if !hasTag(all[name].Tags, tag) {
+			continue
+		}
+		tagged = append(tagged, name)
+		if entries != nil {
+			taggedEntries = append(taggedEntries, entries[i])
+		}
+	}
+	return tagged, taggedEntries
+}
+
+// setTagFilter plays only the photos with the given tag, or all photos if the
+// tag is empty
+func setTagFilter(tag string) error {
+	if tag != "" {
+		var err error
+		if tag, err = normalizeTag(tag); err != nil {
+			return err
+		}
+	}
+	show.setFilter(func(f *showFilter) { f.tag = tag })
+	reload()
+	streamer.SendString("", "filter", tag)
+	return nil
+}
+
+// tagInfo is an entry of the tag list
+type tagInfo struct {
+	Tag    string   `json:"tag"`
+	Photos []string `json:"photos"`
+}
+
+// Tags lists all tags of the current album with their photos
+func Tags(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	byTag := make(map[string][]string)
+	for name, m := range meta.album(show.currentAlbum()) {
+		for _, tag := range m.Tags {
+			byTag[tag] = append(byTag[tag], name)
+		}
+	}
+
+	tags := make([]tagInfo, 0, len(byTag))
+	for tag, names := range byTag {
+		sort.Strings(names)
+		tags = append(tags, tagInfo{Tag: tag, Photos: names})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(tags)
+}
+
+// tagChanged reloads the show if the tag filter is affected
+func tagChanged(tags ...string) {
+	filter := show.filters().tag
+	for _, tag := range tags {
+		if tag == filter {
+			reload()
+			return
+		}
+	}
+}
+
+// TagPhotos adds the tag to the given photos (repeated photo form values)
+func TagPhotos(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tag, err := normalizeTag(r.PostFormValue("tag"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := r.PostForm["photo"]
+	for _, name := range names {
+		if !hasPhoto(name) {
+			http.Error(w, "unknown photo: "+name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = meta.updatePhotos(show.currentAlbum(), names, func(_ string, m *photoMeta) {
+		m.Tags = addTag(m.Tags, tag)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tagChanged(tag)
+}
+
+// RenameTag renames a tag on all photos of the current album (form value
+// name), or removes it from the given photos (form values photo, with
+// action=untag)
+func RenameTag(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tag, err := normalizeTag(ps.ByName("tag"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.PostFormValue("action") == "untag" {
+		err = meta.updatePhotos(show.currentAlbum(), r.PostForm["photo"], func(_ string, m *photoMeta) {
+			m.Tags = removeTag(m.Tags, tag)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tagChanged(tag)
+		return
+	}
+
+	name, err := normalizeTag(r.PostFormValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = meta.updatePhotos(show.currentAlbum(), nil, func(_ string, m *photoMeta) {
+		if hasTag(m.Tags, tag) {
+			m.Tags = addTag(removeTag(m.Tags, tag), name)
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if show.filters().tag == tag {
+		setTagFilter(name)
+	} else {
+		tagChanged(name)
+	}
+}
+
+// DeleteTag removes a tag from all photos of the current album
+func DeleteTag(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tag, err := normalizeTag(ps.ByName("tag"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = meta.updatePhotos(show.currentAlbum(), nil, func(_ string, m *photoMeta) {
+		m.Tags = removeTag(m.Tags, tag)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if show.filters().tag == tag {
+		setTagFilter("") // show all photos again
+	}
+}
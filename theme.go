@@ -0,0 +1,172 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultTheme provides all pages and assets missing in the selected theme
+const defaultTheme = "default"
+
+// pages are the templates of the HTML pages, by file name
+var pages = make(map[string]*template.Template)
+
+// injected holds the custom CSS and JS added to all pages
+var injected struct {
+	css, js []byte
+}
+
+// readSnippets joins the snippets, reading the entries with the extension
+// from files
+func readSnippets(entries []string, ext string) ([]byte, error) {
+	var b bytes.Buffer
+	for _, e := range entries {
+		if strings.HasSuffix(strings.ToLower(e), ext) {
+			data, err := os.ReadFile(e)
+			if err != nil {
+				return nil, err
+			}
+			b.Write(data)
+		} else {
+			b.WriteString(e)
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// loadCustomCode reads the configured custom CSS and JS
+func loadCustomCode() error {
+	css, err := readSnippets(customCSS, ".css")
+	if err != nil {
+		return err
+	}
+	js, err := readSnippets(customJS, ".js")
+	if err != nil {
+		return err
+	}
+	injected.css, injected.js = css, js
+	return nil
+}
+
+// inject adds the custom CSS at the end of the head and the custom JS at the
+// end of the page, after all other scripts
+func inject(page []byte) []byte {
+	if len(injected.css) > 0 {
+		style := append(append([]byte("<style>\n"), injected.css...), "</style>\n</head>"...)
+		page = bytes.Replace(page, []byte("</head>"), style, 1)
+	}
+	if len(injected.js) > 0 {
+		script := append(append([]byte("<script>\n"), injected.js...), "</script>\n"...)
+		if i := bytes.LastIndex(page, []byte("</html>")); i >= 0 {
+			page = append(page[:i:i], append(script, page[i:]...)...)
+		} else {
+			page = append(page, script...)
+		}
+	}
+	return page
+}
+
+// pageData is passed to the page templates
+type pageData struct {
+	Title       string
+	Description string
+	URL         string // public URL of the show
+	Background  string // colors
+	Text        string
+	Accent      string
+	Logo        string // URL of the logo, if any
+	OGImage     string // absolute URL of the link preview image, if any
+	Footer      string
+	Slide       template.HTML // of the text slide page
+
+	Lang string
+	I18n map[string]interface{} // the translations for the scripts
+}
+
+// loadTemplates parses the page templates of the theme
+func loadTemplates() error {
+	fsys := themeFS()
+	for _, name := range []string{"remotephoto.html", "remotemaster.html", "textslide.html"} {
+		t, err := template.New(name).Funcs(template.FuncMap{"tr": tr}).ParseFS(fsys, name)
+		if err != nil {
+			return err
+		}
+		pages[name] = t
+	}
+	return nil
+}
+
+// renderPage renders the page in the client's language
+func renderPage(w http.ResponseWriter, r *http.Request, name string) {
+	writePage(w, name, newPageData(r))
+}
+
+// newPageData returns the data of the pages for the client's language
+func newPageData(r *http.Request) pageData {
+	lang := requestLanguage(r)
+	strs := bundles[lang]
+	if strs == nil {
+		strs = make(map[string]string)
+	}
+	colors := currentMode()
+	return pageData{
+		Title:       pageTitle,
+		Description: pageDescription,
+		URL:         publicURL + "/",
+		Background:  colors.Background,
+		Text:        colors.Text,
+		Accent:      accentColor,
+		Logo:        logoLink(),
+		OGImage:     ogImageLink(),
+		Footer:      footerText,
+		Lang:        lang,
+		I18n:        map[string]interface{}{"lang": lang, "strings": strs},
+	}
+}
+
+// writePage renders the page with the data
+func writePage(w http.ResponseWriter, name string, data pageData) {
+	// render into a buffer first, so that errors can still be reported
+	var buf bytes.Buffer
+	if err := pages[name].Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", data.Lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Write(inject(buf.Bytes()))
+}
+
+// ThemeFile serves the assets of the theme, like images and stylesheets,
+// under /theme/
+func ThemeFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := path.Clean("/" + ps.ByName("filepath"))[1:]
+	if path.Ext(name) == ".html" { // templates
+		http.NotFound(w, r)
+		return
+	}
+	serveAsset(w, r, name)
+}
+
+// serveAsset serves a file of the theme
+func serveAsset(w http.ResponseWriter, r *http.Request, name string) {
+	fsys := themeFS()
+	if fi, err := fs.Stat(fsys, name); err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFileFS(w, r, fsys, name)
+}
@@ -0,0 +1,167 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	thumbSize      = 320 // maximum width and height of thumbnails in pixels
+	timelineThumbs = 4   // representative thumbnails per timeline bucket
+)
+
+// thumbPath returns the path of the cached thumbnail of the photo, which is
+// created if it does not exist yet or is older than the photo
+func thumbPath(ctx context.Context, album, name string) (string, error) {
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(cacheDir, "thumbs", album, name+".jpg")
+	if ofi, err := os.Stat(out); err == nil && !ofi.ModTime().Before(fi.ModTime()) {
+		return out, nil
+	}
+
+	img, err := decodeImage(path)
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(out), ".thumb-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = jpeg.Encode(tmp, thumbnail(img, thumbSize), &jpeg.Options{Quality: 80})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return out, os.Rename(tmp.Name(), out)
+}
+
+// ThumbServer serves a thumbnail of a photo of the show
+func ThumbServer(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if hotlinked(r) {
+		statusPage(w, r, http.StatusForbidden)
+		return
+	}
+	name := ps.ByName("photo")
+	album := show.currentAlbum()
+	if meta.get(album, name).Hidden {
+		http.NotFound(w, r)
+		return
+	}
+	path, err := thumbPath(r.Context(), album, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// timelineBucket is a period of the timeline with the photos taken in it
+type timelineBucket struct {
+	Start      time.Time `json:"start"`
+	Count      int       `json:"count"`
+	IDs        []int     `json:"ids"`        // positions in the show, in capture order
+	Thumbnails []string  `json:"thumbnails"` // URLs of representative photos
+}
+
+// timeline is the response of the timeline API
+type timeline struct {
+	Bucket  string           `json:"bucket"`
+	Buckets []timelineBucket `json:"buckets"`
+	Undated []int            `json:"undated"` // photos without capture date
+}
+
+// bucketStart returns the start of the day or hour of t
+func bucketStart(t time.Time, hourly bool) time.Time {
+	hour := 0
+	if hourly {
+		hour = t.Hour()
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), hour, 0, 0, 0, t.Location())
+}
+
+// Timeline groups the photos of the show by the day (bucket=day, default) or
+// hour (bucket=hour) they were taken, according to their EXIF data
+func Timeline(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	bucket := r.FormValue("bucket")
+	if bucket == "" {
+		bucket = "day"
+	}
+	if bucket != "day" && bucket != "hour" {
+		http.Error(w, "invalid bucket", http.StatusBadRequest)
+		return
+	}
+
+	type dated struct {
+		id    int
+		taken time.Time
+	}
+	snap := show.snapshot()
+	album, names := snap.album, snap.photos
+	res := timeline{Bucket: bucket, Buckets: make([]timelineBucket, 0), Undated: make([]int, 0)}
+	var all []dated
+	for i, name := range names {
+		exif, err := photoEXIF(r.Context(), album, name)
+		if err != nil || exif.Taken.IsZero() {
+			res.Undated = append(res.Undated, i)
+			continue
+		}
+		all = append(all, dated{i, exif.Taken})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].taken.Before(all[j].taken) })
+
+	for _, d := range all {
+		start := bucketStart(d.taken, bucket == "hour")
+		if n := len(res.Buckets); n == 0 || !res.Buckets[n-1].Start.Equal(start) {
+			res.Buckets = append(res.Buckets, timelineBucket{Start: start})
+		}
+		b := &res.Buckets[len(res.Buckets)-1]
+		b.IDs = append(b.IDs, d.id)
+		b.Count++
+	}
+
+	// pick photos spread evenly over each bucket
+	query := photoQuery(clientIP(r))
+	for i := range res.Buckets {
+		b := &res.Buckets[i]
+		n := timelineThumbs
+		if b.Count < n {
+			n = b.Count
+		}
+		b.Thumbnails = make([]string, n)
+		for j := 0; j < n; j++ {
+			name := names[b.IDs[j*b.Count/n]]
+			b.Thumbnails[j] = "/thumbs/" + url.PathEscape(name) + query
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(res)
+}
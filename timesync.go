@@ -0,0 +1,35 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Time serves the server time in milliseconds since the Unix epoch, for the
+// clients to estimate the offset of their clocks. The "at" times of the
+// slide events are in server time.
+func Time(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Time int64 `json:"time"`
+	}{time.Now().UnixMilli()})
+}
+
+// timed sets the time the slide event is sent and, with syncDelay, the time
+// all screens should show the slide
+func timed(e slideEvent) slideEvent {
+	now := time.Now()
+	e.Time = now.UnixMilli()
+	if syncDelay > 0 {
+		e.At = now.Add(syncDelay).UnixMilli()
+	}
+	return e
+}
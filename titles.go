@@ -0,0 +1,32 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import "strings"
+
+// maxDescriptionLength limits the length of photo descriptions in bytes
+const maxDescriptionLength = 2000
+
+// cleanDescription trims a description of a photo to at most
+// maxDescriptionLength. Unlike captions, descriptions keep their line breaks.
+func cleanDescription(s string) string {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return truncateBytes(strings.TrimSpace(strings.Join(lines, "\n")), maxDescriptionLength)
+}
+
+// photoTitles returns the titles and descriptions of the photos of the
+// current album set by the master, aligned with the names
+func photoTitles(names []string) ([]string, []string) {
+	all := meta.album(show.currentAlbum())
+	titles := make([]string, len(names))
+	descriptions := make([]string, len(names))
+	for i, name := range names {
+		titles[i], descriptions[i] = all[name].Title, all[name].Description
+	}
+	return titles, descriptions
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Transition types between two slides
+const (
+	transitionNone  = "none"
+	transitionFade  = "fade"  // cross-fade
+	transitionSlide = "slide" // the new photo pushes the old one out
+)
+
+// maxTransition limits the duration of transitions
+const maxTransition = 10 * time.Second
+
+// slideTransition is how the screens change to a new slide, sent with the
+// "set" event
+type slideTransition struct {
+	Type     string `json:"type"`
+	Duration int64  `json:"duration"` // ms
+}
+
+// showTransition is the transition selected by the master, nil for the one of
+// the config. It is guarded by modeMu as part of the saved show state.
+var showTransition *slideTransition
+
+// newTransition validates the transition
+func newTransition(typ string, d time.Duration) (*slideTransition, error) {
+	switch typ {
+	case transitionNone:
+		d = 0
+	case transitionFade, transitionSlide:
+		if d < 0 || d > maxTransition {
+			return nil, errors.New("invalid transition duration")
+		}
+	default:
+		return nil, errors.New("unknown transition: " + typ)
+	}
+	return &slideTransition{Type: typ, Duration: d.Milliseconds()}, nil
+}
+
+// currentTransition returns the transition selected by the master, else the
+// one of the album or else the default one
+func currentTransition() *slideTransition {
+	modeMu.Lock()
+	t := showTransition
+	modeMu.Unlock()
+	if t != nil {
+		return t
+	}
+	if t, ok := albumTransitions[show.currentAlbum()]; ok {
+		return &t
+	}
+	t, _ = newTransition(transition, transitionDuration) // checked by checkTransitions
+	return t
+}
+
+// checkTransitions validates the transitions of the config
+func checkTransitions() error {
+	if _, err := newTransition(transition, transitionDuration); err != nil {
+		return err
+	}
+	for album, t := range albumTransitions {
+		if _, err := newTransition(t.Type, time.Duration(t.Duration)*time.Millisecond); err != nil {
+			return errors.New("album " + album + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// formTransition returns the transition given by the form fields
+// "transition" and "duration" (in ms) of a master command, nil if there is
+// none. Without duration, the current one is kept, else the one of the config.
+func formTransition(form url.Values) (*slideTransition, error) {
+	typ := form.Get("transition")
+	if typ == "" {
+		return nil, nil
+	}
+	d := time.Duration(currentTransition().Duration) * time.Millisecond
+	if d == 0 {
+		d = transitionDuration
+	}
+	if s := form.Get("duration"); s != "" {
+		ms, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			return nil, errors.New("invalid transition duration")
+		}
+		d = time.Duration(ms) * time.Millisecond
+	}
+	return newTransition(typ, d)
+}
+
+// setTransition selects the transition of all slide changes, nil restores
+// the one of the config
+func setTransition(t *slideTransition) error {
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	showTransition = t
+	return saveShow()
+}
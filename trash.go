@@ -0,0 +1,243 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// trashEntry is a deleted photo which can still be restored
+type trashEntry struct {
+	ID      string    `json:"id"`
+	Album   string    `json:"album"`
+	Photo   string    `json:"photo"`
+	Deleted time.Time `json:"deleted"`
+	Meta    photoMeta `json:"meta"` // catalog entry, restored with the photo
+}
+
+// path returns the path of the photo file in the trash
+func (e *trashEntry) path() string {
+	return filepath.Join(trashDir, e.ID+"-"+e.Photo)
+}
+
+// trash keeps deleted photos in trashDir for trashRetention. The entries are
+// stored in trashDir/trash.json.
+var trash = struct {
+	sync.Mutex
+	entries []*trashEntry
+}{}
+
+// loadTrash reads the list of deleted photos. A missing file is an empty trash.
+func loadTrash() error {
+	data, err := os.ReadFile(filepath.Join(trashDir, "trash.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	trash.Lock()
+	defer trash.Unlock()
+	return json.Unmarshal(data, &trash.entries)
+}
+
+// saveTrash writes the list of deleted photos.
+// It must be called with trash held.
+func saveTrash() error {
+	data, err := json.MarshalIndent(trash.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(trashDir, "trash.json")
+	if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// trashPhoto moves a photo of the album to the trash, together with its
+// catalog entry
+func trashPhoto(ctx context.Context, album, name string) error {
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(trashDir, 0755); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	e := &trashEntry{
+		ID:      strconv.FormatInt(now.UnixNano(), 36),
+		Album:   album,
+		Photo:   name,
+		Deleted: now,
+		Meta:    meta.get(album, name),
+	}
+
+	trash.Lock()
+	defer trash.Unlock()
+	if err = os.Rename(path, e.path()); err != nil {
+		return err
+	}
+	trash.entries = append(trash.entries, e)
+	if err = saveTrash(); err != nil {
+		return err
+	}
+	return meta.update(album, name, func(m *photoMeta) { *m = photoMeta{} })
+}
+
+// restorePhoto moves a photo from the trash back into its album
+func restorePhoto(ctx context.Context, id string) (*trashEntry, error) {
+	trash.Lock()
+	defer trash.Unlock()
+
+	for i, e := range trash.entries {
+		if e.ID != id {
+			continue
+		}
+
+		path, err := source.Path(ctx, e.Album, e.Photo)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = os.Stat(path); err == nil {
+			return nil, &os.PathError{Op: "restore", Path: e.Photo, Err: os.ErrExist}
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err = os.Rename(e.path(), path); err != nil {
+			return nil, err
+		}
+
+		trash.entries = append(trash.entries[:i:i], trash.entries[i+1:]...)
+		if err = saveTrash(); err != nil {
+			return nil, err
+		}
+		return e, meta.update(e.Album, e.Photo, func(m *photoMeta) { *m = e.Meta })
+	}
+	return nil, os.ErrNotExist
+}
+
+// purgeTrash permanently deletes the photos in the trash for which keep
+// returns false
+func purgeTrash(keep func(*trashEntry) bool) error {
+	trash.Lock()
+	defer trash.Unlock()
+
+	kept := make([]*trashEntry, 0, len(trash.entries))
+	for _, e := range trash.entries {
+		if keep(e) {
+			kept = append(kept, e)
+			continue
+		}
+		if err := os.Remove(e.path()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(kept) == len(trash.entries) {
+		return nil
+	}
+	trash.entries = kept
+	return saveTrash()
+}
+
+// startTrash loads the trash and purges expired photos once an hour, until
+// the context is done
+func startTrash(ctx context.Context) {
+	if err := loadTrash(); err != nil {
+		log.Println("trash:", err)
+		return
+	}
+
+	expire := func() {
+		err := purgeTrash(func(e *trashEntry) bool {
+			return time.Since(e.Deleted) < trashRetention
+		})
+		if err != nil {
+			log.Println("trash:", err)
+		}
+	}
+	expire()
+	go func() {
+		for sleep(ctx, time.Hour) {
+			expire()
+		}
+	}()
+}
+
+// Trash lists the deleted photos, the most recent first
+func Trash(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	trash.Lock()
+	entries := append([]*trashEntry{}, trash.entries...)
+	trash.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted.After(entries[j].Deleted) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// DeletePhoto moves a photo of the current album to the trash
+func DeletePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if sourceType != "dir" {
+		http.Error(w, "Deleting photos is only supported for the dir photo source", http.StatusNotImplemented)
+		return
+	}
+	name := ps.ByName("photo")
+	if !hasPhoto(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := trashPhoto(r.Context(), show.currentAlbum(), name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rescan()
+}
+
+// RestorePhoto moves a photo from the trash back into its album
+func RestorePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	e, err := restorePhoto(r.Context(), ps.ByName("id"))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if os.IsExist(err) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if e.Album == show.currentAlbum() {
+		rescan()
+	}
+}
+
+// PurgePhoto permanently deletes a photo in the trash
+func PurgePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	err := purgeTrash(func(e *trashEntry) bool { return e.ID != id })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
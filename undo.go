@@ -0,0 +1,120 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// undoDepth is the number of commands which can be undone
+const undoDepth = 20
+
+// undoPoint is the state of the show before a command of the master
+type undoPoint struct {
+	album      string
+	photo      string
+	id         uint64
+	autoplay   time.Duration
+	mode       string
+	transition *slideTransition
+}
+
+// undos is the history of the states before the last commands, the latest
+// last
+var undos struct {
+	sync.Mutex
+	points []undoPoint
+}
+
+var errNothingToUndo = errors.New("nothing to undo")
+
+// undoable reports whether the command, or text command, changes what the
+// viewers see in a way which can be undone
+func undoable(cmd string) bool {
+	switch cmd {
+	case "set", "next", "prev", "reset", "album", "preset", "autoplay", "play", "pause", "mode", "transition":
+		return true
+	}
+	return false
+}
+
+// currentUndoPoint returns the current state of the show
+func currentUndoPoint() undoPoint {
+	p := undoPoint{
+		album:    show.currentAlbum(),
+		photo:    currentPhoto(),
+		id:       show.current(),
+		autoplay: player.playing(),
+	}
+	modeMu.Lock()
+	p.mode, p.transition = mode, showTransition
+	modeMu.Unlock()
+	return p
+}
+
+// pushUndo remembers the state before a command, forgetting the oldest one
+// beyond undoDepth
+func pushUndo(p undoPoint) {
+	undos.Lock()
+	defer undos.Unlock()
+	if len(undos.points) == undoDepth {
+		undos.points = append(undos.points[:0], undos.points[1:]...)
+	}
+	undos.points = append(undos.points, p)
+}
+
+// undo restores the state before the last undoable command. The viewers are
+// sent the restored slide like after any other change.
+func undo() error {
+	undos.Lock()
+	n := len(undos.points)
+	if n == 0 {
+		undos.Unlock()
+		return errNothingToUndo
+	}
+	p := undos.points[n-1]
+	undos.points = undos.points[:n-1]
+	undos.Unlock()
+	return restore(p)
+}
+
+// restore changes the show back to the state
+func restore(p undoPoint) error {
+	if p.album != show.currentAlbum() {
+		if err := setAlbum(p.album); err != nil {
+			return err
+		}
+	}
+	now := currentUndoPoint()
+	if p.mode != now.mode {
+		if err := setMode(p.mode); err != nil {
+			return err
+		}
+	}
+	if p.transition != now.transition {
+		if err := setTransition(p.transition); err != nil {
+			return err
+		}
+	}
+	if p.autoplay != now.autoplay {
+		if p.autoplay == 0 {
+			player.pause()
+		} else if err := player.start(p.autoplay); err != nil {
+			return err
+		}
+	}
+
+	// the photo may have moved, e.g. after a reset
+	id := p.id
+	for i, name := range show.snapshot().photos {
+		if name == p.photo {
+			id = uint64(i)
+			break
+		}
+	}
+	return setID(id, nil)
+}
@@ -0,0 +1,336 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// guestUpload is a photo uploaded by a viewer, waiting for review
+type guestUpload struct {
+	ID       string    `json:"id"`
+	Album    string    `json:"album"`    // the photo is added to
+	Filename string    `json:"filename"` // as uploaded
+	Uploader string    `json:"uploader,omitempty"`
+	IP       string    `json:"ip"`
+	Uploaded time.Time `json:"uploaded"`
+
+	Screening *screenResult `json:"screening,omitempty"` // nil if not screened
+}
+
+// suspect reports whether the screening flagged the upload
+func (u *guestUpload) suspect() bool {
+	return u.Screening != nil && u.Screening.Suspect
+}
+
+// path returns the path of the uploaded file in the queue
+func (u *guestUpload) path() string {
+	return filepath.Join(uploadDir, u.ID+strings.ToLower(path.Ext(u.Filename)))
+}
+
+// uploads is the moderation queue, stored in uploadDir/uploads.json
+var uploads = struct {
+	sync.Mutex
+	pending []*guestUpload
+	next    uint64
+}{}
+
+// uploadLimiter limits the guest uploads per IP address
+var uploadLimiter = rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// loadUploads reads the moderation queue. A missing file is an empty queue.
+func loadUploads() error {
+	data, err := os.ReadFile(filepath.Join(uploadDir, "uploads.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	uploads.Lock()
+	defer uploads.Unlock()
+	return json.Unmarshal(data, &uploads.pending)
+}
+
+// saveUploads writes the moderation queue and notifies the master about the
+// number of pending uploads.
+// It must be called with uploads held.
+func saveUploads() error {
+	data, err := json.MarshalIndent(uploads.pending, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(uploadDir, "uploads.json")
+	if err = os.WriteFile(p+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(p+".tmp", p); err != nil {
+		return err
+	}
+	streamer.SendUint("", "pending", uint64(len(uploads.pending)))
+	uploadsPending(len(uploads.pending))
+	return nil
+}
+
+// queueUpload saves an uploaded file in the moderation queue
+func queueUpload(fh *multipart.FileHeader, album, uploader, ip string) (*guestUpload, error) {
+	name := path.Base(strings.Replace(fh.Filename, `\`, "/", -1))
+	if !validName(name) || strings.HasPrefix(name, ".") {
+		return nil, errors.New("invalid filename")
+	}
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	uploads.Lock()
+	uploads.next++
+	u := &guestUpload{
+		ID:       strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatUint(uploads.next, 36),
+		Album:    album,
+		Filename: name,
+		Uploader: uploader,
+		IP:       ip,
+		Uploaded: time.Now(),
+	}
+	uploads.Unlock()
+	if err = saveImage(f, u.path()); err != nil {
+		return nil, err
+	}
+
+	uploads.Lock()
+	defer uploads.Unlock()
+	uploads.pending = append(uploads.pending, u)
+	return u, saveUploads()
+}
+
+// findUpload returns the upload with the given ID, nil if not found
+func findUpload(id string) *guestUpload {
+	uploads.Lock()
+	defer uploads.Unlock()
+	for _, u := range uploads.pending {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+// dequeueUpload removes the upload from the queue
+func dequeueUpload(id string) error {
+	uploads.Lock()
+	defer uploads.Unlock()
+	for i, u := range uploads.pending {
+		if u.ID == id {
+			uploads.pending = append(uploads.pending[:i:i], uploads.pending[i+1:]...)
+			return saveUploads()
+		}
+	}
+	return nil
+}
+
+// uniqueName returns the name, or if a file with this name exists in dir
+// already, the name with a number appended, e.g. photo-2.jpg
+func uniqueName(dir, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			return name
+		}
+		name = base + "-" + strconv.Itoa(i) + ext
+	}
+}
+
+// publishUpload moves an upload into its album and adds it to the show, or
+// into the staging area with stagePhotos. It returns the name of the photo in
+// the album.
+func publishUpload(u *guestUpload) (string, error) {
+	if stagePhotos {
+		_, err := stagePhoto(u.path(), u.Album, u.Filename, u.Uploader)
+		return u.Filename, err
+	}
+	dir := albumDir(u.Album)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := uniqueName(dir, u.Filename)
+	if err := os.Rename(u.path(), filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+
+	sendWebhook(hookUpload, uploadData{Album: u.Album, Photos: []string{name}})
+	pushPhotosAdded(u.Album, 1)
+	if u.Album == show.currentAlbum() {
+		rescan()
+		streamer.SendJSON("", "upload", map[string]string{"photo": name, "uploader": u.Uploader})
+	}
+	return name, nil
+}
+
+// uploadResult is the response to a guest upload
+type uploadResult struct {
+	Published []string `json:"published"`
+	Queued    []string `json:"queued"` // waiting for review or to be published
+	Skipped   []string `json:"skipped"`
+}
+
+// GuestUpload accepts photos uploaded by viewers in the multipart form field
+// photo (repeatable), with the optional name of the uploader. Uploads are
+// queued for review by the master if moderateUploads is set or if they are
+// flagged by the screening.
+func GuestUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	res, code, err := receiveUploads(w, r)
+	if err != nil {
+		errorPage(w, r, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// receiveUploads handles the photos of a guest upload request. If the request is
+// rejected as a whole, an error and the status code are returned instead.
+func receiveUploads(w http.ResponseWriter, r *http.Request) (uploadResult, int, error) {
+	if !guestUploads || sourceType != "dir" {
+		return uploadResult{}, http.StatusForbidden, errors.New("Uploads are disabled")
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		return uploadResult{}, http.StatusBadRequest, err
+	}
+	files := r.MultipartForm.File["photo"]
+	if len(files) == 0 {
+		return uploadResult{}, http.StatusBadRequest, errors.New("No photo")
+	}
+	uploader := strings.TrimSpace(r.FormValue("name"))
+	if len(uploader) > 64 {
+		uploader = uploader[:64]
+	}
+
+	album := show.currentAlbum()
+	if !requestAccess(r).allowed(album) {
+		return uploadResult{}, http.StatusForbidden, errors.New("Forbidden") // the album changed
+	}
+
+	ip, lang := clientIP(r), requestLanguage(r)
+	res := uploadResult{Published: make([]string, 0), Queued: make([]string, 0), Skipped: make([]string, 0)}
+	for _, fh := range files {
+		if ok, _ := uploadLimiter.allow(ip, uploadRate, time.Hour); !ok {
+			res.Skipped = append(res.Skipped, fh.Filename+": "+tr(lang, "Too many uploads"))
+			continue
+		}
+		u, err := queueUpload(fh, album, uploader, ip)
+		if err != nil {
+			res.Skipped = append(res.Skipped, fh.Filename+": "+err.Error())
+			continue
+		}
+		if s := screenUpload(r.Context(), u); s != nil {
+			uploads.Lock()
+			u.Screening = s
+			err = saveUploads()
+			uploads.Unlock()
+			if err != nil {
+				res.Skipped = append(res.Skipped, fh.Filename+": "+err.Error())
+				continue
+			}
+			if u.suspect() {
+				log.Printf("upload %s flagged by screening: %s", u.ID, s.Reason)
+			}
+		}
+		if moderateUploads || u.suspect() {
+			res.Queued = append(res.Queued, u.Filename)
+			continue
+		}
+
+		name, err := publishUpload(u)
+		if err == nil {
+			err = dequeueUpload(u.ID)
+		}
+		if err != nil {
+			res.Skipped = append(res.Skipped, fh.Filename+": "+err.Error())
+			continue
+		}
+		if stagePhotos {
+			res.Queued = append(res.Queued, name)
+			continue
+		}
+		res.Published = append(res.Published, name)
+	}
+	return res, http.StatusOK, nil
+}
+
+// Uploads lists the uploads waiting for review, the oldest first
+func Uploads(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uploads.Lock()
+	pending := append([]*guestUpload{}, uploads.pending...)
+	uploads.Unlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Uploaded.Before(pending[j].Uploaded) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(pending)
+}
+
+// UploadPhoto serves a photo waiting for review
+func UploadPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	upload := findUpload(ps.ByName("id"))
+	if upload == nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, upload.path())
+}
+
+// ReviewUpload approves (action=approve) or rejects (action=reject) an upload
+func ReviewUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	action := r.PostFormValue("action")
+	if action != "approve" && action != "reject" {
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+
+	u := findUpload(ps.ByName("id"))
+	if u == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var err error
+	if action == "reject" {
+		err = os.Remove(u.path())
+	} else {
+		_, err = publishUpload(u)
+	}
+	if err == nil {
+		err = dequeueUpload(u.ID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
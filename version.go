@@ -0,0 +1,54 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// stateVersion is the ID of the last event of the slides channel, which is
+// sent whenever the state of the show changes. Clients know it from the
+// photos.json and the IDs of the events. Commands can carry the version they
+// were based on in stateVersion, so that masters don't clobber each other's
+// changes.
+var stateVersion atomic.Uint64
+
+// stateMu serializes the commands and the other changes of the slide, e.g. by
+// autoplay or the schedule, so that the state version does not change between
+// its check and the command, and a batch only holds back its own events.
+// Reloads after the photos changed are not serialized.
+var stateMu sync.Mutex
+
+// errVersionConflict is returned for commands based on an outdated state
+var errVersionConflict = errors.New("the show was changed meanwhile")
+
+// expectVersion runs the command with stateMu held if the state still has the
+// expected version, any version if it is empty
+func expectVersion(expected string, run func() error) error {
+	var v uint64
+	if expected != "" {
+		var err error
+		if v, err = strconv.ParseUint(expected, 10, 64); err != nil {
+			return errors.New("invalid stateVersion")
+		}
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if expected != "" && v != stateVersion.Load() {
+		return errVersionConflict
+	}
+	return run()
+}
+
+// changeState runs a change of the show state which is not a command of a
+// master, serialized with the commands
+func changeState(change func() error) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return change()
+}
@@ -0,0 +1,160 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// videoWall is a layout of displays showing the photos as one logical screen.
+// Each display opens the show with ?tile=<name> and shows its part of it.
+type videoWall struct {
+	Tiles []wallTile `json:"tiles"`
+}
+
+// wallTile is the part of the wall a display shows, as fractions of the
+// wall's width and height
+type wallTile struct {
+	Name string  `json:"name"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+	W    float64 `json:"w"`
+	H    float64 `json:"h"`
+}
+
+// wallCrop tells a display how to show its part of the photos: the photo is
+// fitted into a box scaled by ScaleX and ScaleY relative to the display,
+// which is shifted by OffsetX and OffsetY times the display size
+type wallCrop struct {
+	ScaleX  float64 `json:"scaleX"`
+	ScaleY  float64 `json:"scaleY"`
+	OffsetX float64 `json:"offsetX"`
+	OffsetY float64 `json:"offsetY"`
+}
+
+// wallLayout is the body of POST /master/wall. Without tiles, a grid of
+// cols by rows tiles named "1", "2", ... row by row is created.
+type wallLayout struct {
+	Tiles []wallTile `json:"tiles"`
+	Cols  int        `json:"cols"`
+	Rows  int        `json:"rows"`
+}
+
+// wall is the current layout, nil without video wall. It is guarded by modeMu
+// as part of the saved show state.
+var wall *videoWall
+
+// newVideoWall validates the layout
+func newVideoWall(l wallLayout) (*videoWall, error) {
+	if len(l.Tiles) == 0 {
+		if l.Cols < 1 || l.Rows < 1 {
+			return nil, errors.New("tiles or cols and rows required")
+		}
+		for i := 0; i < l.Cols*l.Rows; i++ {
+			l.Tiles = append(l.Tiles, wallTile{
+				Name: strconv.Itoa(i + 1),
+				X:    float64(i%l.Cols) / float64(l.Cols),
+				Y:    float64(i/l.Cols) / float64(l.Rows),
+				W:    1 / float64(l.Cols),
+				H:    1 / float64(l.Rows),
+			})
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, t := range l.Tiles {
+		switch {
+		case t.Name == "":
+			return nil, errors.New("tile without name")
+		case names[t.Name]:
+			return nil, errors.New("duplicate tile: " + t.Name)
+		case t.W <= 0 || t.H <= 0 || t.X < 0 || t.Y < 0 || t.X+t.W > 1.0001 || t.Y+t.H > 1.0001:
+			return nil, errors.New("tile outside of the wall: " + t.Name)
+		}
+		names[t.Name] = true
+	}
+	return &videoWall{Tiles: l.Tiles}, nil
+}
+
+// crops returns the crop of each tile by name
+func (v *videoWall) crops() map[string]wallCrop {
+	crops := make(map[string]wallCrop, len(v.Tiles))
+	for _, t := range v.Tiles {
+		crops[t.Name] = wallCrop{
+			ScaleX:  1 / t.W,
+			ScaleY:  1 / t.H,
+			OffsetX: (0 - t.X) / t.W, // not -0 for the first column
+			OffsetY: (0 - t.Y) / t.H,
+		}
+	}
+	return crops
+}
+
+// currentWall returns the crops of the tiles of the current layout, nil
+// without video wall
+func currentWall() map[string]wallCrop {
+	modeMu.Lock()
+	defer modeMu.Unlock()
+	if wall == nil {
+		return nil
+	}
+	return wall.crops()
+}
+
+// setWall changes the layout, nil removes the video wall
+func setWall(v *videoWall) error {
+	modeMu.Lock()
+	wall = v
+	err := saveShow()
+	modeMu.Unlock()
+
+	streamer.SendJSON("", "wall", currentWall())
+	return err
+}
+
+// VideoWall serves the layout of the video wall, null if there is none
+func VideoWall(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	modeMu.Lock()
+	data, err := json.Marshal(wall)
+	modeMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
+
+// SetVideoWall defines the layout of the video wall, see wallLayout
+func SetVideoWall(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var l wallLayout
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v, err := newVideoWall(l)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = setWall(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	VideoWall(w, r, nil)
+}
+
+// DeleteVideoWall removes the video wall, all displays show whole photos again
+func DeleteVideoWall(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := setWall(nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
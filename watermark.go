@@ -0,0 +1,248 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// font5x7 is a 5x7 pixel font for the printable ASCII characters. Each glyph
+// consists of 5 columns, the lowest bit is the top row.
+var font5x7 = [95][5]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, {0x00, 0x00, 0x5F, 0x00, 0x00}, {0x00, 0x07, 0x00, 0x07, 0x00}, // space ! "
+	{0x14, 0x7F, 0x14, 0x7F, 0x14}, {0x24, 0x2A, 0x7F, 0x2A, 0x12}, {0x23, 0x13, 0x08, 0x64, 0x62}, // # $ %
+	{0x36, 0x49, 0x55, 0x22, 0x50}, {0x00, 0x05, 0x03, 0x00, 0x00}, {0x00, 0x1C, 0x22, 0x41, 0x00}, // & ' (
+	{0x00, 0x41, 0x22, 0x1C, 0x00}, {0x14, 0x08, 0x3E, 0x08, 0x14}, {0x08, 0x08, 0x3E, 0x08, 0x08}, // ) * +
+	{0x00, 0x50, 0x30, 0x00, 0x00}, {0x08, 0x08, 0x08, 0x08, 0x08}, {0x00, 0x60, 0x60, 0x00, 0x00}, // , - .
+	{0x20, 0x10, 0x08, 0x04, 0x02}, {0x3E, 0x51, 0x49, 0x45, 0x3E}, {0x00, 0x42, 0x7F, 0x40, 0x00}, // / 0 1
+	{0x42, 0x61, 0x51, 0x49, 0x46}, {0x21, 0x41, 0x45, 0x4B, 0x31}, {0x18, 0x14, 0x12, 0x7F, 0x10}, // 2 3 4
+	{0x27, 0x45, 0x45, 0x45, 0x39}, {0x3C, 0x4A, 0x49, 0x49, 0x30}, {0x01, 0x71, 0x09, 0x05, 0x03}, // 5 6 7
+	{0x36, 0x49, 0x49, 0x49, 0x36}, {0x06, 0x49, 0x49, 0x29, 0x1E}, {0x00, 0x36, 0x36, 0x00, 0x00}, // 8 9 :
+	{0x00, 0x56, 0x36, 0x00, 0x00}, {0x08, 0x14, 0x22, 0x41, 0x00}, {0x14, 0x14, 0x14, 0x14, 0x14}, // ; < =
+	{0x00, 0x41, 0x22, 0x14, 0x08}, {0x02, 0x01, 0x51, 0x09, 0x06}, {0x32, 0x49, 0x79, 0x41, 0x3E}, // > ? @
+	{0x7E, 0x11, 0x11, 0x11, 0x7E}, {0x7F, 0x49, 0x49, 0x49, 0x36}, {0x3E, 0x41, 0x41, 0x41, 0x22}, // A B C
+	{0x7F, 0x41, 0x41, 0x22, 0x1C}, {0x7F, 0x49, 0x49, 0x49, 0x41}, {0x7F, 0x09, 0x09, 0x01, 0x01}, // D E F
+	{0x3E, 0x41, 0x41, 0x51, 0x32}, {0x7F, 0x08, 0x08, 0x08, 0x7F}, {0x00, 0x41, 0x7F, 0x41, 0x00}, // G H I
+	{0x20, 0x40, 0x41, 0x3F, 0x01}, {0x7F, 0x08, 0x14, 0x22, 0x41}, {0x7F, 0x40, 0x40, 0x40, 0x40}, // J K L
+	{0x7F, 0x02, 0x04, 0x02, 0x7F}, {0x7F, 0x04, 0x08, 0x10, 0x7F}, {0x3E, 0x41, 0x41, 0x41, 0x3E}, // M N O
+	{0x7F, 0x09, 0x09, 0x09, 0x06}, {0x3E, 0x41, 0x51, 0x21, 0x5E}, {0x7F, 0x09, 0x19, 0x29, 0x46}, // P Q R
+	{0x46, 0x49, 0x49, 0x49, 0x31}, {0x01, 0x01, 0x7F, 0x01, 0x01}, {0x3F, 0x40, 0x40, 0x40, 0x3F}, // S T U
+	{0x1F, 0x20, 0x40, 0x20, 0x1F}, {0x7F, 0x20, 0x18, 0x20, 0x7F}, {0x63, 0x14, 0x08, 0x14, 0x63}, // V W X
+	{0x03, 0x04, 0x78, 0x04, 0x03}, {0x61, 0x51, 0x49, 0x45, 0x43}, {0x00, 0x7F, 0x41, 0x41, 0x00}, // Y Z [
+	{0x02, 0x04, 0x08, 0x10, 0x20}, {0x00, 0x41, 0x41, 0x7F, 0x00}, {0x04, 0x02, 0x01, 0x02, 0x04}, // \ ] ^
+	{0x40, 0x40, 0x40, 0x40, 0x40}, {0x00, 0x01, 0x02, 0x04, 0x00}, {0x20, 0x54, 0x54, 0x54, 0x78}, // _ ` a
+	{0x7F, 0x48, 0x44, 0x44, 0x38}, {0x38, 0x44, 0x44, 0x44, 0x20}, {0x38, 0x44, 0x44, 0x48, 0x7F}, // b c d
+	{0x38, 0x54, 0x54, 0x54, 0x18}, {0x08, 0x7E, 0x09, 0x01, 0x02}, {0x08, 0x54, 0x54, 0x54, 0x3C}, // e f g
+	{0x7F, 0x08, 0x04, 0x04, 0x78}, {0x00, 0x44, 0x7D, 0x40, 0x00}, {0x20, 0x40, 0x44, 0x3D, 0x00}, // h i j
+	{0x7F, 0x10, 0x28, 0x44, 0x00}, {0x00, 0x41, 0x7F, 0x40, 0x00}, {0x7C, 0x04, 0x18, 0x04, 0x78}, // k l m
+	{0x7C, 0x08, 0x04, 0x04, 0x78}, {0x38, 0x44, 0x44, 0x44, 0x38}, {0x7C, 0x14, 0x14, 0x14, 0x08}, // n o p
+	{0x08, 0x14, 0x14, 0x18, 0x7C}, {0x7C, 0x08, 0x04, 0x04, 0x08}, {0x48, 0x54, 0x54, 0x54, 0x20}, // q r s
+	{0x04, 0x3F, 0x44, 0x40, 0x20}, {0x3C, 0x40, 0x40, 0x20, 0x7C}, {0x1C, 0x20, 0x40, 0x20, 0x1C}, // t u v
+	{0x3C, 0x40, 0x30, 0x40, 0x3C}, {0x44, 0x28, 0x10, 0x28, 0x44}, {0x0C, 0x50, 0x50, 0x50, 0x3C}, // w x y
+	{0x44, 0x64, 0x54, 0x4C, 0x44}, {0x00, 0x08, 0x36, 0x41, 0x00}, {0x00, 0x00, 0x7F, 0x00, 0x00}, // z { |
+	{0x00, 0x41, 0x36, 0x08, 0x00}, {0x08, 0x04, 0x08, 0x10, 0x08}, // } ~
+}
+
+// renderText draws the text in white on a transparent background with a
+// dark outline, so it stays readable on light photos. Characters missing in
+// the font are drawn as '?'.
+func renderText(text string) *image.RGBA {
+	text = strings.Replace(text, "©", "(c)", -1)
+
+	// 6x8 cells with a 1 pixel border for the outline
+	img := image.NewRGBA(image.Rect(0, 0, 6*len(text)+1, 9))
+	white := color.RGBA{255, 255, 255, 255}
+	shadow := color.RGBA{0, 0, 0, 160}
+	for pass := 0; pass < 2; pass++ {
+		for i, c := range []byte(text) {
+			if c < ' ' || c > '~' {
+				c = '?'
+			}
+			for x, col := range font5x7[c-' '] {
+				for y := 0; y < 7; y++ {
+					if col&(1<<uint(y)) == 0 {
+						continue
+					}
+					px, py := 1+6*i+x, 1+y
+					if pass == 1 {
+						img.SetRGBA(px, py, white)
+						continue
+					}
+					for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+						if img.RGBAAt(px+d[0], py+d[1]).A == 0 {
+							img.SetRGBA(px+d[0], py+d[1], shadow)
+						}
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+var (
+	watermarkOnce sync.Once
+	watermarkImg  image.Image // nil if disabled
+	watermarkErr  error
+)
+
+// loadWatermark returns the configured watermark image, nil if disabled
+func loadWatermark() (image.Image, error) {
+	watermarkOnce.Do(func() {
+		switch {
+		case watermarkImage != "":
+			if watermarkImg, watermarkErr = decodeImage(watermarkImage); watermarkErr != nil {
+				// photos are not served at all instead of without watermark
+				log.Println("watermark:", watermarkErr)
+			}
+		case watermarkText != "":
+			watermarkImg = renderText(watermarkText)
+		}
+	})
+	return watermarkImg, watermarkErr
+}
+
+// applyWatermark composites the watermark onto the photo
+func applyWatermark(photo, mark image.Image) *image.RGBA {
+	b := photo.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), photo, b.Min, draw.Src)
+
+	// scale the watermark to watermarkScale of the photo width
+	mb := mark.Bounds()
+	w := int(float64(b.Dx()) * watermarkScale)
+	h := mb.Dy() * w / mb.Dx()
+	if w < 1 || h < 1 {
+		return dst
+	}
+	if watermarkImage == "" {
+		// scale the pixel font by whole pixels only to keep it crisp
+		n := w / mb.Dx()
+		if n < 1 {
+			n = 1
+		}
+		w, h = n*mb.Dx(), n*mb.Dy()
+	}
+	scaled := resize(mark, w, h)
+
+	margin := b.Dx() / 50
+	if b.Dy() < b.Dx() {
+		margin = b.Dy() / 50
+	}
+	x, y := margin, margin
+	pos := strings.Split(watermarkPosition, "-")
+	switch {
+	case watermarkPosition == "center":
+		x, y = (b.Dx()-w)/2, (b.Dy()-h)/2
+	case len(pos) == 2:
+		if pos[0] == "bottom" {
+			y = b.Dy() - h - margin
+		}
+		if pos[1] == "right" {
+			x = b.Dx() - w - margin
+		}
+	}
+
+	opacity := uint8(watermarkOpacity * 255)
+	draw.DrawMask(dst, image.Rect(x, y, x+w, y+h), scaled, image.Point{}, image.NewUniform(color.Alpha{opacity}), image.Point{}, draw.Over)
+	return dst
+}
+
+// displayDir is the cache directory of the display variants. It depends on
+// the config, so that changing it doesn't serve outdated copies.
+func displayDir() string {
+	h := sha256.Sum256([]byte(fmt.Sprint(displaySize, watermarkText, watermarkImage, watermarkPosition, watermarkOpacity, watermarkScale)))
+	return filepath.Join(cacheDir, "display-"+hex.EncodeToString(h[:4]))
+}
+
+// servedPath returns the path of the display variant of the given photo,
+// which is scaled down to displaySize and watermarked if configured. Photos
+// which don't need a variant or can't be decoded are served as they are.
+func servedPath(ctx context.Context, album, name string) (string, error) {
+	path, err := source.Path(ctx, album, name)
+	if err != nil {
+		return "", err
+	}
+	mark, err := loadWatermark()
+	if err != nil {
+		return "", err
+	}
+	if mark == nil && displaySize <= 0 {
+		return path, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(displayDir(), album, name)
+	if ofi, err := os.Stat(out); err == nil && !ofi.ModTime().Before(fi.ModTime()) {
+		return out, nil
+	}
+
+	var img image.Image
+	if mark == nil {
+		// only decode the header to check whether the photo is too large
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		cfg, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil || (cfg.Width <= displaySize && cfg.Height <= displaySize) {
+			return path, nil
+		}
+	}
+	if img, err = decodeImage(path); err != nil {
+		return path, nil
+	}
+	if b := img.Bounds(); displaySize > 0 && (b.Dx() > displaySize || b.Dy() > displaySize) {
+		img = thumbnail(img, displaySize)
+	}
+	if mark != nil {
+		img = applyWatermark(img, mark)
+	}
+	if err = os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first, so that concurrent requests never see
+	// partial files
+	tmp, err := os.CreateTemp(filepath.Dir(out), ".watermark-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png":
+		err = png.Encode(tmp, img)
+	case ".gif":
+		err = gif.Encode(tmp, img, nil)
+	default:
+		err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: 90})
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return out, os.Rename(tmp.Name(), out)
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Webhook event types
+const (
+	hookSlide     = "slide"
+	hookReset     = "reset"
+	hookShowStart = "show.start"
+	hookShowEnd   = "show.end"
+	hookUpload    = "upload"
+)
+
+// webhookPayload is the JSON body POSTed to the webhook URLs
+type webhookPayload struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// slideData describes the displayed photo in webhook payloads
+type slideData struct {
+	Album string `json:"album"`
+	ID    uint64 `json:"id"`
+	Photo string `json:"photo"`
+}
+
+// uploadData describes newly added photos in webhook payloads
+type uploadData struct {
+	Album  string   `json:"album"`
+	Photos []string `json:"photos"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookSignature returns the hex encoded HMAC-SHA256 of the body.
+// Receivers verify the X-Photoshow-Signature header with the shared secret.
+func webhookSignature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook delivers the event asynchronously to all configured webhooks.
+// The returned WaitGroup is done when all deliveries finished.
+func sendWebhook(event string, data interface{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	if len(webhooks) == 0 {
+		return &wg
+	}
+
+	body, err := json.Marshal(webhookPayload{Event: event, Time: time.Now(), Data: data})
+	if err != nil {
+		log.Println("webhook:", err)
+		return &wg
+	}
+	for _, u := range webhooks {
+		wg.Add(1)
+		go func(u string) {
+			deliverWebhook(u, event, body)
+			wg.Done()
+		}(u)
+	}
+	return &wg
+}
+
+// deliverWebhook POSTs the body to the URL, retrying with exponential backoff
+func deliverWebhook(u, event string, body []byte) error {
+	const attempts = 5
+	backoff := time.Second
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = postWebhook(u, event, body); err == nil {
+			return nil
+		}
+	}
+	log.Printf("webhook %s: giving up after %d attempts: %v", u, attempts, err)
+	return err
+}
+
+func postWebhook(u, event string, body []byte) error {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "remotephotoshow")
+	req.Header.Set("X-Photoshow-Event", event)
+	if webhookSecret != "" {
+		req.Header.Set("X-Photoshow-Signature", webhookSignature(body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
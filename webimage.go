@@ -0,0 +1,187 @@
+// Copyright 2014 Julien Schmidt. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webPrefix starts the names of the images of web servers in the photo list
+const webPrefix = "_web-"
+
+var webImageClient = &http.Client{Timeout: 30 * time.Second}
+
+// webImages holds the URLs of the images of web servers listed in playlists
+// by their names, and a lock per name, so that each image is fetched once at
+// a time
+var webImages = struct {
+	sync.Mutex
+	byName   map[string]string
+	fetching map[string]*sync.Mutex
+}{byName: make(map[string]string), fetching: make(map[string]*sync.Mutex)}
+
+// addWebImage registers the image URL of the playlist entry e and returns the
+// entry with the name of the image. It is fetched in the background, so that
+// it is cached when it is shown.
+func addWebImage(e playlistEntry) (playlistEntry, error) {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return e, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return e, errors.New("not an HTTP(S) URL: " + e.URL)
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	if _, ok := imageTypes[ext]; !ok {
+		ext = ".jpg"
+	}
+	h := sha256.Sum256([]byte(e.URL))
+	e.Photo = webPrefix + hex.EncodeToString(h[:6]) + ext
+
+	webImages.Lock()
+	webImages.byName[e.Photo] = e.URL
+	webImages.Unlock()
+	go func(name, u string) {
+		if _, err := webImagePath(rootCtx, name, u); err != nil {
+			log.Println("web image:", err)
+		}
+	}(e.Photo, e.URL)
+	return e, nil
+}
+
+// webImageURL returns the URL of the image of a web server with the name
+func webImageURL(name string) (string, bool) {
+	if !strings.HasPrefix(name, webPrefix) {
+		return "", false
+	}
+	webImages.Lock()
+	defer webImages.Unlock()
+	u, ok := webImages.byName[name]
+	return u, ok
+}
+
+// webImagePath returns the path of the cached copy of the image at u. It is
+// fetched again after webImageRefresh. If that fails, the cached copy is
+// still served, so that the show does not depend on the web server being
+// available.
+func webImagePath(ctx context.Context, name, u string) (string, error) {
+	p := filepath.Join(cacheDir, "web", name)
+	if fi, err := os.Stat(p); err == nil && time.Since(fi.ModTime()) < webImageRefresh {
+		return p, nil
+	}
+
+	webImages.Lock()
+	mu := webImages.fetching[name]
+	if mu == nil {
+		mu = new(sync.Mutex)
+		webImages.fetching[name] = mu
+	}
+	webImages.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	fi, err := os.Stat(p)
+	if err == nil && time.Since(fi.ModTime()) < webImageRefresh {
+		return p, nil // fetched meanwhile
+	}
+	var modified time.Time
+	if err == nil {
+		modified = fi.ModTime()
+	}
+	if ferr := fetchWebImage(ctx, u, p, modified); ferr != nil {
+		if err == nil {
+			log.Printf("web image %s: %v, serving the cached copy", u, ferr)
+			return p, nil
+		}
+		return "", ferr
+	}
+	return p, nil
+}
+
+// fetchWebImage downloads the image at u to the file p. If the file was
+// modified at the given time and the image has not changed since, only its
+// modification time is updated. Responses which are not a supported image
+// or larger than maxWebImageSize are rejected.
+func fetchWebImage(ctx context.Context, u, p string, modified time.Time) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if !modified.IsZero() {
+		req.Header.Set("If-Modified-Since", modified.UTC().Format(http.TimeFormat))
+	}
+	resp, err := webImageClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if !modified.IsZero() {
+			now := time.Now()
+			return os.Chtimes(p, now, now)
+		}
+		fallthrough
+	default:
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	ctype := http.DetectContentType(head[:n])
+	supported := false
+	for _, t := range imageTypes {
+		supported = supported || t == ctype
+	}
+	if !supported {
+		return errors.New(u + ": not a supported image: " + ctype)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// Download to a temporary file first, so that concurrent requests never
+	// see partial files
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(head[:n])
+	if err == nil {
+		var written int64
+		written, err = io.Copy(tmp, io.LimitReader(resp.Body, maxWebImageSize-int64(n)+1))
+		if err == nil && written > maxWebImageSize-int64(n) {
+			err = errors.New(u + ": image too large")
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}